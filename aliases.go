@@ -0,0 +1,467 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/gosimple/slug"
+)
+
+// Aliases let several names refer to one canonical tag, eg. nyc and "New York City" for new-york.
+// TAG_ALIASES maps the slugified alias to a serialized Alias. Aliases always point at a tag that
+// exists, never at another alias: merging a tag moves its aliases to the target, and deleting a tag
+// deletes its aliases.
+const tagAliasBucket = "TAG_ALIASES"
+
+var errAliasTaken = errors.New("alias is already in use")
+
+// Alias is another name for a tag.
+type Alias struct {
+	Alias     string    `json:"alias"`
+	Tag       string    `json:"tag"`
+	CreatedAt time.Time `json:"createdAt,omitempty"`
+}
+
+// aliasKey normalises a name so that "New York City", "new york city" and new-york-city are the same alias.
+func aliasKey(name string) string {
+	return slug.Make(name)
+}
+
+// resolveTagSlug returns the slug of the canonical tag for name, following an alias if there is one.
+// It returns name unchanged when it is neither a tag nor an alias.
+func resolveTagSlug(tx *bolt.Tx, name string) string {
+	if tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagBucket)).Get([]byte(name)) != nil {
+		return name
+	}
+	alias, err := lookupAlias(tx, name)
+	if err != nil || alias == nil {
+		return name
+	}
+	return alias.Tag
+}
+
+// lookupAlias reads an alias inside an existing transaction. It returns nil if there is no such alias.
+func lookupAlias(tx *bolt.Tx, name string) (*Alias, error) {
+	v := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagAliasBucket)).Get([]byte(aliasKey(name)))
+	if v == nil {
+		return nil, nil
+	}
+	alias := Alias{}
+	if err := json.Unmarshal(v, &alias); err != nil {
+		return nil, err
+	}
+	return &alias, nil
+}
+
+// putAlias points an alias at a tag inside an existing transaction.
+// It fails with errAliasTaken if the alias names a tag or already points at a different tag.
+func putAlias(tx *bolt.Tx, name string, target string) error {
+	key := aliasKey(name)
+	if key == "" {
+		return fmt.Errorf("%w: an alias needs at least one letter or digit", errAliasTaken)
+	}
+	if tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagBucket)).Get([]byte(key)) != nil {
+		return fmt.Errorf("%w: %s is a tag", errAliasTaken, key)
+	}
+	existing, err := lookupAlias(tx, key)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if existing.Tag == target {
+			return nil
+		}
+		return fmt.Errorf("%w: %s already refers to %s", errAliasTaken, key, existing.Tag)
+	}
+	return storeAlias(tx, Alias{Alias: key, Tag: target, CreatedAt: time.Now()})
+}
+
+// storeAlias writes an alias under its key and indexes it for suggestions, without any checks.
+func storeAlias(tx *bolt.Tx, alias Alias) error {
+	buf, err := json.Marshal(alias)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagAliasBucket)).Put([]byte(alias.Alias), buf); err != nil {
+		return fmt.Errorf("could not insert alias: %v", err)
+	}
+	return indexTagName(tx, alias.Tag, alias.Alias, true)
+}
+
+// aliasesForTag returns every alias pointing at a tag, sorted by name.
+func aliasesForTag(tx *bolt.Tx, target string) ([]Alias, error) {
+	results := []Alias{}
+	err := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagAliasBucket)).ForEach(func(k, v []byte) error {
+		alias := Alias{}
+		if err := json.Unmarshal(v, &alias); err != nil {
+			return err
+		}
+		if alias.Tag == target {
+			results = append(results, alias)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Alias < results[j].Alias })
+	return results, nil
+}
+
+// retargetAliases moves every alias of one tag to another, or deletes them when to is empty.
+func retargetAliases(tx *bolt.Tx, from string, to string) error {
+	aliases, err := aliasesForTag(tx, from)
+	if err != nil {
+		return err
+	}
+	b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagAliasBucket))
+	for _, alias := range aliases {
+		if err := unindexTagName(tx, from, alias.Alias, true); err != nil {
+			return err
+		}
+		if to == "" {
+			if err := b.Delete([]byte(alias.Alias)); err != nil {
+				return fmt.Errorf("could not delete alias: %v", err)
+			}
+			continue
+		}
+		alias.Tag = to
+		buf, err := json.Marshal(alias)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(alias.Alias), buf); err != nil {
+			return fmt.Errorf("could not insert alias: %v", err)
+		}
+		if err := indexTagName(tx, to, alias.Alias, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listAliases returns every alias of a tag.
+func listAliases(db *bolt.DB, target string) ([]Alias, error) {
+	var results []Alias
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		results, err = aliasesForTag(tx, target)
+		return err
+	})
+	return results, err
+}
+
+// allAliases returns every alias, sorted by name.
+func allAliases(db *bolt.DB) ([]Alias, error) {
+	results := []Alias{}
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagAliasBucket)).ForEach(func(k, v []byte) error {
+			alias := Alias{}
+			if err := json.Unmarshal(v, &alias); err != nil {
+				return err
+			}
+			results = append(results, alias)
+			return nil
+		})
+	})
+	return results, err
+}
+
+// createAlias adds name as an alias of the target tag and returns the stored alias.
+func createAlias(db *bolt.DB, target string, name string) (*Alias, error) {
+	var created *Alias
+	err := db.Update(func(tx *bolt.Tx) error {
+		tag, err := lookupTag(tx, target)
+		if err != nil {
+			return err
+		}
+		if tag == nil {
+			return errTagNotFound
+		}
+		if err := putAlias(tx, name, target); err != nil {
+			return err
+		}
+		created, err = lookupAlias(tx, name)
+		return err
+	})
+	return created, err
+}
+
+// deleteAlias removes name if it is an alias of the target tag.
+func deleteAlias(db *bolt.DB, target string, name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		alias, err := lookupAlias(tx, name)
+		if err != nil || alias == nil || alias.Tag != target {
+			return err
+		}
+		if err := unindexTagName(tx, target, alias.Alias, true); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagAliasBucket)).Delete([]byte(alias.Alias))
+	})
+}
+
+// mergeTags folds the source tag into the target in one transaction. Every edge, alias and child of the
+// source moves to the target, the target gains the source's parents, and the source is deleted and left
+// behind as an alias of the target so old links and queries keep working.
+func mergeTags(db *bolt.DB, source string, target string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if source == target {
+			return fmt.Errorf("%w: can not merge a tag into itself", errTagCycle)
+		}
+		from, err := lookupTag(tx, source)
+		if err != nil {
+			return err
+		}
+		to, err := lookupTag(tx, target)
+		if err != nil {
+			return err
+		}
+		if from == nil || to == nil {
+			return errTagNotFound
+		}
+
+		byTag := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(edgeByTagBucket)).Bucket([]byte(source))
+		if byTag != nil {
+			edges := []Edge{}
+			err := byTag.ForEach(func(k, v []byte) error {
+				edge := Edge{}
+				if err := json.Unmarshal(v, &edge); err != nil {
+					return err
+				}
+				edge.Tag, edge.Content = target, string(k)
+				edges = append(edges, edge)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, edge := range edges {
+				if err := putEdge(tx, edge); err != nil {
+					return err
+				}
+			}
+		}
+
+		children, err := tagRelatives(tx, source, tagChildren)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			c, err := lookupTag(tx, child)
+			if err != nil {
+				return err
+			}
+			parents := removeString(c.Parents, source)
+			if child != target {
+				parents = append(parents, target)
+			}
+			c.Parents = parents
+			if err := putTag(tx, *c, child); err != nil {
+				return err
+			}
+		}
+		to, err = lookupTag(tx, target)
+		if err != nil {
+			return err
+		}
+		// Parents the target already descends from are implied, and adding the target's own
+		// descendants would make a cycle, so only the rest are carried over.
+		descendants, err := tagRelatives(tx, target, tagDescendants)
+		if err != nil {
+			return err
+		}
+		for _, parent := range from.Parents {
+			if parent != target && !containsString(descendants, parent) {
+				to.Parents = append(to.Parents, parent)
+			}
+		}
+		if err := putTag(tx, *to, target); err != nil {
+			return err
+		}
+
+		if err := retargetAliases(tx, source, target); err != nil {
+			return err
+		}
+		if err := removeTag(tx, source); err != nil {
+			return err
+		}
+		return putAlias(tx, source, target)
+	})
+}
+
+// ALIAS HANDLERS
+
+// listAliasesHandler returns the aliases of the tag in the URL as JSON.
+func listAliasesHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		target := mux.Vars(r)["slug"]
+		if _, err := getTag(db, target); err != nil {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusNotFound)
+			res.Write([]byte("404 Page Not Found"))
+			return
+		}
+		aliases, err := listAliases(db, target)
+		if err != nil {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusInternalServerError)
+			res.Write([]byte("Could not list aliases."))
+			return
+		}
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		res.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(res).Encode(aliases); err != nil {
+			panic(err)
+		}
+	}
+	return fn
+}
+
+// createAliasHandler adds the alias in the JSON body, eg. {"alias": "nyc"}, to the tag in the URL.
+func createAliasHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var alias Alias
+		var created *Alias
+		target := mux.Vars(r)["slug"]
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+		if err != nil {
+			panic(err)
+		}
+		if err := r.Body.Close(); err != nil {
+			panic(err)
+		}
+		if err := json.Unmarshal(body, &alias); err != nil {
+			res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			res.WriteHeader(422) // unprocessable entity
+			if err := json.NewEncoder(res).Encode(err); err != nil {
+				panic(err)
+			}
+			return
+		}
+		created, err = createAlias(db, target, alias.Alias)
+		res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		switch {
+		case errors.Is(err, errTagNotFound):
+			res.WriteHeader(http.StatusNotFound)
+			res.Write([]byte("Tag not found."))
+			return
+		case errors.Is(err, errAliasTaken):
+			res.WriteHeader(http.StatusConflict)
+			res.Write([]byte(err.Error()))
+			return
+		case err != nil:
+			res.WriteHeader(http.StatusInternalServerError)
+			res.Write([]byte("Error writing to DB."))
+			return
+		}
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		res.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(res).Encode(created); err != nil {
+			panic(err)
+		}
+	}
+	return fn
+}
+
+// deleteAliasHandler removes the alias in the URL from the tag in the URL.
+func deleteAliasHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if err := deleteAlias(db, vars["slug"], vars["alias"]); err != nil {
+			panic(err)
+		}
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		res.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(res).Encode(struct {
+			Deleted bool
+		}{
+			true,
+		}); err != nil {
+			panic(err)
+		}
+	}
+	return fn
+}
+
+// mergeTagHandler merges the tag in the URL into the tag named in the JSON body, eg. {"into": "new-york"}.
+// It responds with the target tag.
+func mergeTagHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Into string `json:"into"`
+		}
+		source := mux.Vars(r)["slug"]
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+		if err != nil {
+			panic(err)
+		}
+		if err := r.Body.Close(); err != nil {
+			panic(err)
+		}
+		if err := json.Unmarshal(body, &request); err != nil {
+			res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			res.WriteHeader(422) // unprocessable entity
+			if err := json.NewEncoder(res).Encode(err); err != nil {
+				panic(err)
+			}
+			return
+		}
+		err = mergeTags(db, source, request.Into)
+		res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		switch {
+		case errors.Is(err, errTagNotFound):
+			res.WriteHeader(http.StatusNotFound)
+			res.Write([]byte("Tag not found."))
+			return
+		case isHierarchyError(err), errors.Is(err, errAliasTaken):
+			res.WriteHeader(422) // unprocessable entity
+			res.Write([]byte(err.Error()))
+			return
+		case err != nil:
+			res.WriteHeader(http.StatusInternalServerError)
+			res.Write([]byte("Error writing to DB."))
+			return
+		}
+		tag, err := getTag(db, request.Into)
+		if err != nil {
+			panic(err)
+		}
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		res.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(res).Encode(tag); err != nil {
+			panic(err)
+		}
+	}
+	return fn
+}
+
+// redirectAlias sends the client to the canonical tag when name is an alias, replacing name in the
+// request path. It reports whether it redirected. Stores other than bolt have no aliases, so db may be nil.
+func redirectAlias(db *bolt.DB, res http.ResponseWriter, r *http.Request, name string) bool {
+	if db == nil {
+		return false
+	}
+	var alias *Alias
+	db.View(func(tx *bolt.Tx) error {
+		var err error
+		alias, err = lookupAlias(tx, name)
+		return err
+	})
+	prefix := "/tags/" + name
+	if alias == nil || !strings.HasPrefix(r.URL.Path, prefix) {
+		return false
+	}
+	path := "/tags/" + alias.Tag + strings.TrimPrefix(r.URL.Path, prefix)
+	http.Redirect(res, r, path, http.StatusMovedPermanently)
+	return true
+}
@@ -0,0 +1,776 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// The /api/v1 routes mirror the HTML and JSON routes under the same paths, but only ever speak JSON.
+// Every response is an envelope:
+//
+//	{"data": {...}}                       a single resource
+//	{"data": [...], "page": {...}}        a list; page is only present on paginated lists
+//	{"error": {"status": 404, "message": "..."}}
+//
+// Request bodies are the same JSON documents the existing write routes accept.
+
+// DataEnvelope wraps a single resource returned by the API.
+type DataEnvelope struct {
+	Data interface{} `json:"data"`
+}
+
+// APIError describes a failed API request. Details carries extra machine readable context,
+// such as the position of a query syntax error.
+type APIError struct {
+	Status  int         `json:"status"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// ErrorEnvelope wraps an APIError.
+type ErrorEnvelope struct {
+	Error APIError `json:"error"`
+}
+
+// registerAPIRoutes adds the /api/v1 routes to the subrouter api. Search, collections, tag suggestions, aliases,
+// namespaces, content types, hierarchy walks, scans, revision history and accounts need the bolt store; on the
+// others their routes answer 501 Not Implemented.
+func registerAPIRoutes(api *mux.Router, store Store, client *http.Client, scans *scanJobs, roles Roles) {
+	api.NotFoundHandler = http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		writeAPIError(res, http.StatusNotFound, "Not found.", nil)
+	})
+	api.MethodNotAllowedHandler = http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+		writeAPIError(res, http.StatusMethodNotAllowed, "Method not allowed.", nil)
+	})
+
+	api.HandleFunc("/content", apiListContentHandler(store)).Methods("GET")
+	api.HandleFunc("/content", apiCreateContentHandler(store)).Methods("POST")
+	api.HandleFunc("/content/remote", apiCreateRemoteContentHandler(store, client)).Methods("POST")
+	api.HandleFunc("/content/{hash}", apiGetContentHandler(store)).Methods("GET")
+	api.HandleFunc("/content/{hash}", apiModifyContentHandler(store)).Methods("POST", "PUT")
+	api.HandleFunc("/content/{hash}", apiDeleteContentHandler(store)).Methods("DELETE")
+	api.HandleFunc("/content/{hash}/refresh", apiRefreshRemoteContentHandler(store, client)).Methods("POST")
+	api.HandleFunc("/content/{hash}/tags", apiListContentTagsHandler(store)).Methods("GET")
+	api.HandleFunc("/content/{hash}/tags/{slug}", apiGetEdgeHandler(store)).Methods("GET")
+	api.HandleFunc("/content/{hash}/tags/{slug}", apiCreateEdgeHandler(store)).Methods("PUT")
+	api.HandleFunc("/content/{hash}/tags/{slug}", apiDeleteEdgeHandler(store)).Methods("DELETE")
+
+	api.HandleFunc("/tags", apiListTagHandler(store)).Methods("GET")
+	api.HandleFunc("/tags", apiCreateTagHandler(store)).Methods("POST")
+	// Registered before /tags/{slug}, which would take suggest for a slug.
+	api.HandleFunc("/tags/suggest", boltOnly(store, apiTagSuggestHandler(store))).Methods("GET")
+	api.HandleFunc("/tags/{slug}", apiGetTagHandler(store)).Methods("GET")
+	api.HandleFunc("/tags/{slug}", apiModifyTagHandler(store)).Methods("POST", "PUT")
+	api.HandleFunc("/tags/{slug}", apiDeleteTagHandler(store)).Methods("DELETE")
+	api.HandleFunc("/tags/{slug}/content", apiListTagContentHandler(store)).Methods("GET")
+	api.HandleFunc("/tags/{slug}/children", apiListChildTagsHandler(store)).Methods("GET")
+
+	api.HandleFunc("/stats", apiStatsHandler(store)).Methods("GET")
+	api.HandleFunc("/export", apiExportHandler(store)).Methods("GET")
+	api.HandleFunc("/import", apiImportHandler(store)).Methods("POST")
+	api.HandleFunc("/permissions", apiPermissionsHandler(roles)).Methods("GET")
+
+	api.HandleFunc("/tags/{slug}/parents", boltOnly(store, apiListTagRelativesHandler(store, tagParents))).Methods("GET")
+	api.HandleFunc("/tags/{slug}/ancestors", boltOnly(store, apiListTagRelativesHandler(store, tagAncestors))).Methods("GET")
+	api.HandleFunc("/tags/{slug}/descendants", boltOnly(store, apiListTagRelativesHandler(store, tagDescendants))).Methods("GET")
+	api.HandleFunc("/tags/{slug}/aliases", boltOnly(store, apiListAliasesHandler(store))).Methods("GET")
+	api.HandleFunc("/tags/{slug}/aliases", boltOnly(store, apiCreateAliasHandler(store))).Methods("POST")
+	api.HandleFunc("/tags/{slug}/aliases/{alias}", boltOnly(store, apiDeleteAliasHandler(store))).Methods("DELETE")
+	api.HandleFunc("/tags/{slug}/merge", boltOnly(store, apiMergeTagHandler(store))).Methods("POST")
+
+	api.HandleFunc("/namespaces", boltOnly(store, apiListNamespacesHandler(store))).Methods("GET")
+	api.HandleFunc("/namespaces", boltOnly(store, apiCreateNamespaceHandler(store))).Methods("POST")
+	api.HandleFunc("/namespaces/{name}", boltOnly(store, apiGetNamespaceHandler(store))).Methods("GET")
+	api.HandleFunc("/namespaces/{name}", boltOnly(store, apiModifyNamespaceHandler(store))).Methods("PUT")
+	api.HandleFunc("/namespaces/{name}", boltOnly(store, apiDeleteNamespaceHandler(store))).Methods("DELETE")
+	api.HandleFunc("/namespaces/{name}/tags", boltOnly(store, apiListNamespaceTagsHandler(store))).Methods("GET")
+	api.HandleFunc("/bulk/tags", boltOnly(store, apiBulkTagHandler(store))).Methods("POST")
+
+	api.HandleFunc("/types", boltOnly(store, apiListContentTypesHandler(store))).Methods("GET")
+	api.HandleFunc("/types", boltOnly(store, apiCreateContentTypeHandler(store))).Methods("POST")
+	api.HandleFunc("/types/{name}", boltOnly(store, apiGetContentTypeHandler(store))).Methods("GET")
+	api.HandleFunc("/types/{name}", boltOnly(store, apiModifyContentTypeHandler(store))).Methods("PUT")
+	api.HandleFunc("/types/{name}", boltOnly(store, apiDeleteContentTypeHandler(store))).Methods("DELETE")
+
+	api.HandleFunc("/collections", boltOnly(store, apiListCollectionsHandler(store))).Methods("GET")
+	api.HandleFunc("/collections", boltOnly(store, apiCreateCollectionHandler(store))).Methods("POST")
+	api.HandleFunc("/collections/{slug}", boltOnly(store, apiGetCollectionHandler(store))).Methods("GET")
+	api.HandleFunc("/collections/{slug}", boltOnly(store, apiModifyCollectionHandler(store))).Methods("PUT")
+	api.HandleFunc("/collections/{slug}", boltOnly(store, apiDeleteCollectionHandler(store))).Methods("DELETE")
+	api.HandleFunc("/collections/{slug}/items", boltOnly(store, apiInsertCollectionItemHandler(store))).Methods("POST")
+	api.HandleFunc("/collections/{slug}/items", boltOnly(store, apiReorderCollectionHandler(store))).Methods("PUT")
+	api.HandleFunc("/collections/{slug}/items/{hash}", boltOnly(store, apiRemoveCollectionItemHandler(store))).Methods("DELETE")
+	api.HandleFunc("/content/{hash}/collections", boltOnly(store, apiListContentCollectionsHandler(store))).Methods("GET")
+
+	api.HandleFunc("/content/{hash}/revisions", boltOnly(store, apiListRevisionsHandler(store, contentHistory))).Methods("GET")
+	api.HandleFunc("/content/{hash}/revisions/diff", boltOnly(store, apiDiffRevisionsHandler(store, contentHistory))).Methods("GET")
+	api.HandleFunc("/content/{hash}/revisions/{number:[0-9]+}", boltOnly(store, apiGetRevisionHandler(store, contentHistory))).Methods("GET")
+	api.HandleFunc("/content/{hash}/revisions/{number:[0-9]+}/revert", boltOnly(store, apiRevertRevisionHandler(store, contentHistory))).Methods("POST")
+	api.HandleFunc("/tags/{slug}/revisions", boltOnly(store, apiListRevisionsHandler(store, tagHistory))).Methods("GET")
+	api.HandleFunc("/tags/{slug}/revisions/diff", boltOnly(store, apiDiffRevisionsHandler(store, tagHistory))).Methods("GET")
+	api.HandleFunc("/tags/{slug}/revisions/{number:[0-9]+}", boltOnly(store, apiGetRevisionHandler(store, tagHistory))).Methods("GET")
+	api.HandleFunc("/tags/{slug}/revisions/{number:[0-9]+}/revert", boltOnly(store, apiRevertRevisionHandler(store, tagHistory))).Methods("POST")
+
+	api.HandleFunc("/search", boltOnly(store, apiSearchHandler(store))).Methods("GET")
+	api.HandleFunc("/search/text", boltOnly(store, apiTextSearchHandler(store))).Methods("GET")
+
+	api.HandleFunc("/scan", boltOnly(store, apiCreateScanHandler(store, scans))).Methods("POST")
+	api.HandleFunc("/scan/{id}", apiGetScanHandler(scans)).Methods("GET")
+
+	db := boltDB(store)
+	api.HandleFunc("/me", apiMeHandler()).Methods("GET")
+	api.HandleFunc("/tokens", boltOnly(store, apiListTokensHandler(db))).Methods("GET")
+	api.HandleFunc("/tokens", boltOnly(store, apiCreateTokenHandler(db))).Methods("POST")
+	api.HandleFunc("/tokens/{id}", boltOnly(store, apiDeleteTokenHandler(db))).Methods("DELETE")
+	api.HandleFunc("/users", boltOnly(store, apiListUsersHandler(db))).Methods("GET")
+	api.HandleFunc("/users/{username}/role", boltOnly(store, apiSetRoleHandler(db, roles))).Methods("PUT")
+}
+
+// writeAPIData writes a single resource envelope.
+func writeAPIData(res http.ResponseWriter, status int, data interface{}) {
+	res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	res.WriteHeader(status)
+	if err := json.NewEncoder(res).Encode(DataEnvelope{Data: data}); err != nil {
+		panic(err)
+	}
+}
+
+// writeAPIList writes a list envelope. page is nil for lists that are returned whole.
+func writeAPIList(res http.ResponseWriter, data interface{}, page *PageInfo) {
+	res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	res.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(res).Encode(ListPage{Data: data, Page: page}); err != nil {
+		panic(err)
+	}
+}
+
+// writeAPIError writes an error envelope.
+func writeAPIError(res http.ResponseWriter, status int, message string, details interface{}) {
+	res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	res.WriteHeader(status)
+	if err := json.NewEncoder(res).Encode(ErrorEnvelope{Error: APIError{Status: status, Message: message, Details: details}}); err != nil {
+		panic(err)
+	}
+}
+
+// writeAPIStoreError reports an error returned by a data store function with the status it deserves.
+func writeAPIStoreError(res http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errContentNotFound):
+		writeAPIError(res, http.StatusNotFound, "Content not found.", nil)
+	case errors.Is(err, errTagNotFound):
+		writeAPIError(res, http.StatusNotFound, "Tag not found.", nil)
+	case errors.Is(err, errEdgeNotFound):
+		writeAPIError(res, http.StatusNotFound, "Edge not found.", nil)
+	case errors.Is(err, errBadListOptions), errors.Is(err, errBadImportPolicy), errors.Is(err, errBadRevisionRange):
+		writeAPIError(res, http.StatusBadRequest, err.Error(), nil)
+	case errors.Is(err, errUserNotFound), errors.Is(err, errTokenNotFound), errors.Is(err, errRevisionNotFound),
+		errors.Is(err, errNamespaceNotFound), errors.Is(err, errContentTypeNotFound), errors.Is(err, errCollectionNotFound):
+		writeAPIError(res, http.StatusNotFound, err.Error(), nil)
+	case errors.Is(err, errAliasTaken), errors.Is(err, errUserExists), errors.Is(err, errNamespaceExists),
+		errors.Is(err, errNamespaceInUse), errors.Is(err, errNamespaceExclusive), errors.Is(err, errContentTypeExists),
+		errors.Is(err, errContentTypeInUse), errors.Is(err, errCollectionExists), errors.Is(err, errInCollection):
+		writeAPIError(res, http.StatusConflict, err.Error(), nil)
+	case isHierarchyError(err), errors.Is(err, errBadRemoteURL), errors.Is(err, errBadImport),
+		errors.Is(err, errBadUsername), errors.Is(err, errBadPassword), errors.Is(err, errUnknownRole),
+		errors.Is(err, errBadBulkTag), errors.Is(err, errBadNamespace), errors.Is(err, errBadContentType),
+		errors.Is(err, errBadFields), errors.Is(err, errBadCollection):
+		writeAPIError(res, 422, err.Error(), nil) // unprocessable entity
+	case errors.Is(err, errRemoteFetch):
+		writeAPIError(res, http.StatusBadGateway, err.Error(), nil)
+	default:
+		writeAPIError(res, http.StatusInternalServerError, "Error accessing the DB.", nil)
+	}
+}
+
+// readAPIBody decodes the JSON request body into v. If the body is not valid JSON it writes
+// an unprocessable entity error and returns false.
+func readAPIBody(res http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		panic(err)
+	}
+	if err := r.Body.Close(); err != nil {
+		panic(err)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		writeAPIError(res, 422, err.Error(), nil) // unprocessable entity
+		return false
+	}
+	return true
+}
+
+// readJSONBody decodes the JSON request body into v for the handlers outside the API. If the body is not
+// valid JSON it answers with the error as JSON and an unprocessable entity status, and returns false.
+func readJSONBody(res http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		panic(err)
+	}
+	if err := r.Body.Close(); err != nil {
+		panic(err)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		res.WriteHeader(422) // unprocessable entity
+		if err := json.NewEncoder(res).Encode(err); err != nil {
+			panic(err)
+		}
+		return false
+	}
+	return true
+}
+
+// apiTag looks up a tag by slug or alias, writing a 404 and returning nil if there is neither.
+func apiTag(res http.ResponseWriter, store Store, name string) *Tag {
+	tag, err := resolveTag(store, name)
+	if err != nil {
+		writeAPIStoreError(res, err)
+		return nil
+	}
+	return tag
+}
+
+// apiContent looks up content by hash, writing a 404 and returning nil if there is none.
+func apiContent(res http.ResponseWriter, store Store, hash string) *Content {
+	content, err := store.GetContent(hash)
+	if err != nil {
+		writeAPIStoreError(res, err)
+		return nil
+	}
+	return content
+}
+
+// CONTENT API HANDLERS
+
+// apiListContentHandler returns one page of content. It takes the same parameters as the HTML list.
+func apiListContentHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		opts, err := parseListOptions(r)
+		if err != nil {
+			writeAPIError(res, http.StatusBadRequest, err.Error(), nil)
+			return
+		}
+		content, page, err := store.ListContent(opts)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIList(res, content, &page)
+	}
+	return fn
+}
+
+// apiGetContentHandler returns the content with the hash in the URL.
+func apiGetContentHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		if content := apiContent(res, store, mux.Vars(r)["hash"]); content != nil {
+			writeAPIData(res, http.StatusOK, content)
+		}
+	}
+	return fn
+}
+
+// apiCreateContentHandler stores the content in the request body under a new key.
+func apiCreateContentHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var content Content
+		if !readAPIBody(res, r, &content) {
+			return
+		}
+		content.Author = requestAuthor(r, content.Author)
+		content, err := createContent(store, content)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		res.Header().Set("Location", "/api/v1/content/"+content.Hash)
+		writeAPIData(res, http.StatusCreated, content)
+	}
+	return fn
+}
+
+// apiModifyContentHandler replaces the content with the hash in the URL.
+func apiModifyContentHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var content Content
+		if !readAPIBody(res, r, &content) {
+			return
+		}
+		content.Author = requestAuthor(r, content.Author)
+		content, err := modifyContent(store, mux.Vars(r)["hash"], content)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, content)
+	}
+	return fn
+}
+
+// apiDeleteContentHandler deletes the content with the hash in the URL.
+func apiDeleteContentHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		hash := mux.Vars(r)["hash"]
+		if apiContent(res, store, hash) == nil {
+			return
+		}
+		if err := store.DeleteContent(hash); err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, struct {
+			Deleted bool `json:"deleted"`
+		}{true})
+	}
+	return fn
+}
+
+// apiCreateRemoteContentHandler ingests the URL in the request body, eg. {"url": "https://example.com"}.
+func apiCreateRemoteContentHandler(store Store, client *http.Client) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var request Content
+		if !readAPIBody(res, r, &request) {
+			return
+		}
+		content, err := ingestRemote(store, client, request.URL, requestAuthor(r, request.Author))
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		res.Header().Set("Location", "/api/v1/content/"+content.Hash)
+		writeAPIData(res, http.StatusCreated, content)
+	}
+	return fn
+}
+
+// apiRefreshRemoteContentHandler fetches the URL of the content in the URL path again.
+func apiRefreshRemoteContentHandler(store Store, client *http.Client) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		content := apiContent(res, store, mux.Vars(r)["hash"])
+		if content == nil {
+			return
+		}
+		if content.URL == "" {
+			writeAPIError(res, 422, "Content has no URL to refresh.", nil) // unprocessable entity
+			return
+		}
+		content, err := ingestRemote(store, client, content.URL, content.Author)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, content)
+	}
+	return fn
+}
+
+// EDGE API HANDLERS
+
+// apiListContentTagsHandler returns the tags applied to the content in the URL.
+func apiListContentTagsHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		hash := mux.Vars(r)["hash"]
+		if apiContent(res, store, hash) == nil {
+			return
+		}
+		tags, err := store.TagsForContent(hash)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIList(res, tags, nil)
+	}
+	return fn
+}
+
+// apiGetEdgeHandler returns the edge between the content and tag in the URL.
+func apiGetEdgeHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		edge, err := store.GetEdge(vars["slug"], vars["hash"])
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, edge)
+	}
+	return fn
+}
+
+// apiCreateEdgeHandler applies the tag in the URL to the content in the URL.
+func apiCreateEdgeHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		edge, err := store.ApplyTag(vars["hash"], vars["slug"])
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusCreated, edge)
+	}
+	return fn
+}
+
+// apiDeleteEdgeHandler removes the tag in the URL from the content in the URL.
+func apiDeleteEdgeHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if err := store.DeleteEdge(vars["slug"], vars["hash"]); err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, struct {
+			Deleted bool `json:"deleted"`
+		}{true})
+	}
+	return fn
+}
+
+// TAG API HANDLERS
+
+// apiListTagHandler returns one page of tags. It takes the same parameters as the HTML list.
+func apiListTagHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		opts, err := parseListOptions(r)
+		if err != nil {
+			writeAPIError(res, http.StatusBadRequest, err.Error(), nil)
+			return
+		}
+		tags, page, err := store.ListTags(opts)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIList(res, tags, &page)
+	}
+	return fn
+}
+
+// apiGetTagHandler returns the tag with the slug in the URL. Aliases return the tag they refer to.
+func apiGetTagHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		if tag := apiTag(res, store, mux.Vars(r)["slug"]); tag != nil {
+			writeAPIData(res, http.StatusOK, tag)
+		}
+	}
+	return fn
+}
+
+// apiCreateTagHandler stores the tag in the request body under a new slug.
+func apiCreateTagHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var tag Tag
+		if !readAPIBody(res, r, &tag) {
+			return
+		}
+		tag.Author = requestAuthor(r, tag.Author)
+		tag, err := createTag(store, tag)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		res.Header().Set("Location", "/api/v1/tags/"+tag.Slug)
+		writeAPIData(res, http.StatusCreated, tag)
+	}
+	return fn
+}
+
+// apiModifyTagHandler replaces the tag with the slug in the URL.
+func apiModifyTagHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var tag Tag
+		if !readAPIBody(res, r, &tag) {
+			return
+		}
+		tag.Author = requestAuthor(r, tag.Author)
+		tag, err := modifyTag(store, mux.Vars(r)["slug"], tag)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, tag)
+	}
+	return fn
+}
+
+// apiDeleteTagHandler deletes the tag with the slug in the URL.
+func apiDeleteTagHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		slug := mux.Vars(r)["slug"]
+		if _, err := store.GetTag(slug); err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		if err := store.DeleteTag(slug); err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, struct {
+			Deleted bool `json:"deleted"`
+		}{true})
+	}
+	return fn
+}
+
+// apiListTagContentHandler returns the content the tag in the URL has been applied to.
+func apiListTagContentHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		tag := apiTag(res, store, mux.Vars(r)["slug"])
+		if tag == nil {
+			return
+		}
+		content, err := store.ContentForTag(tag.Slug)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIList(res, content, nil)
+	}
+	return fn
+}
+
+// apiListTagRelativesHandler returns the tags related to the tag in the URL by relation.
+func apiListTagRelativesHandler(store Store, relation tagRelation) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		tag := apiTag(res, store, mux.Vars(r)["slug"])
+		if tag == nil {
+			return
+		}
+		tags, err := listTagRelatives(db, tag.Slug, relation)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIList(res, tagSlice(tags), nil)
+	}
+	return fn
+}
+
+// apiListChildTagsHandler returns the tags that have the tag in the URL as a parent.
+func apiListChildTagsHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		tag := apiTag(res, store, mux.Vars(r)["slug"])
+		if tag == nil {
+			return
+		}
+		tags, err := store.ChildTags(tag.Slug)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIList(res, tags, nil)
+	}
+	return fn
+}
+
+// ALIAS API HANDLERS
+
+// apiListAliasesHandler returns the aliases of the tag in the URL.
+func apiListAliasesHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		tag := apiTag(res, store, mux.Vars(r)["slug"])
+		if tag == nil {
+			return
+		}
+		aliases, err := listAliases(db, tag.Slug)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIList(res, aliases, nil)
+	}
+	return fn
+}
+
+// apiCreateAliasHandler adds the alias in the request body, eg. {"alias": "nyc"}, to the tag in the URL.
+func apiCreateAliasHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var alias Alias
+		if !readAPIBody(res, r, &alias) {
+			return
+		}
+		created, err := createAlias(db, mux.Vars(r)["slug"], alias.Alias)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusCreated, created)
+	}
+	return fn
+}
+
+// apiDeleteAliasHandler removes the alias in the URL from the tag in the URL.
+func apiDeleteAliasHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if err := deleteAlias(db, vars["slug"], vars["alias"]); err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, struct {
+			Deleted bool `json:"deleted"`
+		}{true})
+	}
+	return fn
+}
+
+// apiMergeTagHandler merges the tag in the URL into the tag named in the request body, eg. {"into": "new-york"},
+// and returns the target tag.
+func apiMergeTagHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Into string `json:"into"`
+		}
+		if !readAPIBody(res, r, &request) {
+			return
+		}
+		if err := mergeTags(db, mux.Vars(r)["slug"], request.Into); err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		if tag := apiTag(res, store, request.Into); tag != nil {
+			writeAPIData(res, http.StatusOK, tag)
+		}
+	}
+	return fn
+}
+
+// SEARCH API HANDLERS
+
+// apiSearchHandler returns the content matching the tag query in the q parameter.
+// Syntax errors are reported with their position in the error details.
+func apiSearchHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		content, err := searchContent(db, r.URL.Query().Get("q"))
+		var queryErr *QueryError
+		if errors.As(err, &queryErr) {
+			writeAPIError(res, http.StatusBadRequest, queryErr.Msg, queryErr)
+			return
+		}
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIList(res, contentSlice(content), nil)
+	}
+	return fn
+}
+
+// apiTextSearchHandler ranks content and tags against the words in the q parameter.
+// The optional limit parameter caps the number of results, which defaults to 20.
+func apiTextSearchHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		limit := 20
+		if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+			limit = l
+		}
+		results, err := searchText(db, strings.TrimSpace(r.URL.Query().Get("q")), limit)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIList(res, results, nil)
+	}
+	return fn
+}
+
+// SCAN API HANDLERS
+
+// apiCreateScanHandler starts a background scan of the directories in the request body, eg. {"roots": ["/photos"]}.
+func apiCreateScanHandler(store Store, jobs *scanJobs) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Roots []string `json:"roots"`
+		}
+		if !readAPIBody(res, r, &request) {
+			return
+		}
+		if len(request.Roots) == 0 {
+			writeAPIError(res, 422, "At least one root directory is required.", nil) // unprocessable entity
+			return
+		}
+		for _, root := range request.Roots {
+			if !jobs.allows(root) {
+				writeAPIError(res, http.StatusForbidden, root+" is not under a watched directory or a scan root of the server.", nil)
+				return
+			}
+		}
+		job := jobs.start(db, request.Roots)
+		res.Header().Set("Location", "/api/v1/scan/"+job.ID)
+		writeAPIData(res, http.StatusAccepted, job)
+	}
+	return fn
+}
+
+// apiGetScanHandler returns the status of a scan job, including its report once it is done.
+func apiGetScanHandler(jobs *scanJobs) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		job, ok := jobs.get(mux.Vars(r)["id"])
+		if !ok {
+			writeAPIError(res, http.StatusNotFound, "Scan not found.", nil)
+			return
+		}
+		writeAPIData(res, http.StatusOK, job)
+	}
+	return fn
+}
+
+// apiStatsHandler counts what is in the library.
+func apiStatsHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		stats, err := libraryStats(store)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, stats)
+	}
+	return fn
+}
+
+// EXPORT API HANDLERS
+
+// apiExportHandler downloads the whole library as JSON Lines, or as an archive with ?format=tar.gz.
+func apiExportHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "jsonl" && format != "tar.gz" {
+			writeAPIError(res, http.StatusBadRequest, "format must be jsonl or tar.gz", nil)
+			return
+		}
+		writeExport(res, store, format)
+	}
+	return fn
+}
+
+// apiImportHandler imports the export in the request body and answers with the import report.
+func apiImportHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		report, err := importLibrary(store, r.Body, r.URL.Query().Get("policy"))
+		if err := r.Body.Close(); err != nil {
+			panic(err)
+		}
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, report)
+	}
+	return fn
+}
@@ -0,0 +1,826 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+// Accounts live in three buckets of the root bucket. USERS maps a username to its User record.
+// SESSIONS and API_TOKENS are keyed by the SHA-256 of the secret handed to the client, so a copy
+// of the database does not give away working credentials.
+const userBucket = "USERS"
+const sessionBucket = "SESSIONS"
+const apiTokenBucket = "API_TOKENS"
+
+// sessionCookie is the cookie that carries the session secret of a browser logged in to the HTML UI.
+const sessionCookie = "anansi_session"
+
+// sessionLifetime is how long a login lasts.
+const sessionLifetime = 30 * 24 * time.Hour
+
+// User is an account that can log in and make changes.
+type User struct {
+	Username     string    `json:"username"`
+	PasswordHash []byte    `json:"passwordHash,omitempty"` // bcrypt
+	Role         string    `json:"role"`                   // One of the configured roles, see Roles.
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// Session is a login to the HTML UI.
+type Session struct {
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// APIToken is a bearer token for scripts, eg. "Authorization: Bearer <token>". The token itself is
+// only shown when it is created; ID names it afterwards.
+type APIToken struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"username"`
+	Name      string    `json:"name,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	Token     string    `json:"token,omitempty"` // Only set in the response to creating the token.
+}
+
+// Identity is who made a request, their role and how they proved it: "session" or "token".
+type Identity struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	Method   string `json:"method"`
+}
+
+var errUserNotFound = errors.New("user not found")
+var errUserExists = errors.New("user already exists")
+var errBadUsername = errors.New("invalid username")
+var errBadPassword = errors.New("invalid password")
+var errBadLogin = errors.New("wrong username or password")
+var errTokenNotFound = errors.New("token not found")
+
+// minPasswordLength is the shortest password an account can have.
+const minPasswordLength = 8
+
+// decoyPasswordHash is checked against when a login names an unknown user.
+var decoyPasswordHash = []byte("$2a$10$Puueydq4AF/.wK1JG2dNu.BATpVY464hvtaWaDz/CA/hfpS5D4hOm")
+
+type identityKey struct{}
+
+// requestIdentity returns the identity of an authenticated request, or nil.
+func requestIdentity(r *http.Request) *Identity {
+	identity, _ := r.Context().Value(identityKey{}).(*Identity)
+	return identity
+}
+
+// requestAuthor is the author recorded for a create or modify: the authenticated user. A server running
+// without accounts keeps whatever the client sent.
+func requestAuthor(r *http.Request, sent string) string {
+	if identity := requestIdentity(r); identity != nil {
+		return identity.Username
+	}
+	return sent
+}
+
+// MIDDLEWARE
+
+// authMiddleware identifies the user behind each request from a bearer token or a session cookie.
+// What they may do is up to permissionMiddleware. A bearer token that does not match is refused with a 401,
+// an error envelope for API requests and plain text for the HTML routes, even on reads, so a script with
+// a revoked token finds out straight away.
+func authMiddleware(db *bolt.DB) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+			identity, err := authenticate(db, r)
+			if err != nil {
+				unauthorized(res, r, err.Error())
+				return
+			}
+			if identity != nil {
+				r = r.WithContext(context.WithValue(r.Context(), identityKey{}, identity))
+			}
+			next.ServeHTTP(res, r)
+		})
+	}
+}
+
+// authenticate finds the identity behind a request. It returns an error for a bearer token that does not
+// match, and no identity for a request without credentials or with a stale session cookie.
+func authenticate(db *bolt.DB, r *http.Request) (*Identity, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		secret := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+		if !strings.HasPrefix(header, "Bearer ") || secret == "" {
+			return nil, errors.New("The Authorization header must be \"Bearer <token>\".")
+		}
+		token, user, err := lookupAPIToken(db, secret)
+		if err != nil {
+			return nil, errors.New("Invalid API token.")
+		}
+		return &Identity{Username: token.Username, Role: user.Role, Method: "token"}, nil
+	}
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, nil
+	}
+	session, user, err := lookupSession(db, cookie.Value)
+	if err != nil {
+		return nil, nil
+	}
+	return &Identity{Username: session.Username, Role: user.Role, Method: "session"}, nil
+}
+
+// unauthorized refuses a request that needs an identity.
+func unauthorized(res http.ResponseWriter, r *http.Request, message string) {
+	res.Header().Set("WWW-Authenticate", `Bearer realm="anansi"`)
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeAPIError(res, http.StatusUnauthorized, message, nil)
+		return
+	}
+	res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	res.WriteHeader(http.StatusUnauthorized)
+	res.Write([]byte(message))
+}
+
+// loginRequired sends visitors who are not logged in to the login page before showing them h,
+// which is how the create and edit forms ask for a login before anything is typed into them.
+// Without a database there are no accounts and h is returned as is.
+func loginRequired(db *bolt.DB, h http.HandlerFunc) http.HandlerFunc {
+	if db == nil {
+		return h
+	}
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		if requestIdentity(r) == nil {
+			http.Redirect(res, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		h(res, r)
+	}
+	return fn
+}
+
+// LOGIN HANDLERS
+
+// LoginPageData is the data required to render the login form.
+type LoginPageData struct {
+	SiteMetaData SiteMetaData
+	Next         string
+	Username     string
+	Error        string
+}
+
+// loginPageHandler serves the login form. next is where to go after logging in.
+func loginPageHandler(t *template.Template) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		res.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		res.WriteHeader(http.StatusOK)
+		t.Execute(res, LoginPageData{SiteMetaData: siteMetaData, Next: localRedirect(r.URL.Query().Get("next"))})
+	}
+	return fn
+}
+
+// loginHandler checks the username and password posted by the login form, starts a session and
+// redirects to next. A failed login shows the form again.
+func loginHandler(db *bolt.DB, t *template.Template) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		username, password := r.PostFormValue("username"), r.PostFormValue("password")
+		next := localRedirect(r.PostFormValue("next"))
+		secret, session, err := login(db, username, password)
+		if err != nil {
+			log.Printf("Failed login for %q \n", username)
+			status := http.StatusUnauthorized
+			if !errors.Is(err, errBadLogin) {
+				status = http.StatusInternalServerError
+			}
+			res.Header().Set("Content-Type", "text/html; charset=UTF-8")
+			res.WriteHeader(status)
+			t.Execute(res, LoginPageData{SiteMetaData: siteMetaData, Next: next, Username: username, Error: err.Error()})
+			return
+		}
+		log.Printf("Logged in: %s \n", username)
+		http.SetCookie(res, &http.Cookie{
+			Name:     sessionCookie,
+			Value:    secret,
+			Path:     "/",
+			Expires:  session.ExpiresAt,
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(res, r, next, http.StatusSeeOther)
+	}
+	return fn
+}
+
+// logoutHandler ends the session of the browser and returns to the home page.
+func logoutHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie(sessionCookie); err == nil {
+			if err := deleteSession(db, cookie.Value); err != nil {
+				log.Println(err)
+			}
+		}
+		http.SetCookie(res, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+		http.Redirect(res, r, "/", http.StatusSeeOther)
+	}
+	return fn
+}
+
+// localRedirect keeps next if it is a path on this site, so the login form can not be used to send
+// people elsewhere.
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// ACCOUNT API HANDLERS
+
+// apiIdentity returns the identity of the request, writing a 401 and returning nil if there is none.
+func apiIdentity(res http.ResponseWriter, r *http.Request) *Identity {
+	identity := requestIdentity(r)
+	if identity == nil {
+		unauthorized(res, r, "Log in or send an API token.")
+	}
+	return identity
+}
+
+// apiMeHandler returns the identity of the caller.
+func apiMeHandler() http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		if identity := apiIdentity(res, r); identity != nil {
+			writeAPIData(res, http.StatusOK, identity)
+		}
+	}
+	return fn
+}
+
+// apiListTokensHandler returns the API tokens of the caller, without their secrets.
+func apiListTokensHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		identity := apiIdentity(res, r)
+		if identity == nil {
+			return
+		}
+		tokens, err := listAPITokens(db, identity.Username)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIList(res, tokens, nil)
+	}
+	return fn
+}
+
+// apiCreateTokenHandler creates an API token for the caller, eg. {"name": "backup script"}.
+// The response is the only time the token is shown.
+func apiCreateTokenHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		identity := apiIdentity(res, r)
+		if identity == nil {
+			return
+		}
+		var request APIToken
+		if !readAPIBody(res, r, &request) {
+			return
+		}
+		token, err := createAPIToken(db, identity.Username, request.Name)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusCreated, token)
+	}
+	return fn
+}
+
+// apiDeleteTokenHandler revokes one of the caller's API tokens.
+func apiDeleteTokenHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		identity := apiIdentity(res, r)
+		if identity == nil {
+			return
+		}
+		if err := deleteAPIToken(db, identity.Username, mux.Vars(r)["id"]); err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, struct {
+			Deleted bool `json:"deleted"`
+		}{true})
+	}
+	return fn
+}
+
+// DATA STORE FUNCTIONS
+
+// setupAuthBuckets creates the account buckets.
+func setupAuthBuckets(root *bolt.Bucket) error {
+	for _, name := range []string{userBucket, sessionBucket, apiTokenBucket} {
+		if _, err := root.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return fmt.Errorf("could not create %s bucket: %v", strings.ToLower(name), err)
+		}
+	}
+	return nil
+}
+
+// authBucket returns one of the account buckets inside a transaction.
+func authBucket(tx *bolt.Tx, name string) *bolt.Bucket {
+	return tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(name))
+}
+
+// newSecret returns a random secret for a session or token, and the key it is stored under.
+func newSecret() (string, []byte, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(buf)
+	return secret, secretKey(secret), nil
+}
+
+// secretKey is the key a session or token secret is stored under.
+func secretKey(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+// validUsername reports whether a username can be used. Usernames are recorded as authors, so they are
+// kept to a plain set of characters.
+func validUsername(username string) bool {
+	if username == "" || len(username) > 64 {
+		return false
+	}
+	for _, c := range username {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("._-", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// hashPassword checks a password is long enough and hashes it with bcrypt.
+func hashPassword(password string) ([]byte, error) {
+	if len(password) < minPasswordLength {
+		return nil, fmt.Errorf("%w: passwords must be at least %d characters", errBadPassword, minPasswordLength)
+	}
+	if len(password) > 72 {
+		return nil, fmt.Errorf("%w: passwords can be at most 72 bytes", errBadPassword)
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// createUser adds an account with a role, which the caller checks is configured.
+func createUser(db *bolt.DB, username string, password string, role string) (*User, error) {
+	if !validUsername(username) {
+		return nil, fmt.Errorf("%w: %q, use letters, digits, '.', '_' and '-'", errBadUsername, username)
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	user := &User{Username: username, PasswordHash: hash, Role: role, CreatedAt: time.Now()}
+	return user, db.Update(func(tx *bolt.Tx) error {
+		users := authBucket(tx, userBucket)
+		if users.Get([]byte(username)) != nil {
+			return fmt.Errorf("%w: %s", errUserExists, username)
+		}
+		return putUser(tx, *user)
+	})
+}
+
+// setPassword changes the password of an account and ends its sessions.
+func setPassword(db *bolt.DB, username string, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		user, err := lookupUser(tx, username)
+		if err != nil {
+			return err
+		}
+		user.PasswordHash = hash
+		if err := putUser(tx, *user); err != nil {
+			return err
+		}
+		return removeCredentials(tx, sessionBucket, username)
+	})
+}
+
+// deleteUser removes an account with its sessions and tokens. What the user authored keeps their name.
+func deleteUser(db *bolt.DB, username string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if _, err := lookupUser(tx, username); err != nil {
+			return err
+		}
+		if err := removeCredentials(tx, sessionBucket, username); err != nil {
+			return err
+		}
+		if err := removeCredentials(tx, apiTokenBucket, username); err != nil {
+			return err
+		}
+		return authBucket(tx, userBucket).Delete([]byte(username))
+	})
+}
+
+// listUsers returns every account in username order.
+func listUsers(db *bolt.DB) ([]User, error) {
+	users := []User{}
+	err := db.View(func(tx *bolt.Tx) error {
+		return authBucket(tx, userBucket).ForEach(func(k, v []byte) error {
+			user := User{}
+			if err := json.Unmarshal(v, &user); err != nil {
+				return err
+			}
+			users = append(users, user)
+			return nil
+		})
+	})
+	return users, err
+}
+
+// putUser writes an account inside an existing transaction.
+func putUser(tx *bolt.Tx, user User) error {
+	buf, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return authBucket(tx, userBucket).Put([]byte(user.Username), buf)
+}
+
+// lookupUser reads an account inside an existing transaction.
+func lookupUser(tx *bolt.Tx, username string) (*User, error) {
+	v := authBucket(tx, userBucket).Get([]byte(username))
+	if v == nil {
+		return nil, fmt.Errorf("%w: %s", errUserNotFound, username)
+	}
+	user := &User{}
+	return user, json.Unmarshal(v, user)
+}
+
+// login checks a username and password and starts a session, returning its secret.
+// Expired sessions of the user are cleared out on the way.
+func login(db *bolt.DB, username string, password string) (string, *Session, error) {
+	var user *User
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		user, err = lookupUser(tx, username)
+		return err
+	})
+	if errors.Is(err, errUserNotFound) {
+		// Spend the time a real check takes, so response times do not tell which usernames exist.
+		bcrypt.CompareHashAndPassword(decoyPasswordHash, []byte(password))
+		return "", nil, errBadLogin
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(password)) != nil {
+		return "", nil, errBadLogin
+	}
+	secret, key, err := newSecret()
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now()
+	session := &Session{Username: username, CreatedAt: now, ExpiresAt: now.Add(sessionLifetime)}
+	err = db.Update(func(tx *bolt.Tx) error {
+		sessions := authBucket(tx, sessionBucket)
+		expired := [][]byte{}
+		sessions.ForEach(func(k, v []byte) error {
+			old := Session{}
+			if json.Unmarshal(v, &old) == nil && old.Username == username && now.After(old.ExpiresAt) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := sessions.Delete(k); err != nil {
+				return err
+			}
+		}
+		buf, err := json.Marshal(session)
+		if err != nil {
+			return err
+		}
+		return sessions.Put(key, buf)
+	})
+	return secret, session, err
+}
+
+// lookupSession finds the live session with the secret and its user. Sessions of deleted users do not count.
+func lookupSession(db *bolt.DB, secret string) (*Session, *User, error) {
+	session := &Session{}
+	var user *User
+	err := db.View(func(tx *bolt.Tx) error {
+		v := authBucket(tx, sessionBucket).Get(secretKey(secret))
+		if v == nil {
+			return errBadLogin
+		}
+		if err := json.Unmarshal(v, session); err != nil {
+			return err
+		}
+		if time.Now().After(session.ExpiresAt) {
+			return errBadLogin
+		}
+		var err error
+		user, err = lookupUser(tx, session.Username)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return session, user, nil
+}
+
+// deleteSession ends the session with the secret.
+func deleteSession(db *bolt.DB, secret string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return authBucket(tx, sessionBucket).Delete(secretKey(secret))
+	})
+}
+
+// createAPIToken makes a token for the user. The returned token carries its secret, which is not stored.
+func createAPIToken(db *bolt.DB, username string, name string) (*APIToken, error) {
+	secret, key, err := newSecret()
+	if err != nil {
+		return nil, err
+	}
+	token := APIToken{ID: uuid.New().String(), Username: username, Name: name, CreatedAt: time.Now()}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := lookupUser(tx, username); err != nil {
+			return err
+		}
+		buf, err := json.Marshal(token)
+		if err != nil {
+			return err
+		}
+		return authBucket(tx, apiTokenBucket).Put(key, buf)
+	})
+	if err != nil {
+		return nil, err
+	}
+	token.Token = secret
+	return &token, nil
+}
+
+// lookupAPIToken finds the token with the secret and its user. Tokens of deleted users do not count.
+func lookupAPIToken(db *bolt.DB, secret string) (*APIToken, *User, error) {
+	token := &APIToken{}
+	var user *User
+	err := db.View(func(tx *bolt.Tx) error {
+		v := authBucket(tx, apiTokenBucket).Get(secretKey(secret))
+		if v == nil {
+			return errTokenNotFound
+		}
+		if err := json.Unmarshal(v, token); err != nil {
+			return err
+		}
+		var err error
+		user, err = lookupUser(tx, token.Username)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return token, user, nil
+}
+
+// listAPITokens returns the tokens of a user, or of every user when username is empty, oldest first.
+func listAPITokens(db *bolt.DB, username string) ([]APIToken, error) {
+	tokens := []APIToken{}
+	err := db.View(func(tx *bolt.Tx) error {
+		return authBucket(tx, apiTokenBucket).ForEach(func(k, v []byte) error {
+			token := APIToken{}
+			if err := json.Unmarshal(v, &token); err != nil {
+				return err
+			}
+			if username == "" || token.Username == username {
+				tokens = append(tokens, token)
+			}
+			return nil
+		})
+	})
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+	return tokens, err
+}
+
+// deleteAPIToken revokes the token with the ID. When username is not empty the token must belong to that user.
+func deleteAPIToken(db *bolt.DB, username string, id string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		tokens := authBucket(tx, apiTokenBucket)
+		var found []byte
+		tokens.ForEach(func(k, v []byte) error {
+			token := APIToken{}
+			if json.Unmarshal(v, &token) == nil && token.ID == id && (username == "" || token.Username == username) {
+				found = k
+			}
+			return nil
+		})
+		if found == nil {
+			return fmt.Errorf("%w: %s", errTokenNotFound, id)
+		}
+		return tokens.Delete(found)
+	})
+}
+
+// removeCredentials deletes the sessions or tokens of a user inside an existing transaction.
+func removeCredentials(tx *bolt.Tx, bucket string, username string) error {
+	b := authBucket(tx, bucket)
+	keys := [][]byte{}
+	err := b.ForEach(func(k, v []byte) error {
+		record := struct {
+			Username string `json:"username"`
+		}{}
+		if err := json.Unmarshal(v, &record); err != nil {
+			return err
+		}
+		if record.Username == username {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// COMMANDS
+
+// runUserCommand implements "anansi user add [-role r] <name>", "anansi user passwd|delete <name>",
+// "anansi user role <name> <role>" and "anansi user list".
+// Passwords are prompted for on a terminal, or read from the first line of stdin.
+func runUserCommand(db *bolt.DB, roles Roles, args []string) error {
+	usage := fmt.Errorf("usage: anansi user add [-role r] <name>, anansi user passwd|delete <name>, anansi user role <name> <role> or anansi user list")
+	if len(args) == 0 {
+		return usage
+	}
+	switch args[0] {
+	case "list":
+		users, err := listUsers(db)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			fmt.Printf("%s\t%s\tcreated %s\n", user.Username, user.Role, user.CreatedAt.Format(time.RFC3339))
+		}
+		return nil
+	case "add":
+		flags := flag.NewFlagSet("user add", flag.ContinueOnError)
+		role := flags.String("role", "viewer", "role of the account: "+strings.Join(roles.names(), ", "))
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return usage
+		}
+		if !roles.has(*role) {
+			return fmt.Errorf("%w: %q, use one of %s", errUnknownRole, *role, strings.Join(roles.names(), ", "))
+		}
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if _, err := createUser(db, flags.Arg(0), password, *role); err != nil {
+			return err
+		}
+		fmt.Printf("Added %s user %s.\n", *role, flags.Arg(0))
+		return nil
+	case "role":
+		if len(args) != 3 {
+			return usage
+		}
+		if _, err := setRole(db, roles, args[1], args[2]); err != nil {
+			return err
+		}
+		fmt.Printf("%s is now %s.\n", args[1], args[2])
+		return nil
+	}
+	if len(args) != 2 {
+		return usage
+	}
+	username := args[1]
+	switch args[0] {
+	case "passwd":
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if err := setPassword(db, username, password); err != nil {
+			return err
+		}
+		fmt.Printf("Changed the password of %s and logged them out.\n", username)
+	case "delete":
+		if err := deleteUser(db, username); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted user %s with their sessions and tokens.\n", username)
+	default:
+		return usage
+	}
+	return nil
+}
+
+// readPassword prompts for a new password twice on a terminal, or reads it from the first line of stdin.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("could not read a password from stdin: %v", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	first, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprint(os.Stderr, "Again: ")
+	second, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if string(first) != string(second) {
+		return "", fmt.Errorf("%w: the passwords do not match", errBadPassword)
+	}
+	return string(first), nil
+}
+
+// runTokenCommand implements "anansi token create [-name n] <user>", "anansi token list [user]" and
+// "anansi token revoke <id>".
+func runTokenCommand(db *bolt.DB, args []string) error {
+	usage := fmt.Errorf("usage: anansi token create [-name n] <user>, anansi token list [user] or anansi token revoke <id>")
+	if len(args) == 0 {
+		return usage
+	}
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("token create", flag.ContinueOnError)
+		name := flags.String("name", "", "what the token is for")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return usage
+		}
+		token, err := createAPIToken(db, flags.Arg(0), *name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Created token %s for %s. It is only shown once:\n", token.ID, token.Username)
+		fmt.Println(token.Token)
+	case "list":
+		username := ""
+		if len(args) > 1 {
+			username = args[1]
+		}
+		tokens, err := listAPITokens(db, username)
+		if err != nil {
+			return err
+		}
+		for _, token := range tokens {
+			fmt.Printf("%s\t%s\t%s\t%s\n", token.ID, token.Username, token.CreatedAt.Format(time.RFC3339), token.Name)
+		}
+	case "revoke":
+		if len(args) != 2 {
+			return usage
+		}
+		if err := deleteAPIToken(db, "", args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked token %s.\n", args[1])
+	default:
+		return usage
+	}
+	return nil
+}
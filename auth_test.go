@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testPassword = "correct horse"
+
+// newTestRouter sets up a bolt store with the templates of the repository and returns its router.
+func newTestRouter(t *testing.T, roles Roles) (*mux.Router, *bolt.DB) {
+	t.Helper()
+	db := newTestDB(t)
+	r, err := newRouter(&boltStore{db: db}, "templates", t.TempDir(), roles, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, db
+}
+
+// newTestUser adds an account with a role and returns an API token for it.
+func newTestUser(t *testing.T, db *bolt.DB, username string, role string) string {
+	t.Helper()
+	if _, err := createUser(db, username, testPassword, role); err != nil {
+		t.Fatal(err)
+	}
+	token, err := createAPIToken(db, username, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token.Token
+}
+
+// request sends a request with an optional bearer token through h.
+func request(h http.Handler, method string, target string, body string, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, r)
+	return res
+}
+
+func TestLogin(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := createUser(db, "stephen", testPassword, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := login(db, "stephen", "wrong password"); !errors.Is(err, errBadLogin) {
+		t.Errorf("login with a wrong password: got %v, want errBadLogin", err)
+	}
+	if _, _, err := login(db, "nobody", testPassword); !errors.Is(err, errBadLogin) {
+		t.Errorf("login as an unknown user: got %v, want errBadLogin", err)
+	}
+	secret, session, err := login(db, "stephen", testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Username != "stephen" || !session.ExpiresAt.After(time.Now().Add(sessionLifetime-time.Minute)) {
+		t.Errorf("session %+v, want stephen's lasting %v", session, sessionLifetime)
+	}
+	found, user, err := lookupSession(db, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Username != "stephen" || user.Role != "admin" {
+		t.Errorf("session of %s with role %s, want stephen's with admin", found.Username, user.Role)
+	}
+	if _, _, err := lookupSession(db, secret+"x"); err == nil {
+		t.Error("a session was found for a wrong secret")
+	}
+	if err := deleteSession(db, secret); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := lookupSession(db, secret); err == nil {
+		t.Error("the session was found after logging out")
+	}
+}
+
+func TestDecoyPasswordHash(t *testing.T) {
+	// Logins for unknown users check against the decoy, so it must be a real hash of the same cost.
+	cost, err := bcrypt.Cost(decoyPasswordHash)
+	if err != nil {
+		t.Fatalf("the decoy is not a bcrypt hash: %v", err)
+	}
+	if cost != bcrypt.DefaultCost {
+		t.Errorf("the decoy has cost %d, passwords are hashed with %d", cost, bcrypt.DefaultCost)
+	}
+	if err := bcrypt.CompareHashAndPassword(decoyPasswordHash, []byte(testPassword)); !errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		t.Errorf("checking a password against the decoy: got %v, want a mismatch", err)
+	}
+}
+
+func TestSecretsAreStoredHashed(t *testing.T) {
+	db := newTestDB(t)
+	token := newTestUser(t, db, "stephen", "admin")
+	secret, _, err := login(db, "stephen", testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		for bucket, s := range map[string]string{sessionBucket: secret, apiTokenBucket: token} {
+			b := authBucket(tx, bucket)
+			if b.Get([]byte(s)) != nil {
+				t.Errorf("%s holds the secret itself", bucket)
+			}
+			if b.Get(secretKey(s)) == nil {
+				t.Errorf("%s does not hold the hash of the secret", bucket)
+			}
+			b.ForEach(func(k, v []byte) error {
+				if strings.Contains(string(v), s) {
+					t.Errorf("%s record %s contains the secret", bucket, k)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+func TestSessionExpiry(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := createUser(db, "stephen", testPassword, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	expired := "expired-secret"
+	err := db.Update(func(tx *bolt.Tx) error {
+		then := time.Now().Add(-sessionLifetime - time.Hour)
+		buf, err := json.Marshal(Session{Username: "stephen", CreatedAt: then, ExpiresAt: then.Add(sessionLifetime)})
+		if err != nil {
+			return err
+		}
+		return authBucket(tx, sessionBucket).Put(secretKey(expired), buf)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := lookupSession(db, expired); err == nil {
+		t.Error("an expired session was found")
+	}
+	// Logging in again clears the user's expired sessions out.
+	if _, _, err := login(db, "stephen", testPassword); err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if authBucket(tx, sessionBucket).Get(secretKey(expired)) != nil {
+			t.Error("the expired session was kept after logging in")
+		}
+		return nil
+	})
+}
+
+func TestAPITokens(t *testing.T) {
+	db := newTestDB(t)
+	secret := newTestUser(t, db, "stephen", "editor")
+	token, user, err := lookupAPIToken(db, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Username != "stephen" || user.Role != "editor" || token.Token != "" {
+		t.Errorf("token %+v of a %s, want stephen's without its secret and editor", token, user.Role)
+	}
+	if err := deleteAPIToken(db, "someone-else", token.ID); !errors.Is(err, errTokenNotFound) {
+		t.Errorf("revoking someone else's token: got %v, want errTokenNotFound", err)
+	}
+	if err := deleteAPIToken(db, "stephen", token.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := lookupAPIToken(db, secret); err == nil {
+		t.Error("the token was found after it was revoked")
+	}
+
+	// Deleting a user ends their sessions and tokens.
+	token, err = createAPIToken(db, "stephen", "again")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, _, err := login(db, "stephen", testPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteUser(db, "stephen"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := lookupAPIToken(db, token.Token); err == nil {
+		t.Error("the token of a deleted user was found")
+	}
+	if _, _, err := lookupSession(db, session); err == nil {
+		t.Error("the session of a deleted user was found")
+	}
+}
+
+func TestLocalRedirect(t *testing.T) {
+	tests := []struct {
+		next string
+		want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/content/abc?sort=label", "/content/abc?sort=label"},
+		{"/tags/dog/edit", "/tags/dog/edit"},
+		{"https://evil.example.com/", "/"},
+		{"//evil.example.com/", "/"},
+		{"/\\evil.example.com/", "/"},
+		{"evil.example.com", "/"},
+		{"javascript:alert(1)", "/"},
+	}
+	for _, tt := range tests {
+		if got := localRedirect(tt.next); got != tt.want {
+			t.Errorf("localRedirect(%q) = %q, want %q", tt.next, got, tt.want)
+		}
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	r, db := newTestRouter(t, defaultRoles())
+	token := newTestUser(t, db, "stephen", "editor")
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"token", "Bearer " + token, http.StatusOK},
+		{"wrong token", "Bearer nope", http.StatusUnauthorized},
+		{"empty token", "Bearer ", http.StatusUnauthorized},
+		{"basic auth", "Basic c3RlcGhlbjpwYXNzd29yZA==", http.StatusUnauthorized},
+		{"no credentials", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/v1/me", nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, req)
+		if res.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, res.Code, tt.status)
+		}
+		if tt.status == http.StatusUnauthorized && res.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: a 401 without WWW-Authenticate", tt.name)
+		}
+	}
+
+	// A bad token is refused even where anonymous callers may read.
+	if res := request(r, "GET", "/content", "", "nope"); res.Code != http.StatusUnauthorized {
+		t.Errorf("reading with a bad token: status %d, want 401", res.Code)
+	}
+
+	res := request(r, "GET", "/api/v1/me", "", token)
+	identity := struct{ Data Identity }{}
+	if err := json.Unmarshal(res.Body.Bytes(), &identity); err != nil {
+		t.Fatal(err)
+	}
+	if identity.Data != (Identity{Username: "stephen", Role: "editor", Method: "token"}) {
+		t.Errorf("identity %+v, want stephen's editor token", identity.Data)
+	}
+}
+
+func TestLoginHandler(t *testing.T) {
+	r, db := newTestRouter(t, defaultRoles())
+	newTestUser(t, db, "stephen", "editor")
+	post := func(username string, password string, next string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {username}, "password": {password}, "next": {next}}
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, req)
+		return res
+	}
+
+	for _, tt := range []struct{ username, password string }{{"stephen", "wrong password"}, {"nobody", testPassword}} {
+		res := post(tt.username, tt.password, "/tags")
+		if res.Code != http.StatusUnauthorized {
+			t.Errorf("login as %s with %q: status %d, want 401", tt.username, tt.password, res.Code)
+		}
+		if len(res.Result().Cookies()) != 0 {
+			t.Errorf("login as %s with %q set a cookie", tt.username, tt.password)
+		}
+	}
+
+	res := post("stephen", testPassword, "//evil.example.com/")
+	if res.Code != http.StatusSeeOther || res.Header().Get("Location") != "/" {
+		t.Errorf("login with an offsite next: status %d to %q, want 303 to /", res.Code, res.Header().Get("Location"))
+	}
+	res = post("stephen", testPassword, "/tags")
+	if res.Code != http.StatusSeeOther || res.Header().Get("Location") != "/tags" {
+		t.Fatalf("login: status %d to %q, want 303 to /tags", res.Code, res.Header().Get("Location"))
+	}
+	cookies := res.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie || !cookies[0].HttpOnly {
+		t.Fatalf("login set cookies %v, want an HttpOnly %s", cookies, sessionCookie)
+	}
+	withCookie := func(method string, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.AddCookie(cookies[0])
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, req)
+		return res
+	}
+	if res := withCookie("GET", "/api/v1/me"); res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `"method":"session"`) {
+		t.Errorf("me with the session cookie: status %d %s, want stephen's session", res.Code, res.Body)
+	}
+	if res := withCookie("POST", "/logout"); res.Code != http.StatusSeeOther {
+		t.Errorf("logout: status %d, want 303", res.Code)
+	}
+	// A stale session cookie is ignored rather than refused, so the pages still show.
+	if res := withCookie("GET", "/api/v1/me"); res.Code != http.StatusUnauthorized {
+		t.Errorf("me after logging out: status %d, want 401", res.Code)
+	}
+	if res := withCookie("GET", "/content"); res.Code != http.StatusOK {
+		t.Errorf("content list after logging out: status %d, want 200", res.Code)
+	}
+}
+
+func TestServeNeedsAccounts(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Store = "memory"
+	err := runServeCommand(cfg, newMemoryStore(), nil)
+	if err == nil || !strings.Contains(err.Error(), "-no-auth") {
+		t.Errorf("serving the memory store without -no-auth: got %v, want a refusal", err)
+	}
+}
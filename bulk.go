@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// BulkTagRequest adds and removes tags on many pieces of content at once. The content is the hashes in
+// Content, the content matching the tag query in Query, or both. Tags are named the way queries name them:
+// by slug, by alias or by label.
+type BulkTagRequest struct {
+	Content []string `json:"content,omitempty"`
+	Query   string   `json:"query,omitempty"`
+	Add     []string `json:"add,omitempty"`
+	Remove  []string `json:"remove,omitempty"`
+}
+
+// Statuses of the content in a bulk tag report.
+const (
+	bulkChanged   = "changed"
+	bulkUnchanged = "unchanged"
+	bulkNotFound  = "not found"
+	bulkConflict  = "conflict" // A tag to add is in an exclusive namespace the content already has another tag of.
+)
+
+// BulkTagResult is what a bulk tag request did to one piece of content.
+type BulkTagResult struct {
+	Content string   `json:"content"`
+	Status  string   `json:"status"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// BulkTagReport is the result of a bulk tag request. Add and Remove are the slugs the tag names resolved to.
+type BulkTagReport struct {
+	Add     []string        `json:"add"`
+	Remove  []string        `json:"remove"`
+	Changed int             `json:"changed"`
+	Results []BulkTagResult `json:"results"`
+}
+
+var errBadBulkTag = errors.New("bad bulk tag request")
+
+// bulkTagHandler applies a bulk tag request in the body and returns its report as JSON.
+func bulkTagHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var request BulkTagRequest
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+		if err != nil {
+			panic(err)
+		}
+		if err := r.Body.Close(); err != nil {
+			panic(err)
+		}
+		if err := json.Unmarshal(body, &request); err != nil {
+			res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			res.WriteHeader(422) // unprocessable entity
+			if err := json.NewEncoder(res).Encode(err); err != nil {
+				panic(err)
+			}
+			return
+		}
+		report, err := bulkTag(db, request)
+		var queryErr *QueryError
+		switch {
+		case errors.As(err, &queryErr):
+			res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			res.WriteHeader(http.StatusBadRequest)
+			if err := json.NewEncoder(res).Encode(queryErr); err != nil {
+				panic(err)
+			}
+			return
+		case errors.Is(err, errBadBulkTag):
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(422) // unprocessable entity
+			res.Write([]byte(err.Error()))
+			return
+		case err != nil:
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusInternalServerError)
+			res.Write([]byte("Error writing to DB."))
+			return
+		}
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		res.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(res).Encode(report); err != nil {
+			panic(err)
+		}
+	}
+	return fn
+}
+
+// apiBulkTagHandler applies a bulk tag request in the body and returns its report.
+func apiBulkTagHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var request BulkTagRequest
+		if !readAPIBody(res, r, &request) {
+			return
+		}
+		report, err := bulkTag(db, request)
+		var queryErr *QueryError
+		if errors.As(err, &queryErr) {
+			writeAPIError(res, http.StatusBadRequest, queryErr.Msg, queryErr)
+			return
+		}
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, report)
+	}
+	return fn
+}
+
+// DATA STORE FUNCTIONS
+
+// bulkTag applies a bulk tag request in one transaction. Every tag has to exist or nothing changes;
+// content that does not is reported as not found and skipped.
+func bulkTag(db *bolt.DB, request BulkTagRequest) (*BulkTagReport, error) {
+	if len(request.Add) == 0 && len(request.Remove) == 0 {
+		return nil, fmt.Errorf("%w: there are no tags to add or remove", errBadBulkTag)
+	}
+	if len(request.Content) == 0 && strings.TrimSpace(request.Query) == "" {
+		return nil, fmt.Errorf("%w: there is no content or query to select content", errBadBulkTag)
+	}
+	var node queryNode
+	if strings.TrimSpace(request.Query) != "" {
+		var err error
+		if node, err = parseQuery(request.Query); err != nil {
+			return nil, err
+		}
+	}
+	report := &BulkTagReport{Results: []BulkTagResult{}}
+	now := time.Now()
+	err := db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if report.Add, err = bulkTagSlugs(tx, request.Add); err != nil {
+			return err
+		}
+		if report.Remove, err = bulkTagSlugs(tx, request.Remove); err != nil {
+			return err
+		}
+		for _, slug := range report.Add {
+			for _, other := range report.Remove {
+				if slug == other {
+					return fmt.Errorf("%w: %s is both added and removed", errBadBulkTag, slug)
+				}
+			}
+		}
+		hashes := append([]string{}, request.Content...)
+		if node != nil {
+			matches, err := node.eval(tx)
+			if err != nil {
+				return err
+			}
+			queried := []string{}
+			for hash := range matches {
+				queried = append(queried, hash)
+			}
+			sort.Strings(queried)
+			hashes = append(hashes, queried...)
+		}
+		seen := map[string]bool{}
+		for _, hash := range hashes {
+			if seen[hash] {
+				continue
+			}
+			seen[hash] = true
+			result, err := bulkTagContent(tx, hash, report.Add, report.Remove, now)
+			if err != nil {
+				return err
+			}
+			if result.Status == bulkChanged {
+				report.Changed++
+			}
+			report.Results = append(report.Results, result)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// bulkTagSlugs resolves the tag names of a bulk tag request to slugs inside an existing transaction.
+func bulkTagSlugs(tx *bolt.Tx, names []string) ([]string, error) {
+	slugs := []string{}
+	for _, name := range names {
+		matches, err := resolveQueryTerm(tx, name)
+		if err != nil {
+			return nil, err
+		}
+		switch len(matches) {
+		case 0:
+			return nil, fmt.Errorf("%w: no tag is called %q", errBadBulkTag, name)
+		case 1:
+			slugs = append(slugs, matches[0])
+		default:
+			return nil, fmt.Errorf("%w: %q could be any of %s; use a slug", errBadBulkTag, name, strings.Join(matches, ", "))
+		}
+	}
+	return slugs, nil
+}
+
+// bulkTagContent adds and removes tags on one piece of content inside an existing transaction. Removals
+// happen first, so one request can swap the value of an exclusive namespace. Content that would end up
+// with two tags of an exclusive namespace is left as it was.
+func bulkTagContent(tx *bolt.Tx, hash string, add []string, remove []string, now time.Time) (BulkTagResult, error) {
+	result := BulkTagResult{Content: hash, Status: bulkUnchanged, Added: []string{}, Removed: []string{}}
+	content, err := lookupContent(tx, hash)
+	if err != nil {
+		return result, err
+	}
+	if content == nil {
+		result.Status = bulkNotFound
+		return result, nil
+	}
+	applied := map[string]bool{}
+	for _, slug := range edgeKeys(tx, edgeByContentBucket, hash) {
+		applied[slug] = true
+	}
+	after := []string{}
+	for slug := range applied {
+		if !containsString(remove, slug) {
+			after = append(after, slug)
+		}
+	}
+	for _, slug := range add {
+		if !applied[slug] && !containsString(after, slug) {
+			after = append(after, slug)
+		}
+	}
+	for _, slug := range add {
+		if applied[slug] {
+			continue
+		}
+		conflict, err := exclusiveConflict(tx, slug, after)
+		if err != nil {
+			return result, err
+		}
+		if conflict != "" {
+			result.Status, result.Error = bulkConflict, exclusiveError(tx, slug, conflict).Error()
+			return result, nil
+		}
+	}
+	for _, slug := range remove {
+		if !applied[slug] {
+			continue
+		}
+		if err := removeEdge(tx, slug, hash); err != nil {
+			return result, err
+		}
+		delete(applied, slug)
+		result.Removed = append(result.Removed, slug)
+	}
+	for _, slug := range add {
+		if applied[slug] {
+			continue
+		}
+		if err := putEdge(tx, Edge{Tag: slug, Content: hash, CreatedAt: now}); err != nil {
+			return result, err
+		}
+		applied[slug] = true
+		result.Added = append(result.Added, slug)
+	}
+	if len(result.Added) > 0 || len(result.Removed) > 0 {
+		result.Status = bulkChanged
+	}
+	return result, nil
+}
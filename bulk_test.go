@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+// edgeList returns every edge in the database as tag/content pairs.
+func edgeList(t *testing.T, store *boltStore) string {
+	t.Helper()
+	edges := []string{}
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(edgeByContentBucket)).ForEach(func(k, v []byte) error {
+			for _, slug := range edgeKeys(tx, edgeByContentBucket, string(k)) {
+				edges = append(edges, slug+"/"+string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(edges, " ")
+}
+
+func TestBulkTag(t *testing.T) {
+	store := &boltStore{db: newTestDB(t)}
+	seedStore(t, store)
+	if _, err := createNamespace(store.db, Namespace{Name: "type", Exclusive: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []Tag{{Slug: "type-photo", Label: "type:photo"}, {Slug: "type-video", Label: "type:video"}} {
+		if err := store.PutTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.ApplyTag("c", "type-video"); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := bulkTag(store.db, BulkTagRequest{Content: []string{"missing", "b"}, Query: "red", Add: []string{"blue", "type:photo"}, Remove: []string{"red"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, result := range report.Results {
+		got = append(got, fmt.Sprintf("%s:%s+%v-%v", result.Content, result.Status, result.Added, result.Removed))
+	}
+	// The listed content comes first and the query's matches, a and b, follow without b again.
+	want := "missing:not found+[]-[] b:changed+[blue type-photo]-[red] a:changed+[type-photo]-[red]"
+	if strings.Join(got, " ") != want || report.Changed != 2 {
+		t.Errorf("report %s with %d changed, want %s with 2", strings.Join(got, " "), report.Changed, want)
+	}
+
+	// c already has a type, so it is left as it was while a's swap of type goes through.
+	report, err = bulkTag(store.db, BulkTagRequest{Content: []string{"c", "a"}, Add: []string{"type-video"}, Remove: []string{"type-photo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Changed != 1 || report.Results[0].Status != bulkUnchanged || report.Results[1].Status != bulkChanged {
+		t.Errorf("swapping type: %+v, want c unchanged and a changed", report)
+	}
+	report, err = bulkTag(store.db, BulkTagRequest{Content: []string{"b"}, Add: []string{"type-video"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Results[0].Status != bulkConflict || report.Results[0].Error == "" {
+		t.Errorf("a second type: %+v, want a conflict", report.Results[0])
+	}
+	if got, want := edgeList(t, store), "blue/a type-video/a blue/b type-photo/b type-video/c"; got != want {
+		t.Errorf("edges %s, want %s", got, want)
+	}
+}
+
+func TestBulkTagRollsBack(t *testing.T) {
+	store := &boltStore{db: newTestDB(t)}
+	seedStore(t, store)
+	before := edgeList(t, store)
+
+	tests := []struct {
+		name    string
+		request BulkTagRequest
+	}{
+		{"unknown tag", BulkTagRequest{Content: []string{"a", "b", "c"}, Add: []string{"blue", "green"}}},
+		{"added and removed", BulkTagRequest{Content: []string{"a", "b", "c"}, Add: []string{"blue"}, Remove: []string{"red", "blue"}}},
+		{"nothing to do", BulkTagRequest{Content: []string{"a"}}},
+		{"no content", BulkTagRequest{Add: []string{"blue"}}},
+	}
+	for _, tt := range tests {
+		if _, err := bulkTag(store.db, tt.request); !errors.Is(err, errBadBulkTag) {
+			t.Errorf("%s: %v, want %v", tt.name, err, errBadBulkTag)
+		}
+	}
+	if _, err := bulkTag(store.db, BulkTagRequest{Query: "red and (", Add: []string{"blue"}}); err == nil {
+		t.Error("a bad query was applied")
+	}
+
+	// Content the transaction can not read fails the request after the items before it were tagged,
+	// and those are rolled back with it.
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(contentBucket)).Put([]byte("d"), []byte("{not json"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bulkTag(store.db, BulkTagRequest{Content: []string{"b", "c", "d"}, Add: []string{"blue"}, Remove: []string{"red"}}); err == nil {
+		t.Fatal("a request over unreadable content succeeded")
+	}
+	if got := edgeList(t, store); got != before {
+		t.Errorf("edges %s after failed requests, want them as before: %s", got, before)
+	}
+}
+
+func TestBulkTagHandler(t *testing.T) {
+	store := &boltStore{db: newTestDB(t)}
+	seedStore(t, store)
+	r := mux.NewRouter()
+	r.HandleFunc("/bulk/tags", bulkTagHandler(store.db)).Methods("POST")
+	r.HandleFunc("/api/v1/bulk/tags", apiBulkTagHandler(store)).Methods("POST")
+
+	tests := []struct {
+		body string
+		code int
+	}{
+		{`{"content": ["c"], "add": ["blue"]}`, http.StatusOK},
+		{`{"query": "red and (", "add": ["blue"]}`, http.StatusBadRequest},
+		{`{"content": ["c"], "add": ["green"]}`, 422},
+		{`{"content": `, 422},
+	}
+	for _, target := range []string{"/bulk/tags", "/api/v1/bulk/tags"} {
+		for _, tt := range tests {
+			if res := request(r, "POST", target, tt.body, ""); res.Code != tt.code {
+				t.Errorf("POST %s %s: status %d %s, want %d", target, tt.body, res.Code, res.Body, tt.code)
+			}
+		}
+	}
+	if _, err := store.GetEdge("blue", "c"); err != nil {
+		t.Errorf("c was not tagged blue: %v", err)
+	}
+}
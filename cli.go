@@ -0,0 +1,697 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const cliUsage = `usage: anansi [settings] <command> [flags] [args]
+
+Commands:
+  serve [-no-auth]                 start the web server (the default)
+  tag <file> <tag>...              apply tags to a file
+  untag <file> <tag>...            remove tags from a file
+  bulk [-add t,..] [-remove t,..] [-query "<expr>"] [<file>...]
+                                   add and remove tags on many files at once
+  tags <file>                      list the tags of a file
+  suggest <prefix>                 list the tags whose name starts with prefix, the most used first
+  query "<expr>"                   list the content matching a tag query, eg. "dog AND NOT cat"
+  scan <dir>...                    add the files under directories to the library
+  stats                            count what is in the library
+  export [-format jsonl|tar.gz]    write the library to stdout or -o <file>
+  import [-policy p] <file>        read an export into the library
+  watch <dir>...                   keep the paths of content under directories up to date
+  migrate [-dry-run]               bring the database up to the current schema version
+  user add [-role r] <name>        add an account; user passwd|delete|role and user list manage them
+  token create [-name n] <user>    make an API token for scripts; token list|revoke manage them
+  config print [-format f]         show the effective settings as toml, yaml or json
+
+tag, untag, bulk, tags, suggest, query, scan and stats open the database directly, or work through
+a running server with -server http://host:port (or ANANSI_SERVER), sending the API token in
+-token (or ANANSI_TOKEN) for changes. They print JSON with -json.
+A <file> is a path on disk or a content hash. A <tag> is a slug, an alias or a label.
+
+Settings come from the defaults, then a config file (anansi.toml, anansi.yaml or -config),
+then ANANSI_* environment variables, then the settings flags, eg. anansi -listen :9000 serve.`
+
+// runCommand runs an anansi subcommand with its arguments.
+func runCommand(cfg Config, name string, args []string) error {
+	switch name {
+	case "migrate":
+		// Opening the bolt store applies pending migrations, so migrate has to run before it.
+		return runMigrateCommand(cfg, args)
+	case "config":
+		return runConfigCommand(cfg, args)
+	case "tag", "untag", "bulk", "tags", "suggest", "query", "scan", "stats":
+		return runCLICommand(cfg, name, args)
+	case "serve", "export", "import", "watch", "user", "token":
+	case "help", "-h", "-help", "--help":
+		fmt.Println(cliUsage)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", name, cliUsage)
+	}
+
+	store, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	switch name {
+	case "serve":
+		return runServeCommand(cfg, store, args)
+	case "export":
+		return runExportCommand(store, args)
+	case "import":
+		return runImportCommand(store, args)
+	}
+	db := boltDB(store)
+	if db == nil {
+		return fmt.Errorf("the %s command needs the bolt store", name)
+	}
+	switch name {
+	case "user":
+		return runUserCommand(db, cfg.Roles, args)
+	case "token":
+		return runTokenCommand(db, args)
+	default:
+		return runWatchCommand(db, args)
+	}
+}
+
+// LibraryStats counts what is in the library.
+type LibraryStats struct {
+	Content  int `json:"content"`
+	Tags     int `json:"tags"`
+	Edges    int `json:"edges"`
+	Untagged int `json:"untagged"` // Content without any tags.
+	Missing  int `json:"missing"`  // Content whose files are all gone.
+	Remote   int `json:"remote"`   // Content ingested from a URL.
+}
+
+// libraryStats walks the store to count its records.
+func libraryStats(store Store) (*LibraryStats, error) {
+	stats := &LibraryStats{}
+	err := forEachContent(store, func(content Content) error {
+		tags, err := store.TagsForContent(content.Hash)
+		if err != nil {
+			return err
+		}
+		stats.Content++
+		stats.Edges += len(tags)
+		if len(tags) == 0 {
+			stats.Untagged++
+		}
+		if content.Missing {
+			stats.Missing++
+		}
+		if content.URL != "" {
+			stats.Remote++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	tags, err := allTags(store)
+	if err != nil {
+		return nil, err
+	}
+	stats.Tags = len(tags)
+	return stats, nil
+}
+
+// cliBackend is what the command line works against: the database on disk or a running server.
+type cliBackend interface {
+	content(file string) (*Content, error)
+	tag(name string) (*Tag, error)
+	applyTag(hash string, slug string) error
+	removeTag(hash string, slug string) error
+	bulkTag(request BulkTagRequest) (*BulkTagReport, error)
+	tagsFor(hash string) ([]Tag, error)
+	suggest(prefix string) ([]TagSuggestion, error)
+	query(expr string) ([]Content, error)
+	scan(roots []string) (*ScanReport, error)
+	stats() (*LibraryStats, error)
+}
+
+// runCLICommand runs one of the commands that can work either on the database or through a server.
+func runCLICommand(cfg Config, name string, args []string) error {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	server := flags.String("server", os.Getenv("ANANSI_SERVER"), "URL of a running anansi server to work through instead of the database")
+	token := flags.String("token", os.Getenv("ANANSI_TOKEN"), "API token to send to the server")
+	asJSON := flags.Bool("json", false, "print JSON instead of text")
+	var add, remove, query *string
+	if name == "bulk" {
+		add = flags.String("add", "", "comma separated tags to apply")
+		remove = flags.String("remove", "", "comma separated tags to remove")
+		query = flags.String("query", "", "tag query selecting the content, as well as any files")
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	args = flags.Args()
+
+	var backend cliBackend
+	if *server != "" {
+		backend = &remoteBackend{base: strings.TrimRight(*server, "/"), token: *token, client: &http.Client{Timeout: 30 * time.Second}}
+	} else {
+		store, err := openStore(cfg)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		backend = &localBackend{store: store}
+	}
+
+	switch name {
+	case "tag", "untag":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: anansi %s [-server url] [-json] <file> <tag>...", name)
+		}
+		return cliChangeTags(backend, *asJSON, args[0], args[1:], name == "tag")
+	case "bulk":
+		if (*add == "" && *remove == "") || (len(args) == 0 && *query == "") {
+			return fmt.Errorf("usage: anansi bulk [-server url] [-json] [-add t,..] [-remove t,..] [-query \"<expr>\"] [<file>...]")
+		}
+		return cliBulkTag(backend, *asJSON, args, splitTagNames(*add), splitTagNames(*remove), *query)
+	case "tags":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: anansi tags [-server url] [-json] <file>")
+		}
+		content, err := backend.content(args[0])
+		if err != nil {
+			return err
+		}
+		tags, err := backend.tagsFor(content.Hash)
+		if err != nil {
+			return err
+		}
+		return printCLI(*asJSON, tags, func() {
+			for _, tag := range tags {
+				fmt.Printf("%s\t%s\n", tag.Slug, tag.Label)
+			}
+		})
+	case "suggest":
+		if len(args) == 0 {
+			return fmt.Errorf("usage: anansi suggest [-server url] [-json] <prefix>")
+		}
+		suggestions, err := backend.suggest(strings.Join(args, " "))
+		if err != nil {
+			return err
+		}
+		return printCLI(*asJSON, suggestions, func() {
+			for _, s := range suggestions {
+				name := s.Label
+				if s.Alias != "" {
+					name = fmt.Sprintf("%s (%s)", s.Label, s.Alias)
+				}
+				fmt.Printf("%s\t%s\t%d\n", s.Slug, name, s.Count)
+			}
+		})
+	case "query":
+		if len(args) == 0 {
+			return fmt.Errorf("usage: anansi query [-server url] [-json] \"<expr>\"")
+		}
+		results, err := backend.query(strings.Join(args, " "))
+		if err != nil {
+			return err
+		}
+		return printCLI(*asJSON, results, func() {
+			for _, content := range results {
+				fmt.Printf("%s\t%s\n", content.Hash, contentName(content))
+			}
+		})
+	case "scan":
+		if len(args) == 0 {
+			return fmt.Errorf("usage: anansi scan [-server url] [-json] <dir>...")
+		}
+		report, err := backend.scan(args)
+		if err != nil {
+			return err
+		}
+		return printCLI(*asJSON, report, func() { printScanReport(report) })
+	default:
+		stats, err := backend.stats()
+		if err != nil {
+			return err
+		}
+		return printCLI(*asJSON, stats, func() {
+			fmt.Printf("content:   %d\n", stats.Content)
+			fmt.Printf("  untagged: %d\n", stats.Untagged)
+			fmt.Printf("  missing:  %d\n", stats.Missing)
+			fmt.Printf("  remote:   %d\n", stats.Remote)
+			fmt.Printf("tags:      %d\n", stats.Tags)
+			fmt.Printf("edges:     %d\n", stats.Edges)
+		})
+	}
+}
+
+// cliChangeTags applies or removes tags on the content of file and prints the tags it is left with.
+// Every tag is looked up before anything changes, so a typo leaves the content as it was.
+func cliChangeTags(backend cliBackend, asJSON bool, file string, names []string, apply bool) error {
+	content, err := backend.content(file)
+	if err != nil {
+		return err
+	}
+	tags := []*Tag{}
+	for _, name := range names {
+		tag, err := backend.tag(name)
+		if err != nil {
+			return err
+		}
+		tags = append(tags, tag)
+	}
+	for _, tag := range tags {
+		if apply {
+			err = backend.applyTag(content.Hash, tag.Slug)
+		} else {
+			err = backend.removeTag(content.Hash, tag.Slug)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", tag.Slug, err)
+		}
+	}
+	current, err := backend.tagsFor(content.Hash)
+	if err != nil {
+		return err
+	}
+	result := struct {
+		Content *Content `json:"content"`
+		Tags    []Tag    `json:"tags"`
+	}{content, current}
+	return printCLI(asJSON, result, func() {
+		labels := []string{}
+		for _, tag := range current {
+			labels = append(labels, tag.Label)
+		}
+		fmt.Printf("%s: %s\n", contentName(*content), strings.Join(labels, ", "))
+	})
+}
+
+// cliBulkTag adds and removes tags on the content of files and of a query in one go, and prints what
+// changed for each. The server checks every tag first, so a typo leaves all the content as it was.
+func cliBulkTag(backend cliBackend, asJSON bool, files []string, add []string, remove []string, query string) error {
+	request := BulkTagRequest{Query: query, Add: add, Remove: remove}
+	for _, file := range files {
+		hash, err := contentHashForFile(file)
+		if err != nil {
+			return err
+		}
+		request.Content = append(request.Content, hash)
+	}
+	report, err := backend.bulkTag(request)
+	if err != nil {
+		return err
+	}
+	err = printCLI(asJSON, report, func() {
+		for _, result := range report.Results {
+			changes := []string{}
+			for _, slug := range result.Added {
+				changes = append(changes, "+"+slug)
+			}
+			for _, slug := range result.Removed {
+				changes = append(changes, "-"+slug)
+			}
+			if result.Error != "" {
+				changes = append(changes, result.Error)
+			}
+			fmt.Printf("%s\t%s\t%s\n", result.Content, result.Status, strings.Join(changes, " "))
+		}
+		fmt.Printf("%d of %d changed\n", report.Changed, len(report.Results))
+	})
+	if err != nil {
+		return err
+	}
+	missing, conflicts := 0, 0
+	for _, result := range report.Results {
+		switch result.Status {
+		case bulkNotFound:
+			missing++
+		case bulkConflict:
+			conflicts++
+		}
+	}
+	switch {
+	case missing > 0:
+		return fmt.Errorf("%d not in the library, scan them first", missing)
+	case conflicts > 0:
+		return fmt.Errorf("%d left as they were, they already have a tag of an exclusive namespace", conflicts)
+	}
+	return nil
+}
+
+// splitTagNames splits a comma separated list of tags, dropping blanks.
+func splitTagNames(v string) []string {
+	names := []string{}
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// printCLI prints v as JSON, or calls text to print it for people.
+func printCLI(asJSON bool, v interface{}, text func()) error {
+	if !asJSON {
+		text()
+		return nil
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// contentName is how the command line refers to content: its label, else its first path, else its hash.
+func contentName(content Content) string {
+	switch {
+	case content.Label != "":
+		return content.Label
+	case len(content.Paths) > 0:
+		return content.Paths[0]
+	case content.URL != "":
+		return content.URL
+	}
+	return content.Hash
+}
+
+// contentHashForFile returns the hash a file argument refers to. Paths of files on disk are hashed
+// the way scans hash them, anything else is taken to be a hash already.
+func contentHashForFile(file string) (string, error) {
+	info, err := os.Stat(file)
+	if err != nil || info.IsDir() {
+		return file, nil
+	}
+	return hashFile(file)
+}
+
+// localBackend runs commands against the store on disk.
+type localBackend struct {
+	store Store
+}
+
+func (b *localBackend) content(file string) (*Content, error) {
+	hash, err := contentHashForFile(file)
+	if err != nil {
+		return nil, err
+	}
+	content, err := b.store.GetContent(hash)
+	if errors.Is(err, errContentNotFound) && hash != file {
+		// The file may have changed since it was scanned, so fall back to the path index.
+		if db := boltDB(b.store); db != nil {
+			abs, _ := filepath.Abs(file)
+			db.View(func(tx *bolt.Tx) error {
+				if v := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(pathBucket)).Get([]byte(abs)); v != nil {
+					hash = string(v)
+				}
+				return nil
+			})
+			content, err = b.store.GetContent(hash)
+		}
+	}
+	if errors.Is(err, errContentNotFound) {
+		return nil, fmt.Errorf("%s is not in the library, scan it first", file)
+	}
+	return content, err
+}
+
+// tag finds a tag the way tag queries do: by slug, by alias, or ignoring case by its label.
+func (b *localBackend) tag(name string) (*Tag, error) {
+	if db := boltDB(b.store); db != nil {
+		var slugs []string
+		err := db.View(func(tx *bolt.Tx) error {
+			var err error
+			slugs, err = resolveQueryTerm(tx, name)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return pickTag(b.store.GetTag, name, slugs)
+	}
+	tag, err := b.store.GetTag(name)
+	if !errors.Is(err, errTagNotFound) {
+		return tag, err
+	}
+	tags, err := allTags(b.store)
+	if err != nil {
+		return nil, err
+	}
+	return pickTag(b.store.GetTag, name, labelMatches(tags, name))
+}
+
+func (b *localBackend) applyTag(hash string, slug string) error {
+	_, err := b.store.ApplyTag(hash, slug)
+	return err
+}
+
+func (b *localBackend) removeTag(hash string, slug string) error {
+	return b.store.DeleteEdge(slug, hash)
+}
+
+func (b *localBackend) bulkTag(request BulkTagRequest) (*BulkTagReport, error) {
+	db := boltDB(b.store)
+	if db == nil {
+		return nil, fmt.Errorf("the bulk command needs the bolt store")
+	}
+	return bulkTag(db, request)
+}
+
+func (b *localBackend) tagsFor(hash string) ([]Tag, error) {
+	return b.store.TagsForContent(hash)
+}
+
+func (b *localBackend) suggest(prefix string) ([]TagSuggestion, error) {
+	db := boltDB(b.store)
+	if db == nil {
+		return nil, fmt.Errorf("the suggest command needs the bolt store")
+	}
+	return suggestTags(db, prefix, defaultSuggestLimit)
+}
+
+func (b *localBackend) query(expr string) ([]Content, error) {
+	db := boltDB(b.store)
+	if db == nil {
+		return nil, fmt.Errorf("the query command needs the bolt store")
+	}
+	results, err := searchContent(db, expr)
+	if err != nil {
+		return nil, err
+	}
+	return contentSlice(results), nil
+}
+
+func (b *localBackend) scan(roots []string) (*ScanReport, error) {
+	db := boltDB(b.store)
+	if db == nil {
+		return nil, fmt.Errorf("the scan command needs the bolt store")
+	}
+	return scanRoots(db, roots)
+}
+
+func (b *localBackend) stats() (*LibraryStats, error) {
+	return libraryStats(b.store)
+}
+
+// labelMatches returns the slugs of the tags whose label, or namespace:label, is name, ignoring case.
+func labelMatches(tags []Tag, name string) []string {
+	slugs := []string{}
+	for _, tag := range tags {
+		if strings.EqualFold(tag.Label, name) || strings.EqualFold(tagName(tag), name) {
+			slugs = append(slugs, tag.Slug)
+		}
+	}
+	return slugs
+}
+
+// pickTag returns the one tag a name resolved to, and fails if it resolved to none or to several.
+func pickTag(get func(string) (*Tag, error), name string, slugs []string) (*Tag, error) {
+	switch len(slugs) {
+	case 0:
+		return nil, fmt.Errorf("no tag is called %q", name)
+	case 1:
+		return get(slugs[0])
+	}
+	return nil, fmt.Errorf("%q could be any of %s; use a slug", name, strings.Join(slugs, ", "))
+}
+
+// remoteBackend runs commands through the /api/v1 routes of a running server.
+type remoteBackend struct {
+	base   string
+	token  string // Sent as a bearer token when set.
+	client *http.Client
+}
+
+// call makes an API request and decodes the data of the response envelope into out, when out is not nil.
+func (b *remoteBackend) call(method string, path string, body interface{}, out interface{}) error {
+	_, err := b.callPage(method, path, body, out)
+	return err
+}
+
+// callPage is call for listings, returning the page of a paged listing or nil for a whole list.
+func (b *remoteBackend) callPage(method string, path string, body interface{}, out interface{}) (*PageInfo, error) {
+	var reader io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, b.base+"/api/v1"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if b.token != "" {
+		req.Header.Set("Authorization", "Bearer "+b.token)
+	}
+	res, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		env := ErrorEnvelope{}
+		if err := json.NewDecoder(res.Body).Decode(&env); err != nil || env.Error.Message == "" {
+			return nil, fmt.Errorf("%s %s: %s", method, path, res.Status)
+		}
+		return nil, &remoteError{Status: res.StatusCode, Message: env.Error.Message}
+	}
+	if out == nil {
+		return nil, nil
+	}
+	env := ListPage{Data: out}
+	if err := json.NewDecoder(res.Body).Decode(&env); err != nil {
+		return nil, err
+	}
+	return env.Page, nil
+}
+
+// remoteError is an error answered by the server.
+type remoteError struct {
+	Status  int
+	Message string
+}
+
+func (e *remoteError) Error() string {
+	return e.Message
+}
+
+func isRemoteNotFound(err error) bool {
+	var remoteErr *remoteError
+	return errors.As(err, &remoteErr) && remoteErr.Status == http.StatusNotFound
+}
+
+func (b *remoteBackend) content(file string) (*Content, error) {
+	hash, err := contentHashForFile(file)
+	if err != nil {
+		return nil, err
+	}
+	content := &Content{}
+	err = b.call("GET", "/content/"+url.PathEscape(hash), nil, content)
+	if isRemoteNotFound(err) {
+		return nil, fmt.Errorf("%s is not in the library, scan it first", file)
+	}
+	return content, err
+}
+
+func (b *remoteBackend) tag(name string) (*Tag, error) {
+	tag := &Tag{}
+	err := b.call("GET", "/tags/"+url.PathEscape(name), nil, tag)
+	if !isRemoteNotFound(err) {
+		return tag, err
+	}
+	// Not a slug or an alias, so look for it by label.
+	tags := []Tag{}
+	cursor := ""
+	for {
+		page := []Tag{}
+		info, err := b.callPage("GET", fmt.Sprintf("/tags?limit=%d&cursor=%s", maxPageLimit, url.QueryEscape(cursor)), nil, &page)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, page...)
+		if info == nil || info.Next == "" {
+			break
+		}
+		cursor = info.Next
+	}
+	return pickTag(func(slug string) (*Tag, error) {
+		tag := &Tag{}
+		return tag, b.call("GET", "/tags/"+url.PathEscape(slug), nil, tag)
+	}, name, labelMatches(tags, name))
+}
+
+func (b *remoteBackend) applyTag(hash string, slug string) error {
+	return b.call("PUT", "/content/"+url.PathEscape(hash)+"/tags/"+url.PathEscape(slug), nil, nil)
+}
+
+func (b *remoteBackend) removeTag(hash string, slug string) error {
+	return b.call("DELETE", "/content/"+url.PathEscape(hash)+"/tags/"+url.PathEscape(slug), nil, nil)
+}
+
+func (b *remoteBackend) bulkTag(request BulkTagRequest) (*BulkTagReport, error) {
+	report := &BulkTagReport{}
+	return report, b.call("POST", "/bulk/tags", request, report)
+}
+
+func (b *remoteBackend) tagsFor(hash string) ([]Tag, error) {
+	tags := []Tag{}
+	return tags, b.call("GET", "/content/"+url.PathEscape(hash)+"/tags", nil, &tags)
+}
+
+func (b *remoteBackend) suggest(prefix string) ([]TagSuggestion, error) {
+	suggestions := []TagSuggestion{}
+	return suggestions, b.call("GET", "/tags/suggest?prefix="+url.QueryEscape(prefix), nil, &suggestions)
+}
+
+func (b *remoteBackend) query(expr string) ([]Content, error) {
+	results := []Content{}
+	return results, b.call("GET", "/search?q="+url.QueryEscape(expr), nil, &results)
+}
+
+// scan starts a scan on the server and waits for it to finish. The server scans its own disk,
+// so relative directories are made absolute first.
+func (b *remoteBackend) scan(roots []string) (*ScanReport, error) {
+	abs := []string{}
+	for _, root := range roots {
+		a, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+		abs = append(abs, a)
+	}
+	job := &ScanJob{}
+	if err := b.call("POST", "/scan", map[string][]string{"roots": abs}, job); err != nil {
+		return nil, err
+	}
+	for job.Status == "running" {
+		time.Sleep(500 * time.Millisecond)
+		if err := b.call("GET", "/scan/"+job.ID, nil, job); err != nil {
+			return nil, err
+		}
+	}
+	if job.Status == "failed" {
+		return nil, errors.New(job.Error)
+	}
+	return job.Report, nil
+}
+
+func (b *remoteBackend) stats() (*LibraryStats, error) {
+	stats := &LibraryStats{}
+	return stats, b.call("GET", "/stats", nil, stats)
+}
@@ -0,0 +1,875 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/gosimple/slug"
+)
+
+// Collections name a set of content. A saved search has a tag query, kept so it does not have to be typed
+// again, which is evaluated when the collection is opened so its content is always what the query matches
+// now. A collection without a query is put together by hand: its items are content hashes in the order
+// they were arranged in, eg. the slides of a presentation or the pages of a comic. COLLECTIONS maps each
+// slug to a serialized Collection, and CONTENT_COLLECTIONS holds a nested bucket per content hash with the
+// slugs of the collections it is an item of, so content can be in many collections and leaves them all
+// when it is deleted.
+const collectionBucket = "COLLECTIONS"
+const contentCollectionsBucket = "CONTENT_COLLECTIONS"
+
+var errCollectionNotFound = errors.New("collection not found")
+var errCollectionExists = errors.New("collection already exists")
+var errBadCollection = errors.New("bad collection")
+
+// errInCollection is returned when adding content to a collection it is already an item of.
+var errInCollection = errors.New("content is already in the collection")
+
+// Collection is a saved search, or a collection put together by hand when Query is empty. Sort and Order
+// order the content of a saved search like the content list: by created or label, asc or desc. Items are
+// the hashes of the content of a collection put together by hand, in order.
+type Collection struct {
+	Slug        string    `json:"slug"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Query       string    `json:"query,omitempty"`
+	Sort        string    `json:"sort,omitempty"`
+	Order       string    `json:"order,omitempty"`
+	Items       []string  `json:"items,omitempty"`
+	Author      string    `json:"author,omitempty"`
+	CreatedAt   time.Time `json:"createdAt,omitempty"`
+	UpdatedAt   time.Time `json:"updatedAt,omitempty"`
+}
+
+// CollectionItem adds content to a collection put together by hand. Position is where it goes, counting
+// from 0; it goes last without one.
+type CollectionItem struct {
+	Content  string `json:"content"`
+	Position *int   `json:"position,omitempty"`
+}
+
+// CollectionOrder rearranges the items of a collection put together by hand. Items must be the hashes
+// already in it, in their new order.
+type CollectionOrder struct {
+	Items []string `json:"items"`
+}
+
+// CollectionView is a collection as it is when opened: the number of items it has and, when it is opened
+// on its own rather than listed, the items in order.
+type CollectionView struct {
+	Collection
+	Count   int       `json:"count"`
+	Content []Content `json:"content,omitempty"`
+}
+
+// CollectionListData is the data required to render the HTML template for the collection list.
+type CollectionListData struct {
+	SiteMetaData SiteMetaData
+	Collections  []CollectionView
+}
+
+// CollectionPageData is the data required to render the HTML template for a collection. Error is set when
+// its query can no longer be evaluated, eg. because it compares a field no content type has any more.
+type CollectionPageData struct {
+	SiteMetaData SiteMetaData
+	Collection   CollectionView
+	Error        string
+}
+
+// COLLECTION HANDLERS
+
+// writeCollectionError answers a request that failed with err as plain text.
+func writeCollectionError(res http.ResponseWriter, err error) {
+	res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	switch {
+	case errors.Is(err, errCollectionNotFound):
+		res.WriteHeader(http.StatusNotFound)
+		res.Write([]byte("Collection not found."))
+	case errors.Is(err, errContentNotFound):
+		res.WriteHeader(http.StatusNotFound)
+		res.Write([]byte("Content not found."))
+	case errors.Is(err, errCollectionExists), errors.Is(err, errInCollection):
+		res.WriteHeader(http.StatusConflict)
+		res.Write([]byte(err.Error()))
+	case errors.Is(err, errBadCollection):
+		res.WriteHeader(422) // unprocessable entity
+		res.Write([]byte(err.Error()))
+	default:
+		res.WriteHeader(http.StatusInternalServerError)
+		res.Write([]byte("Error accessing the DB."))
+	}
+}
+
+// collectionListHandler lists the collections with the number of items each has now.
+// They are returned as JSON when the client accepts it, and as an HTML page otherwise.
+func collectionListHandler(db *bolt.DB, t *template.Template) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		log.Println("Requested the collection list.")
+		collections, err := listCollections(db)
+		if err != nil {
+			writeCollectionError(res, err)
+			return
+		}
+		if wantsJSON(r) {
+			writeJSON(res, http.StatusOK, collections)
+			return
+		}
+		res.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		res.WriteHeader(http.StatusOK)
+		t.Execute(res, CollectionListData{SiteMetaData: siteMetaData, Collections: collections})
+	}
+	return fn
+}
+
+// getCollectionHandler opens the collection in the URL, evaluating its query.
+// It is returned as JSON when the client accepts it, and as an HTML page otherwise.
+func getCollectionHandler(db *bolt.DB, t *template.Template) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		view, err := openCollection(db, mux.Vars(r)["slug"])
+		var queryErr *QueryError
+		if err != nil && !errors.As(err, &queryErr) {
+			writeCollectionError(res, err)
+			return
+		}
+		log.Printf("Requested collection: %s \n", view.Name)
+		if wantsJSON(r) {
+			if queryErr != nil {
+				writeJSON(res, http.StatusBadRequest, queryErr)
+				return
+			}
+			writeJSON(res, http.StatusOK, view)
+			return
+		}
+		data := CollectionPageData{SiteMetaData: siteMetaData, Collection: *view}
+		status := http.StatusOK
+		if queryErr != nil {
+			data.Error = queryErr.Error()
+			status = http.StatusBadRequest
+		}
+		res.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		res.WriteHeader(status)
+		t.Execute(res, data)
+	}
+	return fn
+}
+
+// createCollectionHandler saves the search in the JSON body, eg. {"name": "Best photos", "query": "rating>=4"}.
+// The slug is made from the name.
+func createCollectionHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var collection Collection
+		if !readJSONBody(res, r, &collection) {
+			return
+		}
+		collection.Author = requestAuthor(r, collection.Author)
+		created, err := createCollection(db, collection)
+		if err != nil {
+			writeCollectionError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusCreated, created)
+	}
+	return fn
+}
+
+// modifyCollectionHandler replaces the name, description, query and order of the collection in the URL.
+// The items of a collection put together by hand are changed through its items instead.
+func modifyCollectionHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var collection Collection
+		if !readJSONBody(res, r, &collection) {
+			return
+		}
+		collection.Author = requestAuthor(r, collection.Author)
+		modified, err := modifyCollection(db, mux.Vars(r)["slug"], collection)
+		if err != nil {
+			writeCollectionError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, modified)
+	}
+	return fn
+}
+
+// deleteCollectionHandler deletes the collection in the URL. The content in it is left as it is.
+func deleteCollectionHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		if err := deleteCollection(db, mux.Vars(r)["slug"]); err != nil {
+			writeCollectionError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, struct {
+			Deleted bool
+		}{true})
+	}
+	return fn
+}
+
+// insertCollectionItemHandler adds the content in the JSON body to the collection in the URL,
+// eg. {"content": "<hash>", "position": 0}, and returns the collection.
+func insertCollectionItemHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var item CollectionItem
+		if !readJSONBody(res, r, &item) {
+			return
+		}
+		collection, err := insertCollectionItem(db, mux.Vars(r)["slug"], item)
+		if err != nil {
+			writeCollectionError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, collection)
+	}
+	return fn
+}
+
+// reorderCollectionHandler rearranges the items of the collection in the URL into the order in the JSON
+// body, eg. {"items": ["<hash>", "<hash>"]}, and returns the collection.
+func reorderCollectionHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var order CollectionOrder
+		if !readJSONBody(res, r, &order) {
+			return
+		}
+		collection, err := reorderCollection(db, mux.Vars(r)["slug"], order.Items)
+		if err != nil {
+			writeCollectionError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, collection)
+	}
+	return fn
+}
+
+// removeCollectionItemHandler takes the content in the URL out of the collection in the URL and returns the collection.
+func removeCollectionItemHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		collection, err := removeCollectionItem(db, mux.Vars(r)["slug"], mux.Vars(r)["hash"])
+		if err != nil {
+			writeCollectionError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, collection)
+	}
+	return fn
+}
+
+// listContentCollectionsHandler returns the collections put together by hand that the content in the URL
+// is an item of, as JSON.
+func listContentCollectionsHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		collections, err := contentCollections(db, mux.Vars(r)["hash"])
+		if err != nil {
+			writeCollectionError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, collections)
+	}
+	return fn
+}
+
+// COLLECTION API HANDLERS
+
+// apiListCollectionsHandler returns every collection with the number of items it has now.
+func apiListCollectionsHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		collections, err := listCollections(db)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIList(res, collections, nil)
+	}
+	return fn
+}
+
+// apiGetCollectionHandler returns the collection in the URL with its content.
+func apiGetCollectionHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		view, err := openCollection(db, mux.Vars(r)["slug"])
+		var queryErr *QueryError
+		if errors.As(err, &queryErr) {
+			writeAPIError(res, http.StatusBadRequest, queryErr.Msg, queryErr)
+			return
+		}
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, view)
+	}
+	return fn
+}
+
+// apiCreateCollectionHandler saves the search in the body.
+func apiCreateCollectionHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var collection Collection
+		if !readAPIBody(res, r, &collection) {
+			return
+		}
+		collection.Author = requestAuthor(r, collection.Author)
+		created, err := createCollection(db, collection)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		res.Header().Set("Location", "/api/v1/collections/"+created.Slug)
+		writeAPIData(res, http.StatusCreated, created)
+	}
+	return fn
+}
+
+// apiModifyCollectionHandler replaces the name, description, query and order of the collection in the URL.
+func apiModifyCollectionHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var collection Collection
+		if !readAPIBody(res, r, &collection) {
+			return
+		}
+		collection.Author = requestAuthor(r, collection.Author)
+		modified, err := modifyCollection(db, mux.Vars(r)["slug"], collection)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, modified)
+	}
+	return fn
+}
+
+// apiInsertCollectionItemHandler adds the content in the body to the collection in the URL.
+func apiInsertCollectionItemHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var item CollectionItem
+		if !readAPIBody(res, r, &item) {
+			return
+		}
+		collection, err := insertCollectionItem(db, mux.Vars(r)["slug"], item)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, collection)
+	}
+	return fn
+}
+
+// apiReorderCollectionHandler rearranges the items of the collection in the URL into the order in the body.
+func apiReorderCollectionHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var order CollectionOrder
+		if !readAPIBody(res, r, &order) {
+			return
+		}
+		collection, err := reorderCollection(db, mux.Vars(r)["slug"], order.Items)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, collection)
+	}
+	return fn
+}
+
+// apiRemoveCollectionItemHandler takes the content in the URL out of the collection in the URL.
+func apiRemoveCollectionItemHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		collection, err := removeCollectionItem(db, mux.Vars(r)["slug"], mux.Vars(r)["hash"])
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, collection)
+	}
+	return fn
+}
+
+// apiListContentCollectionsHandler returns the collections put together by hand that the content in the URL is an item of.
+func apiListContentCollectionsHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		collections, err := contentCollections(db, mux.Vars(r)["hash"])
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIList(res, collections, nil)
+	}
+	return fn
+}
+
+// apiDeleteCollectionHandler deletes the collection in the URL.
+func apiDeleteCollectionHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		if err := deleteCollection(db, mux.Vars(r)["slug"]); err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		res.WriteHeader(http.StatusNoContent)
+	}
+	return fn
+}
+
+// DATA STORE FUNCTIONS
+
+// settleCollection checks a collection about to be saved and fills in the default order of a saved search.
+// Its query has to parse; the tags and fields it names may come later. A collection put together by hand
+// has no order but that of its items.
+func settleCollection(collection *Collection) error {
+	collection.Name = strings.TrimSpace(collection.Name)
+	collection.Query = strings.TrimSpace(collection.Query)
+	if collection.Name == "" {
+		return fmt.Errorf("%w: a collection needs a name", errBadCollection)
+	}
+	if collection.Query == "" {
+		collection.Sort, collection.Order = "", ""
+		return nil
+	}
+	if len(collection.Items) > 0 {
+		return fmt.Errorf("%w: a collection has a query or items, not both", errBadCollection)
+	}
+	if _, err := parseQuery(collection.Query); err != nil {
+		return fmt.Errorf("%w: %v", errBadCollection, err)
+	}
+	switch collection.Sort {
+	case "":
+		collection.Sort = "created"
+	case "created", "label":
+	default:
+		return fmt.Errorf("%w: sort must be created or label", errBadCollection)
+	}
+	switch collection.Order {
+	case "":
+		collection.Order = "asc"
+		if collection.Sort == "created" {
+			collection.Order = "desc"
+		}
+	case "asc", "desc":
+	default:
+		return fmt.Errorf("%w: order must be asc or desc", errBadCollection)
+	}
+	return nil
+}
+
+// createCollection saves a collection under a slug made from its name and returns it as stored.
+func createCollection(db *bolt.DB, collection Collection) (*Collection, error) {
+	if err := settleCollection(&collection); err != nil {
+		return nil, err
+	}
+	collection.Slug = slug.Make(collection.Name)
+	if collection.Slug == "" {
+		return nil, fmt.Errorf("%w: %q makes an empty slug", errBadCollection, collection.Name)
+	}
+	collection.CreatedAt = time.Now()
+	collection.UpdatedAt = collection.CreatedAt
+	err := db.Update(func(tx *bolt.Tx) error {
+		existing, err := lookupCollection(tx, collection.Slug)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return fmt.Errorf("%w: %s", errCollectionExists, collection.Slug)
+		}
+		items := collection.Items
+		collection.Items = nil
+		for _, hash := range items {
+			if err := addCollectionItem(tx, &collection, hash, len(collection.Items)); err != nil {
+				return err
+			}
+		}
+		return putCollection(tx, collection)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &collection, nil
+}
+
+// modifyCollection replaces a collection, keeping its slug, its items and the time it was created.
+func modifyCollection(db *bolt.DB, slug string, collection Collection) (*Collection, error) {
+	collection.Slug = slug
+	collection.UpdatedAt = time.Now()
+	err := db.Update(func(tx *bolt.Tx) error {
+		existing, err := lookupCollection(tx, slug)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return errCollectionNotFound
+		}
+		collection.CreatedAt, collection.Items = existing.CreatedAt, existing.Items
+		if err := settleCollection(&collection); err != nil {
+			return err
+		}
+		return putCollection(tx, collection)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &collection, nil
+}
+
+// deleteCollection removes a collection.
+func deleteCollection(db *bolt.DB, slug string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		existing, err := lookupCollection(tx, slug)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return errCollectionNotFound
+		}
+		if err := indexCollectionItems(tx, slug, existing.Items, nil); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(collectionBucket)).Delete([]byte(slug))
+	})
+}
+
+// insertCollectionItem adds content to a collection put together by hand and returns the collection.
+func insertCollectionItem(db *bolt.DB, slug string, item CollectionItem) (*Collection, error) {
+	return changeCollectionItems(db, slug, func(tx *bolt.Tx, collection *Collection) error {
+		position := len(collection.Items)
+		if item.Position != nil {
+			position = *item.Position
+		}
+		return addCollectionItem(tx, collection, item.Content, position)
+	})
+}
+
+// removeCollectionItem takes content out of a collection put together by hand and returns the collection.
+func removeCollectionItem(db *bolt.DB, slug string, hash string) (*Collection, error) {
+	return changeCollectionItems(db, slug, func(tx *bolt.Tx, collection *Collection) error {
+		items := []string{}
+		for _, item := range collection.Items {
+			if item != hash {
+				items = append(items, item)
+			}
+		}
+		if len(items) == len(collection.Items) {
+			return fmt.Errorf("%w: %s is not in %s", errContentNotFound, hash, slug)
+		}
+		collection.Items = items
+		return nil
+	})
+}
+
+// reorderCollection rearranges the items of a collection put together by hand and returns the collection.
+// The new order has to have every item once and nothing else.
+func reorderCollection(db *bolt.DB, slug string, items []string) (*Collection, error) {
+	return changeCollectionItems(db, slug, func(tx *bolt.Tx, collection *Collection) error {
+		current := append([]string{}, collection.Items...)
+		sorted := append([]string{}, items...)
+		sort.Strings(current)
+		sort.Strings(sorted)
+		if strings.Join(current, "\x00") != strings.Join(sorted, "\x00") {
+			return fmt.Errorf("%w: the new order must have each of the %d items of %s once", errBadCollection, len(current), slug)
+		}
+		collection.Items = items
+		return nil
+	})
+}
+
+// changeCollectionItems applies change to the items of a collection put together by hand in one transaction.
+func changeCollectionItems(db *bolt.DB, slug string, change func(tx *bolt.Tx, collection *Collection) error) (*Collection, error) {
+	var collection *Collection
+	err := db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if collection, err = lookupCollection(tx, slug); err != nil {
+			return err
+		}
+		if collection == nil {
+			return errCollectionNotFound
+		}
+		if collection.Query != "" {
+			return fmt.Errorf("%w: %s is a saved search, its items are what its query matches", errBadCollection, slug)
+		}
+		if err := change(tx, collection); err != nil {
+			return err
+		}
+		collection.UpdatedAt = time.Now()
+		return putCollection(tx, *collection)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return collection, nil
+}
+
+// addCollectionItem puts content into the items of a collection at position inside an existing transaction.
+func addCollectionItem(tx *bolt.Tx, collection *Collection, hash string, position int) error {
+	content, err := lookupContent(tx, hash)
+	if err != nil {
+		return err
+	}
+	if content == nil {
+		return fmt.Errorf("%w: %s", errContentNotFound, hash)
+	}
+	if containsString(collection.Items, hash) {
+		return fmt.Errorf("%w: %s is in %s", errInCollection, hash, collection.Slug)
+	}
+	if position < 0 || position > len(collection.Items) {
+		return fmt.Errorf("%w: position %d is outside 0 to %d", errBadCollection, position, len(collection.Items))
+	}
+	items := append([]string{}, collection.Items[:position]...)
+	items = append(items, hash)
+	collection.Items = append(items, collection.Items[position:]...)
+	return nil
+}
+
+// contentCollections returns the collections put together by hand that content is an item of, by name.
+func contentCollections(db *bolt.DB, hash string) ([]Collection, error) {
+	results := []Collection{}
+	err := db.View(func(tx *bolt.Tx) error {
+		content, err := lookupContent(tx, hash)
+		if err != nil {
+			return err
+		}
+		if content == nil {
+			return errContentNotFound
+		}
+		for _, slug := range contentCollectionSlugs(tx, hash) {
+			collection, err := lookupCollection(tx, slug)
+			if err != nil {
+				return err
+			}
+			if collection != nil {
+				results = append(results, *collection)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(results, func(i, j int) bool { return strings.ToLower(results[i].Name) < strings.ToLower(results[j].Name) })
+	return results, nil
+}
+
+// contentCollectionSlugs returns the slugs of the collections content is an item of inside an existing transaction.
+func contentCollectionSlugs(tx *bolt.Tx, hash string) []string {
+	slugs := []string{}
+	b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(contentCollectionsBucket))
+	if b == nil {
+		return slugs
+	}
+	if b = b.Bucket([]byte(hash)); b == nil {
+		return slugs
+	}
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		slugs = append(slugs, string(k))
+	}
+	return slugs
+}
+
+// indexCollectionItems updates CONTENT_COLLECTIONS for a collection whose items change from old to new
+// inside an existing transaction.
+func indexCollectionItems(tx *bolt.Tx, slug string, old []string, new []string) error {
+	b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(contentCollectionsBucket))
+	if b == nil {
+		return nil
+	}
+	for _, hash := range old {
+		if containsString(new, hash) {
+			continue
+		}
+		if inner := b.Bucket([]byte(hash)); inner != nil {
+			if err := inner.Delete([]byte(slug)); err != nil {
+				return fmt.Errorf("could not delete content_collections: %v", err)
+			}
+			if k, _ := inner.Cursor().First(); k == nil {
+				if err := b.DeleteBucket([]byte(hash)); err != nil {
+					return fmt.Errorf("could not delete content_collections: %v", err)
+				}
+			}
+		}
+	}
+	for _, hash := range new {
+		inner, err := b.CreateBucketIfNotExists([]byte(hash))
+		if err != nil {
+			return fmt.Errorf("could not insert content_collections: %v", err)
+		}
+		if err := inner.Put([]byte(slug), []byte{}); err != nil {
+			return fmt.Errorf("could not insert content_collections: %v", err)
+		}
+	}
+	return nil
+}
+
+// removeFromCollections takes deleted content out of every collection it is an item of inside an existing transaction.
+func removeFromCollections(tx *bolt.Tx, hash string) error {
+	for _, slug := range contentCollectionSlugs(tx, hash) {
+		collection, err := lookupCollection(tx, slug)
+		if err != nil {
+			return err
+		}
+		if collection == nil {
+			continue
+		}
+		items := []string{}
+		for _, item := range collection.Items {
+			if item != hash {
+				items = append(items, item)
+			}
+		}
+		collection.Items = items
+		if err := putCollection(tx, *collection); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openCollection reads a collection and evaluates it. When the query of a saved search can not be evaluated
+// the collection is returned without content, along with the QueryError.
+func openCollection(db *bolt.DB, slug string) (*CollectionView, error) {
+	var view *CollectionView
+	err := db.View(func(tx *bolt.Tx) error {
+		collection, err := lookupCollection(tx, slug)
+		if err != nil {
+			return err
+		}
+		if collection == nil {
+			return errCollectionNotFound
+		}
+		view = &CollectionView{Collection: *collection, Content: []Content{}}
+		content, err := collectionContent(tx, *collection)
+		if err != nil {
+			return err
+		}
+		view.Content, view.Count = content, len(content)
+		return nil
+	})
+	return view, err
+}
+
+// listCollections returns every collection, by name, with the number of items each has now. Collections
+// whose query can not be evaluated count none.
+func listCollections(db *bolt.DB) ([]CollectionView, error) {
+	results := []CollectionView{}
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(collectionBucket)).ForEach(func(k, v []byte) error {
+			collection := Collection{}
+			if err := json.Unmarshal(v, &collection); err != nil {
+				return err
+			}
+			content, err := collectionContent(tx, collection)
+			var queryErr *QueryError
+			if err != nil && !errors.As(err, &queryErr) {
+				return err
+			}
+			results = append(results, CollectionView{Collection: collection, Count: len(content)})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(results, func(i, j int) bool { return strings.ToLower(results[i].Name) < strings.ToLower(results[j].Name) })
+	return results, nil
+}
+
+// collectionContent returns the content of a collection in order inside an existing transaction: its items,
+// or what the query of a saved search matches.
+func collectionContent(tx *bolt.Tx, collection Collection) ([]Content, error) {
+	results := []Content{}
+	if collection.Query == "" {
+		for _, hash := range collection.Items {
+			content, err := lookupContent(tx, hash)
+			if err != nil {
+				return nil, err
+			}
+			if content != nil {
+				results = append(results, *content)
+			}
+		}
+		return results, nil
+	}
+	node, err := parseQuery(collection.Query)
+	if err != nil {
+		return nil, err
+	}
+	hashes, err := node.eval(tx)
+	if err != nil {
+		return nil, err
+	}
+	for hash := range hashes {
+		content, err := lookupContent(tx, hash)
+		if err != nil {
+			return nil, err
+		}
+		if content != nil {
+			results = append(results, *content)
+		}
+	}
+	sortContent(results, collection.Sort, collection.Order)
+	return results, nil
+}
+
+// sortContent orders content by created or label, asc or desc, breaking ties by hash.
+func sortContent(list []Content, by string, order string) {
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if order == "desc" {
+			a, b = b, a
+		}
+		if by == "label" {
+			if x, y := labelSortKey(a.Label), labelSortKey(b.Label); x != y {
+				return x < y
+			}
+		} else if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.Hash < b.Hash
+	})
+}
+
+// lookupCollection reads a collection inside an existing transaction. It returns nil if there is no such collection.
+func lookupCollection(tx *bolt.Tx, slug string) (*Collection, error) {
+	v := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(collectionBucket)).Get([]byte(slug))
+	if v == nil {
+		return nil, nil
+	}
+	collection := Collection{}
+	if err := json.Unmarshal(v, &collection); err != nil {
+		return nil, err
+	}
+	return &collection, nil
+}
+
+// putCollection writes a collection and the index of its items inside an existing transaction.
+func putCollection(tx *bolt.Tx, collection Collection) error {
+	previous, err := lookupCollection(tx, collection.Slug)
+	if err != nil {
+		return err
+	}
+	var old []string
+	if previous != nil {
+		old = previous.Items
+	}
+	if err := indexCollectionItems(tx, collection.Slug, old, collection.Items); err != nil {
+		return err
+	}
+	if err := putRecord(tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(collectionBucket)), collection.Slug, collection); err != nil {
+		return fmt.Errorf("could not insert collection: %v", err)
+	}
+	return nil
+}
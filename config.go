@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings of an anansi process. Each setting is read from, in increasing order of priority,
+// the defaults, a TOML or YAML config file, ANANSI_* environment variables and the flags given before the command.
+type Config struct {
+	DB           string       `toml:"db" yaml:"db" json:"db"`                                  // Path of the bolt database.
+	Store        string       `toml:"store" yaml:"store" json:"store"`                         // bolt, memory or sqlite.
+	SQLite       string       `toml:"sqlite" yaml:"sqlite" json:"sqlite"`                      // Path of the SQLite database.
+	Listen       string       `toml:"listen" yaml:"listen" json:"listen"`                      // host:port the server listens on.
+	Templates    string       `toml:"templates" yaml:"templates" json:"templates"`             // Directory of the HTML templates.
+	Thumbnails   string       `toml:"thumbnails" yaml:"thumbnails" json:"thumbnails"`          // Directory thumbnails of image content are cached in.
+	ReadTimeout  Duration     `toml:"read_timeout" yaml:"read_timeout" json:"read_timeout"`    // Server read timeout.
+	WriteTimeout Duration     `toml:"write_timeout" yaml:"write_timeout" json:"write_timeout"` // Server write timeout.
+	Watch        []string     `toml:"watch" yaml:"watch" json:"watch"`                         // Directories the server keeps paths up to date for.
+	ScanRoots    []string     `toml:"scan_roots" yaml:"scan_roots" json:"scan_roots"`          // Directories, besides the watched ones, the server may be asked to scan.
+	Site         SiteMetaData `toml:"site" yaml:"site" json:"site"`
+	Roles        Roles        `toml:"roles" yaml:"roles" json:"roles"` // Permissions of each role; only in the config file.
+
+	file string // The config file the settings were read from, if any.
+}
+
+// Duration is a time.Duration written as a string such as "15s" in config files.
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+var errBadConfig = errors.New("invalid configuration")
+
+// defaultConfig is the configuration of an anansi run without a config file, environment or flags.
+func defaultConfig() Config {
+	return Config{
+		DB:           "anansi.db",
+		Store:        "bolt",
+		SQLite:       "anansi.sqlite",
+		Listen:       "0.0.0.0:8000",
+		Templates:    "templates",
+		Thumbnails:   "thumbnails",
+		ReadTimeout:  Duration{15 * time.Second},
+		WriteTimeout: Duration{15 * time.Second},
+		Watch:        []string{},
+		ScanRoots:    []string{},
+		Site:         siteMetaData,
+		Roles:        defaultRoles(),
+	}
+}
+
+// configSetting is a setting that can be given in the environment and as a flag.
+// set parses a value in the form both of them use; lists are separated like PATH.
+type configSetting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, v string) error
+}
+
+var configSettings = []configSetting{
+	{"db", "ANANSI_DB", "path of the bolt database", func(c *Config, v string) error { c.DB = v; return nil }},
+	{"store", "ANANSI_STORE", "storage backend: bolt, memory or sqlite", func(c *Config, v string) error { c.Store = v; return nil }},
+	{"sqlite", "ANANSI_SQLITE", "path of the SQLite database", func(c *Config, v string) error { c.SQLite = v; return nil }},
+	{"listen", "ANANSI_LISTEN", "host:port for the server to listen on", func(c *Config, v string) error { c.Listen = v; return nil }},
+	{"templates", "ANANSI_TEMPLATES", "directory of the HTML templates", func(c *Config, v string) error { c.Templates = v; return nil }},
+	{"thumbnails", "ANANSI_THUMBNAILS", "directory to cache thumbnails of image content in", func(c *Config, v string) error { c.Thumbnails = v; return nil }},
+	{"read-timeout", "ANANSI_READ_TIMEOUT", "server read timeout, eg. 15s", func(c *Config, v string) error { return c.ReadTimeout.UnmarshalText([]byte(v)) }},
+	{"write-timeout", "ANANSI_WRITE_TIMEOUT", "server write timeout, eg. 15s", func(c *Config, v string) error { return c.WriteTimeout.UnmarshalText([]byte(v)) }},
+	{"watch", "ANANSI_WATCH", "directories to watch, separated like PATH", func(c *Config, v string) error { c.Watch = splitList(v); return nil }},
+	{"scan-roots", "ANANSI_SCAN_ROOTS", "directories besides the watched ones that scans through the server may cover, separated like PATH", func(c *Config, v string) error { c.ScanRoots = splitList(v); return nil }},
+	{"site-title", "ANANSI_SITE_TITLE", "site title shown in the HTML pages", func(c *Config, v string) error { c.Site.Title = v; return nil }},
+	{"site-description", "ANANSI_SITE_DESCRIPTION", "site description shown in the HTML pages", func(c *Config, v string) error { c.Site.Description = v; return nil }},
+}
+
+// configFlags are the flags given before the command.
+type configFlags struct {
+	flags *flag.FlagSet
+	file  *string
+}
+
+// addConfigFlags defines -config and a flag for every setting on flags.
+func addConfigFlags(flags *flag.FlagSet) *configFlags {
+	cf := &configFlags{flags: flags}
+	cf.file = flags.String("config", "", "config file, .toml, .yaml or .yml (default anansi.toml, anansi.yaml or anansi.yml if present, or ANANSI_CONFIG)")
+	for _, s := range configSettings {
+		flags.String(s.flag, "", s.usage+" (or "+s.env+")")
+	}
+	return cf
+}
+
+// load builds the configuration from the defaults, the config file, the environment and the flags that were set,
+// and validates it.
+func (cf *configFlags) load() (Config, error) {
+	cfg := defaultConfig()
+	path := *cf.file
+	if path == "" {
+		path = os.Getenv("ANANSI_CONFIG")
+	}
+	if err := readConfigFile(&cfg, path); err != nil {
+		return cfg, err
+	}
+	for _, s := range configSettings {
+		if v, ok := os.LookupEnv(s.env); ok && v != "" {
+			if err := s.set(&cfg, v); err != nil {
+				return cfg, fmt.Errorf("%w: %s: %v", errBadConfig, s.env, err)
+			}
+		}
+	}
+	var err error
+	cf.flags.Visit(func(f *flag.Flag) {
+		for _, s := range configSettings {
+			if s.flag == f.Name && err == nil {
+				if e := s.set(&cfg, f.Value.String()); e != nil {
+					err = fmt.Errorf("%w: -%s: %v", errBadConfig, s.flag, e)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.validate()
+}
+
+// readConfigFile reads the config file at path into cfg. Without a path it reads the first of anansi.toml,
+// anansi.yaml and anansi.yml in the working directory, if there is one. Unknown keys are an error, so typos
+// do not go unnoticed.
+func readConfigFile(cfg *Config, path string) error {
+	if path == "" {
+		for _, name := range []string{"anansi.toml", "anansi.yaml", "anansi.yml"} {
+			if _, err := os.Stat(name); err == nil {
+				path = name
+				break
+			}
+		}
+		if path == "" {
+			return nil
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %v", err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		meta, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", errBadConfig, path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("%w: %s: unknown setting %s", errBadConfig, path, undecoded[0])
+		}
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("%w: %s: %v", errBadConfig, path, err)
+		}
+	default:
+		return fmt.Errorf("%w: %s: config files must be .toml, .yaml or .yml", errBadConfig, path)
+	}
+	cfg.file = path
+	return nil
+}
+
+// validate checks the settings every command relies on.
+func (c Config) validate() error {
+	problems := []string{}
+	switch c.Store {
+	case "bolt", "memory", "sqlite":
+	default:
+		problems = append(problems, fmt.Sprintf("store must be bolt, memory or sqlite, not %q", c.Store))
+	}
+	if c.Store == "bolt" && c.DB == "" {
+		problems = append(problems, "db can not be empty")
+	}
+	if c.Store == "sqlite" && c.SQLite == "" {
+		problems = append(problems, "sqlite can not be empty")
+	}
+	if c.Thumbnails == "" {
+		problems = append(problems, "thumbnails can not be empty")
+	}
+	if _, port, err := net.SplitHostPort(c.Listen); err != nil {
+		problems = append(problems, fmt.Sprintf("listen must be host:port: %v", err))
+	} else if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		problems = append(problems, fmt.Sprintf("listen has an invalid port %q", port))
+	}
+	if c.ReadTimeout.Duration <= 0 {
+		problems = append(problems, "read_timeout must be positive")
+	}
+	if c.WriteTimeout.Duration <= 0 {
+		problems = append(problems, "write_timeout must be positive")
+	}
+	problems = append(problems, c.Roles.validate()...)
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", errBadConfig, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validateTemplates checks that the templates directory holds the templates the server parses at startup.
+func (c Config) validateTemplates() error {
+	for _, name := range templateFiles {
+		if _, err := os.Stat(filepath.Join(c.Templates, name)); err != nil {
+			return fmt.Errorf("%w: templates: %v", errBadConfig, err)
+		}
+	}
+	return nil
+}
+
+// splitList splits a PATH style list, dropping empty entries.
+func splitList(v string) []string {
+	list := []string{}
+	for _, item := range filepath.SplitList(v) {
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// runConfigCommand implements "anansi config print [-format toml|yaml|json]", which prints the effective settings.
+func runConfigCommand(cfg Config, args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		return fmt.Errorf("usage: anansi config print [-format toml|yaml|json]")
+	}
+	flags := flag.NewFlagSet("config print", flag.ContinueOnError)
+	format := flags.String("format", "toml", "toml, yaml or json")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	source := "# No config file was read.\n"
+	if cfg.file != "" {
+		source = fmt.Sprintf("# Read from %s.\n", cfg.file)
+	}
+	switch *format {
+	case "toml":
+		fmt.Print(source)
+		return toml.NewEncoder(os.Stdout).Encode(cfg)
+	case "yaml":
+		fmt.Print(source)
+		enc := yaml.NewEncoder(os.Stdout)
+		defer enc.Close()
+		return enc.Encode(cfg)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(cfg)
+	}
+	return fmt.Errorf("format must be toml, yaml or json")
+}
@@ -0,0 +1,900 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gosimple/slug"
+)
+
+// An export is a JSON Lines stream with one record per line: every namespace definition and content type, then
+// every content item, then every tag with parents ahead of their children, then every tag alias, then every
+// edge, then every collection. Records are written through the Store, so any backend can be exported and
+// imported; namespace definitions, content types, aliases and collections are only kept by bolt, so they are
+// only exported from and imported into it. An archive export packs the stream into a tar.gz after a manifest.json.
+const exportFormat = "anansi-export"
+const exportVersion = 1
+const exportDataFile = "anansi.jsonl"
+const exportManifestFile = "manifest.json"
+
+// maxImportLine is the longest record an import will read.
+const maxImportLine = 16 * 1024 * 1024
+
+// Import conflict policies decide what happens to records that already exist.
+// skip keeps the existing record and ignores the tags the import applies to it.
+// overwrite replaces the existing record, and for content replaces its tags with the imported ones.
+// merge-tags keeps the existing record but adds the imported tags to content and the imported parents to tags.
+const (
+	importSkip      = "skip"
+	importOverwrite = "overwrite"
+	importMergeTags = "merge-tags"
+)
+
+var errBadImportPolicy = errors.New("import policy must be skip, overwrite or merge-tags")
+var errBadImport = errors.New("could not read import")
+
+// ExportRecord is one line of an export. Type says which of the other fields is set.
+type ExportRecord struct {
+	Type        string       `json:"type"` // "namespace", "type", "content", "tag", "alias", "edge" or "collection"
+	Namespace   *Namespace   `json:"namespace,omitempty"`
+	ContentType *ContentType `json:"contentType,omitempty"`
+	Content     *Content     `json:"content,omitempty"`
+	Tag         *Tag         `json:"tag,omitempty"`
+	Alias       *Alias       `json:"alias,omitempty"`
+	Edge        *Edge        `json:"edge,omitempty"`
+	Collection  *Collection  `json:"collection,omitempty"`
+}
+
+// ExportCounts is the number of records of each type in an export.
+type ExportCounts struct {
+	Namespaces  int `json:"namespaces"`
+	Types       int `json:"types"`
+	Content     int `json:"content"`
+	Tags        int `json:"tags"`
+	Aliases     int `json:"aliases"`
+	Edges       int `json:"edges"`
+	Collections int `json:"collections"`
+}
+
+// ExportManifest describes the data file of an archive export.
+type ExportManifest struct {
+	Format    string       `json:"format"`
+	Version   int          `json:"version"`
+	CreatedAt time.Time    `json:"createdAt"`
+	File      string       `json:"file"`
+	Counts    ExportCounts `json:"counts"`
+}
+
+// ImportCounts says what an import did with the records of one type.
+type ImportCounts struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"`
+	Removed int `json:"removed,omitempty"` // Edges dropped from content that was overwritten.
+}
+
+// ImportReport summarises an import. Records that could not be imported are listed in Errors by line.
+type ImportReport struct {
+	Policy      string       `json:"policy"`
+	Namespaces  ImportCounts `json:"namespaces"`
+	Types       ImportCounts `json:"types"`
+	Content     ImportCounts `json:"content"`
+	Tags        ImportCounts `json:"tags"`
+	Aliases     ImportCounts `json:"aliases"`
+	Edges       ImportCounts `json:"edges"`
+	Collections ImportCounts `json:"collections"`
+	Errors      []string     `json:"errors,omitempty"`
+}
+
+// forEachContent calls fn with every content item in the store, oldest first.
+func forEachContent(store Store, fn func(Content) error) error {
+	opts := ListOptions{Limit: maxPageLimit, Sort: "created", Order: "asc"}
+	for {
+		page, info, err := store.ListContent(opts)
+		if err != nil {
+			return err
+		}
+		for _, content := range page {
+			if err := fn(content); err != nil {
+				return err
+			}
+		}
+		if info.Next == "" {
+			return nil
+		}
+		opts.Cursor = info.Next
+	}
+}
+
+// allTags returns every tag in the store with parents ahead of their children.
+func allTags(store Store) ([]Tag, error) {
+	tags := []Tag{}
+	opts := ListOptions{Limit: maxPageLimit, Sort: "created", Order: "asc"}
+	for {
+		page, info, err := store.ListTags(opts)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, page...)
+		if info.Next == "" {
+			break
+		}
+		opts.Cursor = info.Next
+	}
+	bySlug := map[string]Tag{}
+	for _, tag := range tags {
+		bySlug[tag.Slug] = tag
+	}
+	ordered := make([]Tag, 0, len(tags))
+	visited := map[string]bool{}
+	var visit func(tag Tag)
+	visit = func(tag Tag) {
+		if visited[tag.Slug] {
+			return
+		}
+		visited[tag.Slug] = true
+		for _, parent := range tag.Parents {
+			if p, ok := bySlug[parent]; ok {
+				visit(p)
+			}
+		}
+		ordered = append(ordered, tag)
+	}
+	for _, tag := range tags {
+		visit(tag)
+	}
+	return ordered, nil
+}
+
+// exportLibrary writes every record in the store to w as JSON Lines.
+func exportLibrary(store Store, w io.Writer) (ExportCounts, error) {
+	counts := ExportCounts{}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if db := boltDB(store); db != nil {
+		namespaces, err := listNamespaces(db)
+		if err != nil {
+			return counts, err
+		}
+		for i := range namespaces {
+			counts.Namespaces++
+			if err := enc.Encode(ExportRecord{Type: "namespace", Namespace: &namespaces[i]}); err != nil {
+				return counts, err
+			}
+		}
+		types, err := listContentTypes(db)
+		if err != nil {
+			return counts, err
+		}
+		for i := range types {
+			counts.Types++
+			if err := enc.Encode(ExportRecord{Type: "type", ContentType: &types[i]}); err != nil {
+				return counts, err
+			}
+		}
+	}
+	err := forEachContent(store, func(content Content) error {
+		counts.Content++
+		return enc.Encode(ExportRecord{Type: "content", Content: &content})
+	})
+	if err != nil {
+		return counts, err
+	}
+	tags, err := allTags(store)
+	if err != nil {
+		return counts, err
+	}
+	for i := range tags {
+		counts.Tags++
+		if err := enc.Encode(ExportRecord{Type: "tag", Tag: &tags[i]}); err != nil {
+			return counts, err
+		}
+	}
+	if db := boltDB(store); db != nil {
+		aliases, err := allAliases(db)
+		if err != nil {
+			return counts, err
+		}
+		for i := range aliases {
+			counts.Aliases++
+			if err := enc.Encode(ExportRecord{Type: "alias", Alias: &aliases[i]}); err != nil {
+				return counts, err
+			}
+		}
+	}
+	err = forEachContent(store, func(content Content) error {
+		tags, err := store.TagsForContent(content.Hash)
+		if err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			edge, err := store.GetEdge(tag.Slug, content.Hash)
+			if errors.Is(err, errEdgeNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			counts.Edges++
+			if err := enc.Encode(ExportRecord{Type: "edge", Edge: edge}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return counts, err
+	}
+	if db := boltDB(store); db != nil {
+		collections, err := listCollections(db)
+		if err != nil {
+			return counts, err
+		}
+		for i := range collections {
+			counts.Collections++
+			if err := enc.Encode(ExportRecord{Type: "collection", Collection: &collections[i].Collection}); err != nil {
+				return counts, err
+			}
+		}
+	}
+	return counts, nil
+}
+
+// exportArchive writes a tar.gz holding a manifest and the JSON Lines export to w. The export is staged in a
+// temporary file first so the manifest, which comes first in the archive, can count the records.
+func exportArchive(store Store, w io.Writer) (ExportCounts, error) {
+	tmp, err := ioutil.TempFile("", "anansi-export-*.jsonl")
+	if err != nil {
+		return ExportCounts{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	counts, err := exportLibrary(store, tmp)
+	if err != nil {
+		return counts, err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return counts, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return counts, err
+	}
+
+	now := time.Now()
+	manifest, err := json.MarshalIndent(ExportManifest{
+		Format:    exportFormat,
+		Version:   exportVersion,
+		CreatedAt: now,
+		File:      exportDataFile,
+		Counts:    counts,
+	}, "", "  ")
+	if err != nil {
+		return counts, err
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: exportManifestFile, Mode: 0644, Size: int64(len(manifest)), ModTime: now}); err != nil {
+		return counts, err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return counts, err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: exportDataFile, Mode: 0644, Size: size, ModTime: now}); err != nil {
+		return counts, err
+	}
+	if _, err := io.Copy(tw, tmp); err != nil {
+		return counts, err
+	}
+	if err := tw.Close(); err != nil {
+		return counts, err
+	}
+	return counts, gz.Close()
+}
+
+// openImport returns the JSON Lines to import from r, which holds either the lines themselves or an archive export.
+func openImport(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err != nil || magic[0] != 0x1f || magic[1] != 0x8b {
+		return br, nil
+	}
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadImport, err)
+	}
+	tr := tar.NewReader(gz)
+	data := exportDataFile
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: the archive has no %s", errBadImport, data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errBadImport, err)
+		}
+		switch hdr.Name {
+		case exportManifestFile:
+			manifest := ExportManifest{}
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return nil, fmt.Errorf("%w: bad manifest: %v", errBadImport, err)
+			}
+			if manifest.Format != exportFormat {
+				return nil, fmt.Errorf("%w: the archive is not an Anansi export", errBadImport)
+			}
+			if manifest.Version > exportVersion {
+				return nil, fmt.Errorf("%w: the archive is export version %d, this build reads up to %d", errBadImport, manifest.Version, exportVersion)
+			}
+			if manifest.File != "" {
+				data = manifest.File
+			}
+		case data:
+			return tr, nil
+		}
+	}
+}
+
+// pendingImport is a record put aside until the records it depends on have been imported.
+type pendingImport struct {
+	line   int
+	record ExportRecord
+	err    error
+}
+
+// importer applies the records of one import to a store.
+type importer struct {
+	store   Store
+	policy  string
+	report  ImportReport
+	skipped map[string]bool // Content kept under the skip policy, whose imported edges are ignored.
+	tags    []pendingImport // Tags whose parents have not been imported yet.
+	aliases []pendingImport // Aliases whose tag has not been imported yet.
+	edges   []pendingImport // Edges whose tag has not been imported yet.
+}
+
+// importLibrary reads an export from r into the store, resolving conflicts with existing records by policy.
+// The report covers every record read, including those imported before an unreadable stream stopped the import.
+func importLibrary(store Store, r io.Reader, policy string) (ImportReport, error) {
+	switch policy {
+	case "":
+		policy = importSkip
+	case importSkip, importOverwrite, importMergeTags:
+	default:
+		return ImportReport{}, errBadImportPolicy
+	}
+	imp := &importer{store: store, policy: policy, report: ImportReport{Policy: policy}, skipped: map[string]bool{}}
+	data, err := openImport(r)
+	if err != nil {
+		return imp.report, err
+	}
+	scanner := bufio.NewScanner(data)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLine)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		record := ExportRecord{}
+		if err := json.Unmarshal(text, &record); err != nil {
+			imp.fail(line, err)
+			continue
+		}
+		imp.apply(line, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return imp.report, fmt.Errorf("%w: line %d: %v", errBadImport, line+1, err)
+	}
+	imp.finish()
+	return imp.report, nil
+}
+
+func (imp *importer) fail(line int, err error) {
+	imp.report.Errors = append(imp.report.Errors, fmt.Sprintf("line %d: %v", line, err))
+}
+
+func (imp *importer) apply(line int, record ExportRecord) {
+	var err error
+	switch {
+	case record.Type == "namespace" && record.Namespace != nil:
+		err = imp.importNamespace(*record.Namespace)
+	case record.Type == "type" && record.ContentType != nil:
+		err = imp.importContentType(*record.ContentType)
+	case record.Type == "content" && record.Content != nil:
+		err = imp.importContent(*record.Content)
+	case record.Type == "tag" && record.Tag != nil:
+		err = imp.importTag(*record.Tag)
+		if errors.Is(err, errUnknownParent) {
+			imp.tags = append(imp.tags, pendingImport{line, record, err})
+			return
+		}
+	case record.Type == "alias" && record.Alias != nil:
+		err = imp.importAlias(*record.Alias)
+		if errors.Is(err, errTagNotFound) {
+			imp.aliases = append(imp.aliases, pendingImport{line, record, err})
+			return
+		}
+	case record.Type == "edge" && record.Edge != nil:
+		err = imp.importEdge(*record.Edge)
+		if errors.Is(err, errTagNotFound) {
+			imp.edges = append(imp.edges, pendingImport{line, record, err})
+			return
+		}
+	case record.Type == "collection" && record.Collection != nil:
+		err = imp.importCollection(*record.Collection)
+	default:
+		err = fmt.Errorf("unknown record type %q", record.Type)
+	}
+	if err != nil {
+		imp.fail(line, err)
+	}
+}
+
+// finish retries the records that were put aside until no more of them can be imported.
+func (imp *importer) finish() {
+	for progress := true; progress && len(imp.tags) > 0; {
+		progress = false
+		pending := imp.tags
+		imp.tags = nil
+		for _, p := range pending {
+			err := imp.importTag(*p.record.Tag)
+			switch {
+			case errors.Is(err, errUnknownParent):
+				p.err = err
+				imp.tags = append(imp.tags, p)
+			case err != nil:
+				imp.fail(p.line, err)
+			default:
+				progress = true
+			}
+		}
+	}
+	for _, p := range imp.tags {
+		imp.fail(p.line, p.err)
+	}
+	for _, p := range imp.aliases {
+		if err := imp.importAlias(*p.record.Alias); err != nil {
+			imp.fail(p.line, err)
+		}
+	}
+	for _, p := range imp.edges {
+		if err := imp.importEdge(*p.record.Edge); err != nil {
+			imp.fail(p.line, err)
+		}
+	}
+}
+
+// importNamespace imports a namespace definition. It has to come before the tags in the namespace, or they
+// define it without its description, color and exclusivity.
+func (imp *importer) importNamespace(namespace Namespace) error {
+	db := boltDB(imp.store)
+	if db == nil {
+		return fmt.Errorf("namespace %s: namespaces can only be imported into the bolt store", namespace.Name)
+	}
+	if err := validateNamespace(namespace); err != nil {
+		return err
+	}
+	if namespace.CreatedAt.IsZero() {
+		namespace.CreatedAt = time.Now()
+	}
+	counts := &imp.report.Namespaces.Skipped
+	err := db.Update(func(tx *bolt.Tx) error {
+		existing, err := lookupNamespace(tx, namespace.Name)
+		if err != nil {
+			return err
+		}
+		switch {
+		case existing == nil:
+			counts = &imp.report.Namespaces.Created
+		case imp.policy == importOverwrite:
+			counts = &imp.report.Namespaces.Updated
+		default:
+			return nil
+		}
+		return putNamespace(tx, namespace)
+	})
+	if err != nil {
+		return err
+	}
+	*counts++
+	return nil
+}
+
+// importContentType imports a content type. It has to come before the content of the type, whose fields are
+// checked against it.
+func (imp *importer) importContentType(ct ContentType) error {
+	db := boltDB(imp.store)
+	if db == nil {
+		return fmt.Errorf("content type %s: content types can only be imported into the bolt store", ct.Name)
+	}
+	if ct.Fields == nil {
+		ct.Fields = []FieldSpec{}
+	}
+	if ct.CreatedAt.IsZero() {
+		ct.CreatedAt = time.Now()
+	}
+	counts := &imp.report.Types.Skipped
+	err := db.Update(func(tx *bolt.Tx) error {
+		existing, err := lookupContentType(tx, ct.Name)
+		if err != nil {
+			return err
+		}
+		switch {
+		case existing == nil:
+			counts = &imp.report.Types.Created
+		case imp.policy == importOverwrite:
+			counts = &imp.report.Types.Updated
+		default:
+			return nil
+		}
+		if err := validateContentType(tx, ct); err != nil {
+			return err
+		}
+		return putContentType(tx, ct)
+	})
+	if err != nil {
+		return err
+	}
+	*counts++
+	return nil
+}
+
+func (imp *importer) importContent(content Content) error {
+	if content.Hash == "" {
+		return errors.New("content has no slug")
+	}
+	existing, err := imp.store.GetContent(content.Hash)
+	if err != nil && !errors.Is(err, errContentNotFound) {
+		return err
+	}
+	switch {
+	case existing == nil:
+		if err := imp.store.PutContent(content); err != nil {
+			return err
+		}
+		imp.report.Content.Created++
+	case imp.policy == importOverwrite:
+		if err := imp.store.PutContent(content); err != nil {
+			return err
+		}
+		tags, err := imp.store.TagsForContent(content.Hash)
+		if err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			if err := imp.store.DeleteEdge(tag.Slug, content.Hash); err != nil {
+				return err
+			}
+			imp.report.Edges.Removed++
+		}
+		imp.report.Content.Updated++
+	case imp.policy == importSkip:
+		imp.skipped[content.Hash] = true
+		imp.report.Content.Skipped++
+	default:
+		imp.report.Content.Skipped++
+	}
+	return nil
+}
+
+func (imp *importer) importTag(tag Tag) error {
+	if tag.Slug == "" {
+		return errors.New("tag has no slug")
+	}
+	existing, err := imp.store.GetTag(tag.Slug)
+	if err != nil && !errors.Is(err, errTagNotFound) {
+		return err
+	}
+	switch {
+	case existing == nil:
+		if err := imp.store.PutTag(tag); err != nil {
+			return err
+		}
+		imp.report.Tags.Created++
+	case imp.policy == importOverwrite:
+		if err := imp.store.PutTag(tag); err != nil {
+			return err
+		}
+		imp.report.Tags.Updated++
+	case imp.policy == importMergeTags:
+		parents := uniqueStrings(append(append([]string{}, existing.Parents...), tag.Parents...))
+		if len(parents) == len(uniqueStrings(existing.Parents)) {
+			imp.report.Tags.Skipped++
+			return nil
+		}
+		existing.Parents = parents
+		if err := imp.store.PutTag(*existing); err != nil {
+			return err
+		}
+		imp.report.Tags.Updated++
+	default:
+		imp.report.Tags.Skipped++
+	}
+	return nil
+}
+
+// importAlias imports an alias of a tag that exists. An alias that already refers to another tag is moved to the
+// imported one under the overwrite policy and kept otherwise.
+func (imp *importer) importAlias(alias Alias) error {
+	db := boltDB(imp.store)
+	if db == nil {
+		return fmt.Errorf("alias %s: aliases can only be imported into the bolt store", alias.Alias)
+	}
+	alias.Alias = aliasKey(alias.Alias)
+	if alias.Alias == "" || alias.Tag == "" {
+		return errors.New("alias needs a name and a tag slug")
+	}
+	if alias.CreatedAt.IsZero() {
+		alias.CreatedAt = time.Now()
+	}
+	counts := &imp.report.Aliases.Skipped
+	err := db.Update(func(tx *bolt.Tx) error {
+		tag, err := lookupTag(tx, alias.Tag)
+		if err != nil {
+			return err
+		}
+		if tag == nil {
+			return fmt.Errorf("alias %s of %s: %w", alias.Alias, alias.Tag, errTagNotFound)
+		}
+		if tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagBucket)).Get([]byte(alias.Alias)) != nil {
+			return fmt.Errorf("%w: %s is a tag", errAliasTaken, alias.Alias)
+		}
+		existing, err := lookupAlias(tx, alias.Alias)
+		if err != nil {
+			return err
+		}
+		switch {
+		case existing == nil:
+			counts = &imp.report.Aliases.Created
+		case existing.Tag != alias.Tag && imp.policy == importOverwrite:
+			if err := unindexTagName(tx, existing.Tag, existing.Alias, true); err != nil {
+				return err
+			}
+			counts = &imp.report.Aliases.Updated
+		default:
+			return nil
+		}
+		return storeAlias(tx, alias)
+	})
+	if err != nil {
+		return err
+	}
+	*counts++
+	return nil
+}
+
+// importCollection imports a collection under its slug, or one made from its name when it has none. The items
+// of a collection put together by hand are checked like items added to it: content that is not in the store,
+// eg. because its own record could not be imported, is left out and reported.
+func (imp *importer) importCollection(collection Collection) error {
+	db := boltDB(imp.store)
+	if db == nil {
+		return fmt.Errorf("collection %s: collections can only be imported into the bolt store", collection.Slug)
+	}
+	if err := settleCollection(&collection); err != nil {
+		return err
+	}
+	if collection.Slug == "" {
+		collection.Slug = slug.Make(collection.Name)
+	}
+	if collection.Slug == "" {
+		return fmt.Errorf("%w: %q makes an empty slug", errBadCollection, collection.Name)
+	}
+	if collection.CreatedAt.IsZero() {
+		collection.CreatedAt = time.Now()
+	}
+	if collection.UpdatedAt.IsZero() {
+		collection.UpdatedAt = collection.CreatedAt
+	}
+	counts := &imp.report.Collections.Skipped
+	missing := []string{}
+	err := db.Update(func(tx *bolt.Tx) error {
+		existing, err := lookupCollection(tx, collection.Slug)
+		if err != nil {
+			return err
+		}
+		switch {
+		case existing == nil:
+			counts = &imp.report.Collections.Created
+		case imp.policy == importOverwrite:
+			counts = &imp.report.Collections.Updated
+		default:
+			return nil
+		}
+		items := collection.Items
+		collection.Items = nil
+		for _, hash := range items {
+			err := addCollectionItem(tx, &collection, hash, len(collection.Items))
+			if errors.Is(err, errContentNotFound) {
+				missing = append(missing, hash)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return putCollection(tx, collection)
+	})
+	if err != nil {
+		return err
+	}
+	*counts++
+	if len(missing) > 0 {
+		return fmt.Errorf("collection %s was imported without the content it does not find: %v", collection.Slug, missing)
+	}
+	return nil
+}
+
+func (imp *importer) importEdge(edge Edge) error {
+	if edge.Tag == "" || edge.Content == "" {
+		return errors.New("edge needs a tag and a content slug")
+	}
+	if imp.skipped[edge.Content] {
+		imp.report.Edges.Skipped++
+		return nil
+	}
+	if _, err := imp.store.GetEdge(edge.Tag, edge.Content); err == nil {
+		imp.report.Edges.Skipped++
+		return nil
+	}
+	if edge.CreatedAt.IsZero() {
+		edge.CreatedAt = time.Now()
+	}
+	if _, err := imp.store.PutEdge(edge); err != nil {
+		return err
+	}
+	imp.report.Edges.Created++
+	return nil
+}
+
+// writeExport streams an export in format, "jsonl" or "tar.gz", as a file download.
+// Headers are sent before the export starts, so a failure part way through can only be logged.
+func writeExport(res http.ResponseWriter, store Store, format string) {
+	name := "anansi-" + time.Now().Format("20060102")
+	switch format {
+	case "tar.gz":
+		res.Header().Set("Content-Type", "application/gzip")
+		res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".tar.gz"))
+		if _, err := exportArchive(store, res); err != nil {
+			log.Println("Export failed:", err)
+		}
+	default:
+		res.Header().Set("Content-Type", "application/x-ndjson")
+		res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".jsonl"))
+		if _, err := exportLibrary(store, res); err != nil {
+			log.Println("Export failed:", err)
+		}
+	}
+}
+
+// exportHandler downloads the whole library. ?format=tar.gz packs it in an archive with a manifest.
+func exportHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "jsonl" && format != "tar.gz" {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusBadRequest)
+			res.Write([]byte("format must be jsonl or tar.gz"))
+			return
+		}
+		log.Println("Requested an export.")
+		writeExport(res, store, format)
+	}
+	return fn
+}
+
+// importHandler imports the export in the request body, JSON Lines or an archive, and answers with the report.
+// ?policy= picks the conflict policy and defaults to skip.
+func importHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		report, err := importLibrary(store, r.Body, r.URL.Query().Get("policy"))
+		if err := r.Body.Close(); err != nil {
+			panic(err)
+		}
+		switch {
+		case errors.Is(err, errBadImportPolicy):
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusBadRequest)
+			res.Write([]byte(err.Error()))
+			return
+		case err != nil:
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(422) // unprocessable entity
+			res.Write([]byte(err.Error()))
+			return
+		}
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		res.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(res).Encode(report); err != nil {
+			panic(err)
+		}
+	}
+	return fn
+}
+
+// runExportCommand implements "anansi export [-format jsonl|tar.gz] [-o file]", writing to stdout by default.
+func runExportCommand(store Store, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := flags.String("format", "jsonl", "jsonl or tar.gz")
+	out := flags.String("o", "", "write the export to this file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	export := exportLibrary
+	switch *format {
+	case "jsonl":
+	case "tar.gz":
+		export = exportArchive
+	default:
+		return fmt.Errorf("format must be jsonl or tar.gz")
+	}
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	counts, err := export(store, w)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d namespaces, %d content types, %d content items, %d tags, %d aliases, %d edges and %d collections.\n",
+		counts.Namespaces, counts.Types, counts.Content, counts.Tags, counts.Aliases, counts.Edges, counts.Collections)
+	return nil
+}
+
+// runImportCommand implements "anansi import [-policy skip|overwrite|merge-tags] <file>", reading stdin for "-".
+func runImportCommand(store Store, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	policy := flags.String("policy", importSkip, "what to do with records that already exist: skip, overwrite or merge-tags")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: anansi import [-policy skip|overwrite|merge-tags] <file>")
+	}
+	r := io.Reader(os.Stdin)
+	if name := flags.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	report, err := importLibrary(store, r, *policy)
+	if errors.Is(err, errBadImportPolicy) {
+		return err
+	}
+	fmt.Printf("Imported with the %s policy\n", report.Policy)
+	for _, c := range []struct {
+		name   string
+		counts ImportCounts
+	}{{"namespaces", report.Namespaces}, {"types", report.Types}, {"content", report.Content}, {"tags", report.Tags}, {"aliases", report.Aliases}, {"edges", report.Edges}, {"collections", report.Collections}} {
+		fmt.Printf("  %-12s created %d, updated %d, skipped %d", c.name+":", c.counts.Created, c.counts.Updated, c.counts.Skipped)
+		if c.counts.Removed > 0 {
+			fmt.Printf(", removed %d", c.counts.Removed)
+		}
+		fmt.Println()
+	}
+	for _, e := range report.Errors {
+		fmt.Printf("  error: %s\n", e)
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// aliasTargets returns the tag each alias in the database refers to.
+func aliasTargets(t *testing.T, store *boltStore) map[string]string {
+	t.Helper()
+	aliases, err := allAliases(store.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets := map[string]string{}
+	for _, alias := range aliases {
+		targets[alias.Alias] = alias.Tag
+	}
+	return targets
+}
+
+func TestExportAliasesRoundTrip(t *testing.T) {
+	from := &boltStore{db: newTestDB(t)}
+	seedStore(t, from)
+	if _, err := createAlias(from.db, "red", "Crimson"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createAlias(from.db, "blue", "navy"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	counts, err := exportLibrary(from, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts.Aliases != 2 {
+		t.Errorf("exported %d aliases, want 2", counts.Aliases)
+	}
+
+	to := &boltStore{db: newTestDB(t)}
+	report, err := importLibrary(to, bytes.NewReader(buf.Bytes()), importSkip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Errors) > 0 || report.Aliases.Created != 2 {
+		t.Fatalf("import report %+v, want 2 aliases created without errors", report)
+	}
+	if got := aliasTargets(t, to); len(got) != 2 || got["crimson"] != "red" || got["navy"] != "blue" {
+		t.Errorf("aliases after importing %v, want crimson for red and navy for blue", got)
+	}
+	want, err := listAliases(from.db, "red")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := listAliases(to.db, "red")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || !got[0].CreatedAt.Equal(want[0].CreatedAt) {
+		t.Errorf("aliases of red %+v after importing, want %+v", got, want)
+	}
+	// Imported aliases are indexed, so they resolve in suggestions like the ones created by hand.
+	suggestions, err := suggestTags(to.db, "crim", defaultSuggestLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(suggestions) != 1 || suggestions[0].Slug != "red" {
+		t.Errorf("suggestions for crim %+v, want red", suggestions)
+	}
+}
+
+func TestImportAliasPolicies(t *testing.T) {
+	from := &boltStore{db: newTestDB(t)}
+	seedStore(t, from)
+	if _, err := createAlias(from.db, "red", "crimson"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := exportLibrary(from, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		policy string
+		want   string
+		counts ImportCounts
+	}{
+		{importSkip, "blue", ImportCounts{Skipped: 1}},
+		{importMergeTags, "blue", ImportCounts{Skipped: 1}},
+		{importOverwrite, "red", ImportCounts{Updated: 1}},
+	}
+	for _, tt := range tests {
+		to := &boltStore{db: newTestDB(t)}
+		seedStore(t, to)
+		if _, err := createAlias(to.db, "blue", "crimson"); err != nil {
+			t.Fatal(err)
+		}
+		report, err := importLibrary(to, bytes.NewReader(buf.Bytes()), tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Errors) > 0 || report.Aliases != tt.counts {
+			t.Errorf("%s: aliases %+v errors %v, want %+v", tt.policy, report.Aliases, report.Errors, tt.counts)
+		}
+		if got := aliasTargets(t, to)["crimson"]; got != tt.want {
+			t.Errorf("%s: crimson refers to %q, want %q", tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestImportAliasNeedsItsTag(t *testing.T) {
+	to := &boltStore{db: newTestDB(t)}
+	seedStore(t, to)
+	lines := `{"type":"alias","alias":{"alias":"gone","tag":"missing"}}
+{"type":"alias","alias":{"alias":"red","tag":"blue"}}
+`
+	report, err := importLibrary(to, bytes.NewReader([]byte(lines)), importOverwrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Errors) != 2 || report.Aliases.Created != 0 {
+		t.Errorf("import report %+v, want both aliases refused", report)
+	}
+	if got := aliasTargets(t, to); len(got) != 0 {
+		t.Errorf("aliases %v after a refused import, want none", got)
+	}
+}
@@ -0,0 +1,790 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+// Content types give content typed fields beyond the ones every item has, eg. a photo with a number
+// rating and a date taken. A content type is a schema: the fields content of that type may have, what kind
+// of value each holds and which are required. CONTENT_TYPES maps each name to a serialized ContentType,
+// TYPE_CONTENT holds a nested bucket per type with the hashes of its content, and FIELD_INDEX holds a nested
+// bucket per field whose keys are the encoded value followed by the hash, in value order, so comparisons
+// like rating>=4 are one cursor range.
+const contentTypeBucket = "CONTENT_TYPES"
+const typeContentBucket = "TYPE_CONTENT"
+const fieldIndexBucket = "FIELD_INDEX"
+
+// Kinds of value a field holds. Dates are written YYYY-MM-DD and enums are strings from a fixed list.
+const (
+	fieldString = "string"
+	fieldNumber = "number"
+	fieldDate   = "date"
+	fieldBool   = "bool"
+	fieldEnum   = "enum"
+)
+
+const fieldDateLayout = "2006-01-02"
+
+// typeField is the name queries use for the content type itself, eg. type=photo. No field can be called it.
+const typeField = "type"
+
+var errContentTypeNotFound = errors.New("content type not found")
+var errContentTypeExists = errors.New("content type already exists")
+var errContentTypeInUse = errors.New("content type still has content")
+var errBadContentType = errors.New("bad content type")
+
+// errBadFields is returned when the fields of content do not match its content type.
+var errBadFields = errors.New("bad fields")
+
+var contentTypeNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+var fieldNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+// ContentType is the schema of the fields of content with Type set to its name.
+type ContentType struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Fields      []FieldSpec `json:"fields"`
+	CreatedAt   time.Time   `json:"createdAt,omitempty"`
+}
+
+// FieldSpec describes one field of a content type. A field name means the same kind of value in every
+// content type that has it, so a query can compare it across types.
+type FieldSpec struct {
+	Name     string   `json:"name"`
+	Kind     string   `json:"type"` // string, number, date, bool or enum.
+	Required bool     `json:"required,omitempty"`
+	Values   []string `json:"values,omitempty"` // The values an enum may take.
+}
+
+// field returns the spec of the field with the name, or nil when the content type does not have it.
+func (ct ContentType) field(name string) *FieldSpec {
+	for i := range ct.Fields {
+		if ct.Fields[i].Name == name {
+			return &ct.Fields[i]
+		}
+	}
+	return nil
+}
+
+// CONTENT TYPE HANDLERS
+
+// writeContentTypeError answers a request that failed with err as plain text.
+func writeContentTypeError(res http.ResponseWriter, err error) {
+	res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	switch {
+	case errors.Is(err, errContentTypeNotFound):
+		res.WriteHeader(http.StatusNotFound)
+		res.Write([]byte("Content type not found."))
+	case errors.Is(err, errContentTypeExists), errors.Is(err, errContentTypeInUse):
+		res.WriteHeader(http.StatusConflict)
+		res.Write([]byte(err.Error()))
+	case errors.Is(err, errBadContentType):
+		res.WriteHeader(422) // unprocessable entity
+		res.Write([]byte(err.Error()))
+	default:
+		res.WriteHeader(http.StatusInternalServerError)
+		res.Write([]byte("Error accessing the DB."))
+	}
+}
+
+// listContentTypesHandler returns every content type as JSON.
+func listContentTypesHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		types, err := listContentTypes(db)
+		if err != nil {
+			writeContentTypeError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, types)
+	}
+	return fn
+}
+
+// getContentTypeHandler returns the content type in the URL as JSON.
+func getContentTypeHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		ct, err := getContentType(db, mux.Vars(r)["name"])
+		if err != nil {
+			writeContentTypeError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, ct)
+	}
+	return fn
+}
+
+// createContentTypeHandler defines the content type in the JSON body,
+// eg. {"name": "photo", "fields": [{"name": "rating", "type": "number"}]}.
+func createContentTypeHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var ct ContentType
+		if !readJSONBody(res, r, &ct) {
+			return
+		}
+		created, err := createContentType(db, ct)
+		if err != nil {
+			writeContentTypeError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusCreated, created)
+	}
+	return fn
+}
+
+// modifyContentTypeHandler replaces the description and fields of the content type in the URL.
+func modifyContentTypeHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var ct ContentType
+		if !readJSONBody(res, r, &ct) {
+			return
+		}
+		modified, err := modifyContentType(db, mux.Vars(r)["name"], ct)
+		if err != nil {
+			writeContentTypeError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, modified)
+	}
+	return fn
+}
+
+// deleteContentTypeHandler deletes the content type in the URL. Content types that content still has are kept.
+func deleteContentTypeHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		if err := deleteContentType(db, mux.Vars(r)["name"]); err != nil {
+			writeContentTypeError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, struct {
+			Deleted bool
+		}{true})
+	}
+	return fn
+}
+
+// CONTENT TYPE API HANDLERS
+
+// apiListContentTypesHandler returns every content type.
+func apiListContentTypesHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		types, err := listContentTypes(db)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIList(res, types, nil)
+	}
+	return fn
+}
+
+// apiGetContentTypeHandler returns the content type in the URL.
+func apiGetContentTypeHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		ct, err := getContentType(db, mux.Vars(r)["name"])
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, ct)
+	}
+	return fn
+}
+
+// apiCreateContentTypeHandler defines the content type in the body.
+func apiCreateContentTypeHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var ct ContentType
+		if !readAPIBody(res, r, &ct) {
+			return
+		}
+		created, err := createContentType(db, ct)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		res.Header().Set("Location", "/api/v1/types/"+created.Name)
+		writeAPIData(res, http.StatusCreated, created)
+	}
+	return fn
+}
+
+// apiModifyContentTypeHandler replaces the description and fields of the content type in the URL.
+func apiModifyContentTypeHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var ct ContentType
+		if !readAPIBody(res, r, &ct) {
+			return
+		}
+		modified, err := modifyContentType(db, mux.Vars(r)["name"], ct)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, modified)
+	}
+	return fn
+}
+
+// apiDeleteContentTypeHandler deletes the content type in the URL.
+func apiDeleteContentTypeHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		if err := deleteContentType(db, mux.Vars(r)["name"]); err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		res.WriteHeader(http.StatusNoContent)
+	}
+	return fn
+}
+
+// DATA STORE FUNCTIONS
+
+// validateContentType checks a content type inside an existing transaction: its name, and that each field
+// has a name, a kind and, for enums, values. A field another content type has must be of the same kind.
+func validateContentType(tx *bolt.Tx, ct ContentType) error {
+	if !contentTypeNamePattern.MatchString(ct.Name) {
+		return fmt.Errorf("%w: %q, a name is up to 64 lower case letters, digits, - and _", errBadContentType, ct.Name)
+	}
+	others, err := lookupContentTypes(tx)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, f := range ct.Fields {
+		if !fieldNamePattern.MatchString(f.Name) || f.Name == typeField {
+			return fmt.Errorf("%w: field %q, a field name is up to 64 lower case letters, digits and _ starting with a letter, and not %s", errBadContentType, f.Name, typeField)
+		}
+		if seen[f.Name] {
+			return fmt.Errorf("%w: field %s is defined twice", errBadContentType, f.Name)
+		}
+		seen[f.Name] = true
+		switch f.Kind {
+		case fieldString, fieldNumber, fieldDate, fieldBool:
+			if len(f.Values) > 0 {
+				return fmt.Errorf("%w: field %s is a %s, only enums have values", errBadContentType, f.Name, f.Kind)
+			}
+		case fieldEnum:
+			if len(f.Values) == 0 {
+				return fmt.Errorf("%w: enum field %s has no values", errBadContentType, f.Name)
+			}
+			for i, v := range f.Values {
+				if v == "" || containsString(f.Values[:i], v) {
+					return fmt.Errorf("%w: enum field %s has an empty or repeated value %q", errBadContentType, f.Name, v)
+				}
+			}
+		default:
+			return fmt.Errorf("%w: field %s has type %q, use string, number, date, bool or enum", errBadContentType, f.Name, f.Kind)
+		}
+		for _, other := range others {
+			if other.Name == ct.Name {
+				continue
+			}
+			if o := other.field(f.Name); o != nil && o.Kind != f.Kind {
+				return fmt.Errorf("%w: field %s is a %s in %s, it can not be a %s here", errBadContentType, f.Name, o.Kind, other.Name, f.Kind)
+			}
+		}
+	}
+	return nil
+}
+
+// createContentType defines a content type and returns it as stored.
+func createContentType(db *bolt.DB, ct ContentType) (*ContentType, error) {
+	ct.Name = strings.TrimSpace(ct.Name)
+	if ct.Fields == nil {
+		ct.Fields = []FieldSpec{}
+	}
+	ct.CreatedAt = time.Now()
+	err := db.Update(func(tx *bolt.Tx) error {
+		existing, err := lookupContentType(tx, ct.Name)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return fmt.Errorf("%w: %s", errContentTypeExists, ct.Name)
+		}
+		if err := validateContentType(tx, ct); err != nil {
+			return err
+		}
+		return putContentType(tx, ct)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ct, nil
+}
+
+// modifyContentType replaces the description and fields of a content type. Content that no longer matches
+// the new fields keeps its values; they are checked again the next time its fields change.
+func modifyContentType(db *bolt.DB, name string, ct ContentType) (*ContentType, error) {
+	ct.Name = name
+	if ct.Fields == nil {
+		ct.Fields = []FieldSpec{}
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		existing, err := lookupContentType(tx, name)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return errContentTypeNotFound
+		}
+		if err := validateContentType(tx, ct); err != nil {
+			return err
+		}
+		ct.CreatedAt = existing.CreatedAt
+		return putContentType(tx, ct)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ct, nil
+}
+
+// deleteContentType removes a content type that no content has.
+func deleteContentType(db *bolt.DB, name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		existing, err := lookupContentType(tx, name)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return errContentTypeNotFound
+		}
+		if hashes := typeContentHashes(tx, name); len(hashes) > 0 {
+			return fmt.Errorf("%w: %s has %d, change their type or delete them first", errContentTypeInUse, name, len(hashes))
+		}
+		root := tx.Bucket([]byte(topLevelBucket))
+		if root.Bucket([]byte(typeContentBucket)).Bucket([]byte(name)) != nil {
+			if err := root.Bucket([]byte(typeContentBucket)).DeleteBucket([]byte(name)); err != nil {
+				return fmt.Errorf("could not delete type_content: %v", err)
+			}
+		}
+		return root.Bucket([]byte(contentTypeBucket)).Delete([]byte(name))
+	})
+}
+
+// getContentType reads a content type.
+func getContentType(db *bolt.DB, name string) (*ContentType, error) {
+	var ct *ContentType
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		ct, err = lookupContentType(tx, name)
+		if err == nil && ct == nil {
+			err = errContentTypeNotFound
+		}
+		return err
+	})
+	return ct, err
+}
+
+// listContentTypes returns every content type, by name.
+func listContentTypes(db *bolt.DB) ([]ContentType, error) {
+	var results []ContentType
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		results, err = lookupContentTypes(tx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// lookupContentTypes reads every content type inside an existing transaction, by name.
+func lookupContentTypes(tx *bolt.Tx) ([]ContentType, error) {
+	results := []ContentType{}
+	b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(contentTypeBucket))
+	if b == nil {
+		return results, nil
+	}
+	err := b.ForEach(func(k, v []byte) error {
+		ct := ContentType{}
+		if err := json.Unmarshal(v, &ct); err != nil {
+			return err
+		}
+		results = append(results, ct)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// lookupContentType reads a content type inside an existing transaction. It returns nil if there is no such type.
+func lookupContentType(tx *bolt.Tx, name string) (*ContentType, error) {
+	b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(contentTypeBucket))
+	if b == nil {
+		return nil, nil
+	}
+	v := b.Get([]byte(name))
+	if v == nil {
+		return nil, nil
+	}
+	ct := ContentType{}
+	if err := json.Unmarshal(v, &ct); err != nil {
+		return nil, err
+	}
+	return &ct, nil
+}
+
+// putContentType writes a content type inside an existing transaction.
+func putContentType(tx *bolt.Tx, ct ContentType) error {
+	if err := putRecord(tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(contentTypeBucket)), ct.Name, ct); err != nil {
+		return fmt.Errorf("could not insert content type: %v", err)
+	}
+	return nil
+}
+
+// typeContentHashes returns the hashes of the content of a content type inside an existing transaction.
+func typeContentHashes(tx *bolt.Tx, name string) []string {
+	hashes := []string{}
+	b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(typeContentBucket))
+	if b == nil {
+		return hashes
+	}
+	if b = b.Bucket([]byte(name)); b == nil {
+		return hashes
+	}
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		hashes = append(hashes, string(k))
+	}
+	return hashes
+}
+
+// settleContentFields checks the fields of content about to be written against its content type inside
+// an existing transaction. Fields set to null are dropped. Content without a type can not have fields.
+func settleContentFields(tx *bolt.Tx, content *Content) error {
+	for name, v := range content.Fields {
+		if v == nil {
+			delete(content.Fields, name)
+		}
+	}
+	if len(content.Fields) == 0 {
+		content.Fields = nil
+	}
+	if content.Type == "" {
+		if content.Fields != nil {
+			return fmt.Errorf("%w: content needs a type to have fields", errBadFields)
+		}
+		return nil
+	}
+	ct, err := lookupContentType(tx, content.Type)
+	if err != nil {
+		return err
+	}
+	if ct == nil {
+		return fmt.Errorf("%w: there is no content type called %q", errBadFields, content.Type)
+	}
+	names := make([]string, 0, len(content.Fields))
+	for name := range content.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		spec := ct.field(name)
+		if spec == nil {
+			return fmt.Errorf("%w: %s has no field called %s", errBadFields, ct.Name, name)
+		}
+		if err := checkFieldValue(*spec, content.Fields[name]); err != nil {
+			return err
+		}
+	}
+	for _, spec := range ct.Fields {
+		if _, ok := content.Fields[spec.Name]; spec.Required && !ok {
+			return fmt.Errorf("%w: %s needs a value for %s", errBadFields, ct.Name, spec.Name)
+		}
+	}
+	return nil
+}
+
+// checkFieldValue checks that a value decoded from JSON is of the field's kind.
+func checkFieldValue(spec FieldSpec, v interface{}) error {
+	ok := false
+	switch spec.Kind {
+	case fieldString:
+		_, ok = v.(string)
+	case fieldNumber:
+		_, ok = v.(float64)
+	case fieldBool:
+		_, ok = v.(bool)
+	case fieldDate:
+		if s, isString := v.(string); isString {
+			_, err := time.Parse(fieldDateLayout, s)
+			ok = err == nil
+		}
+	case fieldEnum:
+		s, isString := v.(string)
+		ok = isString && containsString(spec.Values, s)
+		if !ok {
+			return fmt.Errorf("%w: %s must be one of %s", errBadFields, spec.Name, strings.Join(spec.Values, ", "))
+		}
+	}
+	if !ok {
+		if spec.Kind == fieldDate {
+			return fmt.Errorf("%w: %s must be a date written YYYY-MM-DD", errBadFields, spec.Name)
+		}
+		return fmt.Errorf("%w: %s must be a %s", errBadFields, spec.Name, spec.Kind)
+	}
+	return nil
+}
+
+// sameFields reports whether content keeps its type and field values.
+func sameFields(a *Content, b *Content) bool {
+	return a.Type == b.Type && reflect.DeepEqual(a.Fields, b.Fields)
+}
+
+// encodeFieldValue encodes a field value so that encoded values of one kind sort in value order. The first
+// byte is the kind, so the values of a field that changed kind do not mix. It returns nil for values that
+// are not indexed.
+func encodeFieldValue(v interface{}) []byte {
+	switch v := v.(type) {
+	case float64:
+		bits := math.Float64bits(v)
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+		buf := make([]byte, 9)
+		buf[0] = 'n'
+		binary.BigEndian.PutUint64(buf[1:], bits)
+		return buf
+	case bool:
+		if v {
+			return []byte("b1")
+		}
+		return []byte("b0")
+	case string:
+		return append([]byte{'s'}, v...)
+	}
+	return nil
+}
+
+// fieldIndexKey is the FIELD_INDEX key of a value of a field of the content with the hash.
+func fieldIndexKey(v interface{}, hash string) []byte {
+	encoded := encodeFieldValue(v)
+	if encoded == nil {
+		return nil
+	}
+	return append(append(encoded, 0), hash...)
+}
+
+// indexFields updates FIELD_INDEX and TYPE_CONTENT for content whose type and fields change from previous
+// to content inside an existing transaction. A nil content removes the content from both.
+func indexFields(tx *bolt.Tx, hash string, previous *Content, content *Content) error {
+	root := tx.Bucket([]byte(topLevelBucket))
+	fields, types := root.Bucket([]byte(fieldIndexBucket)), root.Bucket([]byte(typeContentBucket))
+	if fields == nil || types == nil {
+		return nil
+	}
+	if previous != nil {
+		for name, v := range previous.Fields {
+			key := fieldIndexKey(v, hash)
+			if b := fields.Bucket([]byte(name)); b != nil && key != nil {
+				if err := b.Delete(key); err != nil {
+					return fmt.Errorf("could not delete field_index: %v", err)
+				}
+			}
+		}
+		if b := types.Bucket([]byte(previous.Type)); previous.Type != "" && b != nil {
+			if err := b.Delete([]byte(hash)); err != nil {
+				return fmt.Errorf("could not delete type_content: %v", err)
+			}
+		}
+	}
+	if content == nil {
+		return nil
+	}
+	for name, v := range content.Fields {
+		key := fieldIndexKey(v, hash)
+		if key == nil {
+			continue
+		}
+		b, err := fields.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return fmt.Errorf("could not insert field_index: %v", err)
+		}
+		if err := b.Put(key, []byte{}); err != nil {
+			return fmt.Errorf("could not insert field_index: %v", err)
+		}
+	}
+	if content.Type != "" {
+		b, err := types.CreateBucketIfNotExists([]byte(content.Type))
+		if err != nil {
+			return fmt.Errorf("could not insert type_content: %v", err)
+		}
+		if err := b.Put([]byte(hash), []byte{}); err != nil {
+			return fmt.Errorf("could not insert type_content: %v", err)
+		}
+	}
+	return nil
+}
+
+// fieldKind returns the kind of the field with the name in the content types inside an existing
+// transaction, or "" when no content type has it.
+func fieldKind(tx *bolt.Tx, name string) (string, error) {
+	types, err := lookupContentTypes(tx)
+	if err != nil {
+		return "", err
+	}
+	for _, ct := range types {
+		if spec := ct.field(name); spec != nil {
+			return spec.Kind, nil
+		}
+	}
+	return "", nil
+}
+
+// parseFieldValue reads the value a query compares a field of the kind with.
+func parseFieldValue(kind string, s string) (interface{}, error) {
+	switch kind {
+	case fieldNumber:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", s)
+		}
+		return n, nil
+	case fieldBool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not true or false", s)
+		}
+		return b, nil
+	case fieldDate:
+		if _, err := time.Parse(fieldDateLayout, s); err != nil {
+			return nil, fmt.Errorf("%q is not a date written YYYY-MM-DD", s)
+		}
+	}
+	return s, nil
+}
+
+// comparisonOperators are the operators of field comparisons, longest first so >= is not read as >.
+var comparisonOperators = []string{">=", "<=", "!=", "=", ">", "<"}
+
+// splitComparison splits a query word written field<op>value, eg. rating>=4. ok is false when the word
+// does not start with a field name followed by an operator.
+func splitComparison(word string) (field string, op string, value string, ok bool) {
+	i := strings.IndexAny(word, "<>=!")
+	if i <= 0 || !fieldNamePattern.MatchString(word[:i]) {
+		return "", "", "", false
+	}
+	for _, op := range comparisonOperators {
+		if strings.HasPrefix(word[i:], op) {
+			return word[:i], op, word[i+len(op):], true
+		}
+	}
+	return "", "", "", false
+}
+
+// compareMatches reports whether a value that compares to the value in a query as cmp, as from bytes.Compare, satisfies op.
+func compareMatches(op string, cmp int) bool {
+	switch op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+// compareField returns the hashes of the content whose field compares to value as op inside an existing
+// transaction. The field type compares the content type with = and !=. A comparison that can not be made
+// is a QueryError at pos.
+func compareField(tx *bolt.Tx, field string, op string, value string, pos int) (hashSet, error) {
+	result := hashSet{}
+	if field == typeField {
+		if op != "=" && op != "!=" {
+			return nil, &QueryError{pos, fmt.Sprintf("compare %s with = or !=", typeField)}
+		}
+		types, err := lookupContentTypes(tx)
+		if err != nil {
+			return nil, err
+		}
+		for _, ct := range types {
+			if compareMatches(op, strings.Compare(ct.Name, value)) {
+				for _, hash := range typeContentHashes(tx, ct.Name) {
+					result[hash] = struct{}{}
+				}
+			}
+		}
+		return result, nil
+	}
+	kind, err := fieldKind(tx, field)
+	if err != nil {
+		return nil, err
+	}
+	if kind == "" {
+		return nil, &QueryError{pos, fmt.Sprintf("no content type has a field called %s", field)}
+	}
+	if (kind == fieldBool || kind == fieldEnum) && op != "=" && op != "!=" {
+		return nil, &QueryError{pos, fmt.Sprintf("%s is a %s field, compare it with = or !=", field, kind)}
+	}
+	v, err := parseFieldValue(kind, value)
+	if err != nil {
+		return nil, &QueryError{pos + len(field) + len(op), err.Error()}
+	}
+	b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(fieldIndexBucket))
+	if b == nil {
+		return result, nil
+	}
+	if b = b.Bucket([]byte(field)); b == nil {
+		return result, nil
+	}
+	encoded := encodeFieldValue(v)
+	start := encoded[:1]
+	if op == "=" || op == ">" || op == ">=" {
+		start = encoded
+	}
+	c := b.Cursor()
+	for k, _ := c.Seek(start); k != nil && k[0] == encoded[0]; k, _ = c.Next() {
+		i := bytes.LastIndexByte(k, 0)
+		cmp := bytes.Compare(k[:i], encoded)
+		if compareMatches(op, cmp) {
+			result[string(k[i+1:])] = struct{}{}
+		} else if cmp > 0 && (op == "=" || op == "<" || op == "<=") {
+			break
+		}
+	}
+	return result, nil
+}
+
+// setupContentTypes creates the content type and field index buckets.
+func setupContentTypes(root *bolt.Bucket) error {
+	for _, name := range []string{contentTypeBucket, typeContentBucket, fieldIndexBucket} {
+		if _, err := root.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return fmt.Errorf("could not create %s bucket: %v", strings.ToLower(name), err)
+		}
+	}
+	return nil
+}
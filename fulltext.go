@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/boltdb/bolt"
+	"github.com/kljensen/snowball/english"
+)
+
+// The full text index is an inverted index over the Label and Definition of content and tags.
+// It is kept in three buckets inside the top level bucket and is updated in the same
+// transaction as the record it describes, so it never drifts from the data.
+//
+//	FULLTEXT_POSTINGS/<term>/<docID> -> uvarint term frequency
+//	FULLTEXT_DOCS/<docID>            -> JSON textDoc, used for document length and unindexing
+//	FULLTEXT_STATS/docs|length       -> uvarint document count and total length, for BM25
+//
+// Document IDs are the record kind and key joined by a colon, eg. "content:<hash>" or "tag:<slug>".
+const fullTextPostingsBucket = "FULLTEXT_POSTINGS"
+const fullTextDocsBucket = "FULLTEXT_DOCS"
+const fullTextStatsBucket = "FULLTEXT_STATS"
+
+const contentDocKind = "content"
+const tagDocKind = "tag"
+
+// BM25 tuning parameters. These are the usual defaults.
+const bm25K1 = 1.2
+const bm25B = 0.75
+
+// snippetTokens is the number of words shown around the best match in a result snippet.
+const snippetTokens = 24
+
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"but": true, "by": true, "for": true, "if": true, "in": true, "into": true, "is": true,
+	"it": true, "no": true, "not": true, "of": true, "on": true, "or": true, "such": true,
+	"that": true, "the": true, "their": true, "then": true, "there": true, "these": true,
+	"they": true, "this": true, "to": true, "was": true, "will": true, "with": true,
+}
+
+// textDoc is what the index remembers about a document.
+type textDoc struct {
+	Length int            `json:"length"`
+	Terms  map[string]int `json:"terms"`
+}
+
+// TextResult is a single ranked full text search hit.
+type TextResult struct {
+	Kind    string        `json:"kind"`
+	Key     string        `json:"key"`
+	Label   string        `json:"title"`
+	Score   float64       `json:"score"`
+	Snippet template.HTML `json:"snippet"`
+}
+
+// textToken is a word found in a piece of text, with its byte offsets so it can be highlighted.
+type textToken struct {
+	term  string
+	start int
+	end   int
+}
+
+// tokenizeText splits text into lower case words, drops stop words and stems the rest.
+func tokenizeText(text string) []textToken {
+	tokens := []textToken{}
+	start := -1
+	flush := func(end int) {
+		if start < 0 {
+			return
+		}
+		word := strings.ToLower(text[start:end])
+		if !stopWords[word] {
+			tokens = append(tokens, textToken{english.Stem(word, true), start, end})
+		}
+		start = -1
+	}
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		flush(i)
+	}
+	flush(len(text))
+	return tokens
+}
+
+// docID builds the full text document ID for a record.
+func docID(kind string, key string) string {
+	return kind + ":" + key
+}
+
+// indexDocument replaces the index entries for a document with the terms found in fields.
+func indexDocument(tx *bolt.Tx, id string, fields ...string) error {
+	if err := unindexDocument(tx, id); err != nil {
+		return err
+	}
+	doc := textDoc{Terms: map[string]int{}}
+	for _, field := range fields {
+		for _, t := range tokenizeText(field) {
+			doc.Terms[t.term]++
+			doc.Length++
+		}
+	}
+	root := tx.Bucket([]byte(topLevelBucket))
+	postings := root.Bucket([]byte(fullTextPostingsBucket))
+	for term, freq := range doc.Terms {
+		b, err := postings.CreateBucketIfNotExists([]byte(term))
+		if err != nil {
+			return fmt.Errorf("could not index term %q: %v", term, err)
+		}
+		if err := b.Put([]byte(id), encodeUvarint(uint64(freq))); err != nil {
+			return fmt.Errorf("could not index term %q: %v", term, err)
+		}
+	}
+	buf, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if err := root.Bucket([]byte(fullTextDocsBucket)).Put([]byte(id), buf); err != nil {
+		return fmt.Errorf("could not index document: %v", err)
+	}
+	return updateTextStats(tx, 1, doc.Length)
+}
+
+// unindexDocument removes every index entry for a document. Unknown documents are ignored.
+func unindexDocument(tx *bolt.Tx, id string) error {
+	root := tx.Bucket([]byte(topLevelBucket))
+	docs := root.Bucket([]byte(fullTextDocsBucket))
+	v := docs.Get([]byte(id))
+	if v == nil {
+		return nil
+	}
+	doc := textDoc{}
+	if err := json.Unmarshal(v, &doc); err != nil {
+		return err
+	}
+	postings := root.Bucket([]byte(fullTextPostingsBucket))
+	for term := range doc.Terms {
+		b := postings.Bucket([]byte(term))
+		if b == nil {
+			continue
+		}
+		if err := b.Delete([]byte(id)); err != nil {
+			return fmt.Errorf("could not unindex term %q: %v", term, err)
+		}
+		if k, _ := b.Cursor().First(); k == nil {
+			if err := postings.DeleteBucket([]byte(term)); err != nil {
+				return fmt.Errorf("could not unindex term %q: %v", term, err)
+			}
+		}
+	}
+	if err := docs.Delete([]byte(id)); err != nil {
+		return fmt.Errorf("could not unindex document: %v", err)
+	}
+	return updateTextStats(tx, -1, -doc.Length)
+}
+
+// updateTextStats adjusts the document count and total document length used by BM25.
+func updateTextStats(tx *bolt.Tx, docs int, length int) error {
+	b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(fullTextStatsBucket))
+	for key, delta := range map[string]int{"docs": docs, "length": length} {
+		current := int64(decodeUvarint(b.Get([]byte(key))))
+		next := current + int64(delta)
+		if next < 0 {
+			next = 0
+		}
+		if err := b.Put([]byte(key), encodeUvarint(uint64(next))); err != nil {
+			return fmt.Errorf("could not update index stats: %v", err)
+		}
+	}
+	return nil
+}
+
+// reindexAll rebuilds the full text index from the content and tag buckets.
+// setupDB calls it when the index has never been built, so existing databases get indexed on upgrade.
+func reindexAll(tx *bolt.Tx) error {
+	root := tx.Bucket([]byte(topLevelBucket))
+	for _, name := range []string{fullTextPostingsBucket, fullTextDocsBucket, fullTextStatsBucket} {
+		if err := root.DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+			return fmt.Errorf("could not reset %s bucket: %v", strings.ToLower(name), err)
+		}
+		if _, err := root.CreateBucket([]byte(name)); err != nil {
+			return fmt.Errorf("could not create %s bucket: %v", strings.ToLower(name), err)
+		}
+	}
+	err := root.Bucket([]byte(contentBucket)).ForEach(func(k, v []byte) error {
+		content := Content{}
+		if err := json.Unmarshal(v, &content); err != nil {
+			return err
+		}
+		return indexDocument(tx, docID(contentDocKind, string(k)), content.Label, content.Definition)
+	})
+	if err != nil {
+		return err
+	}
+	err = root.Bucket([]byte(tagBucket)).ForEach(func(k, v []byte) error {
+		tag := Tag{}
+		if err := json.Unmarshal(v, &tag); err != nil {
+			return err
+		}
+		return indexDocument(tx, docID(tagDocKind, string(k)), tag.Label, tag.Definition)
+	})
+	if err != nil {
+		return err
+	}
+	// Mark the index as built even when there was nothing to index.
+	return updateTextStats(tx, 0, 0)
+}
+
+// searchText ranks content and tags against the words in q using BM25 and returns at most limit results.
+func searchText(db *bolt.DB, q string, limit int) ([]TextResult, error) {
+	terms := map[string]bool{}
+	for _, t := range tokenizeText(q) {
+		terms[t.term] = true
+	}
+	results := []TextResult{}
+	if len(terms) == 0 {
+		return results, nil
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(topLevelBucket))
+		stats := root.Bucket([]byte(fullTextStatsBucket))
+		docs := root.Bucket([]byte(fullTextDocsBucket))
+		n := float64(decodeUvarint(stats.Get([]byte("docs"))))
+		if n == 0 {
+			return nil
+		}
+		avgLength := float64(decodeUvarint(stats.Get([]byte("length")))) / n
+		lengths := map[string]float64{}
+		scores := map[string]float64{}
+		for term := range terms {
+			b := root.Bucket([]byte(fullTextPostingsBucket)).Bucket([]byte(term))
+			if b == nil {
+				continue
+			}
+			df := float64(b.Stats().KeyN)
+			idf := math.Log((n-df+0.5)/(df+0.5) + 1)
+			err := b.ForEach(func(k, v []byte) error {
+				id := string(k)
+				length, ok := lengths[id]
+				if !ok {
+					doc := textDoc{}
+					if err := json.Unmarshal(docs.Get(k), &doc); err != nil {
+						return err
+					}
+					length = float64(doc.Length)
+					lengths[id] = length
+				}
+				tf := float64(decodeUvarint(v))
+				scores[id] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*length/avgLength))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for id, score := range scores {
+			parts := strings.SplitN(id, ":", 2)
+			result := TextResult{Kind: parts[0], Key: parts[1], Score: score}
+			var body string
+			switch result.Kind {
+			case contentDocKind:
+				content := Content{}
+				if err := json.Unmarshal(root.Bucket([]byte(contentBucket)).Get([]byte(result.Key)), &content); err != nil {
+					return err
+				}
+				result.Label, body = content.Label, content.Definition
+			case tagDocKind:
+				tag := Tag{}
+				if err := json.Unmarshal(root.Bucket([]byte(tagBucket)).Get([]byte(result.Key)), &tag); err != nil {
+					return err
+				}
+				result.Label, body = tag.Label, tag.Definition
+			}
+			if body == "" {
+				body = result.Label
+			}
+			result.Snippet = highlightSnippet(body, terms)
+			results = append(results, result)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Key < results[j].Key
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// highlightSnippet returns an HTML escaped window of text around the densest cluster of matching
+// words, with each match wrapped in a mark element.
+func highlightSnippet(text string, terms map[string]bool) template.HTML {
+	tokens := tokenizeText(text)
+	if len(tokens) == 0 {
+		return template.HTML(template.HTMLEscapeString(truncateRunes(text, 200)))
+	}
+	best, bestHits := 0, -1
+	for i := range tokens {
+		hits := 0
+		for j := i; j < len(tokens) && j < i+snippetTokens; j++ {
+			if terms[tokens[j].term] {
+				hits++
+			}
+		}
+		if hits > bestHits {
+			best, bestHits = i, hits
+		}
+	}
+	last := best + snippetTokens - 1
+	if last >= len(tokens) {
+		last = len(tokens) - 1
+	}
+	start, end := tokens[best].start, tokens[last].end
+	if best == 0 {
+		start = 0
+	}
+	if last == len(tokens)-1 {
+		end = len(text)
+	}
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, t := range tokens[best : last+1] {
+		if !terms[t.term] {
+			continue
+		}
+		b.WriteString(template.HTMLEscapeString(text[pos:t.start]))
+		b.WriteString("<mark>")
+		b.WriteString(template.HTMLEscapeString(text[t.start:t.end]))
+		b.WriteString("</mark>")
+		pos = t.end
+	}
+	b.WriteString(template.HTMLEscapeString(text[pos:end]))
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return template.HTML(b.String())
+}
+
+// truncateRunes shortens s to at most n runes without splitting a character.
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n]) + "…"
+}
+
+func encodeUvarint(v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return buf[:binary.PutUvarint(buf, v)]
+}
+
+func decodeUvarint(buf []byte) uint64 {
+	v, _ := binary.Uvarint(buf)
+	return v
+}
+
+// TextSearchPageData is the data required to render the HTML template for the full text search page.
+type TextSearchPageData struct {
+	SiteMetaData SiteMetaData
+	Query        string
+	Results      []TextResult
+}
+
+// textSearchHandler ranks content and tags against the words in the q parameter.
+// The optional limit parameter caps the number of results, which defaults to 20.
+// Results are returned as JSON when the client accepts it, and as an HTML page otherwise.
+func textSearchHandler(db *bolt.DB, t *template.Template) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		q := strings.TrimSpace(r.URL.Query().Get("q"))
+		limit := 20
+		if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+			limit = l
+		}
+		log.Printf("Requested text search for: %s \n", q)
+		results, err := searchText(db, q, limit)
+		if err != nil {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusInternalServerError)
+			res.Write([]byte("Could not search."))
+			return
+		}
+		if wantsJSON(r) {
+			res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			res.WriteHeader(http.StatusOK)
+			if err := json.NewEncoder(res).Encode(results); err != nil {
+				panic(err)
+			}
+			return
+		}
+		res.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		res.WriteHeader(http.StatusOK)
+		t.Execute(res, TextSearchPageData{SiteMetaData: siteMetaData, Query: q, Results: results})
+	}
+	return fn
+}
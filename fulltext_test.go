@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestTokenizeText(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"", ""},
+		{"The dogs are running", "dog@4-8 run@13-20"},
+		{"Running runner runs", "run@0-7 runner@8-14 run@15-19"},
+		{"  walking,in   the PARKS! ", "walk@2-9 park@19-24"},
+		{"2021 photos", "2021@0-4 photo@5-11"},
+		{"Café, naïve!", "café@0-5 naïv@7-13"},
+		{"it is not this or that", ""},
+		{"!?;-- ...", ""},
+	}
+	for _, tt := range tests {
+		got := []string{}
+		for _, token := range tokenizeText(tt.text) {
+			got = append(got, fmt.Sprintf("%s@%d-%d", token.term, token.start, token.end))
+		}
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("tokenizeText(%q) = %q, want %q", tt.text, strings.Join(got, " "), tt.want)
+		}
+	}
+}
+
+// textResultKeys runs a full text search and returns the kind and key of each result, best first.
+func textResultKeys(t *testing.T, db *bolt.DB, q string, limit int) string {
+	t.Helper()
+	results, err := searchText(db, q, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, r := range results {
+		keys = append(keys, r.Kind+":"+r.Key)
+	}
+	return strings.Join(keys, " ")
+}
+
+func TestSearchTextRanking(t *testing.T) {
+	db := newTestDB(t)
+	store := &boltStore{db: db}
+	for _, content := range []Content{
+		{Hash: "twice", Label: "Dog", Definition: "A dog and a cat."},
+		{Hash: "once", Label: "Pet", Definition: "A dog and a cat."},
+		{Hash: "longer", Label: "Pet", Definition: "A dog, a cat, a bird and a fish."},
+		{Hash: "park", Label: "Park", Definition: "Cats in the park."},
+	} {
+		if err := store.PutContent(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.PutTag(Tag{Slug: "fish", Label: "Fish", Definition: "Fishing by the river."}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		q     string
+		limit int
+		want  string
+	}{
+		// More occurrences rank higher, and the shorter of two documents with as many.
+		{"dog", 0, "content:twice content:once content:longer"},
+		{"dogs", 0, "content:twice content:once content:longer"},
+		{"dog", 2, "content:twice content:once"},
+		// A document with both words ranks ahead of those with only one of them.
+		{"pet dog", 0, "content:once content:longer content:twice"},
+		// The rarer word counts for more: bird is in one document, cat in four.
+		{"cat bird", 1, "content:longer"},
+		{"fishing", 0, "tag:fish content:longer"},
+		{"the and", 0, ""},
+		{"unicorn", 0, ""},
+	}
+	for _, tt := range tests {
+		if got := textResultKeys(t, db, tt.q, tt.limit); got != tt.want {
+			t.Errorf("searchText(%q, %d) = %q, want %q", tt.q, tt.limit, got, tt.want)
+		}
+	}
+
+	results, err := searchText(db, "river", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Label != "Fish" || results[0].Snippet != "Fishing by the <mark>river</mark>." || results[0].Score <= 0 {
+		t.Errorf("searchText(river) = %+v, want the Fish tag with its definition", results)
+	}
+}
+
+func TestHighlightSnippet(t *testing.T) {
+	words := []string{}
+	for i := 0; i < 60; i++ {
+		words = append(words, fmt.Sprintf("w%d", i))
+	}
+	long := strings.Join(words, " ")
+	tests := []struct {
+		name  string
+		text  string
+		terms []string
+		want  string
+	}{
+		{"match", "A dog in a park.", []string{"dog"}, "A <mark>dog</mark> in a park."},
+		{"stemmed", "Running dogs", []string{"run", "dog"}, "<mark>Running</mark> <mark>dogs</mark>"},
+		{"escaped", "<b>dog</b> & cat", []string{"dog"}, "&lt;b&gt;<mark>dog</mark>&lt;/b&gt; &amp; cat"},
+		{"no match", "A cat.", []string{"dog"}, "A cat."},
+		{"no words", "<!-- -->", []string{"dog"}, "&lt;!-- --&gt;"},
+		// The window starts where the first match comes into view and ends at the last word it holds.
+		{"middle", long, []string{"w40"}, "…" + strings.Join(words[17:40], " ") + " <mark>w40</mark>…"},
+		{"start", long, []string{"w0"}, "<mark>w0</mark> " + strings.Join(words[1:24], " ") + "…"},
+		{"end", long, []string{"w59"}, "…" + strings.Join(words[36:59], " ") + " <mark>w59</mark>"},
+		// The window covers the densest cluster of matches.
+		{"cluster", long, []string{"w5", "w50", "w52"}, "…" + strings.Join(words[29:50], " ") + " <mark>w50</mark> w51 <mark>w52</mark>…"},
+	}
+	for _, tt := range tests {
+		terms := map[string]bool{}
+		for _, term := range tt.terms {
+			terms[term] = true
+		}
+		if got := string(highlightSnippet(tt.text, terms)); got != tt.want {
+			t.Errorf("%s: highlightSnippet = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if got := string(highlightSnippet(strings.Repeat("!", 300), nil)); got != strings.Repeat("!", 200)+"…" {
+		t.Errorf("text without words is shown as %d bytes, want it cut to 200 characters", len(got))
+	}
+}
+
+func TestReindexAll(t *testing.T) {
+	db := newTestDB(t)
+	store := &boltStore{db: db}
+	if err := store.PutContent(Content{Hash: "indexed", Label: "Indexed dog"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutTag(Tag{Slug: "dog", Label: "Dog"}); err != nil {
+		t.Fatal(err)
+	}
+	// Content written straight to its bucket, as before the index existed, is not found until a reindex.
+	err := db.Update(func(tx *bolt.Tx) error {
+		buf, err := json.Marshal(Content{Hash: "raw", Label: "Raw dog"})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(contentBucket)).Put([]byte("raw"), buf)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := textResultKeys(t, db, "dog", 0); strings.Contains(got, "content:raw") {
+		t.Fatalf("found %q before reindexing", got)
+	}
+	stats := func() string {
+		var s string
+		db.View(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(fullTextStatsBucket))
+			s = fmt.Sprintf("%d docs of %d words", decodeUvarint(b.Get([]byte("docs"))), decodeUvarint(b.Get([]byte("length"))))
+			return nil
+		})
+		return s
+	}
+	for i := 0; i < 2; i++ {
+		if err := db.Update(reindexAll); err != nil {
+			t.Fatal(err)
+		}
+		if got := stats(); got != "3 docs of 5 words" {
+			t.Errorf("reindex %d: %s, want 3 docs of 5 words", i+1, got)
+		}
+		if got := textResultKeys(t, db, "dog", 0); got != "tag:dog content:indexed content:raw" {
+			t.Errorf("reindex %d: searchText(dog) = %q, want the tag and both content", i+1, got)
+		}
+	}
+}
@@ -1,13 +1,29 @@
 module github.com/SteveCastle/anansi
 
-go 1.14
+go 1.21
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/boltdb/bolt v1.3.1
-	github.com/chris-ramon/douceur v0.2.0 // indirect
-	github.com/gomarkdown/markdown v0.0.0-20210408062403-ad838ccf8cdd // indirect
-	github.com/google/uuid v1.2.0 // indirect
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/gomarkdown/markdown v0.0.0-20210408062403-ad838ccf8cdd
+	github.com/google/uuid v1.2.0
 	github.com/gorilla/mux v1.7.4
-	github.com/gosimple/slug v1.9.0 // indirect
-	github.com/microcosm-cc/bluemonday v1.0.8 // indirect
+	github.com/gosimple/slug v1.9.0
+	github.com/kljensen/snowball v0.6.0
+	github.com/mattn/go-sqlite3 v1.14.7
+	github.com/microcosm-cc/bluemonday v1.0.8
+	golang.org/x/crypto v0.21.0
+	golang.org/x/image v0.15.0
+	golang.org/x/net v0.21.0
+	golang.org/x/term v0.18.0
+	golang.org/x/text v0.14.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/aymerick/douceur v0.2.0 // indirect
+	github.com/gorilla/css v1.0.0 // indirect
+	github.com/rainycape/unidecode v0.0.0-20150907023854-cb7f23ec59be // indirect
+	golang.org/x/sys v0.18.0 // indirect
 )
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+// Tags form a hierarchy through Tag.Parents, eg. cat has the parent mammal, which has the parent animal.
+// A tag may have several parents, so the hierarchy is a directed acyclic graph rather than a strict tree.
+// The parents are stored on the tag itself, and the reverse direction is kept in TAG_CHILDREN,
+// which holds a nested bucket per parent slug whose keys are the slugs of its children.
+
+var errUnknownParent = errors.New("unknown parent tag")
+var errTagCycle = errors.New("tag hierarchy would contain a cycle")
+
+// isHierarchyError reports whether err was caused by invalid tag parents rather than a storage failure.
+func isHierarchyError(err error) bool {
+	return errors.Is(err, errUnknownParent) || errors.Is(err, errTagCycle)
+}
+
+// tagRelation selects which tags related to a tag are returned by tagRelatives.
+type tagRelation int
+
+const (
+	tagParents tagRelation = iota
+	tagChildren
+	tagAncestors
+	tagDescendants
+)
+
+// setTagParents validates the new parents of a tag and updates the children index to match.
+// Every parent must exist, and no parent may be the tag itself or one of its descendants.
+func setTagParents(tx *bolt.Tx, slug string, oldParents []string, newParents []string) error {
+	for _, parent := range newParents {
+		p, err := lookupTag(tx, parent)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			return fmt.Errorf("%w: %s", errUnknownParent, parent)
+		}
+		if parent == slug {
+			return fmt.Errorf("%w: %s can not be its own parent", errTagCycle, slug)
+		}
+		ancestors, err := tagRelatives(tx, parent, tagAncestors)
+		if err != nil {
+			return err
+		}
+		if containsString(ancestors, slug) {
+			return fmt.Errorf("%w: %s is already an ancestor of %s", errTagCycle, slug, parent)
+		}
+	}
+
+	children := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagChildrenBucket))
+	for _, parent := range oldParents {
+		if containsString(newParents, parent) {
+			continue
+		}
+		b := children.Bucket([]byte(parent))
+		if b == nil {
+			continue
+		}
+		if err := b.Delete([]byte(slug)); err != nil {
+			return fmt.Errorf("could not delete tag_children: %v", err)
+		}
+		if k, _ := b.Cursor().First(); k == nil {
+			if err := children.DeleteBucket([]byte(parent)); err != nil {
+				return fmt.Errorf("could not delete tag_children: %v", err)
+			}
+		}
+	}
+	for _, parent := range newParents {
+		b, err := children.CreateBucketIfNotExists([]byte(parent))
+		if err != nil {
+			return fmt.Errorf("could not insert tag_children: %v", err)
+		}
+		if err := b.Put([]byte(slug), []byte{}); err != nil {
+			return fmt.Errorf("could not insert tag_children: %v", err)
+		}
+	}
+	return nil
+}
+
+// checkTagParents validates the parents of a tag for stores without a children index, using the same rules
+// as setTagParents. lookup returns a tag by slug, or errTagNotFound.
+func checkTagParents(slug string, parents []string, lookup func(string) (*Tag, error)) error {
+	for _, parent := range parents {
+		if _, err := lookup(parent); errors.Is(err, errTagNotFound) {
+			return fmt.Errorf("%w: %s", errUnknownParent, parent)
+		} else if err != nil {
+			return err
+		}
+		if parent == slug {
+			return fmt.Errorf("%w: %s can not be its own parent", errTagCycle, slug)
+		}
+		seen := map[string]bool{}
+		queue := []string{parent}
+		for len(queue) > 0 {
+			s := queue[0]
+			queue = queue[1:]
+			if seen[s] {
+				continue
+			}
+			seen[s] = true
+			tag, err := lookup(s)
+			if errors.Is(err, errTagNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, p := range tag.Parents {
+				if p == slug {
+					return fmt.Errorf("%w: %s is already an ancestor of %s", errTagCycle, slug, parent)
+				}
+				queue = append(queue, p)
+			}
+		}
+	}
+	return nil
+}
+
+// detachTag removes a tag from the hierarchy before it is deleted.
+// Its children keep their other parents, and its own parents forget it as a child.
+func detachTag(tx *bolt.Tx, slug string) error {
+	tag, err := lookupTag(tx, slug)
+	if err != nil || tag == nil {
+		return err
+	}
+	children, err := tagRelatives(tx, slug, tagChildren)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		c, err := lookupTag(tx, child)
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			continue
+		}
+		c.Parents = removeString(c.Parents, slug)
+		if err := putTag(tx, *c, child); err != nil {
+			return err
+		}
+	}
+	return setTagParents(tx, slug, tag.Parents, nil)
+}
+
+// tagRelatives returns the slugs of the tags related to slug. Ancestors and descendants are
+// returned nearest first, and each tag appears once even if it is reachable along several paths.
+func tagRelatives(tx *bolt.Tx, slug string, relation tagRelation) ([]string, error) {
+	step := func(s string) ([]string, error) {
+		if relation == tagParents || relation == tagAncestors {
+			tag, err := lookupTag(tx, s)
+			if err != nil || tag == nil {
+				return nil, err
+			}
+			return tag.Parents, nil
+		}
+		keys := []string{}
+		b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagChildrenBucket)).Bucket([]byte(s))
+		if b == nil {
+			return keys, nil
+		}
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+		return keys, nil
+	}
+	if relation == tagParents || relation == tagChildren {
+		return step(slug)
+	}
+
+	results := []string{}
+	seen := map[string]bool{slug: true}
+	queue := []string{slug}
+	for len(queue) > 0 {
+		next, err := step(queue[0])
+		if err != nil {
+			return nil, err
+		}
+		queue = queue[1:]
+		for _, s := range next {
+			if seen[s] {
+				continue
+			}
+			seen[s] = true
+			results = append(results, s)
+			queue = append(queue, s)
+		}
+	}
+	return results, nil
+}
+
+// listTagRelatives returns a map of the tags related to slug indexed by their slug.
+func listTagRelatives(db *bolt.DB, slug string, relation tagRelation) (TagMap, error) {
+	results := TagMap{}
+	err := db.View(func(tx *bolt.Tx) error {
+		slugs, err := tagRelatives(tx, slug, relation)
+		if err != nil {
+			return err
+		}
+		for _, s := range slugs {
+			tag, err := lookupTag(tx, s)
+			if err != nil {
+				return err
+			}
+			if tag != nil {
+				results[s] = *tag
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// listTagRelativesHandler returns the ancestors or descendants of the tag in the URL as JSON.
+func listTagRelativesHandler(db *bolt.DB, relation tagRelation) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		slug := mux.Vars(r)["slug"]
+		if _, err := getTag(db, slug); err != nil {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusNotFound)
+			res.Write([]byte("404 Page Not Found"))
+			return
+		}
+		tags, err := listTagRelatives(db, slug, relation)
+		if err != nil {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusInternalServerError)
+			res.Write([]byte("Could not list tags."))
+			return
+		}
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		res.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(res).Encode(tags); err != nil {
+			panic(err)
+		}
+	}
+	return fn
+}
+
+// uniqueStrings returns list without empty or repeated entries, keeping the first occurrence.
+func uniqueStrings(list []string) []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, s := range list {
+		if s == "" || seen[s] {
+			continue
+		}
+		seen[s] = true
+		result = append(result, s)
+	}
+	return result
+}
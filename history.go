@@ -0,0 +1,461 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+// Every write of a content item or tag keeps a snapshot of the record. CONTENT_HISTORY and TAG_HISTORY
+// hold a nested bucket per hash or slug, with the revisions keyed by their number as 8 big-endian bytes.
+// Revisions are never changed or removed, not even when the record is deleted, so a deleted record
+// can be brought back by reverting to one of them.
+const contentHistoryBucket = "CONTENT_HISTORY"
+const tagHistoryBucket = "TAG_HISTORY"
+
+// Revision is a snapshot of a content item or tag as it was written. Author is who wrote it, which for
+// writes through the server is the account that created or modified the record.
+type Revision struct {
+	Number    int       `json:"number"`
+	Author    string    `json:"author,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	Content   *Content  `json:"content,omitempty"`
+	Tag       *Tag      `json:"tag,omitempty"`
+}
+
+// FieldChange is a field that differs between two revisions.
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// RevisionDiff lists the fields that changed from one revision to another.
+type RevisionDiff struct {
+	From    int           `json:"from"`
+	To      int           `json:"to"`
+	Changes []FieldChange `json:"changes"`
+}
+
+// historyKind selects the history of content or of tags.
+type historyKind struct {
+	bucket string
+	param  string // The URL variable holding the hash or slug.
+	name   string
+}
+
+var contentHistory = historyKind{contentHistoryBucket, "hash", "Content"}
+var tagHistory = historyKind{tagHistoryBucket, "slug", "Tag"}
+
+var errRevisionNotFound = errors.New("revision not found")
+var errBadRevisionRange = errors.New("invalid revision range")
+
+// HISTORY HANDLERS
+
+// listRevisionsHandler returns every revision of the record in the URL as JSON, oldest first.
+func listRevisionsHandler(db *bolt.DB, kind historyKind) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		revisions, err := listRevisions(db, kind, mux.Vars(r)[kind.param])
+		if err != nil {
+			writeHistoryError(res, err)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		res.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(res).Encode(revisions); err != nil {
+			panic(err)
+		}
+	}
+	return fn
+}
+
+// getRevisionHandler returns one revision of the record in the URL as JSON.
+func getRevisionHandler(db *bolt.DB, kind historyKind) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		revision, err := revisionFromURL(db, kind, r)
+		if err != nil {
+			writeHistoryError(res, err)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		res.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(res).Encode(revision); err != nil {
+			panic(err)
+		}
+	}
+	return fn
+}
+
+// diffRevisionsHandler returns the fields that changed between the revisions in the from and to parameters.
+// to defaults to the latest revision and from to the one before to.
+func diffRevisionsHandler(db *bolt.DB, kind historyKind) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		diff, err := diffFromURL(db, kind, r)
+		if err != nil {
+			writeHistoryError(res, err)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		res.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(res).Encode(diff); err != nil {
+			panic(err)
+		}
+	}
+	return fn
+}
+
+// revertRevisionHandler writes the revision in the URL back as the current record, which becomes a new revision.
+func revertRevisionHandler(db *bolt.DB, kind historyKind) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(mux.Vars(r)["number"])
+		if err != nil {
+			writeHistoryError(res, fmt.Errorf("%w: %s", errRevisionNotFound, mux.Vars(r)["number"]))
+			return
+		}
+		record, err := revertRevision(db, kind, mux.Vars(r)[kind.param], n, requestAuthor(r, ""))
+		if err != nil {
+			writeHistoryError(res, err)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		res.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(res).Encode(record); err != nil {
+			panic(err)
+		}
+	}
+	return fn
+}
+
+// writeHistoryError reports a failed history request as plain text.
+func writeHistoryError(res http.ResponseWriter, err error) {
+	res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	switch {
+	case errors.Is(err, errRevisionNotFound):
+		res.WriteHeader(http.StatusNotFound)
+		res.Write([]byte("Revision not found."))
+	case errors.Is(err, errBadRevisionRange):
+		res.WriteHeader(http.StatusBadRequest)
+		res.Write([]byte(err.Error()))
+	case isHierarchyError(err), errors.Is(err, errBadNamespace), errors.Is(err, errBadFields):
+		res.WriteHeader(422) // unprocessable entity
+		res.Write([]byte(err.Error()))
+	default:
+		res.WriteHeader(http.StatusInternalServerError)
+		res.Write([]byte("Error accessing the DB."))
+	}
+}
+
+// revisionFromURL reads the revision named by the hash or slug and number in the URL.
+func revisionFromURL(db *bolt.DB, kind historyKind, r *http.Request) (*Revision, error) {
+	n, err := strconv.Atoi(mux.Vars(r)["number"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errRevisionNotFound, mux.Vars(r)["number"])
+	}
+	return getRevision(db, kind, mux.Vars(r)[kind.param], n)
+}
+
+// diffFromURL compares the revisions named by the from and to parameters of the URL.
+func diffFromURL(db *bolt.DB, kind historyKind, r *http.Request) (*RevisionDiff, error) {
+	key := mux.Vars(r)[kind.param]
+	revisions, err := listRevisions(db, kind, key)
+	if err != nil {
+		return nil, err
+	}
+	number := func(param string, fallback int) (int, error) {
+		v := r.URL.Query().Get(param)
+		if v == "" {
+			return fallback, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s must be a revision number", errBadRevisionRange, param)
+		}
+		return n, nil
+	}
+	to, err := number("to", len(revisions))
+	if err != nil {
+		return nil, err
+	}
+	from, err := number("from", to-1)
+	if err != nil {
+		return nil, err
+	}
+	if from < 1 || from > len(revisions) {
+		return nil, fmt.Errorf("%w: %d", errRevisionNotFound, from)
+	}
+	if to < 1 || to > len(revisions) {
+		return nil, fmt.Errorf("%w: %d", errRevisionNotFound, to)
+	}
+	return diffRevisions(revisions[from-1], revisions[to-1])
+}
+
+// HISTORY API HANDLERS
+
+// apiListRevisionsHandler returns every revision of the record in the URL, oldest first.
+func apiListRevisionsHandler(store Store, kind historyKind) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		revisions, err := listRevisions(boltDB(store), kind, mux.Vars(r)[kind.param])
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIList(res, revisions, nil)
+	}
+	return fn
+}
+
+// apiGetRevisionHandler returns one revision of the record in the URL.
+func apiGetRevisionHandler(store Store, kind historyKind) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		revision, err := revisionFromURL(boltDB(store), kind, r)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, revision)
+	}
+	return fn
+}
+
+// apiDiffRevisionsHandler returns the fields that changed between the revisions in the from and to parameters.
+func apiDiffRevisionsHandler(store Store, kind historyKind) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		diff, err := diffFromURL(boltDB(store), kind, r)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, diff)
+	}
+	return fn
+}
+
+// apiRevertRevisionHandler writes the revision in the URL back as the current record.
+func apiRevertRevisionHandler(store Store, kind historyKind) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(mux.Vars(r)["number"])
+		if err != nil {
+			writeAPIStoreError(res, fmt.Errorf("%w: %s", errRevisionNotFound, mux.Vars(r)["number"]))
+			return
+		}
+		record, err := revertRevision(boltDB(store), kind, mux.Vars(r)[kind.param], n, requestAuthor(r, ""))
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, record)
+	}
+	return fn
+}
+
+// DATA STORE FUNCTIONS
+
+// revisionKey is the key of a revision number.
+func revisionKey(n int) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(n))
+	return k
+}
+
+// recordRevision appends a snapshot to the history of the record with the key, inside an existing transaction.
+// The revision is stamped with when, the time of the write.
+func recordRevision(tx *bolt.Tx, kind historyKind, key string, revision Revision, when time.Time) error {
+	root, err := tx.Bucket([]byte(topLevelBucket)).CreateBucketIfNotExists([]byte(kind.bucket))
+	if err != nil {
+		return err
+	}
+	history, err := root.CreateBucketIfNotExists([]byte(key))
+	if err != nil {
+		return fmt.Errorf("could not create history bucket: %v", err)
+	}
+	seq, err := history.NextSequence()
+	if err != nil {
+		return err
+	}
+	revision.Number, revision.CreatedAt = int(seq), when
+	buf, err := json.Marshal(revision)
+	if err != nil {
+		return err
+	}
+	return history.Put(revisionKey(revision.Number), buf)
+}
+
+// listRevisions returns the revisions of the record with the key, oldest first.
+func listRevisions(db *bolt.DB, kind historyKind, key string) ([]Revision, error) {
+	revisions := []Revision{}
+	err := db.View(func(tx *bolt.Tx) error {
+		history := historyBucket(tx, kind, key)
+		if history == nil {
+			return fmt.Errorf("%w: %s has no history", errRevisionNotFound, key)
+		}
+		return history.ForEach(func(k, v []byte) error {
+			revision := Revision{}
+			if err := json.Unmarshal(v, &revision); err != nil {
+				return err
+			}
+			revisions = append(revisions, revision)
+			return nil
+		})
+	})
+	return revisions, err
+}
+
+// getRevision reads one revision of the record with the key.
+func getRevision(db *bolt.DB, kind historyKind, key string, n int) (*Revision, error) {
+	var revision *Revision
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		revision, err = lookupRevision(tx, kind, key, n)
+		return err
+	})
+	return revision, err
+}
+
+// lookupRevision reads a revision inside an existing transaction.
+func lookupRevision(tx *bolt.Tx, kind historyKind, key string, n int) (*Revision, error) {
+	history := historyBucket(tx, kind, key)
+	if history == nil {
+		return nil, fmt.Errorf("%w: %s has no history", errRevisionNotFound, key)
+	}
+	v := history.Get(revisionKey(n))
+	if v == nil {
+		return nil, fmt.Errorf("%w: %d", errRevisionNotFound, n)
+	}
+	revision := &Revision{}
+	return revision, json.Unmarshal(v, revision)
+}
+
+// historyBucket returns the history of the record with the key, or nil if it has none.
+func historyBucket(tx *bolt.Tx, kind historyKind, key string) *bolt.Bucket {
+	root := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(kind.bucket))
+	if root == nil {
+		return nil
+	}
+	return root.Bucket([]byte(key))
+}
+
+// diffRevisions lists the fields of the snapshot that differ between two revisions, in field order.
+func diffRevisions(from Revision, to Revision) (*RevisionDiff, error) {
+	fields := func(revision Revision) (map[string]interface{}, error) {
+		var snapshot interface{} = revision.Content
+		if revision.Tag != nil {
+			snapshot = revision.Tag
+		}
+		buf, err := json.Marshal(snapshot)
+		if err != nil {
+			return nil, err
+		}
+		m := map[string]interface{}{}
+		return m, json.Unmarshal(buf, &m)
+	}
+	a, err := fields(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := fields(to)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for name := range a {
+		names = append(names, name)
+	}
+	for name := range b {
+		if _, ok := a[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	diff := &RevisionDiff{From: from.Number, To: to.Number, Changes: []FieldChange{}}
+	for _, name := range names {
+		if !reflect.DeepEqual(a[name], b[name]) {
+			diff.Changes = append(diff.Changes, FieldChange{Field: name, From: a[name], To: b[name]})
+		}
+	}
+	return diff, nil
+}
+
+// revertRevision writes revision n of the record with the key back as the current record, on behalf of author.
+// The record keeps its creation time if it still exists; a deleted record is brought back, without its tags.
+// The revert is itself recorded as a new revision. It returns the record as written.
+func revertRevision(db *bolt.DB, kind historyKind, key string, n int, author string) (interface{}, error) {
+	var record interface{}
+	err := db.Update(func(tx *bolt.Tx) error {
+		revision, err := lookupRevision(tx, kind, key, n)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		if kind == contentHistory {
+			content := *revision.Content
+			if current, err := lookupContent(tx, key); err != nil {
+				return err
+			} else if current != nil {
+				content.CreatedAt = current.CreatedAt
+			}
+			content.UpdatedAt = now
+			if author != "" {
+				content.Author = author
+			}
+			record = &content
+			return putContent(tx, content, key)
+		}
+		tag := *revision.Tag
+		if current, err := lookupTag(tx, key); err != nil {
+			return err
+		} else if current != nil {
+			tag.CreatedAt = current.CreatedAt
+		}
+		tag.UpdatedAt = now
+		if author != "" {
+			tag.Author = author
+		}
+		record = &tag
+		return putTag(tx, tag, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Reverted %s %s to revision %d \n", kind.name, key, n)
+	return record, nil
+}
+
+// settleUpdatedAt decides the UpdatedAt of a record being written over previous, and whether the write changes
+// anything worth a revision. sameAsBefore reports whether the record equals previous apart from UpdatedAt.
+// A write that changes nothing keeps the previous UpdatedAt. Otherwise the caller's UpdatedAt stands if it set
+// a new one, as an import does, and the record is stamped with now if it did not.
+func settleUpdatedAt(previous *time.Time, updatedAt time.Time, sameAsBefore bool, now time.Time) (time.Time, bool) {
+	if previous != nil && sameAsBefore {
+		return *previous, false
+	}
+	if updatedAt.IsZero() || previous != nil && updatedAt.Equal(*previous) {
+		return now, true
+	}
+	return updatedAt, true
+}
+
+// sameContent reports whether two content records are equal apart from UpdatedAt.
+func sameContent(a Content, b Content) bool {
+	a.UpdatedAt, b.UpdatedAt = time.Time{}, time.Time{}
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return string(x) == string(y)
+}
+
+// sameTag reports whether two tags are equal apart from UpdatedAt.
+func sameTag(a Tag, b Tag) bool {
+	a.UpdatedAt, b.UpdatedAt = time.Time{}, time.Time{}
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return string(x) == string(y)
+}
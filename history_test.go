@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRevisionsRecordChanges(t *testing.T) {
+	db := newTestDB(t)
+	store := &boltStore{db: db}
+	content := Content{Hash: "a", Label: "First", Author: "steve"}
+	for _, label := range []string{"First", "Second", "Second"} {
+		content.Label = label
+		if err := store.PutContent(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	revisions, err := listRevisions(db, contentHistory, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Writing the same record again changes nothing, so it is not a revision.
+	if len(revisions) != 2 {
+		t.Fatalf("%d revisions, want 2", len(revisions))
+	}
+	for i, label := range []string{"First", "Second"} {
+		if revisions[i].Number != i+1 || revisions[i].Content.Label != label || revisions[i].Author != "steve" {
+			t.Errorf("revision %d: %+v, want number %d labelled %s by steve", i+1, revisions[i], i+1, label)
+		}
+	}
+	if _, err := listRevisions(db, contentHistory, "missing"); !errors.Is(err, errRevisionNotFound) {
+		t.Errorf("history of missing content: %v, want %v", err, errRevisionNotFound)
+	}
+	if _, err := getRevision(db, contentHistory, "a", 3); !errors.Is(err, errRevisionNotFound) {
+		t.Errorf("revision 3: %v, want %v", err, errRevisionNotFound)
+	}
+}
+
+func TestDiffRevisions(t *testing.T) {
+	db := newTestDB(t)
+	store := &boltStore{db: db}
+	tag := Tag{Slug: "red", Label: "Red"}
+	for _, change := range []func(){
+		func() {},
+		func() { tag.Label = "Crimson" },
+		func() { tag.Definition = "A deep red." },
+	} {
+		change()
+		if err := store.PutTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/tags/{slug}/revisions/diff", diffRevisionsHandler(db, tagHistory)).Methods("GET")
+
+	tests := []struct {
+		query string
+		code  int
+		want  string
+	}{
+		// The latest revision against the one before it.
+		{"", http.StatusOK, `2-3 [body: null -> "A deep red."]`},
+		{"?to=2", http.StatusOK, `1-2 [title: "Red" -> "Crimson"]`},
+		{"?from=1", http.StatusOK, `1-3 [body: null -> "A deep red." title: "Red" -> "Crimson"]`},
+		{"?from=3&to=1", http.StatusOK, `3-1 [body: "A deep red." -> null title: "Crimson" -> "Red"]`},
+		{"?from=2&to=2", http.StatusOK, `2-2 []`},
+		{"?from=two", http.StatusBadRequest, ""},
+		{"?to=4", http.StatusNotFound, ""},
+		{"?to=1", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		res := request(r, "GET", "/tags/red/revisions/diff"+tt.query, "", "")
+		if res.Code != tt.code {
+			t.Errorf("diff%s: status %d %s, want %d", tt.query, res.Code, res.Body, tt.code)
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		diff := RevisionDiff{}
+		if err := json.NewDecoder(res.Body).Decode(&diff); err != nil {
+			t.Fatal(err)
+		}
+		if got := describeDiff(diff); got != tt.want {
+			t.Errorf("diff%s = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
+
+// describeDiff writes a diff as its revision numbers and the changed fields, leaving out the update times.
+func describeDiff(diff RevisionDiff) string {
+	changes := []string{}
+	for _, change := range diff.Changes {
+		if change.Field == "updatedAt" {
+			continue
+		}
+		from, _ := json.Marshal(change.From)
+		to, _ := json.Marshal(change.To)
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", change.Field, from, to))
+	}
+	return fmt.Sprintf("%d-%d [%s]", diff.From, diff.To, strings.Join(changes, " "))
+}
+
+func TestRevertRevision(t *testing.T) {
+	db := newTestDB(t)
+	store := &boltStore{db: db}
+	created := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	if err := store.PutContent(Content{Hash: "a", Label: "First", Author: "steve", CreatedAt: created}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutContent(Content{Hash: "a", Label: "Second", Author: "steve", CreatedAt: created}); err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := revertRevision(db, contentHistory, "a", 1, "ada")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := store.GetContent("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content.Label != "First" || content.Author != "ada" || !content.CreatedAt.Equal(created) {
+		t.Errorf("reverted content %+v, want First by ada created %v", content, created)
+	}
+	if record.(*Content).Label != content.Label {
+		t.Errorf("revert returned %+v, want the content as written", record)
+	}
+	revisions, err := listRevisions(db, contentHistory, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 3 || revisions[2].Content.Label != "First" || revisions[2].Author != "ada" {
+		t.Errorf("revisions after reverting %+v, want a third one by ada", revisions)
+	}
+
+	// A deleted record comes back from its history, without its tags.
+	if err := store.PutTag(Tag{Slug: "red", Label: "Red"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ApplyTag("a", "red"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteContent("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := revertRevision(db, contentHistory, "a", 2, ""); err != nil {
+		t.Fatal(err)
+	}
+	content, err = store.GetContent("a")
+	if err != nil {
+		t.Fatalf("deleted content was not brought back: %v", err)
+	}
+	if content.Label != "Second" || content.Author != "steve" {
+		t.Errorf("restored content %+v, want Second by steve", content)
+	}
+	if _, err := store.GetEdge("red", "a"); err == nil {
+		t.Error("restored content has its old tag")
+	}
+
+	if _, err := revertRevision(db, contentHistory, "a", 9, ""); !errors.Is(err, errRevisionNotFound) {
+		t.Errorf("revert to revision 9: %v, want %v", err, errRevisionNotFound)
+	}
+	if _, err := revertRevision(db, tagHistory, "missing", 1, ""); !errors.Is(err, errRevisionNotFound) {
+		t.Errorf("revert of a tag without history: %v, want %v", err, errRevisionNotFound)
+	}
+}
+
+func TestRevertRevisionHandler(t *testing.T) {
+	db := newTestDB(t)
+	store := &boltStore{db: db}
+	for _, label := range []string{"Red", "Crimson"} {
+		if err := store.PutTag(Tag{Slug: "red", Label: label}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/tags/{slug}/revisions/{number:[0-9]+}/revert", revertRevisionHandler(db, tagHistory)).Methods("POST")
+	r.HandleFunc("/api/v1/tags/{slug}/revisions/{number:[0-9]+}/revert", apiRevertRevisionHandler(store, tagHistory)).Methods("POST")
+
+	if res := request(r, "POST", "/tags/red/revisions/1/revert", "", ""); res.Code != http.StatusOK {
+		t.Fatalf("revert: status %d %s, want 200", res.Code, res.Body)
+	}
+	tag, err := store.GetTag("red")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Label != "Red" {
+		t.Errorf("reverted tag labelled %q, want Red", tag.Label)
+	}
+	for _, target := range []string{"/tags/red/revisions/7/revert", "/api/v1/tags/red/revisions/7/revert", "/tags/blue/revisions/1/revert"} {
+		if res := request(r, "POST", target, "", ""); res.Code != http.StatusNotFound {
+			t.Errorf("POST %s: status %d, want 404", target, res.Code)
+		}
+	}
+}
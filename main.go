@@ -3,6 +3,8 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
@@ -11,6 +13,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -26,11 +30,13 @@ const contentBucket = "CONTENT"
 const tagBucket = "TAGS"
 const edgeByContentBucket = "EDGE_BY_CONTENT"
 const edgeByTagBucket = "EDGE_BY_TAG"
+const pathBucket = "PATHS"
+const tagChildrenBucket = "TAG_CHILDREN"
 
 // SiteMetaData is general information about the Site
 type SiteMetaData struct {
-	Title       string
-	Description string
+	Title       string `toml:"title" yaml:"title" json:"title"`
+	Description string `toml:"description" yaml:"description" json:"description"`
 }
 
 // Content is the data required to represent a Blog Content Object.
@@ -38,9 +44,15 @@ type Content struct {
 	Author     string    `json:"author,omitempty"`
 	Definition string    `json:"body,omitempty"`
 	CreatedAt  time.Time `json:"createdAt,omitempty"`
+	UpdatedAt  time.Time `json:"updatedAt,omitempty"`
 	Label      string    `json:"title,omitempty"`
 	Paths      []string
-	Hash       string `json:"slug,omitempty"` // MD5 of File
+	Hash       string                 `json:"slug,omitempty"`    // MD5 of File
+	Missing    bool                   `json:"missing,omitempty"` // Every known path for the file is gone.
+	URL        string                 `json:"url,omitempty"`     // Set for remote content, which is keyed by the MD5 of the URL.
+	Remote     *RemoteMeta            `json:"remote,omitempty"`  // What was found at URL when it was last fetched.
+	Type       string                 `json:"type,omitempty"`    // The content type whose schema Fields follow.
+	Fields     map[string]interface{} `json:"fields,omitempty"`  // Typed values of the fields of Type, by name.
 }
 
 // ContentMap is a map of contents with the slug as the key.
@@ -51,12 +63,22 @@ type Tag struct {
 	Author     string    `json:"author,omitempty"`
 	Definition string    `json:"body,omitempty"`
 	CreatedAt  time.Time `json:"createdAt,omitempty"`
+	UpdatedAt  time.Time `json:"updatedAt,omitempty"`
 	Label      string    `json:"title,omitempty"`
 	Slug       string    `json:"slug,omitempty"`
+	Namespace  string    `json:"namespace,omitempty"` // The namespace the tag is in, eg. artist for artist:monet.
+	Parents    []string  `json:"parents,omitempty"`   // Slugs of the broader tags this one implies.
 }
 
 type TagMap map[string]Tag
 
+// Edge records that a tag has been applied to a content item.
+type Edge struct {
+	Tag       string    `json:"tag"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"createdAt,omitempty"`
+}
+
 // Test Data
 
 var siteMetaData = SiteMetaData{
@@ -69,16 +91,31 @@ var siteMetaData = SiteMetaData{
 type HomePageData struct {
 	SiteMetaData SiteMetaData
 	Content      ContentMap
+	Accounts     bool           // Whether the server has user accounts, which it does when backed by bolt.
+	User         string         // The logged in user, if any.
+	Counts       *LibraryCounts // How many records of each kind there are, when backed by bolt.
+}
+
+// LibraryCounts is the number of content items, tags and collections in the library.
+type LibraryCounts struct {
+	Content     int
+	Tags        int
+	Collections int
 }
 
+// ContentListData is one page of the content list, in display order.
 type ContentListData struct {
 	SiteMetaData SiteMetaData
-	Content      ContentMap
+	Content      []Content
+	Page         PageInfo
 }
 
+// TagListData is one page of the tag list, in display order. Groups holds the same tags grouped by namespace.
 type TagListData struct {
 	SiteMetaData SiteMetaData
-	Tags         TagMap
+	Tags         []Tag
+	Groups       []TagGroup
+	Page         PageInfo
 }
 
 // ContentPageData is the data required to render the HTML template for the content page.
@@ -87,30 +124,88 @@ type ContentPageData struct {
 	SiteMetaData SiteMetaData
 	Content      Content
 	HTML         template.HTML
+	Tags         []Tag
 }
 
 type TagPageData struct {
 	SiteMetaData SiteMetaData
 	Tag          Tag
 	HTML         template.HTML
+	Content      []Content
+	Parents      []Tag
+	Children     []Tag
+	Aliases      []Alias
 }
 
 func main() {
+	flags := flag.NewFlagSet("anansi", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), cliUsage)
+		fmt.Fprintln(flags.Output(), "\nSettings, given before the command:")
+		flags.PrintDefaults()
+	}
+	settings := addConfigFlags(flags)
+	flags.Parse(os.Args[1:])
+	cfg, err := settings.load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	cmd, args := "serve", []string{}
+	if flags.NArg() > 0 {
+		cmd, args = flags.Arg(0), flags.Args()[1:]
+	}
+	if err := runCommand(cfg, cmd, args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
 
-	db, err := setupDB()
-	defer db.Close()
-
+// runServeCommand implements "anansi serve [-no-auth]", which is also what anansi does when run without a command.
+// Only the bolt store keeps user accounts, so the other stores are only served with -no-auth, which
+// lets anyone who can reach the server do anything.
+func runServeCommand(cfg Config, store Store, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	noAuth := flags.Bool("no-auth", false, "serve without accounts or roles, so anyone who can reach the server can change anything")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("usage: anansi [settings] serve [-no-auth]")
+	}
+	if err := cfg.validateTemplates(); err != nil {
+		return err
+	}
+	siteMetaData = cfg.Site
+	db := boltDB(store)
+	if db == nil && !*noAuth {
+		return fmt.Errorf("the %s store has no user accounts, so anyone who can reach %s could change or delete anything; use the bolt store, or serve -no-auth if that is what you want", cfg.Store, cfg.Listen)
+	}
+	roles := cfg.Roles
+	if *noAuth {
+		log.Printf("Serving without accounts or roles; anyone who can reach %s can make changes.", cfg.Listen)
+		roles = nil
+	} else if users, err := listUsers(db); err == nil && len(users) == 0 {
+		log.Println("No user accounts yet, so nothing can be changed through the server. Add one with: anansi user add <name>")
+	}
+	r, err := newRouter(store, cfg.Templates, cfg.Thumbnails, roles, append(append([]string{}, cfg.Watch...), cfg.ScanRoots...))
 	if err != nil {
-		log.Println(err)
+		return err
 	}
 
-	r := newRouter(db)
+	// Keep content paths up to date for the watched directories.
+	var watcher *Watcher
+	if len(cfg.Watch) > 0 && db != nil {
+		if watcher, err = startWatcher(db, cfg.Watch); err != nil {
+			log.Println(err)
+		}
+	}
 	// Create http server and run inside go routine for graceful shutdown.
 	srv := &http.Server{
 		Handler:      r,
-		Addr:         "0.0.0.0:8000",
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+		Addr:         cfg.Listen,
+		WriteTimeout: cfg.WriteTimeout.Duration,
+		ReadTimeout:  cfg.ReadTimeout.Duration,
 	}
 	log.Println("Starting up..")
 
@@ -133,26 +228,56 @@ func main() {
 	defer cancel()
 
 	srv.Shutdown(ctx)
+	if watcher != nil {
+		watcher.Close()
+	}
 	log.Println("Shutting down..")
-	os.Exit(0)
+	return nil
 }
 
 // homeHandler returns the list of blog contents rendered in an HTML template.
-func homeHandler(db *bolt.DB, t *template.Template) http.HandlerFunc {
+func homeHandler(store Store, t *template.Template) http.HandlerFunc {
 	fn := func(res http.ResponseWriter, r *http.Request) {
 		log.Println("Requested the home page.")
+		data := HomePageData{SiteMetaData: siteMetaData, Accounts: boltDB(store) != nil}
+		if identity := requestIdentity(r); identity != nil {
+			data.User = identity.Username
+		}
+		if db := boltDB(store); db != nil {
+			counts, err := countLibrary(db)
+			if err != nil {
+				res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+				res.WriteHeader(http.StatusInternalServerError)
+				res.Write([]byte("Could not count the library."))
+				return
+			}
+			data.Counts = counts
+		}
 		res.Header().Set("Content-Type", "text/html; charset=UTF-8")
 		res.WriteHeader(http.StatusOK)
-		t.Execute(res, HomePageData{SiteMetaData: siteMetaData})
+		t.Execute(res, data)
 	}
 
 	return fn
 }
 
 // homeHandler returns the list of blog contents rendered in an HTML template.
-func contentListHandler(db *bolt.DB, t *template.Template) http.HandlerFunc {
+func contentListHandler(store Store, t *template.Template) http.HandlerFunc {
 	fn := func(res http.ResponseWriter, r *http.Request) {
-		contentData, err := listContent(db)
+		opts, err := parseListOptions(r)
+		if err != nil {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusBadRequest)
+			res.Write([]byte(err.Error()))
+			return
+		}
+		contentData, page, err := store.ListContent(opts)
+		if errors.Is(err, errBadListOptions) {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusBadRequest)
+			res.Write([]byte(err.Error()))
+			return
+		}
 		if err != nil {
 			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
 			res.WriteHeader(http.StatusInternalServerError)
@@ -160,16 +285,20 @@ func contentListHandler(db *bolt.DB, t *template.Template) http.HandlerFunc {
 			return
 		}
 		log.Println("Requested the content list page.")
+		if wantsJSON(r) {
+			writeAPIList(res, contentData, &page)
+			return
+		}
 		res.Header().Set("Content-Type", "text/html; charset=UTF-8")
 		res.WriteHeader(http.StatusOK)
-		t.Execute(res, HomePageData{SiteMetaData: siteMetaData, Content: contentData})
+		t.Execute(res, ContentListData{SiteMetaData: siteMetaData, Content: contentData, Page: page})
 	}
 
 	return fn
 }
 
 // createContentPageHandler serves the UI for creating a content. It is a form that submits to the create content REST endpoint.
-func createContentPageHandler(db *bolt.DB, t *template.Template) http.HandlerFunc {
+func createContentPageHandler(store Store, t *template.Template) http.HandlerFunc {
 	fn := func(res http.ResponseWriter, r *http.Request) {
 		log.Println("Requested the create content page.")
 		res.Header().Set("Content-Type", "text/html; charset=UTF-8")
@@ -181,34 +310,45 @@ func createContentPageHandler(db *bolt.DB, t *template.Template) http.HandlerFun
 }
 
 // contentHandler looks up a specific blog content and returns it as an HTML template.
-func getContentHandler(db *bolt.DB, t *template.Template) http.HandlerFunc {
+func getContentHandler(store Store, t *template.Template) http.HandlerFunc {
 
 	fn := func(res http.ResponseWriter, r *http.Request) {
 		// Get the URL param named slug from the response.
 		hash := mux.Vars(r)["hash"]
-		content, err := getContent(db, hash)
+		if wantsJSON(r) {
+			apiGetContentHandler(store)(res, r)
+			return
+		}
+		content, err := store.GetContent(hash)
 		if err != nil {
 			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
 			res.WriteHeader(http.StatusNotFound)
 			res.Write([]byte("404 Page Not Found"))
 			return
 		}
+		tags, err := store.TagsForContent(hash)
+		if err != nil {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusInternalServerError)
+			res.Write([]byte("Could not list tags."))
+			return
+		}
 		log.Printf("Requested: %s by %s \n", content.Label, content.Author)
 		unsafeContentHTML := markdown.ToHTML([]byte(content.Definition), nil, nil)
 		contentHTML := bluemonday.UGCPolicy().SanitizeBytes(unsafeContentHTML)
 		res.Header().Set("Content-Type", "text/html; charset=UTF-8")
 		res.WriteHeader(http.StatusOK)
-		t.Execute(res, ContentPageData{SiteMetaData: siteMetaData, Content: *content, HTML: template.HTML(contentHTML)})
+		t.Execute(res, ContentPageData{SiteMetaData: siteMetaData, Content: *content, HTML: template.HTML(contentHTML), Tags: tags})
 	}
 	return fn
 }
 
 // editContentPageHandler serves the UI for creating a content. It is a form that submits to the create content REST endpoint.
-func editContentPageHandler(db *bolt.DB, t *template.Template) http.HandlerFunc {
+func editContentPageHandler(store Store, t *template.Template) http.HandlerFunc {
 	fn := func(res http.ResponseWriter, r *http.Request) {
 		// Get the URL param named slug from the response.
 		slug := mux.Vars(r)["hash"]
-		content, err := getContent(db, slug)
+		content, err := store.GetContent(slug)
 		if err != nil {
 			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
 			res.WriteHeader(http.StatusNotFound)
@@ -227,7 +367,7 @@ func editContentPageHandler(db *bolt.DB, t *template.Template) http.HandlerFunc
 // createContentHandler handles contented JSON data representing a new content, and stores it in the database.
 // It creates a slug to use as a key using the title of the content.
 // This implies in the current state of affairs that titles must be unique or the keys will overwrite each other.
-func createContentHandler(db *bolt.DB) http.HandlerFunc {
+func createContentHandler(store Store) http.HandlerFunc {
 	fn := func(res http.ResponseWriter, r *http.Request) {
 		var content Content
 		res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
@@ -249,16 +389,15 @@ func createContentHandler(db *bolt.DB) http.HandlerFunc {
 			if err := json.NewEncoder(res).Encode(err); err != nil {
 				panic(err)
 			}
+			return
 		}
 
-		// Set the creation time stamp to the current server time.
-		content.CreatedAt = time.Now()
-
-		// Create a URL safe slug from the timestamp and the title.
-		ID := uuid.New().String()
-		content.Hash = ID
-
-		if err = upsertContent(db, content, ID); err != nil {
+		content.Author = requestAuthor(r, content.Author)
+		if content, err = createContent(store, content); errors.Is(err, errBadFields) {
+			res.WriteHeader(422) // unprocessable entity
+			res.Write([]byte(err.Error()))
+			return
+		} else if err != nil {
 			res.WriteHeader(http.StatusInternalServerError)
 			res.Write([]byte("Error writing to DB."))
 			return
@@ -278,7 +417,7 @@ func createContentHandler(db *bolt.DB) http.HandlerFunc {
 // It writes the new content object to the URL slug value unlike the createContentHandler
 // which generates a new slug using the content date and time. Notice this means you can not change the URI.
 // This is left as homework for the reader.
-func modifyContentHandler(db *bolt.DB) http.HandlerFunc {
+func modifyContentHandler(store Store) http.HandlerFunc {
 	fn := func(res http.ResponseWriter, r *http.Request) {
 		var content Content
 		hash := mux.Vars(r)["hash"]
@@ -295,12 +434,17 @@ func modifyContentHandler(db *bolt.DB) http.HandlerFunc {
 			if err := json.NewEncoder(res).Encode(err); err != nil {
 				panic(err)
 			}
+			return
 		}
-		content.Hash = hash
-		content.CreatedAt = time.Now()
-		// Call the upsertContent function passing in the database, a content struct, and the slug.
+		// Call the modifyContent function passing in the database, the slug, and a content struct.
 		// If there is an error writing to the database write an error to the response and return.
-		if err = upsertContent(db, content, hash); err != nil {
+		content.Author = requestAuthor(r, content.Author)
+		if content, err = modifyContent(store, hash, content); errors.Is(err, errBadFields) {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(422) // unprocessable entity
+			res.Write([]byte(err.Error()))
+			return
+		} else if err != nil {
 			res.WriteHeader(http.StatusInternalServerError)
 			res.Write([]byte("Error writing to DB."))
 			return
@@ -314,11 +458,11 @@ func modifyContentHandler(db *bolt.DB) http.HandlerFunc {
 }
 
 // deleteContentHandler deletes the content with the key matching the slug in the URL.
-func deleteContentHandler(db *bolt.DB) http.HandlerFunc {
+func deleteContentHandler(store Store) http.HandlerFunc {
 	fn := func(res http.ResponseWriter, r *http.Request) {
 		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		slug := mux.Vars(r)["slug"]
-		if err := deleteContent(db, slug); err != nil {
+		hash := mux.Vars(r)["hash"]
+		if err := store.DeleteContent(hash); err != nil {
 			panic(err)
 		}
 		res.WriteHeader(http.StatusOK)
@@ -335,49 +479,166 @@ func deleteContentHandler(db *bolt.DB) http.HandlerFunc {
 
 // DATA STORE FUNCTIONS
 
+// countLibrary counts the content, tags and collections.
+func countLibrary(db *bolt.DB) (*LibraryCounts, error) {
+	counts := &LibraryCounts{}
+	err := db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(topLevelBucket))
+		counts.Content = root.Bucket([]byte(contentBucket)).Stats().KeyN
+		counts.Tags = root.Bucket([]byte(tagBucket)).Stats().KeyN
+		counts.Collections = root.Bucket([]byte(collectionBucket)).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
 // upsertContent writes a content to the boltDB KV store using the slug as a key, and a serialized content struct as the value.
 // If the slug already exists the existing content will be overwritten.
 func upsertContent(db *bolt.DB, content Content, slug string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return putContent(tx, content, slug)
+	})
+}
+
+// createContent stores new content under a generated key, stamped with the current server time.
+func createContent(store Store, content Content) (Content, error) {
+	content.CreatedAt = time.Now()
+	content.UpdatedAt = content.CreatedAt
+	content.Hash = uuid.New().String()
+	if err := store.PutContent(content); err != nil {
+		return content, err
+	}
+	// Writing settles the fields against the content type, eg. dropping those set to null, so return what was stored.
+	stored, err := store.GetContent(content.Hash)
+	if err != nil {
+		return content, err
+	}
+	return *stored, nil
+}
+
+// modifyContent replaces the content stored under hash with the edited fields of content.
+// It keeps the time the content was created and stamps the time of the change.
+func modifyContent(store Store, hash string, content Content) (Content, error) {
+	content.Hash = hash
+	content.CreatedAt = time.Now()
+	content.UpdatedAt = content.CreatedAt
+	// Paths and remote metadata are maintained by Anansi rather than edited, so keep what is stored.
+	// Remote content is keyed by the hash of its URL, so its URL can not change either.
+	if existing, err := store.GetContent(hash); err == nil {
+		content.CreatedAt = existing.CreatedAt
+		content.Paths, content.Missing, content.Remote = existing.Paths, existing.Missing, existing.Remote
+		if content.URL == "" || existing.Remote != nil {
+			content.URL = existing.URL
+		}
+	}
+	if err := store.PutContent(content); err != nil {
+		return content, err
+	}
+	// A change that leaves the content as it was keeps its UpdatedAt, so return what was stored.
+	stored, err := store.GetContent(hash)
+	if err != nil {
+		return content, err
+	}
+	return *stored, nil
+}
+
+// putContent writes a content and its index entries inside an existing transaction.
+// A write that changes the content is kept as a revision in its history. Fields are checked against the
+// content type when they or the type change, so rewriting content whose type has since changed keeps it.
+func putContent(tx *bolt.Tx, content Content, slug string) error {
+	previous, err := lookupContent(tx, slug)
+	if err != nil {
+		return err
+	}
+	if previous == nil || !sameFields(previous, &content) {
+		if err := settleContentFields(tx, &content); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	var changed bool
+	if previous != nil {
+		content.UpdatedAt, changed = settleUpdatedAt(&previous.UpdatedAt, content.UpdatedAt, sameContent(*previous, content), now)
+	} else {
+		content.UpdatedAt, changed = settleUpdatedAt(nil, content.UpdatedAt, false, now)
+	}
 	// Marshl content struct into bytes which can be written to Bolt.
 	buf, err := json.Marshal(content)
 	if err != nil {
 		return err
 	}
+	err = tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(contentBucket)).Put([]byte(slug), buf)
+	if err != nil {
+		return fmt.Errorf("could not insert content: %v", err)
+	}
+	var oldPaths []string
+	if previous != nil {
+		oldPaths = previous.Paths
+	}
+	if err := indexPaths(tx, slug, oldPaths, content.Paths); err != nil {
+		return err
+	}
+	if err := reindexSortKeys(tx, contentSortIndexes, slug, contentSortKeys(previous), contentSortKeys(&content)); err != nil {
+		return err
+	}
+	if err := indexFields(tx, slug, previous, &content); err != nil {
+		return err
+	}
+	if changed {
+		if err := recordRevision(tx, contentHistory, slug, Revision{Author: content.Author, Content: &content}, now); err != nil {
+			return err
+		}
+	}
+	return indexDocument(tx, docID(contentDocKind, slug), content.Label, content.Definition)
+}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		err := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(contentBucket)).Put([]byte(slug), []byte(buf))
-		if err != nil {
-			return fmt.Errorf("could not insert content: %v", err)
+// indexPaths updates the PATHS bucket, which maps each known file path to the hash of the content found there.
+func indexPaths(tx *bolt.Tx, slug string, oldPaths []string, newPaths []string) error {
+	b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(pathBucket))
+	for _, path := range oldPaths {
+		if containsString(newPaths, path) || string(b.Get([]byte(path))) != slug {
+			continue
 		}
-		return nil
-	})
-	return err
+		if err := b.Delete([]byte(path)); err != nil {
+			return fmt.Errorf("could not delete path: %v", err)
+		}
+	}
+	for _, path := range newPaths {
+		if err := b.Put([]byte(path), []byte(slug)); err != nil {
+			return fmt.Errorf("could not insert path: %v", err)
+		}
+	}
+	return nil
 }
 
-// listContent returns a map of contents indexed by the slug.
-// TODO: We could we add pagination to this!
-func listContent(db *bolt.DB) (ContentMap, error) {
-	results := ContentMap{}
+// listContent returns one page of content in the order selected by opts.
+func listContent(db *bolt.DB, opts ListOptions) ([]Content, PageInfo, error) {
+	results := []Content{}
+	var info PageInfo
 	err := db.View(func(tx *bolt.Tx) error {
-		// Assume bucket exists and has keys
-		b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(contentBucket))
-
-		c := b.Cursor()
-
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			content := Content{}
-			if err := json.Unmarshal(v, &content); err != nil {
-				panic(err)
+		slugs, page, err := pageIndex(boltIndexWalker(tx, contentSortIndexes[opts.Sort]), opts)
+		if err != nil {
+			return err
+		}
+		info = page
+		for _, slug := range slugs {
+			content, err := lookupContent(tx, slug)
+			if err != nil {
+				return err
+			}
+			if content != nil {
+				results = append(results, *content)
 			}
-			results[string(k)] = content
 		}
-
 		return nil
 	})
 	if err != nil {
-		return nil, err
+		return nil, info, err
 	}
-	return results, nil
+	return results, info, nil
 }
 
 // getContent gets a specific content from the database by the slug.
@@ -398,23 +659,75 @@ func getContent(db *bolt.DB, slug string) (*Content, error) {
 	return &result, nil
 }
 
-// deleteContent deletes a specific content by slug.
+// lookupContent reads a content inside an existing transaction. It returns nil if there is no content with the hash.
+func lookupContent(tx *bolt.Tx, hash string) (*Content, error) {
+	v := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(contentBucket)).Get([]byte(hash))
+	if v == nil {
+		return nil, nil
+	}
+	content := Content{}
+	if err := json.Unmarshal(v, &content); err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
+
+// deleteContent deletes a specific content by slug along with every edge pointing at it.
 func deleteContent(db *bolt.DB, slug string) error {
 	err := db.Update(func(tx *bolt.Tx) error {
-		err := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(contentBucket)).Delete([]byte(slug))
-		if err != nil {
-			return fmt.Errorf("could not delete content: %v", err)
-		}
-		return nil
+		return removeContent(tx, slug)
 	})
 	return err
 }
 
+// removeContent deletes a content record, its indexes, its edges and its place in collections inside an existing transaction.
+func removeContent(tx *bolt.Tx, slug string) error {
+	content, err := lookupContent(tx, slug)
+	if err != nil {
+		return err
+	}
+	if content != nil {
+		if err := indexPaths(tx, slug, content.Paths, nil); err != nil {
+			return err
+		}
+		if err := reindexSortKeys(tx, contentSortIndexes, slug, contentSortKeys(content), nil); err != nil {
+			return err
+		}
+		if err := indexFields(tx, slug, content, nil); err != nil {
+			return err
+		}
+	}
+	err = tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(contentBucket)).Delete([]byte(slug))
+	if err != nil {
+		return fmt.Errorf("could not delete content: %v", err)
+	}
+	if err := unindexDocument(tx, docID(contentDocKind, slug)); err != nil {
+		return err
+	}
+	if err := removeFromCollections(tx, slug); err != nil {
+		return err
+	}
+	return removeAllEdges(tx, edgeByContentBucket, slug)
+}
+
 // TAG HANDLERS
 // tagListHandler returns the list of blog tags rendered in an HTML template.
-func tagListHandler(db *bolt.DB, t *template.Template) http.HandlerFunc {
+func tagListHandler(store Store, t *template.Template) http.HandlerFunc {
 	fn := func(res http.ResponseWriter, r *http.Request) {
-		tagData, err := listTag(db)
+		opts, err := parseListOptions(r)
+		if err != nil {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusBadRequest)
+			res.Write([]byte(err.Error()))
+			return
+		}
+		tagData, page, err := store.ListTags(opts)
+		if errors.Is(err, errBadListOptions) {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusBadRequest)
+			res.Write([]byte(err.Error()))
+			return
+		}
 		if err != nil {
 			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
 			res.WriteHeader(http.StatusInternalServerError)
@@ -422,16 +735,29 @@ func tagListHandler(db *bolt.DB, t *template.Template) http.HandlerFunc {
 			return
 		}
 		log.Println("Requested the tag list page.")
+		if wantsJSON(r) {
+			writeAPIList(res, tagData, &page)
+			return
+		}
+		namespaces := []Namespace{}
+		if db := boltDB(store); db != nil {
+			if namespaces, err = listNamespaces(db); err != nil {
+				res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+				res.WriteHeader(http.StatusInternalServerError)
+				res.Write([]byte("Could not list namespaces."))
+				return
+			}
+		}
 		res.Header().Set("Content-Type", "text/html; charset=UTF-8")
 		res.WriteHeader(http.StatusOK)
-		t.Execute(res, TagListData{SiteMetaData: siteMetaData, Tags: tagData})
+		t.Execute(res, TagListData{SiteMetaData: siteMetaData, Tags: tagData, Groups: groupTags(tagData, namespaces), Page: page})
 	}
 
 	return fn
 }
 
 // createTagPageHandler serves the UI for creating a tag. It is a form that submits to the create tag REST endpoint.
-func createTagPageHandler(db *bolt.DB, t *template.Template) http.HandlerFunc {
+func createTagPageHandler(store Store, t *template.Template) http.HandlerFunc {
 	fn := func(res http.ResponseWriter, r *http.Request) {
 		log.Println("Requested the create tag page.")
 		res.Header().Set("Content-Type", "text/html; charset=UTF-8")
@@ -443,35 +769,76 @@ func createTagPageHandler(db *bolt.DB, t *template.Template) http.HandlerFunc {
 }
 
 // tagHandler looks up a specific blog tag and returns it as an HTML template.
-func getTagHandler(db *bolt.DB, t *template.Template) http.HandlerFunc {
+func getTagHandler(store Store, t *template.Template) http.HandlerFunc {
 
 	fn := func(res http.ResponseWriter, r *http.Request) {
 		// Get the URL param named slug from the response.
 		slug := mux.Vars(r)["slug"]
-		tag, err := getTag(db, slug)
+		if wantsJSON(r) {
+			apiGetTagHandler(store)(res, r)
+			return
+		}
+		tag, err := store.GetTag(slug)
 		if err != nil {
+			if redirectAlias(boltDB(store), res, r, slug) {
+				return
+			}
 			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
 			res.WriteHeader(http.StatusNotFound)
 			res.Write([]byte("404 Page Not Found"))
 			return
 		}
+		content, err := store.ContentForTag(slug)
+		if err != nil {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusInternalServerError)
+			res.Write([]byte("Could not list contents."))
+			return
+		}
+		parents := TagMap{}
+		for _, parent := range tag.Parents {
+			if p, err := store.GetTag(parent); err == nil {
+				parents[parent] = *p
+			}
+		}
+		children, err := store.ChildTags(slug)
+		if err != nil {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusInternalServerError)
+			res.Write([]byte("Could not list tags."))
+			return
+		}
+		// Aliases are only kept by the bolt store.
+		var aliases []Alias
+		if db := boltDB(store); db != nil {
+			aliases, err = listAliases(db, slug)
+		}
+		if err != nil {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusInternalServerError)
+			res.Write([]byte("Could not list aliases."))
+			return
+		}
 		log.Printf("Requested: %s by %s \n", tag.Label, tag.Author)
 		unsafeContentHTML := markdown.ToHTML([]byte(tag.Definition), nil, nil)
 		tagHTML := bluemonday.UGCPolicy().SanitizeBytes(unsafeContentHTML)
 		res.Header().Set("Content-Type", "text/html; charset=UTF-8")
 		res.WriteHeader(http.StatusOK)
-		t.Execute(res, TagPageData{SiteMetaData: siteMetaData, Tag: *tag, HTML: template.HTML(tagHTML)})
+		t.Execute(res, TagPageData{SiteMetaData: siteMetaData, Tag: *tag, HTML: template.HTML(tagHTML), Content: content, Parents: tagSlice(parents), Children: children, Aliases: aliases})
 	}
 	return fn
 }
 
 // editTagPageHandler serves the UI for creating a tag. It is a form that submits to the create tag REST endpoint.
-func editTagPageHandler(db *bolt.DB, t *template.Template) http.HandlerFunc {
+func editTagPageHandler(store Store, t *template.Template) http.HandlerFunc {
 	fn := func(res http.ResponseWriter, r *http.Request) {
 		// Get the URL param named slug from the response.
 		slug := mux.Vars(r)["slug"]
-		tag, err := getTag(db, slug)
+		tag, err := store.GetTag(slug)
 		if err != nil {
+			if redirectAlias(boltDB(store), res, r, slug) {
+				return
+			}
 			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
 			res.WriteHeader(http.StatusNotFound)
 			res.Write([]byte("404 Page Not Found"))
@@ -489,7 +856,7 @@ func editTagPageHandler(db *bolt.DB, t *template.Template) http.HandlerFunc {
 // createTagHandler handles taged JSON data representing a new tag, and stores it in the database.
 // It creates a slug to use as a key using the title of the tag.
 // This implies in the current state of affairs that titles must be unique or the keys will overwrite each other.
-func createTagHandler(db *bolt.DB) http.HandlerFunc {
+func createTagHandler(store Store) http.HandlerFunc {
 	fn := func(res http.ResponseWriter, r *http.Request) {
 		var tag Tag
 		res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
@@ -511,16 +878,16 @@ func createTagHandler(db *bolt.DB) http.HandlerFunc {
 			if err := json.NewEncoder(res).Encode(err); err != nil {
 				panic(err)
 			}
+			return
 		}
 
-		// Set the creation time stamp to the current server time.
-		tag.CreatedAt = time.Now()
-
-		// Create a URL safe slug from the timestamp and the title.
-		autoSlug := fmt.Sprintf("%s-%s", slug.Make(tag.CreatedAt.Format(time.RFC3339)), slug.Make(tag.Definition))
-		tag.Slug = autoSlug
-
-		if err = upsertTag(db, tag, autoSlug); err != nil {
+		tag.Author = requestAuthor(r, tag.Author)
+		if tag, err = createTag(store, tag); err != nil {
+			if isHierarchyError(err) || errors.Is(err, errBadNamespace) {
+				res.WriteHeader(422) // unprocessable entity
+				res.Write([]byte(err.Error()))
+				return
+			}
 			res.WriteHeader(http.StatusInternalServerError)
 			res.Write([]byte("Error writing to DB."))
 			return
@@ -540,7 +907,7 @@ func createTagHandler(db *bolt.DB) http.HandlerFunc {
 // It writes the new tag object to the URL slug value unlike the createTagHandler
 // which generates a new slug using the tag date and time. Notice this means you can not change the URI.
 // This is left as homework for the reader.
-func modifyTagHandler(db *bolt.DB) http.HandlerFunc {
+func modifyTagHandler(store Store) http.HandlerFunc {
 	fn := func(res http.ResponseWriter, r *http.Request) {
 		var tag Tag
 		slug := mux.Vars(r)["slug"]
@@ -557,12 +924,18 @@ func modifyTagHandler(db *bolt.DB) http.HandlerFunc {
 			if err := json.NewEncoder(res).Encode(err); err != nil {
 				panic(err)
 			}
+			return
 		}
-		tag.Slug = slug
-		tag.CreatedAt = time.Now()
-		// Call the upserTag function passing in the database, a tag struct, and the slug.
+		// Call the modifyTag function passing in the database, the slug, and a tag struct.
 		// If there is an error writing to the database write an error to the response and return.
-		if err = upsertTag(db, tag, slug); err != nil {
+		tag.Author = requestAuthor(r, tag.Author)
+		if tag, err = modifyTag(store, slug, tag); err != nil {
+			if isHierarchyError(err) || errors.Is(err, errBadNamespace) {
+				res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+				res.WriteHeader(422) // unprocessable entity
+				res.Write([]byte(err.Error()))
+				return
+			}
 			res.WriteHeader(http.StatusInternalServerError)
 			res.Write([]byte("Error writing to DB."))
 			return
@@ -576,11 +949,11 @@ func modifyTagHandler(db *bolt.DB) http.HandlerFunc {
 }
 
 // DeleteTagHandler deletes the tag with the key matching the slug in the URL.
-func deleteTagHandler(db *bolt.DB) http.HandlerFunc {
+func deleteTagHandler(store Store) http.HandlerFunc {
 	fn := func(res http.ResponseWriter, r *http.Request) {
 		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		slug := mux.Vars(r)["slug"]
-		if err := deleteTag(db, slug); err != nil {
+		if err := store.DeleteTag(slug); err != nil {
 			panic(err)
 		}
 		res.WriteHeader(http.StatusOK)
@@ -600,49 +973,152 @@ func deleteTagHandler(db *bolt.DB) http.HandlerFunc {
 // upsertTag writes a tag to the boltDB KV store using the slug as a key, and a serialized tag struct as the value.
 // If the slug already exists the existing tag will be overwritten.
 func upsertTag(db *bolt.DB, tag Tag, slug string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return putTag(tx, tag, slug)
+	})
+}
+
+// createTag stores a new tag, stamped with the current server time.
+// Its slug is made from the timestamp and the definition.
+func createTag(store Store, tag Tag) (Tag, error) {
+	tag.CreatedAt = time.Now()
+	tag.UpdatedAt = tag.CreatedAt
+	tag.Slug = fmt.Sprintf("%s-%s", slug.Make(tag.CreatedAt.Format(time.RFC3339)), slug.Make(tag.Definition))
+	if err := store.PutTag(tag); err != nil {
+		return tag, err
+	}
+	// Writing can move a namespace:label title into its namespace, so return what was stored.
+	stored, err := store.GetTag(tag.Slug)
+	if err != nil {
+		return tag, err
+	}
+	return *stored, nil
+}
+
+// modifyTag replaces the tag stored under slug. It keeps the time the tag was created and stamps the time of the change.
+func modifyTag(store Store, slug string, tag Tag) (Tag, error) {
+	tag.Slug = slug
+	tag.CreatedAt = time.Now()
+	tag.UpdatedAt = tag.CreatedAt
+	if existing, err := store.GetTag(slug); err == nil {
+		tag.CreatedAt = existing.CreatedAt
+	}
+	if err := store.PutTag(tag); err != nil {
+		return tag, err
+	}
+	// A change that leaves the tag as it was keeps its UpdatedAt, so return what was stored.
+	stored, err := store.GetTag(slug)
+	if err != nil {
+		return tag, err
+	}
+	return *stored, nil
+}
+
+// putTag writes a tag, its place in the tag hierarchy and its index entries inside an existing transaction.
+// It fails with errUnknownParent or errTagCycle if the tag's parents are not valid.
+// A write that changes the tag is kept as a revision in its history.
+func putTag(tx *bolt.Tx, tag Tag, slug string) error {
+	previous, err := lookupTag(tx, slug)
+	if err != nil {
+		return err
+	}
+	var oldParents []string
+	var oldNamespace string
+	if previous != nil {
+		oldParents, oldNamespace = previous.Parents, previous.Namespace
+	}
+	if err := settleTagNamespace(tx, &tag); err != nil {
+		return err
+	}
+	tag.Parents = uniqueStrings(tag.Parents)
+	if err := setTagParents(tx, slug, oldParents, tag.Parents); err != nil {
+		return err
+	}
+	now := time.Now()
+	var changed bool
+	if previous != nil {
+		tag.UpdatedAt, changed = settleUpdatedAt(&previous.UpdatedAt, tag.UpdatedAt, sameTag(*previous, tag), now)
+	} else {
+		tag.UpdatedAt, changed = settleUpdatedAt(nil, tag.UpdatedAt, false, now)
+	}
 
 	// Marshal tag struct into bytes which can be written to Bolt.
 	buf, err := json.Marshal(tag)
 	if err != nil {
 		return err
 	}
-
-	err = db.Update(func(tx *bolt.Tx) error {
-		err := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagBucket)).Put([]byte(slug), []byte(buf))
-		if err != nil {
-			return fmt.Errorf("could not insert tag: %v", err)
+	err = tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagBucket)).Put([]byte(slug), buf)
+	if err != nil {
+		return fmt.Errorf("could not insert tag: %v", err)
+	}
+	if err := reindexSortKeys(tx, tagSortIndexes, slug, tagSortKeys(previous), tagSortKeys(&tag)); err != nil {
+		return err
+	}
+	if err := indexTagNamespace(tx, slug, oldNamespace, tag.Namespace); err != nil {
+		return err
+	}
+	if previous != nil {
+		for _, name := range tagSuggestNames(*previous) {
+			if err := unindexTagName(tx, slug, name, false); err != nil {
+				return err
+			}
 		}
-		return nil
-	})
-	return err
+	}
+	for _, name := range tagSuggestNames(tag) {
+		if err := indexTagName(tx, slug, name, false); err != nil {
+			return err
+		}
+	}
+	if changed {
+		if err := recordRevision(tx, tagHistory, slug, Revision{Author: tag.Author, Tag: &tag}, now); err != nil {
+			return err
+		}
+	}
+	return indexDocument(tx, docID(tagDocKind, slug), tag.Label, tag.Definition)
 }
 
-// listTag returns a map of tags indexed by the slug.
-// TODO: We could we add pagination to this!
-func listTag(db *bolt.DB) (TagMap, error) {
-	results := TagMap{}
-	err := db.View(func(tx *bolt.Tx) error {
-		// Assume bucket exists and has keys
-		b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagBucket))
-
-		c := b.Cursor()
+// lookupTag reads a tag inside an existing transaction. It returns nil if there is no tag with the slug.
+func lookupTag(tx *bolt.Tx, slug string) (*Tag, error) {
+	v := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagBucket)).Get([]byte(slug))
+	if v == nil {
+		return nil, nil
+	}
+	tag := Tag{}
+	if err := json.Unmarshal(v, &tag); err != nil {
+		return nil, err
+	}
+	return &tag, nil
+}
 
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			tag := Tag{}
-			if err := json.Unmarshal(v, &tag); err != nil {
-				panic(err)
+// listTag returns one page of tags in the order selected by opts.
+func listTag(db *bolt.DB, opts ListOptions) ([]Tag, PageInfo, error) {
+	results := []Tag{}
+	var info PageInfo
+	err := db.View(func(tx *bolt.Tx) error {
+		slugs, page, err := pageIndex(boltIndexWalker(tx, tagSortIndexes[opts.Sort]), opts)
+		if err != nil {
+			return err
+		}
+		info = page
+		for _, slug := range slugs {
+			tag, err := lookupTag(tx, slug)
+			if err != nil {
+				return err
+			}
+			if tag != nil {
+				results = append(results, *tag)
 			}
-			results[string(k)] = tag
 		}
-
 		return nil
 	})
 	if err != nil {
-		return nil, err
+		return nil, info, err
 	}
-	return results, nil
+	return results, info, nil
 }
 
+var errTagNotFound = errors.New("tag not found")
+
 // getTag gets a specific tag from the database by the slug.
 func getTag(db *bolt.DB, slug string) (*Tag, error) {
 	result := Tag{}
@@ -661,95 +1137,177 @@ func getTag(db *bolt.DB, slug string) (*Tag, error) {
 	return &result, nil
 }
 
-// deleteContent deletes a specific tag by slug.
+// deleteTag deletes a specific tag by slug along with every edge and alias pointing at it.
+// Its children lose it as a parent.
 func deleteTag(db *bolt.DB, slug string) error {
 	err := db.Update(func(tx *bolt.Tx) error {
-		err := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagBucket)).Delete([]byte(slug))
-		if err != nil {
-			return fmt.Errorf("could not delete tag: %v", err)
-		}
-		return nil
+		return removeTag(tx, slug)
 	})
 	return err
 }
 
-// upsertEdge writes a tag to the boltDB KV store using the slug as a key, and a serialized tag struct as the value.
-// If the slug already exists the existing tag will be overwritten.
-func upsertEdge(db *bolt.DB, tag Tag, content Content) error {
-	// Marshal content and tag struct into json which
-	// can be converted to byte array which can be written to Bolt.
-	contentBuffer, err := json.Marshal(content)
+// removeTag deletes a tag and everything that refers to it inside an existing transaction.
+func removeTag(tx *bolt.Tx, slug string) error {
+	tag, err := lookupTag(tx, slug)
 	if err != nil {
 		return err
 	}
-	tagBuffer, err := json.Marshal(tag)
+	if err := reindexSortKeys(tx, tagSortIndexes, slug, tagSortKeys(tag), nil); err != nil {
+		return err
+	}
+	if tag != nil {
+		for _, name := range tagSuggestNames(*tag) {
+			if err := unindexTagName(tx, slug, name, false); err != nil {
+				return err
+			}
+		}
+		if err := indexTagNamespace(tx, slug, tag.Namespace, ""); err != nil {
+			return err
+		}
+	}
+	if err := detachTag(tx, slug); err != nil {
+		return err
+	}
+	err = tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagBucket)).Delete([]byte(slug))
 	if err != nil {
+		return fmt.Errorf("could not delete tag: %v", err)
+	}
+	if err := unindexDocument(tx, docID(tagDocKind, slug)); err != nil {
+		return err
+	}
+	if err := retargetAliases(tx, slug, ""); err != nil {
 		return err
 	}
+	return removeAllEdges(tx, edgeByTagBucket, slug)
+}
 
-	// Create a Bolt Update transaction and insert edges and reverse edges to buckets.
-	// The values will be copied for fast lookups. This means editing the content or tag will not automatically update here.
+// EDGE HANDLERS
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		err := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(edgeByTagBucket)).Put([]byte(tag.Slug), []byte(contentBuffer))
-		if err != nil {
-			return fmt.Errorf("could not insert edge_by_tag: %v", err)
+// listContentTagsHandler returns every tag applied to the content in the URL as JSON.
+func listContentTagsHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		hash := mux.Vars(r)["hash"]
+		if _, err := store.GetContent(hash); err != nil {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusNotFound)
+			res.Write([]byte("404 Page Not Found"))
+			return
 		}
-		err = tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(edgeByContentBucket)).Put([]byte(content.Hash), []byte(tagBuffer))
+		tags, err := store.TagsForContent(hash)
 		if err != nil {
-			return fmt.Errorf("could not insert edge_by_content: %v", err)
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusInternalServerError)
+			res.Write([]byte("Could not list tags."))
+			return
 		}
-		return nil
-	})
-	return err
+		// This route has always answered with a map of slug to tag.
+		tagMap := TagMap{}
+		for _, tag := range tags {
+			tagMap[tag.Slug] = tag
+		}
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		res.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(res).Encode(tagMap); err != nil {
+			panic(err)
+		}
+	}
+	return fn
 }
 
-// createEdgeHandler is responsible for modifing the tags of a specific tag.
-// It accepts a new tag object as JSON tag in the request body.
-// It writes the new tag object to the URL slug value unlike the createTagHandler
-// which generates a new slug using the tag date and time. Notice this means you can not change the URI.
-// This is left as homework for the reader.
-func createEdgeHandler(db *bolt.DB) http.HandlerFunc {
+// listTagContentHandler returns every content item the tag in the URL has been applied to as JSON.
+func listTagContentHandler(store Store) http.HandlerFunc {
 	fn := func(res http.ResponseWriter, r *http.Request) {
-		var tag Tag
-		var content Content
-		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+		slug := mux.Vars(r)["slug"]
+		if _, err := store.GetTag(slug); err != nil {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusNotFound)
+			res.Write([]byte("404 Page Not Found"))
+			return
+		}
+		content, err := store.ContentForTag(slug)
 		if err != nil {
-			panic(err)
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusInternalServerError)
+			res.Write([]byte("Could not list contents."))
+			return
 		}
-		if err := r.Body.Close(); err != nil {
+		// This route has always answered with a map of hash to content.
+		contentMap := ContentMap{}
+		for _, c := range content {
+			contentMap[c.Hash] = c
+		}
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		res.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(res).Encode(contentMap); err != nil {
 			panic(err)
 		}
-		if err := json.Unmarshal(body, &tag); err != nil {
-			res.WriteHeader(422) // unprocessable entity
-			if err := json.NewEncoder(res).Encode(err); err != nil {
-				panic(err)
-			}
+	}
+	return fn
+}
+
+// getEdgeHandler returns the edge between the content and tag in the URL, or a 404 if the tag is not applied.
+func getEdgeHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		edge, err := store.GetEdge(vars["slug"], vars["hash"])
+		if err != nil {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusNotFound)
+			res.Write([]byte("404 Page Not Found"))
+			return
 		}
-		tag.CreatedAt = time.Now()
-		// Call the upserTag function passing in the database, a tag struct, and the slug.
-		// If there is an error writing to the database write an error to the response and return.
-		if err = upsertEdge(db, tag, content); err != nil {
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		res.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(res).Encode(edge); err != nil {
+			panic(err)
+		}
+	}
+	return fn
+}
+
+// createEdgeHandler applies the tag in the URL to the content in the URL.
+// Both records must already exist. Applying a tag twice is harmless and keeps the original edge.
+func createEdgeHandler(store Store) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		edge, err := store.ApplyTag(vars["hash"], vars["slug"])
+		switch {
+		case errors.Is(err, errContentNotFound):
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusNotFound)
+			res.Write([]byte("Content not found."))
+			return
+		case errors.Is(err, errTagNotFound):
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusNotFound)
+			res.Write([]byte("Tag not found."))
+			return
+		case errors.Is(err, errNamespaceExclusive):
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusConflict)
+			res.Write([]byte(err.Error()))
+			return
+		case err != nil:
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
 			res.WriteHeader(http.StatusInternalServerError)
 			res.Write([]byte("Error writing to DB."))
 			return
 		}
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
 		res.WriteHeader(http.StatusCreated)
-		if err := json.NewEncoder(res).Encode(tag); err != nil {
+		if err := json.NewEncoder(res).Encode(edge); err != nil {
 			panic(err)
 		}
 	}
 	return fn
 }
 
-// DeleteTagHandler deletes the tag with the key matching the slug in the URL.
-func deleteEdgeHandler(db *bolt.DB) http.HandlerFunc {
+// deleteEdgeHandler removes the tag in the URL, or the tag it is an alias of, from the content in the URL.
+func deleteEdgeHandler(store Store) http.HandlerFunc {
 	fn := func(res http.ResponseWriter, r *http.Request) {
-		var tag Tag
-		var content Content
+		vars := mux.Vars(r)
 		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		if err := deleteEdge(db, tag, content); err != nil {
+		if err := store.DeleteEdge(vars["slug"], vars["hash"]); err != nil {
 			panic(err)
 		}
 		res.WriteHeader(http.StatusOK)
@@ -764,40 +1322,244 @@ func deleteEdgeHandler(db *bolt.DB) http.HandlerFunc {
 	return fn
 }
 
-// deleteEdge deletes a specific tag by slug.
-func deleteEdge(db *bolt.DB, tag Tag, content Content) error {
-	// Marshal content and tag struct into json which
-	// can be converted to byte array which can be written to Bolt.
-	contentBuffer, err := json.Marshal(content)
+// DATA STORE FUNCTIONS
+
+// Edges are stored twice so they can be walked from either side.
+// EDGE_BY_TAG holds a nested bucket per tag slug whose keys are content hashes,
+// and EDGE_BY_CONTENT holds a nested bucket per content hash whose keys are tag slugs.
+// Both sides store the same serialized Edge as the value.
+
+var errContentNotFound = errors.New("content not found")
+
+// applyEdge applies the edge's tag, or the tag it is an alias of, to its content and returns the stored edge.
+// Both records must already exist. If the edge already exists it is left untouched.
+func applyEdge(db *bolt.DB, edge Edge) (*Edge, error) {
+	var result *Edge
+	err := db.Update(func(tx *bolt.Tx) error {
+		edge.Tag = resolveTagSlug(tx, edge.Tag)
+		content, err := lookupContent(tx, edge.Content)
+		if err != nil {
+			return err
+		}
+		if content == nil {
+			return errContentNotFound
+		}
+		tag, err := lookupTag(tx, edge.Tag)
+		if err != nil {
+			return err
+		}
+		if tag == nil {
+			return errTagNotFound
+		}
+		applied := edgeKeys(tx, edgeByContentBucket, edge.Content)
+		if !containsString(applied, edge.Tag) {
+			conflict, err := exclusiveConflict(tx, edge.Tag, applied)
+			if err != nil {
+				return err
+			}
+			if conflict != "" {
+				return exclusiveError(tx, edge.Tag, conflict)
+			}
+		}
+		if err := putEdge(tx, edge); err != nil {
+			return err
+		}
+		result = &Edge{}
+		v := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(edgeByTagBucket)).Bucket([]byte(edge.Tag)).Get([]byte(edge.Content))
+		return json.Unmarshal(v, result)
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	tagBuffer, err := json.Marshal(tag)
+	return result, nil
+}
+
+// getEdge gets the edge between a tag and a content item.
+func getEdge(db *bolt.DB, slug string, hash string) (*Edge, error) {
+	result := Edge{}
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(edgeByTagBucket)).Bucket([]byte(slug))
+		if b == nil {
+			return fmt.Errorf("edge not found")
+		}
+		v := b.Get([]byte(hash))
+		if err := json.Unmarshal(v, &result); err != nil {
+			return err
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return &result, nil
+}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		err := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(edgeByTagBucket)).Put([]byte(tag.Slug), []byte(contentBuffer))
-		if err != nil {
-			return fmt.Errorf("could not delete edge_by_tag: %v", err)
+// deleteEdge removes a tag, or the tag it is an alias of, from a content item.
+func deleteEdge(db *bolt.DB, slug string, hash string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		return removeEdge(tx, resolveTagSlug(tx, slug), hash)
+	})
+}
+
+// listTagsForContent returns a map of the tags applied to a content item indexed by the slug.
+func listTagsForContent(db *bolt.DB, hash string) (TagMap, error) {
+	results := TagMap{}
+	err := db.View(func(tx *bolt.Tx) error {
+		tags := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagBucket))
+		for _, slug := range edgeKeys(tx, edgeByContentBucket, hash) {
+			tag := Tag{}
+			v := tags.Get([]byte(slug))
+			if v == nil {
+				continue
+			}
+			if err := json.Unmarshal(v, &tag); err != nil {
+				return err
+			}
+			results[slug] = tag
 		}
-		err = tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(edgeByContentBucket)).Put([]byte(content.Hash), []byte(tagBuffer))
-		if err != nil {
-			return fmt.Errorf("could not delete edge_by_content: %v", err)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// listContentForTag returns a map of the contents a tag has been applied to indexed by the hash.
+func listContentForTag(db *bolt.DB, slug string) (ContentMap, error) {
+	results := ContentMap{}
+	err := db.View(func(tx *bolt.Tx) error {
+		contents := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(contentBucket))
+		for _, hash := range edgeKeys(tx, edgeByTagBucket, slug) {
+			content := Content{}
+			v := contents.Get([]byte(hash))
+			if v == nil {
+				continue
+			}
+			if err := json.Unmarshal(v, &content); err != nil {
+				return err
+			}
+			results[hash] = content
 		}
 		return nil
 	})
-	return err
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// putEdge writes both sides of an edge inside an existing transaction.
+func putEdge(tx *bolt.Tx, edge Edge) error {
+	byTag, err := edgeBucket(tx, edgeByTagBucket, edge.Tag)
+	if err != nil {
+		return fmt.Errorf("could not insert edge_by_tag: %v", err)
+	}
+	byContent, err := edgeBucket(tx, edgeByContentBucket, edge.Content)
+	if err != nil {
+		return fmt.Errorf("could not insert edge_by_content: %v", err)
+	}
+	if byTag.Get([]byte(edge.Content)) != nil {
+		return nil
+	}
+	buf, err := json.Marshal(edge)
+	if err != nil {
+		return err
+	}
+	if err := byTag.Put([]byte(edge.Content), buf); err != nil {
+		return fmt.Errorf("could not insert edge_by_tag: %v", err)
+	}
+	if err := byContent.Put([]byte(edge.Tag), buf); err != nil {
+		return fmt.Errorf("could not insert edge_by_content: %v", err)
+	}
+	return countTagUsage(tx, edge.Tag, 1)
+}
+
+// removeEdge deletes both sides of an edge inside an existing transaction.
+// Empty nested buckets are dropped so they do not accumulate.
+func removeEdge(tx *bolt.Tx, slug string, hash string) error {
+	root := tx.Bucket([]byte(topLevelBucket))
+	if b := root.Bucket([]byte(edgeByTagBucket)).Bucket([]byte(slug)); b != nil && b.Get([]byte(hash)) != nil {
+		if err := countTagUsage(tx, slug, -1); err != nil {
+			return err
+		}
+	}
+	sides := []struct{ bucket, outer, inner string }{
+		{edgeByTagBucket, slug, hash},
+		{edgeByContentBucket, hash, slug},
+	}
+	for _, side := range sides {
+		parent := root.Bucket([]byte(side.bucket))
+		b := parent.Bucket([]byte(side.outer))
+		if b == nil {
+			continue
+		}
+		if err := b.Delete([]byte(side.inner)); err != nil {
+			return fmt.Errorf("could not delete %s: %v", strings.ToLower(side.bucket), err)
+		}
+		if k, _ := b.Cursor().First(); k == nil {
+			if err := parent.DeleteBucket([]byte(side.outer)); err != nil {
+				return fmt.Errorf("could not delete %s: %v", strings.ToLower(side.bucket), err)
+			}
+		}
+	}
+	return nil
+}
+
+// removeAllEdges deletes every edge touching key. side names the edge bucket key is found in.
+// It is used to cascade deletes of content and tags.
+func removeAllEdges(tx *bolt.Tx, side string, key string) error {
+	for _, other := range edgeKeys(tx, side, key) {
+		slug, hash := key, other
+		if side == edgeByContentBucket {
+			slug, hash = other, key
+		}
+		if err := removeEdge(tx, slug, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// edgeBucket returns the nested edge bucket for key, creating it if needed.
+// Databases written before edges were multi-valued stored a single JSON value at key. migrateSingleValueEdges
+// converts those at startup; any still found here is discarded.
+func edgeBucket(tx *bolt.Tx, side string, key string) (*bolt.Bucket, error) {
+	parent := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(side))
+	if parent.Bucket([]byte(key)) == nil && parent.Get([]byte(key)) != nil {
+		if err := parent.Delete([]byte(key)); err != nil {
+			return nil, err
+		}
+	}
+	return parent.CreateBucketIfNotExists([]byte(key))
+}
+
+// edgeKeys returns the keys of the nested edge bucket for key: tag slugs for a content hash
+// when side is EDGE_BY_CONTENT, or content hashes for a tag slug when side is EDGE_BY_TAG.
+func edgeKeys(tx *bolt.Tx, side string, key string) []string {
+	keys := []string{}
+	b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(side)).Bucket([]byte(key))
+	if b == nil {
+		return keys
+	}
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		keys = append(keys, string(k))
+	}
+	return keys
 }
 
 // INITIALIZATION FUNCTIONS
 // setupDB sets up the database when the program start.
-//  First it connects to the database, then it creates the buckets required to run the app if they do not exist.
-func setupDB() (*bolt.DB, error) {
-	db, err := bolt.Open("anansi.db", 0600, nil)
+//  First it connects to the database and migrates it to the current schema version, then it creates the buckets required to run the app if they do not exist.
+func setupDB(path string) (*bolt.DB, error) {
+	db, err := openBolt(path)
 	if err != nil {
-		return nil, fmt.Errorf("could not open db, %v", err)
+		return nil, err
+	}
+	if err := migrateDB(db); err != nil {
+		db.Close()
+		return nil, err
 	}
 	err = db.Update(func(tx *bolt.Tx) error {
 		root, err := tx.CreateBucketIfNotExists([]byte(topLevelBucket))
@@ -820,50 +1582,230 @@ func setupDB() (*bolt.DB, error) {
 		if err != nil {
 			return fmt.Errorf("could not create edge_by_tag bucket: %v", err)
 		}
+		for _, name := range []string{fullTextPostingsBucket, fullTextDocsBucket, fullTextStatsBucket} {
+			if _, err := root.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return fmt.Errorf("could not create %s bucket: %v", strings.ToLower(name), err)
+			}
+		}
+		_, err = root.CreateBucketIfNotExists([]byte(tagAliasBucket))
+		if err != nil {
+			return fmt.Errorf("could not create tag_aliases bucket: %v", err)
+		}
+		_, err = root.CreateBucketIfNotExists([]byte(tagChildrenBucket))
+		if err != nil {
+			return fmt.Errorf("could not create tag_children bucket: %v", err)
+		}
+		if root.Bucket([]byte(pathBucket)) == nil {
+			paths, err := root.CreateBucket([]byte(pathBucket))
+			if err != nil {
+				return fmt.Errorf("could not create paths bucket: %v", err)
+			}
+			// Index the paths of content written before the paths bucket existed.
+			err = root.Bucket([]byte(contentBucket)).ForEach(func(k, v []byte) error {
+				content := Content{}
+				if err := json.Unmarshal(v, &content); err != nil {
+					return err
+				}
+				for _, path := range content.Paths {
+					if err := paths.Put([]byte(path), k); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("could not index paths: %v", err)
+			}
+		}
+		for _, name := range []string{contentHistoryBucket, tagHistoryBucket} {
+			if _, err := root.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return fmt.Errorf("could not create %s bucket: %v", strings.ToLower(name), err)
+			}
+		}
+		if err := setupAuthBuckets(root); err != nil {
+			return err
+		}
+		if err := setupNamespaces(root); err != nil {
+			return err
+		}
+		if err := setupContentTypes(root); err != nil {
+			return err
+		}
+		if _, err := root.CreateBucketIfNotExists([]byte(collectionBucket)); err != nil {
+			return fmt.Errorf("could not create collections bucket: %v", err)
+		}
+		if _, err := root.CreateBucketIfNotExists([]byte(contentCollectionsBucket)); err != nil {
+			return fmt.Errorf("could not create content_collections bucket: %v", err)
+		}
+		if err := setupSortIndexes(tx); err != nil {
+			return fmt.Errorf("could not build sort indexes: %v", err)
+		}
+		if err := setupTagSuggestions(tx); err != nil {
+			return err
+		}
+		// Build the full text index for databases created before it existed.
+		if root.Bucket([]byte(fullTextStatsBucket)).Get([]byte("docs")) == nil {
+			if err := reindexAll(tx); err != nil {
+				return fmt.Errorf("could not build full text index: %v", err)
+			}
+		}
 		return nil
 	})
 	if err != nil {
 		return nil, fmt.Errorf("could not set up buckets, %v", err)
 	}
-	fmt.Println("DB Setup Done")
+	log.Println("DB Setup Done")
+	return db, nil
+}
+
+// openBolt opens the bolt database file. Bolt allows one process at a time, so it gives up quickly
+// rather than wait for a running server to let go of the file.
+func openBolt(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("could not open db, %s is in use by another process; stop it or pass -server to work through it", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open db, %v", err)
+	}
 	return db, nil
 }
 
+// templateFiles are the templates newRouter parses, relative to the templates directory.
+var templateFiles = []string{
+	"home.html", "login.html", "search.html", "textsearch.html",
+	"content/list.html", "content/detail.html", "content/edit.html", "content/create.html",
+	"tags/list.html", "tags/detail.html", "tags/edit.html", "tags/create.html",
+	"collections/list.html", "collections/detail.html",
+}
+
 // newRouter configures and sets up the gorilla mux router paths and connects the route to the handler function.
-func newRouter(db *bolt.DB) *mux.Router {
+// Search, collections, tag suggestions, aliases, namespaces, content types, hierarchy walks, scans, revision
+// history and accounts need the bolt store; on the others their routes answer 501 Not Implemented.
+// With roles nil, as for serve -no-auth, anyone who can reach the server can make changes; otherwise roles
+// decide who can do what, which needs a store that keeps accounts. Scans may only be started under scanRoots.
+func newRouter(store Store, templates string, thumbnails string, roles Roles, scanRoots []string) (*mux.Router, error) {
+	parse := func(name string) *template.Template {
+		return template.Must(template.ParseFiles(filepath.Join(templates, name)))
+	}
 
 	// Load and parse the html templates to be used.
-	homePageTemplate := template.Must(template.ParseFiles("templates/home.html"))
-	contentListTemplate := template.Must(template.ParseFiles("templates/content/list.html"))
-	contentDetailTemplate := template.Must(template.ParseFiles("templates/content/detail.html"))
-	contentEditTemplate := template.Must(template.ParseFiles("templates/content/edit.html"))
-	contentCreateTemplate := template.Must(template.ParseFiles("templates/content/create.html"))
-
-	tagListTemplate := template.Must(template.ParseFiles("templates/tags/list.html"))
-	tagDetailTemplate := template.Must(template.ParseFiles("templates/tags/detail.html"))
-	tagEditTemplate := template.Must(template.ParseFiles("templates/tags/edit.html"))
-	tagCreateTemplate := template.Must(template.ParseFiles("templates/tags/create.html"))
+	homePageTemplate := parse("home.html")
+	loginTemplate := parse("login.html")
+	contentListTemplate := parse("content/list.html")
+	contentDetailTemplate := parse("content/detail.html")
+	contentEditTemplate := parse("content/edit.html")
+	contentCreateTemplate := parse("content/create.html")
+
+	tagListTemplate := parse("tags/list.html")
+	tagDetailTemplate := parse("tags/detail.html")
+	tagEditTemplate := parse("tags/edit.html")
+	tagCreateTemplate := parse("tags/create.html")
+
+	collectionListTemplate := parse("collections/list.html")
+	collectionDetailTemplate := parse("collections/detail.html")
+
+	searchTemplate := parse("search.html")
+	textSearchTemplate := parse("textsearch.html")
+	remoteClient := &http.Client{Timeout: 15 * time.Second}
+
+	db := boltDB(store)
+	if db == nil && roles != nil {
+		return nil, fmt.Errorf("roles can not be enforced without user accounts, which the store does not keep")
+	}
+	// The create and edit forms only ask for a login when roles are enforced.
+	accounts := db
+	if roles == nil {
+		accounts = nil
+	}
 	r := mux.NewRouter()
 	r.StrictSlash(true)
-	r.HandleFunc("/", homeHandler(db, homePageTemplate)).Methods("GET")
-	r.HandleFunc("/content", contentListHandler(db, contentListTemplate)).Methods("GET")
-	r.HandleFunc("/content", createContentHandler(db)).Methods("POST")
-	r.HandleFunc("/content/create", createContentPageHandler(db, contentCreateTemplate)).Methods("GET")
-	r.HandleFunc("/content/{hash}", getContentHandler(db, contentDetailTemplate)).Methods("GET")
-	r.HandleFunc("/content/{hash}", modifyContentHandler(db)).Methods("POST")
-	r.HandleFunc("/content/{hash}", deleteContentHandler(db)).Methods("DELETE")
-	r.HandleFunc("/content/{hash}/edit", editContentPageHandler(db, contentEditTemplate)).Methods("GET")
-
-	r.HandleFunc("/tags", tagListHandler(db, tagListTemplate)).Methods("GET")
-	r.HandleFunc("/tags", createTagHandler(db)).Methods("POST")
-	r.HandleFunc("/tags/create", createTagPageHandler(db, tagCreateTemplate)).Methods("GET")
-	r.HandleFunc("/tags/{slug}", getTagHandler(db, tagDetailTemplate)).Methods("GET")
-	r.HandleFunc("/tags/{slug}", modifyTagHandler(db)).Methods("POST")
-	r.HandleFunc("/tags/{slug}", deleteTagHandler(db)).Methods("DELETE")
-	r.HandleFunc("/tags/{slug}/edit", editTagPageHandler(db, tagEditTemplate)).Methods("GET")
-
-	r.HandleFunc("/tags", createEdgeHandler(db)).Methods("POST")
-	r.HandleFunc("/tags", deleteEdgeHandler(db)).Methods("DELETE")
-
-	return r
+	if db != nil {
+		r.Use(authMiddleware(db))
+		if roles != nil {
+			r.Use(permissionMiddleware(roles))
+		}
+		r.HandleFunc("/login", loginPageHandler(loginTemplate)).Methods("GET")
+		r.HandleFunc("/login", loginHandler(db, loginTemplate)).Methods("POST")
+		r.HandleFunc("/logout", logoutHandler(db)).Methods("POST")
+	}
+	r.HandleFunc("/", homeHandler(store, homePageTemplate)).Methods("GET")
+	r.HandleFunc("/content", contentListHandler(store, contentListTemplate)).Methods("GET")
+	r.HandleFunc("/content", createContentHandler(store)).Methods("POST")
+	r.HandleFunc("/content/create", loginRequired(accounts, createContentPageHandler(store, contentCreateTemplate))).Methods("GET")
+	r.HandleFunc("/content/remote", createRemoteContentHandler(store, remoteClient)).Methods("POST")
+	r.HandleFunc("/content/{hash}", getContentHandler(store, contentDetailTemplate)).Methods("GET")
+	r.HandleFunc("/content/{hash}", modifyContentHandler(store)).Methods("POST")
+	r.HandleFunc("/content/{hash}", deleteContentHandler(store)).Methods("DELETE")
+	r.HandleFunc("/content/{hash}/edit", loginRequired(accounts, editContentPageHandler(store, contentEditTemplate))).Methods("GET")
+	r.HandleFunc("/content/{hash}/thumb", thumbnailHandler(store, newThumbnails(thumbnails))).Methods("GET")
+	r.HandleFunc("/content/{hash}/refresh", refreshRemoteContentHandler(store, remoteClient)).Methods("POST")
+	r.HandleFunc("/content/{hash}/tags", listContentTagsHandler(store)).Methods("GET")
+	r.HandleFunc("/content/{hash}/tags/{slug}", getEdgeHandler(store)).Methods("GET")
+	r.HandleFunc("/content/{hash}/tags/{slug}", createEdgeHandler(store)).Methods("PUT")
+	r.HandleFunc("/content/{hash}/tags/{slug}", deleteEdgeHandler(store)).Methods("DELETE")
+
+	r.HandleFunc("/tags", tagListHandler(store, tagListTemplate)).Methods("GET")
+	r.HandleFunc("/tags", createTagHandler(store)).Methods("POST")
+	r.HandleFunc("/tags/create", loginRequired(accounts, createTagPageHandler(store, tagCreateTemplate))).Methods("GET")
+	r.HandleFunc("/tags/suggest", boltOnly(store, tagSuggestHandler(db))).Methods("GET")
+	r.HandleFunc("/tags/{slug}", getTagHandler(store, tagDetailTemplate)).Methods("GET")
+	r.HandleFunc("/tags/{slug}", modifyTagHandler(store)).Methods("POST")
+	r.HandleFunc("/tags/{slug}", deleteTagHandler(store)).Methods("DELETE")
+	r.HandleFunc("/tags/{slug}/edit", loginRequired(accounts, editTagPageHandler(store, tagEditTemplate))).Methods("GET")
+	r.HandleFunc("/tags/{slug}/content", listTagContentHandler(store)).Methods("GET")
+
+	r.HandleFunc("/export", exportHandler(store)).Methods("GET")
+	r.HandleFunc("/import", importHandler(store)).Methods("POST")
+
+	scans := newScanJobs(scanRoots)
+	registerAPIRoutes(r.PathPrefix("/api/v1").Subrouter(), store, remoteClient, scans, roles)
+
+	r.HandleFunc("/tags/{slug}/ancestors", boltOnly(store, listTagRelativesHandler(db, tagAncestors))).Methods("GET")
+	r.HandleFunc("/tags/{slug}/descendants", boltOnly(store, listTagRelativesHandler(db, tagDescendants))).Methods("GET")
+	r.HandleFunc("/tags/{slug}/aliases", boltOnly(store, listAliasesHandler(db))).Methods("GET")
+	r.HandleFunc("/tags/{slug}/aliases", boltOnly(store, createAliasHandler(db))).Methods("POST")
+	r.HandleFunc("/tags/{slug}/aliases/{alias}", boltOnly(store, deleteAliasHandler(db))).Methods("DELETE")
+	r.HandleFunc("/tags/{slug}/merge", boltOnly(store, mergeTagHandler(db))).Methods("POST")
+
+	r.HandleFunc("/namespaces", boltOnly(store, listNamespacesHandler(db))).Methods("GET")
+	r.HandleFunc("/namespaces", boltOnly(store, createNamespaceHandler(db))).Methods("POST")
+	r.HandleFunc("/namespaces/{name}", boltOnly(store, getNamespaceHandler(db))).Methods("GET")
+	r.HandleFunc("/namespaces/{name}", boltOnly(store, modifyNamespaceHandler(db))).Methods("PUT")
+	r.HandleFunc("/namespaces/{name}", boltOnly(store, deleteNamespaceHandler(db))).Methods("DELETE")
+	r.HandleFunc("/namespaces/{name}/tags", boltOnly(store, listNamespaceTagsHandler(db))).Methods("GET")
+	r.HandleFunc("/bulk/tags", boltOnly(store, bulkTagHandler(db))).Methods("POST")
+
+	r.HandleFunc("/types", boltOnly(store, listContentTypesHandler(db))).Methods("GET")
+	r.HandleFunc("/types", boltOnly(store, createContentTypeHandler(db))).Methods("POST")
+	r.HandleFunc("/types/{name}", boltOnly(store, getContentTypeHandler(db))).Methods("GET")
+	r.HandleFunc("/types/{name}", boltOnly(store, modifyContentTypeHandler(db))).Methods("PUT")
+	r.HandleFunc("/types/{name}", boltOnly(store, deleteContentTypeHandler(db))).Methods("DELETE")
+
+	r.HandleFunc("/collections", boltOnly(store, collectionListHandler(db, collectionListTemplate))).Methods("GET")
+	r.HandleFunc("/collections", boltOnly(store, createCollectionHandler(db))).Methods("POST")
+	r.HandleFunc("/collections/{slug}", boltOnly(store, getCollectionHandler(db, collectionDetailTemplate))).Methods("GET")
+	r.HandleFunc("/collections/{slug}", boltOnly(store, modifyCollectionHandler(db))).Methods("PUT")
+	r.HandleFunc("/collections/{slug}", boltOnly(store, deleteCollectionHandler(db))).Methods("DELETE")
+	r.HandleFunc("/collections/{slug}/items", boltOnly(store, insertCollectionItemHandler(db))).Methods("POST")
+	r.HandleFunc("/collections/{slug}/items", boltOnly(store, reorderCollectionHandler(db))).Methods("PUT")
+	r.HandleFunc("/collections/{slug}/items/{hash}", boltOnly(store, removeCollectionItemHandler(db))).Methods("DELETE")
+	r.HandleFunc("/content/{hash}/collections", boltOnly(store, listContentCollectionsHandler(db))).Methods("GET")
+
+	r.HandleFunc("/content/{hash}/revisions", boltOnly(store, listRevisionsHandler(db, contentHistory))).Methods("GET")
+	r.HandleFunc("/content/{hash}/revisions/diff", boltOnly(store, diffRevisionsHandler(db, contentHistory))).Methods("GET")
+	r.HandleFunc("/content/{hash}/revisions/{number:[0-9]+}", boltOnly(store, getRevisionHandler(db, contentHistory))).Methods("GET")
+	r.HandleFunc("/content/{hash}/revisions/{number:[0-9]+}/revert", boltOnly(store, revertRevisionHandler(db, contentHistory))).Methods("POST")
+	r.HandleFunc("/tags/{slug}/revisions", boltOnly(store, listRevisionsHandler(db, tagHistory))).Methods("GET")
+	r.HandleFunc("/tags/{slug}/revisions/diff", boltOnly(store, diffRevisionsHandler(db, tagHistory))).Methods("GET")
+	r.HandleFunc("/tags/{slug}/revisions/{number:[0-9]+}", boltOnly(store, getRevisionHandler(db, tagHistory))).Methods("GET")
+	r.HandleFunc("/tags/{slug}/revisions/{number:[0-9]+}/revert", boltOnly(store, revertRevisionHandler(db, tagHistory))).Methods("POST")
+
+	r.HandleFunc("/search", boltOnly(store, searchHandler(db, searchTemplate))).Methods("GET")
+	r.HandleFunc("/search/text", boltOnly(store, textSearchHandler(db, textSearchTemplate))).Methods("GET")
+
+	r.HandleFunc("/scan", boltOnly(store, createScanHandler(db, scans))).Methods("POST")
+	r.HandleFunc("/scan/{id}", getScanHandler(scans)).Methods("GET")
+
+	return r, nil
 }
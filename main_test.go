@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestBadJSONChangesNothing(t *testing.T) {
+	store := newMemoryStore()
+	seedStore(t, store)
+	r, err := newRouter(store, "templates", t.TempDir(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"/content", "/content/a", "/tags", "/tags/red"} {
+		if res := request(r, "POST", target, `{"label": "Broken`, ""); res.Code != http.StatusUnprocessableEntity {
+			t.Errorf("POST %s with bad JSON: status %d, want 422", target, res.Code)
+		}
+	}
+	content, _, err := store.ListContent(ListOptions{Limit: 10, Sort: "created", Order: "asc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != 3 || content[0].Label != "Content a" {
+		t.Errorf("content %v after bad JSON, want a, b and c unchanged", contentHashes(content))
+	}
+	tags, _, err := store.ListTags(ListOptions{Limit: 10, Sort: "created", Order: "asc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag, err := store.GetTag("red"); len(tags) != 2 || err != nil || tag.Label != "red" {
+		t.Errorf("tags %v after bad JSON, want red and blue unchanged", tagSlugs(tags))
+	}
+}
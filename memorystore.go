@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore is a Store that keeps everything in maps and forgets it on exit.
+// It is meant for tests and for embedding Anansi where persistence is handled elsewhere.
+type memoryStore struct {
+	mu      sync.RWMutex
+	content map[string]Content
+	tags    map[string]Tag
+	byTag   map[string]map[string]Edge // tag slug -> content hash -> edge
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		content: map[string]Content{},
+		tags:    map[string]Tag{},
+		byTag:   map[string]map[string]Edge{},
+	}
+}
+
+func (s *memoryStore) GetContent(hash string) (*Content, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	content, ok := s.content[hash]
+	if !ok {
+		return nil, errContentNotFound
+	}
+	return &content, nil
+}
+
+func (s *memoryStore) PutContent(content Content) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	content.Paths = append([]string(nil), content.Paths...)
+	s.content[content.Hash] = content
+	return nil
+}
+
+func (s *memoryStore) DeleteContent(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.content, hash)
+	for slug, edges := range s.byTag {
+		delete(edges, hash)
+		if len(edges) == 0 {
+			delete(s.byTag, slug)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) ListContent(opts ListOptions) ([]Content, PageInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var entries []indexEntry
+	for hash, content := range s.content {
+		entries = append(entries, indexEntry{sortIndexKey(contentSortKeys(&content)[opts.Sort], hash), hash})
+	}
+	hashes, info, err := pageIndex(sliceIndexWalker(sortEntries(entries)), opts)
+	if err != nil {
+		return nil, info, err
+	}
+	results := []Content{}
+	for _, hash := range hashes {
+		results = append(results, s.content[hash])
+	}
+	return results, info, nil
+}
+
+func (s *memoryStore) GetTag(slug string) (*Tag, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lookupTag(slug)
+}
+
+// lookupTag reads a tag while the lock is held.
+func (s *memoryStore) lookupTag(slug string) (*Tag, error) {
+	tag, ok := s.tags[slug]
+	if !ok {
+		return nil, errTagNotFound
+	}
+	return &tag, nil
+}
+
+func (s *memoryStore) PutTag(tag Tag) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tag.Parents = uniqueStrings(tag.Parents)
+	if err := checkTagParents(tag.Slug, tag.Parents, s.lookupTag); err != nil {
+		return err
+	}
+	s.tags[tag.Slug] = tag
+	return nil
+}
+
+func (s *memoryStore) DeleteTag(slug string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tags, slug)
+	delete(s.byTag, slug)
+	// Children keep their other parents.
+	for child, tag := range s.tags {
+		if containsString(tag.Parents, slug) {
+			tag.Parents = removeString(tag.Parents, slug)
+			s.tags[child] = tag
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) ListTags(opts ListOptions) ([]Tag, PageInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var entries []indexEntry
+	for slug, tag := range s.tags {
+		entries = append(entries, indexEntry{sortIndexKey(tagSortKeys(&tag)[opts.Sort], slug), slug})
+	}
+	slugs, info, err := pageIndex(sliceIndexWalker(sortEntries(entries)), opts)
+	if err != nil {
+		return nil, info, err
+	}
+	results := []Tag{}
+	for _, slug := range slugs {
+		results = append(results, s.tags[slug])
+	}
+	return results, info, nil
+}
+
+func (s *memoryStore) ChildTags(slug string) ([]Tag, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	children := TagMap{}
+	for child, tag := range s.tags {
+		if containsString(tag.Parents, slug) {
+			children[child] = tag
+		}
+	}
+	return tagSlice(children), nil
+}
+
+func (s *memoryStore) GetEdge(slug string, hash string) (*Edge, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	edge, ok := s.byTag[slug][hash]
+	if !ok {
+		return nil, errEdgeNotFound
+	}
+	return &edge, nil
+}
+
+func (s *memoryStore) ApplyTag(hash string, slug string) (*Edge, error) {
+	return s.PutEdge(Edge{Tag: slug, Content: hash, CreatedAt: time.Now()})
+}
+
+func (s *memoryStore) PutEdge(edge Edge) (*Edge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.content[edge.Content]; !ok {
+		return nil, errContentNotFound
+	}
+	if _, ok := s.tags[edge.Tag]; !ok {
+		return nil, errTagNotFound
+	}
+	if s.byTag[edge.Tag] == nil {
+		s.byTag[edge.Tag] = map[string]Edge{}
+	}
+	if existing, ok := s.byTag[edge.Tag][edge.Content]; ok {
+		return &existing, nil
+	}
+	s.byTag[edge.Tag][edge.Content] = edge
+	return &edge, nil
+}
+
+func (s *memoryStore) DeleteEdge(slug string, hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.byTag[slug], hash)
+	if len(s.byTag[slug]) == 0 {
+		delete(s.byTag, slug)
+	}
+	return nil
+}
+
+func (s *memoryStore) TagsForContent(hash string) ([]Tag, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tags := TagMap{}
+	for slug, edges := range s.byTag {
+		if _, ok := edges[hash]; ok {
+			tags[slug] = s.tags[slug]
+		}
+	}
+	return tagSlice(tags), nil
+}
+
+func (s *memoryStore) ContentForTag(slug string) ([]Content, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	content := ContentMap{}
+	for hash := range s.byTag[slug] {
+		content[hash] = s.content[hash]
+	}
+	return contentSlice(content), nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// sortEntries orders sort index entries by key so they can be walked like a bolt bucket.
+func sortEntries(entries []indexEntry) []indexEntry {
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].key, entries[j].key) < 0 })
+	return entries
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// The META bucket records the format of the data in the database. Its schema_version key holds the
+// version of the last migration applied; databases written before it existed are at version 0.
+const metaBucket = "META"
+const schemaVersionKey = "schema_version"
+
+// migration upgrades the database from version-1 to version. apply runs inside a single bolt
+// transaction together with the version bump, so a migration is either applied completely or not at all.
+// It returns the number of records it changed.
+type migration struct {
+	version     int
+	description string
+	apply       func(tx *bolt.Tx) (int, error)
+}
+
+// migrations is the ordered list of every change to the stored data format. Append new migrations
+// to the end with the next version number; never edit or reorder one that has shipped.
+// Migrations run before setupDB creates buckets and backfills indexes, so the indexes are built from
+// migrated records. A migration must create any bucket it writes to.
+var migrations = []migration{
+	{1, "convert single-value edges to nested edge buckets", migrateSingleValueEdges},
+	{2, "make accounts created before roles admins", migrateAdminRoles},
+	{3, "record the current content and tags as their first revisions", migrateFirstRevisions},
+}
+
+// currentSchemaVersion is the version of a database with every migration applied.
+func currentSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// schemaVersion reads the schema version of the database.
+func schemaVersion(tx *bolt.Tx) int {
+	root := tx.Bucket([]byte(topLevelBucket))
+	if root == nil || root.Bucket([]byte(metaBucket)) == nil {
+		return 0
+	}
+	v := root.Bucket([]byte(metaBucket)).Get([]byte(schemaVersionKey))
+	if len(v) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(v))
+}
+
+// setSchemaVersion records the schema version of the database.
+func setSchemaVersion(tx *bolt.Tx, version int) error {
+	root, err := tx.CreateBucketIfNotExists([]byte(topLevelBucket))
+	if err != nil {
+		return err
+	}
+	meta, err := root.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		return fmt.Errorf("could not create meta bucket: %v", err)
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(version))
+	return meta.Put([]byte(schemaVersionKey), v)
+}
+
+// pendingMigrations returns the migrations that have not been applied to a database at version.
+func pendingMigrations(version int) []migration {
+	pending := []migration{}
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// migrateDB brings the database up to the current schema version. A copy of the database is written
+// next to it before the first migration runs, and each migration commits in its own transaction.
+// A brand new database has nothing to migrate and is stamped with the current version.
+func migrateDB(db *bolt.DB) error {
+	var version int
+	var fresh bool
+	db.View(func(tx *bolt.Tx) error {
+		version = schemaVersion(tx)
+		fresh = tx.Bucket([]byte(topLevelBucket)) == nil
+		return nil
+	})
+	if fresh {
+		return db.Update(func(tx *bolt.Tx) error {
+			return setSchemaVersion(tx, currentSchemaVersion())
+		})
+	}
+	if version > currentSchemaVersion() {
+		return fmt.Errorf("database schema version %d is newer than this build supports (%d)", version, currentSchemaVersion())
+	}
+	pending := pendingMigrations(version)
+	if len(pending) == 0 {
+		return nil
+	}
+	backup, err := backupDB(db, version)
+	if err != nil {
+		return fmt.Errorf("could not back up the database before migrating: %v", err)
+	}
+	log.Printf("Backed up %s to %s before migrating.", db.Path(), backup)
+	for _, m := range pending {
+		err := db.Update(func(tx *bolt.Tx) error {
+			n, err := m.apply(tx)
+			if err != nil {
+				return err
+			}
+			log.Printf("Migrated to schema version %d: %s (%d records).", m.version, m.description, n)
+			return setSchemaVersion(tx, m.version)
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed, the database is left at version %d: %v", m.version, m.description, version, err)
+		}
+		version = m.version
+	}
+	return nil
+}
+
+// dryRunMigrations applies the pending migrations in a transaction that is rolled back, so nothing is written.
+// It reports what each migration would change and returns the first error a migration would fail with.
+func dryRunMigrations(db *bolt.DB) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	version := schemaVersion(tx)
+	pending := pendingMigrations(version)
+	fmt.Printf("%s is at schema version %d, this build expects %d.\n", db.Path(), version, currentSchemaVersion())
+	if len(pending) == 0 {
+		fmt.Println("Nothing to migrate.")
+		return nil
+	}
+	for _, m := range pending {
+		n, err := m.apply(tx)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) would fail: %v", m.version, m.description, err)
+		}
+		fmt.Printf("  %d: %s (%d records)\n", m.version, m.description, n)
+	}
+	fmt.Println("Dry run, nothing was written.")
+	return nil
+}
+
+// backupDB copies the database to a file named after it, the schema version and the current time.
+func backupDB(db *bolt.DB, version int) (string, error) {
+	path := fmt.Sprintf("%s.v%d-%s.bak", db.Path(), version, time.Now().Format("20060102150405"))
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(path, 0600)
+	})
+	return path, err
+}
+
+// runMigrateCommand implements "anansi migrate [-dry-run]". It runs before the store is opened, since
+// opening the bolt store applies any pending migrations.
+func runMigrateCommand(cfg Config, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "report pending migrations without applying them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if !*dryRun {
+		db, err := setupDB(cfg.DB)
+		if err != nil {
+			return err
+		}
+		return db.Close()
+	}
+	db, err := openBolt(cfg.DB)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return dryRunMigrations(db)
+}
+
+// MIGRATIONS
+
+// migrateSingleValueEdges converts the edges of databases written before edges were multi-valued.
+// Those kept one JSON value per key: the content a tag was last applied to under the tag's slug in
+// EDGE_BY_TAG, and the tag last applied to a content item under its hash in EDGE_BY_CONTENT.
+// Each value becomes an edge in the nested buckets. Edges to records that no longer exist are dropped.
+func migrateSingleValueEdges(tx *bolt.Tx) (int, error) {
+	root := tx.Bucket([]byte(topLevelBucket))
+	edges := []Edge{}
+	legacy := map[string][]string{}
+	for _, side := range []string{edgeByTagBucket, edgeByContentBucket} {
+		err := root.Bucket([]byte(side)).ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil // Already a nested bucket.
+			}
+			legacy[side] = append(legacy[side], string(k))
+			if side == edgeByTagBucket {
+				content := Content{}
+				if err := json.Unmarshal(v, &content); err != nil {
+					return err
+				}
+				edges = append(edges, Edge{Tag: string(k), Content: content.Hash})
+			} else {
+				tag := Tag{}
+				if err := json.Unmarshal(v, &tag); err != nil {
+					return err
+				}
+				edges = append(edges, Edge{Tag: tag.Slug, Content: string(k)})
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("could not read %s: %v", side, err)
+		}
+	}
+	for side, keys := range legacy {
+		for _, k := range keys {
+			if err := root.Bucket([]byte(side)).Delete([]byte(k)); err != nil {
+				return 0, err
+			}
+		}
+	}
+	n := 0
+	seen := map[Edge]bool{}
+	for _, edge := range edges {
+		if seen[edge] {
+			continue
+		}
+		seen[edge] = true
+		content, err := lookupContent(tx, edge.Content)
+		if err != nil {
+			return 0, err
+		}
+		tag, err := lookupTag(tx, edge.Tag)
+		if err != nil {
+			return 0, err
+		}
+		if content == nil || tag == nil {
+			continue
+		}
+		// The old layout did not record when a tag was applied, so the later of the two records stands in.
+		edge.CreatedAt = content.CreatedAt
+		if tag.CreatedAt.After(edge.CreatedAt) {
+			edge.CreatedAt = tag.CreatedAt
+		}
+		if err := putEdge(tx, edge); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// migrateAdminRoles makes the accounts created before roles existed admins, since they could do anything.
+func migrateAdminRoles(tx *bolt.Tx) (int, error) {
+	users := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(userBucket))
+	if users == nil {
+		return 0, nil
+	}
+	updated := []User{}
+	err := users.ForEach(func(k, v []byte) error {
+		user := User{}
+		if err := json.Unmarshal(v, &user); err != nil {
+			return err
+		}
+		if user.Role == "" {
+			user.Role = "admin"
+			updated = append(updated, user)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, user := range updated {
+		if err := putUser(tx, user); err != nil {
+			return 0, err
+		}
+	}
+	return len(updated), nil
+}
+
+// migrateFirstRevisions starts the history of every content item and tag with the record as it is, so the
+// first change after the upgrade can be undone. Before UpdatedAt existed every change reset CreatedAt, so
+// CreatedAt is the best guess at when a record last changed and becomes its UpdatedAt.
+func migrateFirstRevisions(tx *bolt.Tx) (int, error) {
+	root := tx.Bucket([]byte(topLevelBucket))
+	n := 0
+	for _, kind := range []historyKind{contentHistory, tagHistory} {
+		records := root.Bucket([]byte(contentBucket))
+		if kind == tagHistory {
+			records = root.Bucket([]byte(tagBucket))
+		}
+		if records == nil {
+			continue
+		}
+		type record struct {
+			key  string
+			data []byte
+		}
+		pending := []record{}
+		err := records.ForEach(func(k, v []byte) error {
+			pending = append(pending, record{string(k), append([]byte{}, v...)})
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		for _, r := range pending {
+			revision := Revision{}
+			var when time.Time
+			if kind == contentHistory {
+				content := Content{}
+				if err := json.Unmarshal(r.data, &content); err != nil {
+					return 0, err
+				}
+				content.UpdatedAt = content.CreatedAt
+				revision.Author, revision.Content, when = content.Author, &content, content.CreatedAt
+				if err := putRecord(records, r.key, content); err != nil {
+					return 0, err
+				}
+			} else {
+				tag := Tag{}
+				if err := json.Unmarshal(r.data, &tag); err != nil {
+					return 0, err
+				}
+				tag.UpdatedAt = tag.CreatedAt
+				revision.Author, revision.Tag, when = tag.Author, &tag, tag.CreatedAt
+				if err := putRecord(records, r.key, tag); err != nil {
+					return 0, err
+				}
+			}
+			if err := recordRevision(tx, kind, r.key, revision, when); err != nil {
+				return 0, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// putRecord writes a record as JSON into a bucket.
+func putRecord(b *bolt.Bucket, key string, record interface{}) error {
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), buf)
+}
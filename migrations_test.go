@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// baselineDB copies the database committed with the repository, which predates the schema version, into a
+// temporary directory and returns the path of the copy.
+func baselineDB(t *testing.T) string {
+	t.Helper()
+	data, err := ioutil.ReadFile("anansi.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "anansi.db")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// backups returns the backups migrateDB wrote of the database at path.
+func backups(t *testing.T, path string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(path + ".v*.bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+// dbVersion opens the database at path and returns its schema version.
+func dbVersion(t *testing.T, path string) int {
+	t.Helper()
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var version int
+	db.View(func(tx *bolt.Tx) error {
+		version = schemaVersion(tx)
+		return nil
+	})
+	return version
+}
+
+func TestMigrateBaselineDB(t *testing.T) {
+	path := baselineDB(t)
+	if v := dbVersion(t, path); v != 0 {
+		t.Fatalf("the baseline database is at schema version %d, want 0", v)
+	}
+	db, err := setupDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var version int
+	db.View(func(tx *bolt.Tx) error {
+		version = schemaVersion(tx)
+		return nil
+	})
+	if version != currentSchemaVersion() {
+		t.Errorf("migrated to schema version %d, want %d", version, currentSchemaVersion())
+	}
+
+	store := &boltStore{db: db}
+	content, _, err := store.ListContent(ListOptions{Limit: 10, Sort: "created", Order: "asc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != 1 {
+		t.Fatalf("%d content after migrating, want the 1 in the baseline", len(content))
+	}
+	if !content[0].UpdatedAt.Equal(content[0].CreatedAt) {
+		t.Errorf("content updated at %v, want its creation time %v", content[0].UpdatedAt, content[0].CreatedAt)
+	}
+	revisions, err := listRevisions(db, contentHistory, content[0].Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 {
+		t.Errorf("%d revisions of the content after migrating, want its first one", len(revisions))
+	}
+	tags, _, err := store.ListTags(ListOptions{Limit: 10, Sort: "created", Order: "asc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 {
+		t.Errorf("%d tags after migrating, want the 1 in the baseline", len(tags))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	found := backups(t, path)
+	if len(found) != 1 || !strings.HasPrefix(filepath.Base(found[0]), "anansi.db.v0-") {
+		t.Fatalf("backups %v, want one of version 0", found)
+	}
+	if v := dbVersion(t, found[0]); v != 0 {
+		t.Errorf("the backup is at schema version %d, want 0", v)
+	}
+
+	// Opening a migrated database again has nothing to do.
+	db, err = setupDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if found := backups(t, path); len(found) != 1 {
+		t.Errorf("backups %v after opening the migrated database again, want only the first", found)
+	}
+}
+
+func TestMigrateDryRunWritesNothing(t *testing.T) {
+	path := baselineDB(t)
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	err = runMigrateCommand(Config{DB: path}, []string{"-dry-run"})
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("the dry run changed the database")
+	}
+	if v := dbVersion(t, path); v != 0 {
+		t.Errorf("schema version %d after the dry run, want 0", v)
+	}
+	if found := backups(t, path); len(found) != 0 {
+		t.Errorf("the dry run wrote backups %v", found)
+	}
+	report, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations {
+		if !strings.Contains(string(report), m.description) {
+			t.Errorf("the dry run did not report migration %d: %s", m.version, report)
+		}
+	}
+	if !strings.Contains(string(report), "nothing was written") {
+		t.Errorf("the dry run did not say nothing was written: %s", report)
+	}
+}
+
+func TestMigrateSingleValueEdges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "anansi.db")
+	old, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contentCreated := time.Date(2021, 5, 21, 15, 0, 0, 0, time.UTC)
+	tagCreated := contentCreated.Add(time.Hour)
+	dog := Tag{Slug: "dog", Label: "Dog", CreatedAt: tagCreated}
+	park := Tag{Slug: "park", Label: "Park", CreatedAt: contentCreated}
+	photo := Content{Hash: "photo", Label: "A dog in a park", CreatedAt: contentCreated}
+	err = old.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucket([]byte(topLevelBucket))
+		if err != nil {
+			return err
+		}
+		records := map[string]map[string]interface{}{
+			contentBucket: {"photo": photo},
+			tagBucket:     {"dog": dog, "park": park},
+			// Single values: the content a tag was last applied to, and the tag last applied to content.
+			edgeByTagBucket:     {"dog": photo, "park": photo, "cat": photo},
+			edgeByContentBucket: {"photo": park, "gone": dog},
+			userBucket:          {"stephen": User{Username: "stephen", CreatedAt: contentCreated}},
+		}
+		for name, values := range records {
+			b, err := root.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			for k, v := range values {
+				buf, err := json.Marshal(v)
+				if err != nil {
+					return err
+				}
+				if err := b.Put([]byte(k), buf); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := setupDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store := &boltStore{db: db}
+	tags, err := store.TagsForContent("photo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(tagSlugs(tags), " "); got != "dog park" {
+		t.Errorf("tags of the photo %q after migrating, want dog park", got)
+	}
+	edge, err := store.GetEdge("dog", "photo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !edge.CreatedAt.Equal(tagCreated) {
+		t.Errorf("edge created at %v, want the later of its content and tag, %v", edge.CreatedAt, tagCreated)
+	}
+	// Edges to a tag or content that no longer exists are dropped.
+	if _, err := store.GetEdge("cat", "photo"); err == nil {
+		t.Error("the edge to the missing cat tag was kept")
+	}
+	if _, err := store.GetEdge("dog", "gone"); err == nil {
+		t.Error("the edge to the missing content was kept")
+	}
+	var role string
+	var version int
+	db.View(func(tx *bolt.Tx) error {
+		version = schemaVersion(tx)
+		user := User{}
+		if v := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(userBucket)).Get([]byte("stephen")); v != nil {
+			json.Unmarshal(v, &user)
+		}
+		role = user.Role
+		return nil
+	})
+	if role != "admin" {
+		t.Errorf("the account from before roles has role %q, want admin", role)
+	}
+	if version != currentSchemaVersion() {
+		t.Errorf("migrated to schema version %d, want %d", version, currentSchemaVersion())
+	}
+	if found := backups(t, path); len(found) != 1 {
+		t.Errorf("backups %v, want one", found)
+	}
+}
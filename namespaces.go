@@ -0,0 +1,602 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+// Namespaces group tags by what they say about content, eg. artist:monet and artist:turner, or
+// project:apollo. A tag's Namespace holds the name of its namespace and its Label the value, and it is
+// written namespace:label. NAMESPACES maps each name to a serialized Namespace, and NAMESPACE_TAGS holds a
+// nested bucket per namespace with the slugs of its tags as keys, so artist:* is one bucket scan.
+const namespaceBucket = "NAMESPACES"
+const namespaceTagsBucket = "NAMESPACE_TAGS"
+
+var errNamespaceNotFound = errors.New("namespace not found")
+var errNamespaceExists = errors.New("namespace already exists")
+var errNamespaceInUse = errors.New("namespace still has tags")
+var errBadNamespace = errors.New("bad namespace")
+
+// errNamespaceExclusive is returned when applying a tag would give content a second value of an exclusive namespace.
+var errNamespaceExclusive = errors.New("namespace is exclusive")
+
+var namespaceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+var namespaceColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// Namespace is the definition of a namespace. Content can have only one tag of an exclusive namespace,
+// eg. a type:photo can not also be a type:video.
+type Namespace struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Color       string    `json:"color,omitempty"` // A CSS hex color, eg. #ff4f98, to show the namespace's tags in.
+	Exclusive   bool      `json:"exclusive"`
+	CreatedAt   time.Time `json:"createdAt,omitempty"`
+}
+
+// TagGroup is the tags of one namespace on a page of the tag list. Tags without a namespace are grouped
+// last, with an empty Name and no Namespace.
+type TagGroup struct {
+	Name      string
+	Namespace *Namespace
+	Tags      []Tag
+}
+
+// splitNamespace splits a name written namespace:label. ok is false when name has no namespace.
+func splitNamespace(name string) (namespace string, label string, ok bool) {
+	i := strings.Index(name, ":")
+	if i <= 0 || !namespaceNamePattern.MatchString(name[:i]) {
+		return "", name, false
+	}
+	return name[:i], name[i+1:], true
+}
+
+// tagName is how a tag is written: namespace:label, or the label when it has no namespace.
+func tagName(tag Tag) string {
+	if tag.Namespace == "" {
+		return tag.Label
+	}
+	return tag.Namespace + ":" + tag.Label
+}
+
+// groupTags groups a page of tags by namespace, namespaces in order of their names and tags in the order given.
+func groupTags(tags []Tag, namespaces []Namespace) []TagGroup {
+	byName := map[string]*TagGroup{}
+	for i := range namespaces {
+		byName[namespaces[i].Name] = &TagGroup{Name: namespaces[i].Name, Namespace: &namespaces[i]}
+	}
+	plain := &TagGroup{}
+	for _, tag := range tags {
+		if tag.Namespace == "" {
+			plain.Tags = append(plain.Tags, tag)
+			continue
+		}
+		group, ok := byName[tag.Namespace]
+		if !ok {
+			group = &TagGroup{Name: tag.Namespace}
+			byName[tag.Namespace] = group
+		}
+		group.Tags = append(group.Tags, tag)
+	}
+	groups := []TagGroup{}
+	for _, group := range byName {
+		if len(group.Tags) > 0 {
+			groups = append(groups, *group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	if len(plain.Tags) > 0 {
+		groups = append(groups, *plain)
+	}
+	return groups
+}
+
+// NAMESPACE HANDLERS
+
+// writeNamespaceError answers a request that failed with err as plain text.
+func writeNamespaceError(res http.ResponseWriter, err error) {
+	res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	switch {
+	case errors.Is(err, errNamespaceNotFound):
+		res.WriteHeader(http.StatusNotFound)
+		res.Write([]byte("Namespace not found."))
+	case errors.Is(err, errNamespaceExists), errors.Is(err, errNamespaceInUse):
+		res.WriteHeader(http.StatusConflict)
+		res.Write([]byte(err.Error()))
+	case errors.Is(err, errBadNamespace):
+		res.WriteHeader(422) // unprocessable entity
+		res.Write([]byte(err.Error()))
+	default:
+		res.WriteHeader(http.StatusInternalServerError)
+		res.Write([]byte("Error accessing the DB."))
+	}
+}
+
+// writeJSON answers a request with v as JSON.
+func writeJSON(res http.ResponseWriter, status int, v interface{}) {
+	res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	res.WriteHeader(status)
+	if err := json.NewEncoder(res).Encode(v); err != nil {
+		panic(err)
+	}
+}
+
+// listNamespacesHandler returns every namespace as JSON.
+func listNamespacesHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		namespaces, err := listNamespaces(db)
+		if err != nil {
+			writeNamespaceError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, namespaces)
+	}
+	return fn
+}
+
+// getNamespaceHandler returns the namespace in the URL as JSON.
+func getNamespaceHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		namespace, err := getNamespace(db, mux.Vars(r)["name"])
+		if err != nil {
+			writeNamespaceError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, namespace)
+	}
+	return fn
+}
+
+// createNamespaceHandler defines the namespace in the JSON body, eg. {"name": "artist", "exclusive": false}.
+func createNamespaceHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var namespace Namespace
+		if !readJSONBody(res, r, &namespace) {
+			return
+		}
+		created, err := createNamespace(db, namespace)
+		if err != nil {
+			writeNamespaceError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusCreated, created)
+	}
+	return fn
+}
+
+// modifyNamespaceHandler replaces the description, color and exclusivity of the namespace in the URL.
+func modifyNamespaceHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var namespace Namespace
+		if !readJSONBody(res, r, &namespace) {
+			return
+		}
+		modified, err := modifyNamespace(db, mux.Vars(r)["name"], namespace)
+		if err != nil {
+			writeNamespaceError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, modified)
+	}
+	return fn
+}
+
+// deleteNamespaceHandler deletes the namespace in the URL. Namespaces that still have tags are kept.
+func deleteNamespaceHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		if err := deleteNamespace(db, mux.Vars(r)["name"]); err != nil {
+			writeNamespaceError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, struct {
+			Deleted bool
+		}{true})
+	}
+	return fn
+}
+
+// listNamespaceTagsHandler returns the tags of the namespace in the URL as JSON, by label.
+func listNamespaceTagsHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		tags, err := namespaceTags(db, mux.Vars(r)["name"])
+		if err != nil {
+			writeNamespaceError(res, err)
+			return
+		}
+		writeJSON(res, http.StatusOK, tags)
+	}
+	return fn
+}
+
+// NAMESPACE API HANDLERS
+
+// apiListNamespacesHandler returns every namespace.
+func apiListNamespacesHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		namespaces, err := listNamespaces(db)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIList(res, namespaces, nil)
+	}
+	return fn
+}
+
+// apiGetNamespaceHandler returns the namespace in the URL.
+func apiGetNamespaceHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		namespace, err := getNamespace(db, mux.Vars(r)["name"])
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, namespace)
+	}
+	return fn
+}
+
+// apiCreateNamespaceHandler defines the namespace in the body.
+func apiCreateNamespaceHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var namespace Namespace
+		if !readAPIBody(res, r, &namespace) {
+			return
+		}
+		created, err := createNamespace(db, namespace)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		res.Header().Set("Location", "/api/v1/namespaces/"+created.Name)
+		writeAPIData(res, http.StatusCreated, created)
+	}
+	return fn
+}
+
+// apiModifyNamespaceHandler replaces the description, color and exclusivity of the namespace in the URL.
+func apiModifyNamespaceHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var namespace Namespace
+		if !readAPIBody(res, r, &namespace) {
+			return
+		}
+		modified, err := modifyNamespace(db, mux.Vars(r)["name"], namespace)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIData(res, http.StatusOK, modified)
+	}
+	return fn
+}
+
+// apiDeleteNamespaceHandler deletes the namespace in the URL.
+func apiDeleteNamespaceHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		if err := deleteNamespace(db, mux.Vars(r)["name"]); err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		res.WriteHeader(http.StatusNoContent)
+	}
+	return fn
+}
+
+// apiListNamespaceTagsHandler returns the tags of the namespace in the URL, by label.
+func apiListNamespaceTagsHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		tags, err := namespaceTags(db, mux.Vars(r)["name"])
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIList(res, tags, nil)
+	}
+	return fn
+}
+
+// DATA STORE FUNCTIONS
+
+// validateNamespace checks the name and color of a namespace.
+func validateNamespace(namespace Namespace) error {
+	if !namespaceNamePattern.MatchString(namespace.Name) {
+		return fmt.Errorf("%w: %q, a name is up to 64 lower case letters, digits, - and _", errBadNamespace, namespace.Name)
+	}
+	if namespace.Color != "" && !namespaceColorPattern.MatchString(namespace.Color) {
+		return fmt.Errorf("%w: color %q, use #rrggbb", errBadNamespace, namespace.Color)
+	}
+	return nil
+}
+
+// createNamespace defines a namespace and returns it as stored.
+func createNamespace(db *bolt.DB, namespace Namespace) (*Namespace, error) {
+	namespace.Name = strings.TrimSpace(namespace.Name)
+	if err := validateNamespace(namespace); err != nil {
+		return nil, err
+	}
+	namespace.CreatedAt = time.Now()
+	err := db.Update(func(tx *bolt.Tx) error {
+		existing, err := lookupNamespace(tx, namespace.Name)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return fmt.Errorf("%w: %s", errNamespaceExists, namespace.Name)
+		}
+		return putNamespace(tx, namespace)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &namespace, nil
+}
+
+// modifyNamespace replaces the description, color and exclusivity of a namespace. Making a namespace
+// exclusive does not change content that already has several of its tags; it stops more being applied.
+func modifyNamespace(db *bolt.DB, name string, namespace Namespace) (*Namespace, error) {
+	namespace.Name = name
+	if err := validateNamespace(namespace); err != nil {
+		return nil, err
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		existing, err := lookupNamespace(tx, name)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return errNamespaceNotFound
+		}
+		namespace.CreatedAt = existing.CreatedAt
+		return putNamespace(tx, namespace)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &namespace, nil
+}
+
+// deleteNamespace removes the definition of a namespace that no tag is in.
+func deleteNamespace(db *bolt.DB, name string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		existing, err := lookupNamespace(tx, name)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			return errNamespaceNotFound
+		}
+		if slugs := namespaceSlugs(tx, name); len(slugs) > 0 {
+			return fmt.Errorf("%w: %s has %d, move or delete them first", errNamespaceInUse, name, len(slugs))
+		}
+		root := tx.Bucket([]byte(topLevelBucket))
+		if root.Bucket([]byte(namespaceTagsBucket)).Bucket([]byte(name)) != nil {
+			if err := root.Bucket([]byte(namespaceTagsBucket)).DeleteBucket([]byte(name)); err != nil {
+				return fmt.Errorf("could not delete namespace_tags: %v", err)
+			}
+		}
+		return root.Bucket([]byte(namespaceBucket)).Delete([]byte(name))
+	})
+}
+
+// getNamespace reads a namespace.
+func getNamespace(db *bolt.DB, name string) (*Namespace, error) {
+	var namespace *Namespace
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		namespace, err = lookupNamespace(tx, name)
+		if err == nil && namespace == nil {
+			err = errNamespaceNotFound
+		}
+		return err
+	})
+	return namespace, err
+}
+
+// listNamespaces returns every namespace, by name.
+func listNamespaces(db *bolt.DB) ([]Namespace, error) {
+	results := []Namespace{}
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(namespaceBucket)).ForEach(func(k, v []byte) error {
+			namespace := Namespace{}
+			if err := json.Unmarshal(v, &namespace); err != nil {
+				return err
+			}
+			results = append(results, namespace)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// namespaceTags returns the tags in a namespace, by label.
+func namespaceTags(db *bolt.DB, name string) ([]Tag, error) {
+	results := []Tag{}
+	err := db.View(func(tx *bolt.Tx) error {
+		namespace, err := lookupNamespace(tx, name)
+		if err != nil {
+			return err
+		}
+		if namespace == nil {
+			return errNamespaceNotFound
+		}
+		for _, slug := range namespaceSlugs(tx, name) {
+			tag, err := lookupTag(tx, slug)
+			if err != nil {
+				return err
+			}
+			if tag != nil {
+				results = append(results, *tag)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(results, func(i, j int) bool { return strings.ToLower(results[i].Label) < strings.ToLower(results[j].Label) })
+	return results, nil
+}
+
+// lookupNamespace reads a namespace inside an existing transaction. It returns nil if there is no such namespace.
+func lookupNamespace(tx *bolt.Tx, name string) (*Namespace, error) {
+	b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(namespaceBucket))
+	if b == nil {
+		return nil, nil
+	}
+	v := b.Get([]byte(name))
+	if v == nil {
+		return nil, nil
+	}
+	namespace := Namespace{}
+	if err := json.Unmarshal(v, &namespace); err != nil {
+		return nil, err
+	}
+	return &namespace, nil
+}
+
+// putNamespace writes a namespace inside an existing transaction.
+func putNamespace(tx *bolt.Tx, namespace Namespace) error {
+	if err := putRecord(tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(namespaceBucket)), namespace.Name, namespace); err != nil {
+		return fmt.Errorf("could not insert namespace: %v", err)
+	}
+	return nil
+}
+
+// namespaceSlugs returns the slugs of the tags in a namespace inside an existing transaction.
+func namespaceSlugs(tx *bolt.Tx, name string) []string {
+	b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(namespaceTagsBucket))
+	if b == nil {
+		return []string{}
+	}
+	slugs := []string{}
+	if b = b.Bucket([]byte(name)); b == nil {
+		return slugs
+	}
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		slugs = append(slugs, string(k))
+	}
+	return slugs
+}
+
+// settleTagNamespace checks the namespace of a tag about to be written inside an existing transaction. A tag
+// without a namespace whose label is written namespace:label for a namespace that exists is moved into it. A
+// namespace named by a tag that has not been defined yet is defined, so imported tags keep their namespaces.
+func settleTagNamespace(tx *bolt.Tx, tag *Tag) error {
+	if tag.Namespace == "" {
+		if name, label, ok := splitNamespace(tag.Label); ok && label != "" {
+			namespace, err := lookupNamespace(tx, name)
+			if err != nil {
+				return err
+			}
+			if namespace != nil {
+				tag.Namespace, tag.Label = name, label
+			}
+		}
+		return nil
+	}
+	namespace, err := lookupNamespace(tx, tag.Namespace)
+	if err != nil || namespace != nil {
+		return err
+	}
+	if err := validateNamespace(Namespace{Name: tag.Namespace}); err != nil {
+		return err
+	}
+	if tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(namespaceBucket)) == nil {
+		return nil
+	}
+	return putNamespace(tx, Namespace{Name: tag.Namespace, CreatedAt: time.Now()})
+}
+
+// indexTagNamespace moves a tag between namespaces in NAMESPACE_TAGS inside an existing transaction.
+// An empty namespace is no namespace.
+func indexTagNamespace(tx *bolt.Tx, slug string, from string, to string) error {
+	if from == to {
+		return nil
+	}
+	b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(namespaceTagsBucket))
+	if b == nil {
+		return nil
+	}
+	if from != "" {
+		if inner := b.Bucket([]byte(from)); inner != nil {
+			if err := inner.Delete([]byte(slug)); err != nil {
+				return fmt.Errorf("could not delete namespace_tags: %v", err)
+			}
+		}
+	}
+	if to != "" {
+		inner, err := b.CreateBucketIfNotExists([]byte(to))
+		if err != nil {
+			return fmt.Errorf("could not insert namespace_tags: %v", err)
+		}
+		if err := inner.Put([]byte(slug), []byte{}); err != nil {
+			return fmt.Errorf("could not insert namespace_tags: %v", err)
+		}
+	}
+	return nil
+}
+
+// exclusiveConflict returns the slug of a tag among applied, the slugs of the tags on some content, that is
+// in the same exclusive namespace as the tag with the slug. It returns "" when applying the tag is fine.
+func exclusiveConflict(tx *bolt.Tx, slug string, applied []string) (string, error) {
+	tag, err := lookupTag(tx, slug)
+	if err != nil || tag == nil || tag.Namespace == "" {
+		return "", err
+	}
+	namespace, err := lookupNamespace(tx, tag.Namespace)
+	if err != nil || namespace == nil || !namespace.Exclusive {
+		return "", err
+	}
+	for _, other := range applied {
+		if other == slug {
+			continue
+		}
+		t, err := lookupTag(tx, other)
+		if err != nil {
+			return "", err
+		}
+		if t != nil && t.Namespace == tag.Namespace {
+			return other, nil
+		}
+	}
+	return "", nil
+}
+
+// exclusiveError describes applying a tag that conflicts with another of its exclusive namespace.
+func exclusiveError(tx *bolt.Tx, slug string, conflict string) error {
+	tag, _ := lookupTag(tx, slug)
+	other, _ := lookupTag(tx, conflict)
+	if tag == nil || other == nil {
+		return fmt.Errorf("%w: %s conflicts with %s", errNamespaceExclusive, slug, conflict)
+	}
+	return fmt.Errorf("%w: the content already has %s, remove it before applying %s", errNamespaceExclusive, tagName(*other), tagName(*tag))
+}
+
+// setupNamespaces creates the namespace buckets.
+func setupNamespaces(root *bolt.Bucket) error {
+	for _, name := range []string{namespaceBucket, namespaceTagsBucket} {
+		if _, err := root.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return fmt.Errorf("could not create %s bucket: %v", strings.ToLower(name), err)
+		}
+	}
+	return nil
+}
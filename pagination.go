@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Sort indexes keep content and tags ordered by creation time and by label so listings can page
+// through them with a bolt cursor instead of loading every record. Each index maps
+// "<sort key>\x00<slug>" to the slug; the slug suffix keeps keys unique when two records share a sort key.
+const (
+	contentByCreatedBucket = "CONTENT_BY_CREATED"
+	contentByLabelBucket   = "CONTENT_BY_LABEL"
+	tagByCreatedBucket     = "TAGS_BY_CREATED"
+	tagByLabelBucket       = "TAGS_BY_LABEL"
+)
+
+// contentSortIndexes and tagSortIndexes map each supported sort order to the bucket that holds it.
+var contentSortIndexes = map[string]string{"created": contentByCreatedBucket, "label": contentByLabelBucket}
+var tagSortIndexes = map[string]string{"created": tagByCreatedBucket, "label": tagByLabelBucket}
+
+const defaultPageLimit = 50
+const maxPageLimit = 500
+
+var errBadListOptions = errors.New("invalid list options")
+
+// ListOptions selects one page of a listing.
+type ListOptions struct {
+	Limit  int
+	Cursor string
+	Sort   string // "created" or "label"
+	Order  string // "asc" or "desc"
+}
+
+// PageInfo describes the page returned for a ListOptions and holds the cursors of the pages either side of it.
+// Next and Prev are empty when there is nothing further in that direction.
+type PageInfo struct {
+	Limit int    `json:"limit"`
+	Sort  string `json:"sort"`
+	Order string `json:"order"`
+	Next  string `json:"next,omitempty"`
+	Prev  string `json:"prev,omitempty"`
+}
+
+// ListPage is the JSON body of a listing. Page is nil for lists that are returned whole.
+type ListPage struct {
+	Data interface{} `json:"data"`
+	Page *PageInfo   `json:"page,omitempty"`
+}
+
+// NextLink is the query string of the following page, for use in templates.
+func (p PageInfo) NextLink() string {
+	return p.link(p.Next)
+}
+
+// PrevLink is the query string of the preceding page, for use in templates.
+func (p PageInfo) PrevLink() string {
+	return p.link(p.Prev)
+}
+
+func (p PageInfo) link(cursor string) string {
+	v := url.Values{}
+	v.Set("limit", strconv.Itoa(p.Limit))
+	v.Set("sort", p.Sort)
+	v.Set("order", p.Order)
+	v.Set("cursor", cursor)
+	return "?" + v.Encode()
+}
+
+// parseListOptions reads ?limit=&cursor=&sort=&order= from a request. Listings default to the newest
+// items first, or to alphabetical order when sorting by label.
+func parseListOptions(r *http.Request) (ListOptions, error) {
+	q := r.URL.Query()
+	opts := ListOptions{Limit: defaultPageLimit, Cursor: q.Get("cursor"), Sort: q.Get("sort"), Order: q.Get("order")}
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return opts, fmt.Errorf("%w: limit must be between 1 and %d", errBadListOptions, maxPageLimit)
+		}
+		opts.Limit = n
+	}
+	switch opts.Sort {
+	case "":
+		opts.Sort = "created"
+	case "created", "label":
+	default:
+		return opts, fmt.Errorf("%w: sort must be created or label", errBadListOptions)
+	}
+	switch opts.Order {
+	case "":
+		opts.Order = "asc"
+		if opts.Sort == "created" {
+			opts.Order = "desc"
+		}
+	case "asc", "desc":
+	default:
+		return opts, fmt.Errorf("%w: order must be asc or desc", errBadListOptions)
+	}
+	return opts, nil
+}
+
+// createdSortKey formats a time so that byte order matches chronological order.
+func createdSortKey(t time.Time) string {
+	return t.UTC().Format("20060102150405.000000000")
+}
+
+// labelSortKey folds case so that labels sort alphabetically regardless of capitalisation.
+func labelSortKey(label string) string {
+	return strings.ToLower(label)
+}
+
+func contentSortKeys(content *Content) map[string]string {
+	if content == nil {
+		return nil
+	}
+	return map[string]string{"created": createdSortKey(content.CreatedAt), "label": labelSortKey(content.Label)}
+}
+
+func tagSortKeys(tag *Tag) map[string]string {
+	if tag == nil {
+		return nil
+	}
+	return map[string]string{"created": createdSortKey(tag.CreatedAt), "label": labelSortKey(tag.Label)}
+}
+
+func sortIndexKey(sortKey string, slug string) []byte {
+	return []byte(sortKey + "\x00" + slug)
+}
+
+// reindexSortKeys replaces the sort index entries built from old with ones built from new.
+// Either may be nil, for a record that is being created or deleted.
+func reindexSortKeys(tx *bolt.Tx, indexes map[string]string, slug string, old map[string]string, new map[string]string) error {
+	root := tx.Bucket([]byte(topLevelBucket))
+	for order, key := range old {
+		if k, ok := new[order]; ok && k == key {
+			continue
+		}
+		if err := root.Bucket([]byte(indexes[order])).Delete(sortIndexKey(key, slug)); err != nil {
+			return fmt.Errorf("could not delete sort key: %v", err)
+		}
+	}
+	for order, key := range new {
+		if err := root.Bucket([]byte(indexes[order])).Put(sortIndexKey(key, slug), []byte(slug)); err != nil {
+			return fmt.Errorf("could not insert sort key: %v", err)
+		}
+	}
+	return nil
+}
+
+// setupSortIndexes creates the sort index buckets, filling them from the stored records when they are new.
+func setupSortIndexes(tx *bolt.Tx) error {
+	root := tx.Bucket([]byte(topLevelBucket))
+	fresh := map[string]bool{}
+	for _, name := range []string{contentByCreatedBucket, contentByLabelBucket, tagByCreatedBucket, tagByLabelBucket} {
+		if root.Bucket([]byte(name)) != nil {
+			continue
+		}
+		if _, err := root.CreateBucket([]byte(name)); err != nil {
+			return fmt.Errorf("could not create %s bucket: %v", strings.ToLower(name), err)
+		}
+		fresh[name] = true
+	}
+	if fresh[contentByCreatedBucket] || fresh[contentByLabelBucket] {
+		err := root.Bucket([]byte(contentBucket)).ForEach(func(k, v []byte) error {
+			content := Content{}
+			if err := json.Unmarshal(v, &content); err != nil {
+				return err
+			}
+			return reindexSortKeys(tx, contentSortIndexes, string(k), nil, contentSortKeys(&content))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if fresh[tagByCreatedBucket] || fresh[tagByLabelBucket] {
+		err := root.Bucket([]byte(tagBucket)).ForEach(func(k, v []byte) error {
+			tag := Tag{}
+			if err := json.Unmarshal(v, &tag); err != nil {
+				return err
+			}
+			return reindexSortKeys(tx, tagSortIndexes, string(k), nil, tagSortKeys(&tag))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A cursor is an index key and a direction, base64 encoded so it can travel in a query string.
+// "a" cursors select the items after the key in the listing's order, "b" cursors the items before it.
+func encodeCursor(dir byte, key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(append([]byte{dir}, key...))
+}
+
+func decodeCursor(cursor string) (before bool, key []byte, err error) {
+	if cursor == "" {
+		return false, nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(b) < 2 || (b[0] != 'a' && b[0] != 'b') {
+		return false, nil, fmt.Errorf("%w: malformed cursor", errBadListOptions)
+	}
+	return b[0] == 'b', b[1:], nil
+}
+
+// stepFrom positions c on the first key strictly past from, moving forwards or backwards through the bucket.
+func stepFrom(c *bolt.Cursor, from []byte, forwards bool) ([]byte, []byte) {
+	k, v := c.Seek(from)
+	if forwards {
+		if k != nil && bytes.Equal(k, from) {
+			return c.Next()
+		}
+		return k, v
+	}
+	if k == nil {
+		return c.Last()
+	}
+	return c.Prev()
+}
+
+// indexWalker reads up to n entries of a sort index, starting just past from, or at the start of the index
+// when from is nil. It moves through the index in ascending key order when forwards is true and in descending
+// order otherwise, and returns the keys and slugs it read. Each store walks its own kind of index.
+type indexWalker func(from []byte, forwards bool, n int) ([][]byte, []string, error)
+
+// pageIndex returns the slugs on the page selected by opts, reading the sort index with walk.
+func pageIndex(walk indexWalker, opts ListOptions) ([]string, PageInfo, error) {
+	info := PageInfo{Limit: opts.Limit, Sort: opts.Sort, Order: opts.Order}
+	before, from, err := decodeCursor(opts.Cursor)
+	if err != nil {
+		return nil, info, err
+	}
+	// Ascending listings read the index forwards. Pages before a cursor are read against the listing's order.
+	ascending := opts.Order == "asc"
+	keys, slugs, err := walk(from, ascending != before, opts.Limit)
+	if err != nil {
+		return nil, info, err
+	}
+	if before {
+		for i, j := 0, len(slugs)-1; i < j; i, j = i+1, j-1 {
+			keys[i], keys[j] = keys[j], keys[i]
+			slugs[i], slugs[j] = slugs[j], slugs[i]
+		}
+	}
+
+	// Only hand out cursors for directions that have more items.
+	first, last := from, from
+	if len(keys) > 0 {
+		first, last = keys[0], keys[len(keys)-1]
+	}
+	if last != nil {
+		more, _, err := walk(last, ascending, 1)
+		if err != nil {
+			return nil, info, err
+		}
+		if len(more) > 0 {
+			info.Next = encodeCursor('a', last)
+		}
+	}
+	if first != nil {
+		more, _, err := walk(first, !ascending, 1)
+		if err != nil {
+			return nil, info, err
+		}
+		if len(more) > 0 {
+			info.Prev = encodeCursor('b', first)
+		}
+	}
+	return slugs, info, nil
+}
+
+// boltIndexWalker walks the sort index bucket name with a bolt cursor. Keys are only valid for the life of tx.
+func boltIndexWalker(tx *bolt.Tx, name string) indexWalker {
+	return func(from []byte, forwards bool, n int) ([][]byte, []string, error) {
+		c := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(name)).Cursor()
+		var keys [][]byte
+		var slugs []string
+		var k, v []byte
+		switch {
+		case from != nil:
+			k, v = stepFrom(c, from, forwards)
+		case forwards:
+			k, v = c.First()
+		default:
+			k, v = c.Last()
+		}
+		for ; k != nil && len(slugs) < n; k, v = stepOn(c, forwards) {
+			keys = append(keys, k)
+			slugs = append(slugs, string(v))
+		}
+		return keys, slugs, nil
+	}
+}
+
+func stepOn(c *bolt.Cursor, forwards bool) ([]byte, []byte) {
+	if forwards {
+		return c.Next()
+	}
+	return c.Prev()
+}
+
+// indexEntry is one entry of a sort index held in memory.
+type indexEntry struct {
+	key  []byte
+	slug string
+}
+
+// sliceIndexWalker walks a sort index held in a slice sorted by key.
+func sliceIndexWalker(entries []indexEntry) indexWalker {
+	return func(from []byte, forwards bool, n int) ([][]byte, []string, error) {
+		var keys [][]byte
+		var slugs []string
+		i, step := 0, 1
+		switch {
+		case forwards && from != nil:
+			i = sort.Search(len(entries), func(i int) bool { return bytes.Compare(entries[i].key, from) > 0 })
+		case !forwards:
+			step = -1
+			i = len(entries) - 1
+			if from != nil {
+				i = sort.Search(len(entries), func(i int) bool { return bytes.Compare(entries[i].key, from) >= 0 }) - 1
+			}
+		}
+		for ; i >= 0 && i < len(entries) && len(slugs) < n; i += step {
+			keys = append(keys, entries[i].key)
+			slugs = append(slugs, entries[i].slug)
+		}
+		return keys, slugs, nil
+	}
+}
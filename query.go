@@ -0,0 +1,498 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+// The tag query language selects content by the tags applied to it.
+//
+//	query   := or
+//	or      := and { "OR" and }
+//	and     := unary { [ "AND" ] unary }
+//	unary   := ( "NOT" | "-" ) unary | primary
+//	primary := "(" query ")" | compare | word | quoted
+//	compare := field ( "=" | "!=" | "<" | "<=" | ">" | ">=" ) ( word | quoted )
+//
+// Juxtaposition is an implicit AND, so `cats AND (outdoor OR garden) -blurry` reads as
+// cats and either outdoor or garden, but not blurry. Tags in a namespace are written
+// namespace:label, and `artist:*` is any tag in the artist namespace. A comparison selects content by
+// the value of one of its fields, eg. `rating>=4` or `taken<2020-01-01`, and `type=photo` by its content
+// type. Keywords must be upper case so lower case tags named "and" or "or" still work; anything else,
+// including tags with a comparison operator in them, can be quoted.
+
+// QueryError is returned when a query can not be parsed. Pos is the byte offset of the problem.
+type QueryError struct {
+	Pos int    `json:"position"`
+	Msg string `json:"error"`
+}
+
+func (e *QueryError) Error() string {
+	return fmt.Sprintf("query error at position %d: %s", e.Pos, e.Msg)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenLParen
+	tokenRParen
+	tokenCompare
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// lexQuery splits a query into tokens. Quoted strings become words with the quotes removed
+// and backslash escapes applied.
+func lexQuery(q string) ([]token, error) {
+	tokens := []token{}
+	i := 0
+	for i < len(q) {
+		c := q[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokenLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokenRParen, ")", i})
+			i++
+		case c == '-':
+			tokens = append(tokens, token{tokenNot, "-", i})
+			i++
+		case c == '"':
+			start := i
+			word, end, err := lexQuoted(q, i)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+			tokens = append(tokens, token{tokenWord, word, start})
+		default:
+			start := i
+			for i < len(q) && !strings.ContainsRune(" \t\r\n()\"", rune(q[i])) {
+				i++
+			}
+			word := q[start:i]
+			kind := tokenWord
+			switch word {
+			case "AND":
+				kind = tokenAnd
+			case "OR":
+				kind = tokenOr
+			case "NOT":
+				kind = tokenNot
+			}
+			// A comparison's value can be quoted, eg. title="Water Lilies".
+			if field, op, value, ok := splitComparison(word); ok {
+				kind = tokenCompare
+				if value == "" && i < len(q) && q[i] == '"' {
+					quoted, end, err := lexQuoted(q, i)
+					if err != nil {
+						return nil, err
+					}
+					word, i = word+quoted, end
+				} else if value == "" {
+					return nil, &QueryError{start, fmt.Sprintf("%s%s needs a value to compare with", field, op)}
+				}
+			}
+			tokens = append(tokens, token{kind, word, start})
+		}
+	}
+	tokens = append(tokens, token{tokenEOF, "", len(q)})
+	return tokens, nil
+}
+
+// lexQuoted reads the quoted string starting at q[start], returning it without the quotes and with
+// backslash escapes applied, and the offset after the closing quote.
+func lexQuoted(q string, start int) (string, int, error) {
+	i := start + 1
+	var b strings.Builder
+	for i < len(q) {
+		if q[i] == '\\' && i+1 < len(q) {
+			b.WriteByte(q[i+1])
+			i += 2
+			continue
+		}
+		if q[i] == '"' {
+			return b.String(), i + 1, nil
+		}
+		b.WriteByte(q[i])
+		i++
+	}
+	return "", i, &QueryError{start, "unterminated quoted tag"}
+}
+
+// queryNode is a node of a parsed query.
+type queryNode interface {
+	eval(tx *bolt.Tx) (hashSet, error)
+	String() string
+}
+
+type andNode struct{ left, right queryNode }
+type orNode struct{ left, right queryNode }
+type notNode struct{ operand queryNode }
+type termNode struct {
+	name string
+	pos  int
+}
+type compareNode struct {
+	field, op, value string
+	pos              int
+}
+
+func (n andNode) String() string     { return fmt.Sprintf("(%s AND %s)", n.left, n.right) }
+func (n orNode) String() string      { return fmt.Sprintf("(%s OR %s)", n.left, n.right) }
+func (n notNode) String() string     { return fmt.Sprintf("NOT %s", n.operand) }
+func (n termNode) String() string    { return fmt.Sprintf("%q", n.name) }
+func (n compareNode) String() string { return fmt.Sprintf("%s%s%q", n.field, n.op, n.value) }
+
+type queryParser struct {
+	tokens []token
+	pos    int
+}
+
+// parseQuery parses a tag query into a tree that can be evaluated against the database.
+func parseQuery(q string) (queryNode, error) {
+	tokens, err := lexQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{tokens: tokens}
+	if p.peek().kind == tokenEOF {
+		return nil, &QueryError{0, "empty query"}
+	}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		if t.kind == tokenRParen {
+			return nil, &QueryError{t.pos, "unexpected closing parenthesis"}
+		}
+		return nil, &QueryError{t.pos, fmt.Sprintf("unexpected %q", t.text)}
+	}
+	return node, nil
+}
+
+func (p *queryParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *queryParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.peek().kind {
+		case tokenAnd:
+			p.next()
+		case tokenWord, tokenCompare, tokenNot, tokenLParen:
+			// Implicit AND.
+		default:
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left, right}
+	}
+}
+
+func (p *queryParser) parseUnary() (queryNode, error) {
+	if p.peek().kind == tokenNot {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (queryNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenWord:
+		return termNode{t.text, t.pos}, nil
+	case tokenCompare:
+		field, op, value, _ := splitComparison(t.text)
+		return compareNode{field, op, value, t.pos}, nil
+	case tokenLParen:
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, &QueryError{closing.pos, fmt.Sprintf("missing closing parenthesis for the one at position %d", t.pos)}
+		}
+		return node, nil
+	case tokenEOF:
+		return nil, &QueryError{t.pos, "unexpected end of query, expected a tag"}
+	default:
+		return nil, &QueryError{t.pos, fmt.Sprintf("expected a tag but found %q", t.text)}
+	}
+}
+
+// hashSet is a set of content hashes.
+type hashSet map[string]struct{}
+
+func (n andNode) eval(tx *bolt.Tx) (hashSet, error) {
+	left, err := n.left.eval(tx)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(tx)
+	if err != nil {
+		return nil, err
+	}
+	result := hashSet{}
+	for hash := range left {
+		if _, ok := right[hash]; ok {
+			result[hash] = struct{}{}
+		}
+	}
+	return result, nil
+}
+
+func (n orNode) eval(tx *bolt.Tx) (hashSet, error) {
+	left, err := n.left.eval(tx)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(tx)
+	if err != nil {
+		return nil, err
+	}
+	for hash := range right {
+		left[hash] = struct{}{}
+	}
+	return left, nil
+}
+
+func (n notNode) eval(tx *bolt.Tx) (hashSet, error) {
+	excluded, err := n.operand.eval(tx)
+	if err != nil {
+		return nil, err
+	}
+	result := hashSet{}
+	c := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(contentBucket)).Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if _, ok := excluded[string(k)]; !ok {
+			result[string(k)] = struct{}{}
+		}
+	}
+	return result, nil
+}
+
+func (n termNode) eval(tx *bolt.Tx) (hashSet, error) {
+	result := hashSet{}
+	slugs, err := resolveQueryTerm(tx, n.name)
+	if err != nil {
+		return nil, err
+	}
+	// A tag implies its ancestors, so content tagged with any descendant matches too.
+	for _, slug := range slugs {
+		descendants, err := tagRelatives(tx, slug, tagDescendants)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range append([]string{slug}, descendants...) {
+			for _, hash := range edgeKeys(tx, edgeByTagBucket, s) {
+				result[hash] = struct{}{}
+			}
+		}
+	}
+	return result, nil
+}
+
+func (n compareNode) eval(tx *bolt.Tx) (hashSet, error) {
+	return compareField(tx, n.field, n.op, n.value, n.pos)
+}
+
+// resolveQueryTerm returns the slugs of the tags a query term refers to.
+// A term matches a tag by its slug, by one of its aliases or, ignoring case, by its label. A term written
+// namespace:label matches the tags of the namespace by label, and namespace:* matches every tag in it.
+func resolveQueryTerm(tx *bolt.Tx, name string) ([]string, error) {
+	tags := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagBucket))
+	if tags.Get([]byte(name)) != nil {
+		return []string{name}, nil
+	}
+	alias, err := lookupAlias(tx, name)
+	if err != nil {
+		return nil, err
+	}
+	if alias != nil {
+		return []string{alias.Tag}, nil
+	}
+	slugs := []string{}
+	if ns, label, ok := splitNamespace(name); ok {
+		namespace, err := lookupNamespace(tx, ns)
+		if err != nil {
+			return nil, err
+		}
+		if namespace != nil && label == "*" {
+			return namespaceSlugs(tx, ns), nil
+		}
+		if namespace != nil {
+			for _, slug := range namespaceSlugs(tx, ns) {
+				tag, err := lookupTag(tx, slug)
+				if err != nil {
+					return nil, err
+				}
+				if tag != nil && strings.EqualFold(tag.Label, label) {
+					slugs = append(slugs, slug)
+				}
+			}
+			return slugs, nil
+		}
+	}
+	c := tags.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		tag := Tag{}
+		if err := json.Unmarshal(v, &tag); err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(tag.Label, name) {
+			slugs = append(slugs, string(k))
+		}
+	}
+	return slugs, nil
+}
+
+// searchContent parses and evaluates a tag query, returning the matching content indexed by hash.
+func searchContent(db *bolt.DB, q string) (ContentMap, error) {
+	node, err := parseQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	results := ContentMap{}
+	err = db.View(func(tx *bolt.Tx) error {
+		hashes, err := node.eval(tx)
+		if err != nil {
+			return err
+		}
+		b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(contentBucket))
+		for hash := range hashes {
+			content := Content{}
+			v := b.Get([]byte(hash))
+			if v == nil {
+				continue
+			}
+			if err := json.Unmarshal(v, &content); err != nil {
+				return err
+			}
+			results[hash] = content
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// SearchPageData is the data required to render the HTML template for the search page.
+type SearchPageData struct {
+	SiteMetaData SiteMetaData
+	Query        string
+	Error        string
+	Content      ContentMap
+}
+
+// searchHandler evaluates the tag query in the q parameter.
+// Results are returned as JSON when the client accepts it, and as an HTML page otherwise.
+func searchHandler(db *bolt.DB, t *template.Template) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		q := strings.TrimSpace(r.URL.Query().Get("q"))
+		log.Printf("Requested search for: %s \n", q)
+		var content ContentMap
+		var err error
+		if q != "" {
+			content, err = searchContent(db, q)
+		}
+		if wantsJSON(r) {
+			res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			if q == "" {
+				err = &QueryError{0, "empty query"}
+			}
+			if qerr, ok := err.(*QueryError); ok {
+				res.WriteHeader(http.StatusBadRequest)
+				if err := json.NewEncoder(res).Encode(qerr); err != nil {
+					panic(err)
+				}
+				return
+			}
+			if err != nil {
+				res.WriteHeader(http.StatusInternalServerError)
+				res.Write([]byte(`{"error":"Could not search contents."}`))
+				return
+			}
+			res.WriteHeader(http.StatusOK)
+			if err := json.NewEncoder(res).Encode(content); err != nil {
+				panic(err)
+			}
+			return
+		}
+		data := SearchPageData{SiteMetaData: siteMetaData, Query: q, Content: content}
+		status := http.StatusOK
+		if err != nil {
+			data.Error = err.Error()
+			status = http.StatusBadRequest
+			if _, ok := err.(*QueryError); !ok {
+				status = http.StatusInternalServerError
+			}
+		}
+		res.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		res.WriteHeader(status)
+		t.Execute(res, data)
+	}
+	return fn
+}
+
+// wantsJSON reports whether the client asked for a JSON response in its Accept header.
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
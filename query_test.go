@@ -0,0 +1,319 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{`cats`, `"cats"`},
+		// Juxtaposition is an implicit AND.
+		{`cats dogs`, `("cats" AND "dogs")`},
+		{`cats AND dogs`, `("cats" AND "dogs")`},
+		{`a b c`, `(("a" AND "b") AND "c")`},
+		// AND binds tighter than OR.
+		{`a OR b c`, `("a" OR ("b" AND "c"))`},
+		{`a b OR c`, `(("a" AND "b") OR "c")`},
+		{`a OR b AND c OR d`, `(("a" OR ("b" AND "c")) OR "d")`},
+		{`a AND (b OR c)`, `("a" AND ("b" OR "c"))`},
+		{`(a OR b) (c OR d)`, `(("a" OR "b") AND ("c" OR "d"))`},
+		{`cats AND (outdoor OR garden) -blurry`, `(("cats" AND ("outdoor" OR "garden")) AND NOT "blurry")`},
+		// - and NOT both negate, and bind tighter than AND.
+		{`-a`, `NOT "a"`},
+		{`NOT a`, `NOT "a"`},
+		{`a -b`, `("a" AND NOT "b")`},
+		{`a NOT b`, `("a" AND NOT "b")`},
+		{`- a`, `NOT "a"`},
+		{`NOT -a`, `NOT NOT "a"`},
+		{`-(a OR b)`, `NOT ("a" OR "b")`},
+		{`-a OR b`, `(NOT "a" OR "b")`},
+		// A - inside a word is part of it.
+		{`well-known`, `"well-known"`},
+		// Keywords are upper case only.
+		{`and or not`, `(("and" AND "or") AND "not")`},
+		// Quoting keeps spaces, keywords and operators in a tag and applies backslash escapes.
+		{`"water lilies"`, `"water lilies"`},
+		{`"a OR b"`, `"a OR b"`},
+		{`"AND"`, `"AND"`},
+		{`"(paren)"`, `"(paren)"`},
+		{`"-blurry"`, `"-blurry"`},
+		{`"rating>=4"`, `"rating>=4"`},
+		{`"say \"hi\""`, `"say \"hi\""`},
+		{`"back\\slash"`, `"back\\slash"`},
+		{`""`, `""`},
+		{`a"b c"`, `("a" AND "b c")`},
+		// Namespaces are part of the tag.
+		{`artist:monet`, `"artist:monet"`},
+		{`artist:*`, `"artist:*"`},
+		// Comparisons.
+		{`rating>=4`, `rating>="4"`},
+		{`rating<=4`, `rating<="4"`},
+		{`rating>4`, `rating>"4"`},
+		{`rating<4`, `rating<"4"`},
+		{`rating=4`, `rating="4"`},
+		{`rating!=4`, `rating!="4"`},
+		{`title="Water Lilies"`, `title="Water Lilies"`},
+		{`type=photo -taken<2020-01-01`, `(type="photo" AND NOT taken<"2020-01-01")`},
+		{`monet OR rating>=4 type=photo`, `("monet" OR (rating>="4" AND type="photo"))`},
+		// Words that only look like comparisons are tags.
+		{`=4`, `"=4"`},
+		{`Rating>=4`, `"Rating>=4"`},
+		{`a!b`, `"a!b"`},
+	}
+	for _, tt := range tests {
+		node, err := parseQuery(tt.query)
+		if err != nil {
+			t.Errorf("parseQuery(%s): %v", tt.query, err)
+			continue
+		}
+		if got := node.String(); got != tt.want {
+			t.Errorf("parseQuery(%s) = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		pos   int
+		msg   string
+	}{
+		{``, 0, `empty query`},
+		{`   `, 0, `empty query`},
+		{`a)`, 1, `unexpected closing parenthesis`},
+		{`(a OR b) c)`, 10, `unexpected closing parenthesis`},
+		{`(a`, 2, `missing closing parenthesis for the one at position 0`},
+		{`a (b (c)`, 8, `missing closing parenthesis for the one at position 2`},
+		{`a AND`, 5, `unexpected end of query, expected a tag`},
+		{`a OR`, 4, `unexpected end of query, expected a tag`},
+		{`-`, 1, `unexpected end of query, expected a tag`},
+		{`a NOT`, 5, `unexpected end of query, expected a tag`},
+		{`a OR OR b`, 5, `expected a tag but found "OR"`},
+		{`AND a`, 0, `expected a tag but found "AND"`},
+		{`a AND OR b`, 6, `expected a tag but found "OR"`},
+		{`()`, 1, `expected a tag but found ")"`},
+		{`"unterminated`, 0, `unterminated quoted tag`},
+		{`a "b`, 2, `unterminated quoted tag`},
+		{`a "b\"`, 2, `unterminated quoted tag`},
+		{`rating>=`, 0, `rating>= needs a value to compare with`},
+		{`a rating<`, 2, `rating< needs a value to compare with`},
+		{`a title= b`, 2, `title= needs a value to compare with`},
+		{`a title="abc`, 8, `unterminated quoted tag`},
+	}
+	for _, tt := range tests {
+		_, err := parseQuery(tt.query)
+		var qerr *QueryError
+		if !errors.As(err, &qerr) {
+			t.Errorf("parseQuery(%s): got %v, want a QueryError", tt.query, err)
+			continue
+		}
+		if qerr.Pos != tt.pos || qerr.Msg != tt.msg {
+			t.Errorf("parseQuery(%s): error %q at %d, want %q at %d", tt.query, qerr.Msg, qerr.Pos, tt.msg, tt.pos)
+		}
+	}
+}
+
+// searchHashes runs a query against db and returns the hashes of the content it matches, sorted.
+func searchHashes(t *testing.T, db *bolt.DB, q string) string {
+	t.Helper()
+	content, err := searchContent(db, q)
+	if err != nil {
+		t.Fatalf("searchContent(%s): %v", q, err)
+	}
+	hashes := []string{}
+	for hash := range content {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return fmt.Sprint(hashes)
+}
+
+// newFieldsDB sets up photos p1 to p4 with a rating, a date taken, a title and a format, and notes n1 and
+// n2, which have none of those fields. p3 and n1 are tagged monet.
+func newFieldsDB(t *testing.T) *bolt.DB {
+	t.Helper()
+	db := newTestDB(t)
+	store := &boltStore{db: db}
+	types := []ContentType{
+		{Name: "photo", Fields: []FieldSpec{
+			{Name: "rating", Kind: fieldNumber},
+			{Name: "taken", Kind: fieldDate},
+			{Name: "title", Kind: fieldString},
+			{Name: "print", Kind: fieldBool},
+			{Name: "format", Kind: fieldEnum, Values: []string{"film", "digital"}},
+		}},
+		{Name: "note"},
+	}
+	for _, ct := range types {
+		if _, err := createContentType(db, ct); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content := []Content{
+		{Hash: "p1", Type: "photo", Fields: map[string]interface{}{"rating": -1.5, "taken": "2018-07-04", "title": "Haystacks", "print": false, "format": "film"}},
+		{Hash: "p2", Type: "photo", Fields: map[string]interface{}{"rating": 4.0, "taken": "2019-12-31", "title": "Water Lilies", "print": true, "format": "digital"}},
+		{Hash: "p3", Type: "photo", Fields: map[string]interface{}{"rating": 5.0, "taken": "2020-01-01", "title": "Poplars", "format": "film"}},
+		{Hash: "p4", Type: "photo", Fields: map[string]interface{}{"rating": 3.0}},
+		{Hash: "n1", Type: "note"},
+		{Hash: "n2", Type: "note"},
+	}
+	for _, c := range content {
+		if err := store.PutContent(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.PutTag(Tag{Slug: "monet", Label: "Monet"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []string{"p3", "n1"} {
+		if _, err := store.ApplyTag(hash, "monet"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestSearchFieldComparisons(t *testing.T) {
+	db := newFieldsDB(t)
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{`rating>=4`, `[p2 p3]`},
+		{`rating>4`, `[p3]`},
+		{`rating<=4`, `[p1 p2 p4]`},
+		{`rating<4`, `[p1 p4]`},
+		{`rating=4`, `[p2]`},
+		{`rating!=4`, `[p1 p3 p4]`},
+		{`rating<0`, `[p1]`},
+		{`rating>=-1.5`, `[p1 p2 p3 p4]`},
+		{`rating>=4.5`, `[p3]`},
+		{`taken<2020-01-01`, `[p1 p2]`},
+		{`taken>=2019-12-31`, `[p2 p3]`},
+		{`title="Water Lilies"`, `[p2]`},
+		{`title<P`, `[p1]`},
+		{`print=true`, `[p2]`},
+		{`print!=true`, `[p1]`},
+		{`format=film`, `[p1 p3]`},
+		{`format!=film`, `[p2]`},
+		{`type=photo`, `[p1 p2 p3 p4]`},
+		{`type=note`, `[n1 n2]`},
+		{`type!=photo`, `[n1 n2]`},
+		{`type=video`, `[]`},
+		// Content without the field never matches a comparison, but does match its negation.
+		{`-rating>=4`, `[n1 n2 p1 p4]`},
+		{`monet rating>=4`, `[p3]`},
+		{`monet OR rating=4`, `[n1 p2 p3]`},
+		{`type=note OR rating<0`, `[n1 n2 p1]`},
+	}
+	for _, tt := range tests {
+		if got := searchHashes(t, db, tt.query); got != tt.want {
+			t.Errorf("search %s = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestSearchFieldComparisonErrors(t *testing.T) {
+	db := newFieldsDB(t)
+	tests := []struct {
+		query string
+		pos   int
+		msg   string
+	}{
+		{`colour=red`, 0, `no content type has a field called colour`},
+		{`monet colour=red`, 6, `no content type has a field called colour`},
+		{`type>photo`, 0, `compare type with = or !=`},
+		{`rating>=abc`, 8, `"abc" is not a number`},
+		{`monet rating>=abc`, 14, `"abc" is not a number`},
+		{`taken<2020`, 6, `"2020" is not a date written YYYY-MM-DD`},
+		{`print=maybe`, 6, `"maybe" is not true or false`},
+		{`print>true`, 0, `print is a bool field, compare it with = or !=`},
+		{`format<film`, 0, `format is a enum field, compare it with = or !=`},
+	}
+	for _, tt := range tests {
+		_, err := searchContent(db, tt.query)
+		var qerr *QueryError
+		if !errors.As(err, &qerr) {
+			t.Errorf("search %s: got %v, want a QueryError", tt.query, err)
+			continue
+		}
+		if qerr.Pos != tt.pos || qerr.Msg != tt.msg {
+			t.Errorf("search %s: error %q at %d, want %q at %d", tt.query, qerr.Msg, qerr.Pos, tt.msg, tt.pos)
+		}
+	}
+}
+
+func TestSearchNamespaces(t *testing.T) {
+	db := newTestDB(t)
+	store := &boltStore{db: db}
+	for _, hash := range []string{"c1", "c2", "c3", "c4", "c5"} {
+		if err := store.PutContent(Content{Hash: hash}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tags := []Tag{
+		{Slug: "monet", Label: "Monet", Namespace: "artist"},
+		{Slug: "manet", Label: "Manet", Namespace: "artist"},
+		{Slug: "giverny", Label: "Giverny", Namespace: "place"},
+		// Written namespace:label, it is put in the artist namespace.
+		{Slug: "renoir", Label: "artist:Renoir"},
+		// A tag implies its parents, so lilies counts as a tag in the artist namespace.
+		{Slug: "lilies", Label: "Lilies", Parents: []string{"monet"}},
+		{Slug: "plain-monet", Label: "monet"},
+	}
+	for _, tag := range tags {
+		if err := store.PutTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	edges := [][2]string{{"c1", "monet"}, {"c1", "giverny"}, {"c2", "manet"}, {"c3", "renoir"}, {"c4", "lilies"}, {"c5", "plain-monet"}}
+	for _, edge := range edges {
+		if _, err := store.ApplyTag(edge[0], edge[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{`artist:*`, `[c1 c2 c3 c4]`},
+		{`place:*`, `[c1]`},
+		{`-artist:*`, `[c5]`},
+		{`artist:* place:*`, `[c1]`},
+		{`artist:* -place:*`, `[c2 c3 c4]`},
+		{`place:* OR artist:manet`, `[c1 c2]`},
+		{`artist:monet`, `[c1 c4]`},
+		{`artist:MONET`, `[c1 c4]`},
+		{`artist:renoir`, `[c3]`},
+		{`artist:degas`, `[]`},
+		// A slug matches its tag. Otherwise a label matches every tag with it, in any namespace and ignoring case.
+		{`monet`, `[c1 c4]`},
+		{`Monet`, `[c1 c4 c5]`},
+		// An unknown namespace is not a wildcard.
+		{`style:*`, `[]`},
+	}
+	for _, tt := range tests {
+		if got := searchHashes(t, db, tt.query); got != tt.want {
+			t.Errorf("search %s = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+	manet, err := store.GetTag("manet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manet.Namespace = ""
+	if err := store.PutTag(*manet); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchHashes(t, db, `artist:*`); got != `[c1 c3 c4]` {
+		t.Errorf("search artist:* after moving manet out of the namespace = %s, want [c1 c3 c4]", got)
+	}
+}
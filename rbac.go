@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+)
+
+// Permissions name what a role allows. Every route needs one of them, see routePermissions.
+const (
+	permRead          = "read"           // View content, tags and searches.
+	permTag           = "tag"            // Apply existing tags to content and remove them.
+	permContentWrite  = "content:write"  // Create and modify content, content types and collections, ingest URLs and scan directories.
+	permContentDelete = "content:delete" // Delete content, content types and collections.
+	permTagsWrite     = "tags:write"     // Create and modify tags and their aliases.
+	permTagsDelete    = "tags:delete"    // Delete and merge tags.
+	permExport        = "export"         // Export the whole library.
+	permImport        = "import"         // Import a library export.
+	permAccounts      = "accounts"       // See the accounts and change their roles.
+)
+
+// allPermissions lists every permission.
+var allPermissions = []string{
+	permRead, permTag, permContentWrite, permContentDelete, permTagsWrite, permTagsDelete, permExport, permImport, permAccounts,
+}
+
+// anonymousRole is the role of requests without a session or token.
+const anonymousRole = "anonymous"
+
+// Roles maps a role name to the permissions it grants. It is set in the roles table of the config file,
+// eg. tagger = ["read", "tag", "tags:write"]; roles that are not set keep their defaults.
+type Roles map[string][]string
+
+var errUnknownRole = errors.New("unknown role")
+
+// defaultRoles are the roles of a server without any in its config file.
+func defaultRoles() Roles {
+	return Roles{
+		anonymousRole: {permRead},
+		"viewer":      {permRead},
+		"tagger":      {permRead, permTag},
+		"editor":      {permRead, permTag, permContentWrite, permTagsWrite, permTagsDelete},
+		"admin":       append([]string{}, allPermissions...),
+	}
+}
+
+// allows reports whether role grants the permission. Unknown roles grant nothing.
+func (roles Roles) allows(role string, permission string) bool {
+	for _, p := range roles[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// has reports whether role is defined. Anonymous is not a role accounts can have.
+func (roles Roles) has(role string) bool {
+	_, ok := roles[role]
+	return ok && role != anonymousRole
+}
+
+// names lists the roles accounts can have, in order.
+func (roles Roles) names() []string {
+	names := []string{}
+	for name := range roles {
+		if name != anonymousRole {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validate reports roles that grant permissions that do not exist.
+func (roles Roles) validate() []string {
+	problems := []string{}
+	for _, name := range roles.names() {
+		for _, p := range roles[name] {
+			if !knownPermission(p) {
+				problems = append(problems, fmt.Sprintf("role %s has unknown permission %q, use %s", name, p, strings.Join(allPermissions, ", ")))
+			}
+		}
+	}
+	for _, p := range roles[anonymousRole] {
+		if !knownPermission(p) {
+			problems = append(problems, fmt.Sprintf("role %s has unknown permission %q", anonymousRole, p))
+		}
+	}
+	return problems
+}
+
+func knownPermission(permission string) bool {
+	for _, p := range allPermissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// routePermission is the permission a route needs. An empty permission leaves the route open, for the
+// routes that check the identity themselves.
+type routePermission struct {
+	method     string
+	path       string // The route's path template, without the /api/v1 prefix.
+	permission string
+}
+
+// routePermissions are the permissions of the routes that do not only read. GET and HEAD requests to a
+// route that is not listed need read. Other methods need admin's full set when a route is missing from the
+// list, so a new route is closed until it is given a permission here.
+var routePermissions = []routePermission{
+	{"GET", "/login", ""},
+	{"POST", "/login", ""},
+	{"POST", "/logout", ""},
+	{"GET", "/me", ""},
+	{"GET", "/permissions", ""},
+	{"GET", "/tokens", ""},
+	{"POST", "/tokens", ""},
+	{"DELETE", "/tokens/{id}", ""},
+	{"GET", "/users", permAccounts},
+	{"PUT", "/users/{username}/role", permAccounts},
+
+	{"POST", "/content", permContentWrite},
+	{"POST", "/content/remote", permContentWrite},
+	{"POST", "/content/{hash}", permContentWrite},
+	{"PUT", "/content/{hash}", permContentWrite},
+	{"DELETE", "/content/{hash}", permContentDelete},
+	{"POST", "/content/{hash}/refresh", permContentWrite},
+	{"PUT", "/content/{hash}/tags/{slug}", permTag},
+	{"DELETE", "/content/{hash}/tags/{slug}", permTag},
+	{"POST", "/bulk/tags", permTag},
+	{"POST", "/scan", permContentWrite},
+
+	{"POST", "/tags", permTagsWrite},
+	{"POST", "/tags/{slug}", permTagsWrite},
+	{"PUT", "/tags/{slug}", permTagsWrite},
+	{"DELETE", "/tags/{slug}", permTagsDelete},
+	{"POST", "/tags/{slug}/aliases", permTagsWrite},
+	{"DELETE", "/tags/{slug}/aliases/{alias}", permTagsWrite},
+	{"POST", "/tags/{slug}/merge", permTagsDelete},
+	{"POST", "/namespaces", permTagsWrite},
+	{"PUT", "/namespaces/{name}", permTagsWrite},
+	{"DELETE", "/namespaces/{name}", permTagsDelete},
+	{"POST", "/types", permContentWrite},
+	{"PUT", "/types/{name}", permContentWrite},
+	{"DELETE", "/types/{name}", permContentDelete},
+	{"POST", "/collections", permContentWrite},
+	{"PUT", "/collections/{slug}", permContentWrite},
+	{"DELETE", "/collections/{slug}", permContentDelete},
+	{"POST", "/collections/{slug}/items", permContentWrite},
+	{"PUT", "/collections/{slug}/items", permContentWrite},
+	{"DELETE", "/collections/{slug}/items/{hash}", permContentWrite},
+	{"POST", "/content/{hash}/revisions/{number:[0-9]+}/revert", permContentWrite},
+	{"POST", "/tags/{slug}/revisions/{number:[0-9]+}/revert", permTagsWrite},
+
+	{"GET", "/export", permExport},
+	{"POST", "/import", permImport},
+}
+
+// permissionFor returns the permissions a request to the route with the path template needs.
+func permissionFor(method string, template string) []string {
+	template = strings.TrimPrefix(template, "/api/v1")
+	for _, rp := range routePermissions {
+		if rp.method == method && rp.path == template {
+			if rp.permission == "" {
+				return nil
+			}
+			return []string{rp.permission}
+		}
+	}
+	if method == http.MethodGet || method == http.MethodHead {
+		return []string{permRead}
+	}
+	return allPermissions
+}
+
+// permissionMiddleware refuses requests the role of the caller does not allow: with a 401 when nobody is
+// logged in, so they can, and a 403 otherwise. Pages are the exception, they send visitors to the login form.
+// It runs after authMiddleware has identified the caller.
+func permissionMiddleware(roles Roles) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, r *http.Request) {
+			route := mux.CurrentRoute(r)
+			if route == nil {
+				next.ServeHTTP(res, r)
+				return
+			}
+			template, err := route.GetPathTemplate()
+			if err != nil {
+				forbidden(res, r, "This route has no permission.")
+				return
+			}
+			identity := requestIdentity(r)
+			role := anonymousRole
+			if identity != nil {
+				role = identity.Role
+			}
+			for _, permission := range permissionFor(r.Method, template) {
+				if roles.allows(role, permission) {
+					continue
+				}
+				if identity == nil && r.Method == http.MethodGet && !strings.HasPrefix(r.URL.Path, "/api/") && !wantsJSON(r) {
+					http.Redirect(res, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+					return
+				}
+				if identity == nil {
+					unauthorized(res, r, "Log in or send an API token to do this.")
+					return
+				}
+				forbidden(res, r, fmt.Sprintf("The %s role does not allow %s.", role, permission))
+				return
+			}
+			next.ServeHTTP(res, r)
+		})
+	}
+}
+
+// forbidden refuses a request the caller's role does not allow.
+func forbidden(res http.ResponseWriter, r *http.Request, message string) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		writeAPIError(res, http.StatusForbidden, message, nil)
+		return
+	}
+	res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	res.WriteHeader(http.StatusForbidden)
+	res.Write([]byte(message))
+}
+
+// PermissionsData is what the caller is allowed to do, for the UI to hide what it can not.
+type PermissionsData struct {
+	Username    string   `json:"username,omitempty"`
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions"`
+}
+
+// apiPermissionsHandler returns the role and permissions of the caller. When roles is nil, as only for
+// serve -no-auth, everyone may do everything.
+func apiPermissionsHandler(roles Roles) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		if roles == nil {
+			writeAPIData(res, http.StatusOK, PermissionsData{Permissions: allPermissions})
+			return
+		}
+		data := PermissionsData{Role: anonymousRole, Permissions: []string{}}
+		if identity := requestIdentity(r); identity != nil {
+			data.Username, data.Role = identity.Username, identity.Role
+		}
+		for _, p := range allPermissions {
+			if roles.allows(data.Role, p) {
+				data.Permissions = append(data.Permissions, p)
+			}
+		}
+		writeAPIData(res, http.StatusOK, data)
+	}
+	return fn
+}
+
+// apiListUsersHandler returns every account with its role.
+func apiListUsersHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		users, err := listUsers(db)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		for i := range users {
+			users[i].PasswordHash = nil
+		}
+		writeAPIList(res, users, nil)
+	}
+	return fn
+}
+
+// apiSetRoleHandler changes the role of the account in the URL, eg. {"role": "editor"}.
+func apiSetRoleHandler(db *bolt.DB, roles Roles) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var request User
+		if !readAPIBody(res, r, &request) {
+			return
+		}
+		user, err := setRole(db, roles, mux.Vars(r)["username"], request.Role)
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		user.PasswordHash = nil
+		writeAPIData(res, http.StatusOK, user)
+	}
+	return fn
+}
+
+// DATA STORE FUNCTIONS
+
+// setRole gives an account a role.
+func setRole(db *bolt.DB, roles Roles, username string, role string) (*User, error) {
+	if !roles.has(role) {
+		return nil, fmt.Errorf("%w: %q, use one of %s", errUnknownRole, role, strings.Join(roles.names(), ", "))
+	}
+	var user *User
+	err := db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if user, err = lookupUser(tx, username); err != nil {
+			return err
+		}
+		user.Role = role
+		return putUser(tx, *user)
+	})
+	return user, err
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPermissionFor(t *testing.T) {
+	tests := []struct {
+		method   string
+		template string
+		want     []string
+	}{
+		{"GET", "/content", []string{permRead}},
+		{"HEAD", "/content/{hash}", []string{permRead}},
+		{"GET", "/api/v1/content", []string{permRead}},
+		{"POST", "/content", []string{permContentWrite}},
+		{"POST", "/api/v1/content", []string{permContentWrite}},
+		{"DELETE", "/api/v1/content/{hash}", []string{permContentDelete}},
+		{"PUT", "/content/{hash}/tags/{slug}", []string{permTag}},
+		{"POST", "/import", []string{permImport}},
+		{"GET", "/export", []string{permExport}},
+		{"GET", "/api/v1/export", []string{permExport}},
+		{"POST", "/login", nil},
+		{"GET", "/api/v1/me", nil},
+		// Routes nobody gave a permission yet need every one of them.
+		{"POST", "/something/new", allPermissions},
+		{"DELETE", "/api/v1/tags/{slug}/unlisted", allPermissions},
+		{"PATCH", "/content/{hash}", allPermissions},
+	}
+	for _, tt := range tests {
+		if got := permissionFor(tt.method, tt.template); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("permissionFor(%s, %s) = %v, want %v", tt.method, tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestPermissionMiddlewareClosesUnlistedRoutes(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if role := req.Header.Get("X-Role"); role != "" {
+				req = req.WithContext(context.WithValue(req.Context(), identityKey{}, &Identity{Username: role, Role: role}))
+			}
+			next.ServeHTTP(res, req)
+		})
+	})
+	r.Use(permissionMiddleware(defaultRoles()))
+	r.HandleFunc("/api/v1/unlisted", func(res http.ResponseWriter, req *http.Request) {}).Methods("GET", "POST")
+	tests := []struct {
+		method string
+		role   string
+		status int
+	}{
+		{"GET", "", http.StatusOK},
+		{"POST", "", http.StatusUnauthorized},
+		{"POST", "viewer", http.StatusForbidden},
+		{"POST", "editor", http.StatusForbidden},
+		{"POST", "admin", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/api/v1/unlisted", nil)
+		if tt.role != "" {
+			req.Header.Set("X-Role", tt.role)
+		}
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, req)
+		if res.Code != tt.status {
+			t.Errorf("%s as %q: status %d, want %d", tt.method, tt.role, res.Code, tt.status)
+		}
+	}
+}
+
+func TestPermissionMiddleware(t *testing.T) {
+	r, db := newTestRouter(t, defaultRoles())
+	viewer := newTestUser(t, db, "vera", "viewer")
+	tagger := newTestUser(t, db, "tom", "tagger")
+	editor := newTestUser(t, db, "eddie", "editor")
+	admin := newTestUser(t, db, "stephen", "admin")
+	store := &boltStore{db: db}
+	if err := store.PutContent(Content{Hash: "a", Label: "A"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutTag(Tag{Slug: "red", Label: "Red"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		token  string
+		status int
+	}{
+		{"anonymous reads", "GET", "/api/v1/content", "", "", http.StatusOK},
+		{"anonymous creates", "POST", "/api/v1/content", `{"label":"B"}`, "", http.StatusUnauthorized},
+		{"viewer creates", "POST", "/api/v1/content", `{"label":"B"}`, viewer, http.StatusForbidden},
+		{"editor creates", "POST", "/api/v1/content", `{"label":"B"}`, editor, http.StatusCreated},
+		{"tagger creates a tag", "POST", "/api/v1/tags", `{"label":"Blue"}`, tagger, http.StatusForbidden},
+		{"editor creates a tag", "POST", "/api/v1/tags", `{"label":"Blue"}`, editor, http.StatusCreated},
+		{"tagger tags", "PUT", "/api/v1/content/a/tags/red", "", tagger, http.StatusCreated},
+		{"editor deletes", "DELETE", "/api/v1/content/a", "", editor, http.StatusForbidden},
+		{"editor lists accounts", "GET", "/api/v1/users", "", editor, http.StatusForbidden},
+		{"admin lists accounts", "GET", "/api/v1/users", "", admin, http.StatusOK},
+		{"admin deletes", "DELETE", "/api/v1/content/a", "", admin, http.StatusOK},
+		{"anonymous deletes a page", "DELETE", "/tags/red", "", "", http.StatusUnauthorized},
+		{"anonymous exports", "GET", "/export", "", "", http.StatusSeeOther},
+		{"editor exports", "GET", "/api/v1/export", "", editor, http.StatusForbidden},
+		{"admin exports", "GET", "/api/v1/export", "", admin, http.StatusOK},
+	}
+	for _, tt := range tests {
+		res := request(r, tt.method, tt.target, tt.body, tt.token)
+		if res.Code != tt.status {
+			t.Errorf("%s: status %d %s, want %d", tt.name, res.Code, res.Body, tt.status)
+		}
+		if res.Code == http.StatusUnauthorized && res.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: a 401 without WWW-Authenticate", tt.name)
+		}
+	}
+}
+
+func TestPermissionMiddlewareSendsVisitorsToLogin(t *testing.T) {
+	roles := defaultRoles()
+	roles[anonymousRole] = nil
+	r, _ := newTestRouter(t, roles)
+
+	res := request(r, "GET", "/content?sort=label", "", "")
+	if res.Code != http.StatusSeeOther || res.Header().Get("Location") != "/login?next=%2Fcontent%3Fsort%3Dlabel" {
+		t.Errorf("content page: status %d to %q, want 303 to the login form", res.Code, res.Header().Get("Location"))
+	}
+	// Callers that want JSON, and the API, are told to authenticate instead.
+	req := httptest.NewRequest("GET", "/content", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("content as JSON: status %d, want 401", rec.Code)
+	}
+	if res := request(r, "GET", "/api/v1/content", "", ""); res.Code != http.StatusUnauthorized {
+		t.Errorf("API content: status %d, want 401", res.Code)
+	}
+	if res := request(r, "GET", "/login", "", ""); res.Code != http.StatusOK {
+		t.Errorf("login form: status %d, want 200", res.Code)
+	}
+}
+
+func TestAPIPermissions(t *testing.T) {
+	r, db := newTestRouter(t, defaultRoles())
+	tagger := newTestUser(t, db, "tom", "tagger")
+	permissions := func(h http.Handler, token string) PermissionsData {
+		t.Helper()
+		res := request(h, "GET", "/api/v1/permissions", "", token)
+		envelope := struct{ Data PermissionsData }{}
+		if err := json.Unmarshal(res.Body.Bytes(), &envelope); err != nil {
+			t.Fatalf("%v in %s", err, res.Body)
+		}
+		return envelope.Data
+	}
+	if got := permissions(r, ""); got.Role != anonymousRole || strings.Join(got.Permissions, " ") != permRead {
+		t.Errorf("anonymous permissions %+v, want read only", got)
+	}
+	if got := permissions(r, tagger); got.Username != "tom" || strings.Join(got.Permissions, " ") != "read tag" {
+		t.Errorf("tagger permissions %+v, want tom's read and tag", got)
+	}
+
+	open, err := newRouter(newMemoryStore(), "templates", t.TempDir(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := permissions(open, ""); len(got.Permissions) != len(allPermissions) {
+		t.Errorf("permissions without roles %+v, want every one", got)
+	}
+}
+
+func TestRolesNeedAccounts(t *testing.T) {
+	if _, err := newRouter(newMemoryStore(), "templates", t.TempDir(), defaultRoles(), nil); err == nil {
+		t.Error("a router enforcing roles on the memory store was set up")
+	}
+}
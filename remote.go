@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/net/html"
+)
+
+// maxRemoteBytes caps how much of a remote page is read when looking for metadata.
+const maxRemoteBytes = 2 << 20
+
+var errBadRemoteURL = errors.New("remote content needs an absolute http or https URL")
+var errRemoteFetch = errors.New("could not fetch remote content")
+
+// RemoteMeta is the metadata extracted from a remote page the last time it was fetched.
+type RemoteMeta struct {
+	StatusCode   int       `json:"statusCode"`
+	ContentType  string    `json:"contentType,omitempty"`
+	Title        string    `json:"title,omitempty"`
+	Description  string    `json:"description,omitempty"`
+	Image        string    `json:"image,omitempty"`
+	SiteName     string    `json:"siteName,omitempty"`
+	CanonicalURL string    `json:"canonicalUrl,omitempty"`
+	FetchedAt    time.Time `json:"fetchedAt"`
+}
+
+// remoteHash is the content key for a URL. Remote content has no file to hash, so the URL is hashed instead.
+func remoteHash(u string) string {
+	sum := md5.Sum([]byte(u))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseRemoteURL checks that raw is an absolute http(s) URL and returns it in normal form.
+func parseRemoteURL(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errBadRemoteURL
+	}
+	u.Fragment = ""
+	return u.String(), nil
+}
+
+// fetchRemote downloads a page with client and extracts its title, OpenGraph and Twitter card fields,
+// description and canonical URL. Pages that are not HTML only report their status and content type.
+// The client is a parameter so callers control timeouts and tests can point it at an httptest server.
+func fetchRemote(client *http.Client, pageURL string) (*RemoteMeta, error) {
+	req, err := http.NewRequest("GET", pageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9,*/*;q=0.8")
+	req.Header.Set("User-Agent", "Anansi/1.0 (+https://github.com/SteveCastle/anansi)")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w from %s: %v", errRemoteFetch, pageURL, err)
+	}
+	defer resp.Body.Close()
+	meta := &RemoteMeta{StatusCode: resp.StatusCode, ContentType: resp.Header.Get("Content-Type"), FetchedAt: time.Now()}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("%w from %s: %s", errRemoteFetch, pageURL, resp.Status)
+	}
+	mediaType, _, _ := mime.ParseMediaType(meta.ContentType)
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return meta, nil
+	}
+	doc, err := html.Parse(io.LimitReader(resp.Body, maxRemoteBytes))
+	if err != nil {
+		return nil, fmt.Errorf("%w from %s: %v", errRemoteFetch, pageURL, err)
+	}
+	extractRemoteMeta(doc, meta)
+	// Relative links are resolved against the final URL after any redirects.
+	base := resp.Request.URL
+	meta.Image = resolveReference(base, meta.Image)
+	meta.CanonicalURL = resolveReference(base, meta.CanonicalURL)
+	return meta, nil
+}
+
+// extractRemoteMeta walks a parsed page collecting metadata. OpenGraph fields win over Twitter card
+// fields, which win over the plain title element and description meta tag.
+func extractRemoteMeta(doc *html.Node, meta *RemoteMeta) {
+	fields := map[string]string{}
+	var title string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "title":
+				if title == "" && n.FirstChild != nil {
+					title = strings.TrimSpace(n.FirstChild.Data)
+				}
+			case "meta":
+				key := strings.ToLower(htmlAttr(n, "property"))
+				if key == "" {
+					key = strings.ToLower(htmlAttr(n, "name"))
+				}
+				if _, ok := fields[key]; key != "" && !ok {
+					fields[key] = strings.TrimSpace(htmlAttr(n, "content"))
+				}
+			case "link":
+				for _, rel := range strings.Fields(strings.ToLower(htmlAttr(n, "rel"))) {
+					if _, ok := fields["canonical"]; rel == "canonical" && !ok {
+						fields["canonical"] = strings.TrimSpace(htmlAttr(n, "href"))
+					}
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	first := func(keys ...string) string {
+		for _, key := range keys {
+			if v := fields[key]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	meta.Title = first("og:title", "twitter:title")
+	if meta.Title == "" {
+		meta.Title = title
+	}
+	meta.Description = first("og:description", "twitter:description", "description")
+	meta.Image = first("og:image", "og:image:url", "twitter:image", "twitter:image:src")
+	meta.SiteName = first("og:site_name", "application-name")
+	meta.CanonicalURL = first("canonical", "og:url")
+}
+
+// htmlAttr returns the value of an attribute of an element, or an empty string.
+func htmlAttr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if strings.EqualFold(a.Key, name) {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// resolveReference makes ref absolute relative to base. Empty and unparseable references are returned unchanged.
+func resolveReference(base *url.URL, ref string) string {
+	if ref == "" {
+		return ref
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return base.ResolveReference(u).String()
+}
+
+// applyRemoteMeta fills in a content's Label and Definition from freshly fetched metadata.
+func applyRemoteMeta(content *Content, meta *RemoteMeta) {
+	content.Remote = meta
+	content.Label = meta.Title
+	if content.Label == "" {
+		content.Label = path.Base(strings.TrimSuffix(content.URL, "/"))
+	}
+	var b strings.Builder
+	if meta.Image != "" {
+		fmt.Fprintf(&b, "![%s](%s)\n\n", markdownEscape(content.Label), meta.Image)
+	}
+	if meta.Description != "" {
+		fmt.Fprintf(&b, "%s\n\n", meta.Description)
+	}
+	link := meta.CanonicalURL
+	if link == "" {
+		link = content.URL
+	}
+	if meta.SiteName != "" {
+		fmt.Fprintf(&b, "Source: [%s](%s)\n", markdownEscape(meta.SiteName), link)
+	} else {
+		fmt.Fprintf(&b, "Source: <%s>\n", link)
+	}
+	content.Definition = b.String()
+}
+
+// markdownEscape escapes the characters that would end a markdown link label.
+func markdownEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `[`, `\[`, `]`, `\]`).Replace(s)
+}
+
+// ingestRemote fetches a URL and stores it as content keyed by the hash of the URL.
+// Ingesting a URL that is already stored refreshes it and keeps its author, creation time and tags.
+func ingestRemote(store Store, client *http.Client, rawURL string, author string) (*Content, error) {
+	pageURL, err := parseRemoteURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := fetchRemote(client, pageURL)
+	if err != nil {
+		return nil, err
+	}
+	hash := remoteHash(pageURL)
+	content, err := store.GetContent(hash)
+	if errors.Is(err, errContentNotFound) {
+		content, err = &Content{Author: author, CreatedAt: time.Now(), Hash: hash, URL: pageURL}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	applyRemoteMeta(content, meta)
+	if err := store.PutContent(*content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// createRemoteContentHandler creates content from the URL in the JSON body, eg. {"url": "https://example.com"}.
+func createRemoteContentHandler(store Store, client *http.Client) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var request Content
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+		if err != nil {
+			panic(err)
+		}
+		if err := r.Body.Close(); err != nil {
+			panic(err)
+		}
+		if err := json.Unmarshal(body, &request); err != nil {
+			res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			res.WriteHeader(422) // unprocessable entity
+			if err := json.NewEncoder(res).Encode(err); err != nil {
+				panic(err)
+			}
+			return
+		}
+		content, err := ingestRemote(store, client, request.URL, requestAuthor(r, request.Author))
+		if err != nil {
+			writeRemoteError(res, err)
+			return
+		}
+		log.Printf("Ingested remote content: %s \n", content.URL)
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		res.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(res).Encode(content); err != nil {
+			panic(err)
+		}
+	}
+	return fn
+}
+
+// refreshRemoteContentHandler fetches the URL of the content in the URL path again and updates it.
+func refreshRemoteContentHandler(store Store, client *http.Client) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		content, err := store.GetContent(mux.Vars(r)["hash"])
+		if err != nil {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusNotFound)
+			res.Write([]byte("404 Page Not Found"))
+			return
+		}
+		if content.URL == "" {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(422) // unprocessable entity
+			res.Write([]byte("Content has no URL to refresh."))
+			return
+		}
+		content, err = ingestRemote(store, client, content.URL, content.Author)
+		if err != nil {
+			writeRemoteError(res, err)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		res.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(res).Encode(content); err != nil {
+			panic(err)
+		}
+	}
+	return fn
+}
+
+// writeRemoteError reports a failed ingestion, blaming the client for bad URLs and the remote server for failed fetches.
+func writeRemoteError(res http.ResponseWriter, err error) {
+	res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	switch {
+	case errors.Is(err, errBadRemoteURL):
+		res.WriteHeader(422) // unprocessable entity
+		res.Write([]byte(err.Error()))
+	case errors.Is(err, errRemoteFetch):
+		res.WriteHeader(http.StatusBadGateway)
+		res.Write([]byte(err.Error()))
+	default:
+		res.WriteHeader(http.StatusInternalServerError)
+		res.Write([]byte("Error writing to DB."))
+	}
+}
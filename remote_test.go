@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// testPages serves HTML pages by path for remote ingestion tests. Pages can be changed while it is serving.
+type testPages struct {
+	mu    sync.Mutex
+	pages map[string]testPage
+}
+
+type testPage struct {
+	status      int
+	contentType string
+	body        string
+}
+
+func (p *testPages) set(path string, page testPage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pages[path] = page
+}
+
+func (p *testPages) ServeHTTP(res http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	page, ok := p.pages[r.URL.Path]
+	p.mu.Unlock()
+	if !ok {
+		http.NotFound(res, r)
+		return
+	}
+	contentType := page.contentType
+	if contentType == "" {
+		contentType = "text/html; charset=utf-8"
+	}
+	res.Header().Set("Content-Type", contentType)
+	if page.status != 0 {
+		res.WriteHeader(page.status)
+	}
+	res.Write([]byte(page.body))
+}
+
+// newTestPages starts a server for pages that is closed when the test ends.
+func newTestPages(t *testing.T, pages map[string]testPage) (*testPages, *httptest.Server) {
+	t.Helper()
+	p := &testPages{pages: pages}
+	server := httptest.NewServer(p)
+	t.Cleanup(server.Close)
+	return p, server
+}
+
+const openGraphPage = `<!DOCTYPE html>
+<html><head>
+<title>Plain Title</title>
+<meta name="description" content="Plain description.">
+<meta property="og:title" content="Water Lilies">
+<meta property="og:description" content="A series of paintings by Claude Monet.">
+<meta property="og:image" content="/images/lilies.jpg">
+<meta property="og:site_name" content="The [Museum]">
+<meta name="twitter:title" content="Twitter Title">
+<meta name="twitter:description" content="Twitter description.">
+<meta name="twitter:image" content="https://cdn.example.com/twitter.jpg">
+<link rel="canonical" href="/art/water-lilies">
+</head><body><h1>Water Lilies</h1></body></html>`
+
+const twitterPage = `<html><head>
+<title>Plain Title</title>
+<meta name="twitter:title" content="Haystacks">
+<meta name="twitter:description" content="Twenty-five canvases.">
+<meta name="twitter:image" content="https://cdn.example.com/haystacks.jpg">
+<meta property="og:url" content="https://example.com/haystacks">
+</head></html>`
+
+const plainPage = `<html><head>
+<title>  Poplars  </title>
+<meta name="description" content="Poplars on the Epte.">
+</head></html>`
+
+func TestIngestRemote(t *testing.T) {
+	_, server := newTestPages(t, map[string]testPage{
+		"/opengraph":   {body: openGraphPage},
+		"/twitter":     {body: twitterPage},
+		"/plain":       {body: plainPage},
+		"/bare/page/":  {body: `<html><body>Nothing to see.</body></html>`},
+		"/picture.png": {contentType: "image/png", body: "\x89PNG"},
+	})
+	tests := []struct {
+		path       string
+		url        string
+		label      string
+		definition string
+	}{
+		{
+			path:  "/opengraph#top",
+			url:   server.URL + "/opengraph",
+			label: "Water Lilies",
+			definition: "![Water Lilies](" + server.URL + "/images/lilies.jpg)\n\n" +
+				"A series of paintings by Claude Monet.\n\n" +
+				"Source: [The \\[Museum\\]](" + server.URL + "/art/water-lilies)\n",
+		},
+		{
+			path:  "/twitter",
+			url:   server.URL + "/twitter",
+			label: "Haystacks",
+			definition: "![Haystacks](https://cdn.example.com/haystacks.jpg)\n\n" +
+				"Twenty-five canvases.\n\n" +
+				"Source: <https://example.com/haystacks>\n",
+		},
+		{
+			path:       "/plain",
+			url:        server.URL + "/plain",
+			label:      "Poplars",
+			definition: "Poplars on the Epte.\n\nSource: <" + server.URL + "/plain>\n",
+		},
+		{
+			path:       "/bare/page/",
+			url:        server.URL + "/bare/page/",
+			label:      "page",
+			definition: "Source: <" + server.URL + "/bare/page/>\n",
+		},
+		{
+			path:       "/picture.png",
+			url:        server.URL + "/picture.png",
+			label:      "picture.png",
+			definition: "Source: <" + server.URL + "/picture.png>\n",
+		},
+	}
+	for _, tt := range tests {
+		store := newMemoryStore()
+		content, err := ingestRemote(store, server.Client(), server.URL+tt.path, "steve")
+		if err != nil {
+			t.Errorf("ingestRemote(%s): %v", tt.path, err)
+			continue
+		}
+		if content.URL != tt.url {
+			t.Errorf("ingestRemote(%s): URL %q, want %q", tt.path, content.URL, tt.url)
+		}
+		if content.Hash != remoteHash(tt.url) {
+			t.Errorf("ingestRemote(%s): hash %q, want the hash of its URL", tt.path, content.Hash)
+		}
+		if content.Label != tt.label {
+			t.Errorf("ingestRemote(%s): label %q, want %q", tt.path, content.Label, tt.label)
+		}
+		if content.Definition != tt.definition {
+			t.Errorf("ingestRemote(%s): definition\n%s\nwant\n%s", tt.path, content.Definition, tt.definition)
+		}
+		if content.Author != "steve" || content.CreatedAt.IsZero() {
+			t.Errorf("ingestRemote(%s): author %q created at %v, want steve and a time", tt.path, content.Author, content.CreatedAt)
+		}
+		stored, err := store.GetContent(content.Hash)
+		if err != nil {
+			t.Errorf("ingestRemote(%s) did not store the content: %v", tt.path, err)
+			continue
+		}
+		if stored.Label != tt.label || stored.Definition != tt.definition || stored.URL != tt.url {
+			t.Errorf("ingestRemote(%s): stored %q %q %q, want %q %q %q", tt.path, stored.Label, stored.Definition, stored.URL, tt.label, tt.definition, tt.url)
+		}
+	}
+}
+
+func TestIngestRemoteMeta(t *testing.T) {
+	_, server := newTestPages(t, map[string]testPage{"/opengraph": {body: openGraphPage}})
+	content, err := ingestRemote(newMemoryStore(), server.Client(), server.URL+"/opengraph", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RemoteMeta{
+		StatusCode:   http.StatusOK,
+		ContentType:  "text/html; charset=utf-8",
+		Title:        "Water Lilies",
+		Description:  "A series of paintings by Claude Monet.",
+		Image:        server.URL + "/images/lilies.jpg",
+		SiteName:     "The [Museum]",
+		CanonicalURL: server.URL + "/art/water-lilies",
+	}
+	got := *content.Remote
+	got.FetchedAt = want.FetchedAt
+	if got != want {
+		t.Errorf("remote meta %+v, want %+v", got, want)
+	}
+	if content.Remote.FetchedAt.IsZero() {
+		t.Error("remote meta has no fetch time")
+	}
+}
+
+func TestIngestRemoteErrors(t *testing.T) {
+	_, server := newTestPages(t, map[string]testPage{"/broken": {status: http.StatusInternalServerError, body: "oops"}})
+	tests := []struct {
+		url  string
+		want error
+	}{
+		{"ftp://example.com/file", errBadRemoteURL},
+		{"/relative/path", errBadRemoteURL},
+		{"https://", errBadRemoteURL},
+		{server.URL + "/missing", errRemoteFetch},
+		{server.URL + "/broken", errRemoteFetch},
+	}
+	for _, tt := range tests {
+		store := newMemoryStore()
+		_, err := ingestRemote(store, server.Client(), tt.url, "")
+		if !errors.Is(err, tt.want) {
+			t.Errorf("ingestRemote(%s): got %v, want %v", tt.url, err, tt.want)
+		}
+		if content, _, _ := store.ListContent(ListOptions{}); len(content) != 0 {
+			t.Errorf("ingestRemote(%s) stored content after failing", tt.url)
+		}
+	}
+}
+
+// refreshRequest posts to the refresh route of hash through a router, as the server does.
+func refreshRequest(store Store, client *http.Client, hash string) *httptest.ResponseRecorder {
+	r := mux.NewRouter()
+	r.HandleFunc("/content/{hash}/refresh", refreshRemoteContentHandler(store, client)).Methods("POST")
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest("POST", "/content/"+hash+"/refresh", nil))
+	return res
+}
+
+func TestRefreshRemoteContent(t *testing.T) {
+	pages, server := newTestPages(t, map[string]testPage{"/painting": {body: plainPage}})
+	store := newMemoryStore()
+	content, err := ingestRemote(store, server.Client(), server.URL+"/painting", "steve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutTag(Tag{Slug: "monet", Label: "Monet"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ApplyTag(content.Hash, "monet"); err != nil {
+		t.Fatal(err)
+	}
+
+	pages.set("/painting", testPage{body: openGraphPage})
+	res := refreshRequest(store, server.Client(), content.Hash)
+	if res.Code != http.StatusOK {
+		t.Fatalf("refresh: status %d %s, want 200", res.Code, res.Body)
+	}
+	var refreshed Content
+	if err := json.Unmarshal(res.Body.Bytes(), &refreshed); err != nil {
+		t.Fatalf("refresh: %v in %s", err, res.Body)
+	}
+	if refreshed.Label != "Water Lilies" || !strings.HasPrefix(refreshed.Definition, "![Water Lilies](") {
+		t.Errorf("refresh: label %q definition %q, want them from the new page", refreshed.Label, refreshed.Definition)
+	}
+	stored, err := store.GetContent(content.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Label != "Water Lilies" || stored.Definition != refreshed.Definition {
+		t.Errorf("refresh: stored label %q definition %q, want what was returned", stored.Label, stored.Definition)
+	}
+	if stored.URL != content.URL || stored.Author != "steve" || !stored.CreatedAt.Equal(content.CreatedAt) {
+		t.Errorf("refresh: stored URL %q author %q created at %v, want them kept", stored.URL, stored.Author, stored.CreatedAt)
+	}
+	if _, err := store.GetEdge("monet", content.Hash); err != nil {
+		t.Errorf("refresh: the content lost its tag: %v", err)
+	}
+
+	pages.set("/painting", testPage{status: http.StatusInternalServerError})
+	if res := refreshRequest(store, server.Client(), content.Hash); res.Code != http.StatusBadGateway {
+		t.Errorf("refresh of a broken page: status %d, want 502", res.Code)
+	}
+	if stored, _ := store.GetContent(content.Hash); stored.Label != "Water Lilies" {
+		t.Errorf("refresh of a broken page changed the label to %q", stored.Label)
+	}
+
+	if res := refreshRequest(store, server.Client(), "missing"); res.Code != http.StatusNotFound {
+		t.Errorf("refresh of missing content: status %d, want 404", res.Code)
+	}
+	if err := store.PutContent(Content{Hash: "local", Label: "A file"}); err != nil {
+		t.Fatal(err)
+	}
+	if res := refreshRequest(store, server.Client(), "local"); res.Code != 422 {
+		t.Errorf("refresh of content without a URL: status %d, want 422", res.Code)
+	}
+}
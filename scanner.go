@@ -0,0 +1,361 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// ScanReport summarises what a filesystem scan found.
+// Added counts new content records, Updated counts existing records that gained or lost a path,
+// and Missing counts recorded paths under the scanned roots that no longer hold the same bytes.
+type ScanReport struct {
+	Roots     []string `json:"roots"`
+	Files     int      `json:"files"`
+	Added     int      `json:"added"`
+	Updated   int      `json:"updated"`
+	Unchanged int      `json:"unchanged"`
+	Missing   int      `json:"missing"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+// hashFile returns the hex encoded MD5 of a file's bytes, which is used as the content hash.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// scanRoots walks each root directory, hashes every regular file and records it as content keyed by its hash.
+// Files with identical bytes share a single content record with one entry in Paths per location.
+// Paths recorded under a root that are not found with the same hash are removed from their content,
+// and content left without any path is marked as missing.
+// Unreadable files are reported in the Errors of the report rather than stopping the scan.
+func scanRoots(db *bolt.DB, roots []string) (*ScanReport, error) {
+	report := &ScanReport{Roots: []string{}}
+	found := map[string][]string{}
+	seen := map[string]string{}
+	for _, root := range roots {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve %s: %v", root, err)
+		}
+		info, err := os.Stat(abs)
+		if err != nil {
+			return nil, fmt.Errorf("could not scan %s: %v", root, err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("could not scan %s: not a directory", root)
+		}
+		report.Roots = append(report.Roots, abs)
+		err = filepath.Walk(abs, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				report.Errors = append(report.Errors, err.Error())
+				if info != nil && info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			if _, ok := seen[path]; ok {
+				return nil
+			}
+			hash, err := hashFile(path)
+			if err != nil {
+				report.Errors = append(report.Errors, err.Error())
+				return nil
+			}
+			report.Files++
+			seen[path] = hash
+			found[hash] = append(found[hash], path)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		added := map[string]bool{}
+		updated := map[string]bool{}
+		for hash, paths := range found {
+			content, err := lookupContent(tx, hash)
+			if err != nil {
+				return err
+			}
+			if content == nil {
+				content = &Content{Label: filepath.Base(paths[0]), CreatedAt: time.Now(), Hash: hash}
+				added[hash] = true
+			}
+			changed := false
+			for _, path := range paths {
+				if !containsString(content.Paths, path) {
+					content.Paths = append(content.Paths, path)
+					changed = true
+				}
+			}
+			if !changed && !content.Missing {
+				continue
+			}
+			content.Missing = false
+			if !added[hash] {
+				updated[hash] = true
+			}
+			sort.Strings(content.Paths)
+			if err := putContent(tx, *content, hash); err != nil {
+				return err
+			}
+		}
+
+		// Drop paths under the scanned roots that were not found holding the same bytes.
+		stale := map[string]Content{}
+		c := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(contentBucket)).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			content := Content{}
+			if err := json.Unmarshal(v, &content); err != nil {
+				return err
+			}
+			kept := []string{}
+			for _, path := range content.Paths {
+				if underRoots(path, report.Roots) && seen[path] != string(k) {
+					report.Missing++
+					continue
+				}
+				kept = append(kept, path)
+			}
+			if len(kept) != len(content.Paths) {
+				content.Paths = kept
+				content.Missing = len(kept) == 0
+				stale[string(k)] = content
+			}
+		}
+		for hash, content := range stale {
+			if !added[hash] {
+				updated[hash] = true
+			}
+			if err := putContent(tx, content, hash); err != nil {
+				return err
+			}
+		}
+
+		report.Added = len(added)
+		report.Updated = len(updated)
+		for hash := range found {
+			if !added[hash] && !updated[hash] {
+				report.Unchanged++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// underRoots reports whether path is inside one of the root directories.
+func underRoots(path string, roots []string) bool {
+	for _, root := range roots {
+		if path == root || strings.HasPrefix(path, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsString reports whether s is in list.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ScanJob is a scan started over HTTP. It runs in the background and is polled for its report.
+type ScanJob struct {
+	ID         string      `json:"id"`
+	Roots      []string    `json:"roots"`
+	Status     string      `json:"status"`
+	StartedAt  time.Time   `json:"startedAt"`
+	FinishedAt *time.Time  `json:"finishedAt,omitempty"`
+	Report     *ScanReport `json:"report,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// scanJobs keeps track of scan jobs started since the server started. Scans started over HTTP may only cover
+// directories under its roots, the configured watch and scan roots, so a caller can not have the server read
+// and record any directory it can reach.
+type scanJobs struct {
+	mu    sync.Mutex
+	jobs  map[string]*ScanJob
+	roots []string
+}
+
+func newScanJobs(roots []string) *scanJobs {
+	return &scanJobs{jobs: map[string]*ScanJob{}, roots: roots}
+}
+
+// allows reports whether dir is one of the roots of the jobs or below one, after resolving symbolic links.
+func (s *scanJobs) allows(dir string) bool {
+	path := resolvePath(dir)
+	for _, root := range s.roots {
+		rel, err := filepath.Rel(resolvePath(root), path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePath returns the absolute path of path with its symbolic links resolved, as far as it exists.
+func resolvePath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		return resolved
+	}
+	return abs
+}
+
+// start runs a scan of roots in a new goroutine and returns a snapshot of the job.
+func (s *scanJobs) start(db *bolt.DB, roots []string) ScanJob {
+	job := &ScanJob{ID: uuid.New().String(), Roots: roots, Status: "running", StartedAt: time.Now()}
+	s.mu.Lock()
+	s.jobs[job.ID] = job
+	snapshot := *job
+	s.mu.Unlock()
+	go func() {
+		log.Printf("Scan %s started for %s \n", job.ID, strings.Join(roots, ", "))
+		report, err := scanRoots(db, roots)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		now := time.Now()
+		job.FinishedAt = &now
+		if err != nil {
+			job.Status = "failed"
+			job.Error = err.Error()
+			log.Printf("Scan %s failed: %v \n", job.ID, err)
+			return
+		}
+		job.Status = "done"
+		job.Report = report
+		log.Printf("Scan %s done: %d added, %d updated, %d missing \n", job.ID, report.Added, report.Updated, report.Missing)
+	}()
+	return snapshot
+}
+
+// get returns a snapshot of a job.
+func (s *scanJobs) get(id string) (ScanJob, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return ScanJob{}, false
+	}
+	return *job, true
+}
+
+// createScanHandler starts a background scan of the directories listed in the JSON body, eg. {"roots": ["/photos"]}.
+// It responds with the job, whose status can be polled at /scan/{id}.
+func createScanHandler(db *bolt.DB, jobs *scanJobs) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Roots []string `json:"roots"`
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+		if err != nil {
+			panic(err)
+		}
+		if err := r.Body.Close(); err != nil {
+			panic(err)
+		}
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		if err := json.Unmarshal(body, &request); err != nil {
+			res.WriteHeader(422) // unprocessable entity
+			if err := json.NewEncoder(res).Encode(err); err != nil {
+				panic(err)
+			}
+			return
+		}
+		if len(request.Roots) == 0 {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(422) // unprocessable entity
+			res.Write([]byte("At least one root directory is required."))
+			return
+		}
+		for _, root := range request.Roots {
+			if !jobs.allows(root) {
+				res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+				res.WriteHeader(http.StatusForbidden)
+				res.Write([]byte(root + " is not under a watched directory or a scan root of the server."))
+				return
+			}
+		}
+		job := jobs.start(db, request.Roots)
+		res.Header().Set("Location", "/scan/"+job.ID)
+		res.WriteHeader(http.StatusAccepted)
+		if err := json.NewEncoder(res).Encode(job); err != nil {
+			panic(err)
+		}
+	}
+	return fn
+}
+
+// getScanHandler returns the status of a scan job, including its report once it is done.
+func getScanHandler(jobs *scanJobs) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		job, ok := jobs.get(mux.Vars(r)["id"])
+		if !ok {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusNotFound)
+			res.Write([]byte("404 Page Not Found"))
+			return
+		}
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		res.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(res).Encode(job); err != nil {
+			panic(err)
+		}
+	}
+	return fn
+}
+
+// printScanReport prints a scan report for the scan command.
+func printScanReport(report *ScanReport) {
+	fmt.Printf("Scanned %d files in %s\n", report.Files, strings.Join(report.Roots, ", "))
+	fmt.Printf("  added:     %d\n", report.Added)
+	fmt.Printf("  updated:   %d\n", report.Updated)
+	fmt.Printf("  unchanged: %d\n", report.Unchanged)
+	fmt.Printf("  missing:   %d\n", report.Missing)
+	for _, e := range report.Errors {
+		fmt.Printf("  error: %s\n", e)
+	}
+}
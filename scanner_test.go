@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestScanJobsAllows(t *testing.T) {
+	dir := t.TempDir()
+	photos := filepath.Join(dir, "photos")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{filepath.Join(photos, "2021"), filepath.Join(dir, "photos2"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(photos, "link")); err != nil {
+		t.Fatal(err)
+	}
+	jobs := newScanJobs([]string{photos})
+	tests := []struct {
+		dir  string
+		want bool
+	}{
+		{photos, true},
+		{photos + string(filepath.Separator), true},
+		{filepath.Join(photos, "2021"), true},
+		{filepath.Join(photos, "not-yet"), true},
+		{filepath.Join(photos, "2021", "..", ".."), false},
+		{filepath.Join(dir, "photos2"), false},
+		{dir, false},
+		{outside, false},
+		{filepath.Join(photos, "link"), false},
+		{"/", false},
+	}
+	for _, tt := range tests {
+		if got := jobs.allows(tt.dir); got != tt.want {
+			t.Errorf("allows(%s) = %v, want %v", tt.dir, got, tt.want)
+		}
+	}
+	if newScanJobs(nil).allows(photos) {
+		t.Error("a server without watched directories or scan roots allows scans")
+	}
+}
+
+func TestCreateScanHandlerRefusesOtherDirectories(t *testing.T) {
+	db := newTestDB(t)
+	photos := t.TempDir()
+	writeFile(t, photos, "photo.jpg", "photo bytes")
+	jobs := newScanJobs([]string{photos})
+	r := mux.NewRouter()
+	r.HandleFunc("/scan", createScanHandler(db, jobs)).Methods("POST")
+	r.HandleFunc("/api/v1/scan", apiCreateScanHandler(&boltStore{db: db}, jobs)).Methods("POST")
+
+	for _, target := range []string{"/scan", "/api/v1/scan"} {
+		for _, body := range []string{`{"roots": ["/"]}`, `{"roots": ["` + photos + `", "` + t.TempDir() + `"]}`} {
+			if res := request(r, "POST", target, body, ""); res.Code != http.StatusForbidden {
+				t.Errorf("POST %s %s: status %d, want 403", target, body, res.Code)
+			}
+		}
+		if res := request(r, "POST", target, `{"roots": ["`+photos+`"]}`, ""); res.Code != http.StatusAccepted {
+			t.Errorf("POST %s of the scan root: status %d %s, want 202", target, res.Code, res.Body)
+		}
+	}
+	// Let the scans finish before the database is closed.
+	for running := true; running; time.Sleep(10 * time.Millisecond) {
+		jobs.mu.Lock()
+		running = false
+		for _, job := range jobs.jobs {
+			running = running || job.Status == "running"
+		}
+		jobs.mu.Unlock()
+	}
+}
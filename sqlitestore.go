@@ -0,0 +1,415 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteSchema lays the data out so it can be inspected with plain SQL. The commonly queried fields of
+// content and tags have their own columns, and the record column holds the full JSON record that is read back.
+// The *_key columns hold the same sort keys as the bolt sort indexes, so listings page the same way.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS content (
+	hash TEXT PRIMARY KEY,
+	title TEXT NOT NULL,
+	author TEXT NOT NULL,
+	body TEXT NOT NULL,
+	url TEXT NOT NULL,
+	missing INTEGER NOT NULL,
+	created_at TEXT NOT NULL,
+	record TEXT NOT NULL,
+	created_key BLOB NOT NULL,
+	label_key BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS content_created_key ON content (created_key);
+CREATE INDEX IF NOT EXISTS content_label_key ON content (label_key);
+
+CREATE TABLE IF NOT EXISTS tags (
+	slug TEXT PRIMARY KEY,
+	title TEXT NOT NULL,
+	author TEXT NOT NULL,
+	body TEXT NOT NULL,
+	created_at TEXT NOT NULL,
+	record TEXT NOT NULL,
+	created_key BLOB NOT NULL,
+	label_key BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS tags_created_key ON tags (created_key);
+CREATE INDEX IF NOT EXISTS tags_label_key ON tags (label_key);
+
+CREATE TABLE IF NOT EXISTS tag_parents (
+	tag TEXT NOT NULL REFERENCES tags (slug) ON DELETE CASCADE,
+	parent TEXT NOT NULL REFERENCES tags (slug) ON DELETE CASCADE,
+	PRIMARY KEY (tag, parent)
+);
+CREATE INDEX IF NOT EXISTS tag_parents_parent ON tag_parents (parent);
+
+CREATE TABLE IF NOT EXISTS edges (
+	tag TEXT NOT NULL REFERENCES tags (slug) ON DELETE CASCADE,
+	content TEXT NOT NULL REFERENCES content (hash) ON DELETE CASCADE,
+	created_at TEXT NOT NULL,
+	PRIMARY KEY (tag, content)
+);
+CREATE INDEX IF NOT EXISTS edges_content ON edges (content);
+`
+
+// sqliteSortColumns maps each supported sort order to the column holding its key.
+var sqliteSortColumns = map[string]string{"created": "created_key", "label": "label_key"}
+
+// sqliteStore is a Store kept in a SQLite database file.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=on")
+	if err != nil {
+		return nil, fmt.Errorf("could not open sqlite db, %v", err)
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not set up sqlite tables, %v", err)
+	}
+	log.Println("DB Setup Done")
+	return &sqliteStore{db: db}, nil
+}
+
+// readRecords runs a query selecting one JSON record column and decodes each row into a value made by add.
+func readRecords(q queryer, add func([]byte) error, query string, args ...interface{}) error {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var record []byte
+		if err := rows.Scan(&record); err != nil {
+			return err
+		}
+		if err := add(record); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// walker pages through the sort key column of table, returning the id column of each row.
+func (s *sqliteStore) walker(table string, id string, column string) indexWalker {
+	return func(from []byte, forwards bool, n int) ([][]byte, []string, error) {
+		op, dir := ">", "ASC"
+		if !forwards {
+			op, dir = "<", "DESC"
+		}
+		query := fmt.Sprintf("SELECT %s, %s FROM %s", column, id, table)
+		var args []interface{}
+		if from != nil {
+			query += fmt.Sprintf(" WHERE %s %s ?", column, op)
+			args = append(args, from)
+		}
+		query += fmt.Sprintf(" ORDER BY %s %s LIMIT ?", column, dir)
+		args = append(args, n)
+		rows, err := s.db.Query(query, args...)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer rows.Close()
+		var keys [][]byte
+		var ids []string
+		for rows.Next() {
+			var key []byte
+			var slug string
+			if err := rows.Scan(&key, &slug); err != nil {
+				return nil, nil, err
+			}
+			keys = append(keys, key)
+			ids = append(ids, slug)
+		}
+		return keys, ids, rows.Err()
+	}
+}
+
+func (s *sqliteStore) GetContent(hash string) (*Content, error) {
+	return sqliteLookupContent(s.db, hash)
+}
+
+func sqliteLookupContent(q queryer, hash string) (*Content, error) {
+	var record []byte
+	err := q.QueryRow("SELECT record FROM content WHERE hash = ?", hash).Scan(&record)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errContentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	content := Content{}
+	if err := json.Unmarshal(record, &content); err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
+
+func (s *sqliteStore) PutContent(content Content) error {
+	record, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	keys := contentSortKeys(&content)
+	_, err = s.db.Exec(`INSERT INTO content (hash, title, author, body, url, missing, created_at, record, created_key, label_key)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (hash) DO UPDATE SET title = excluded.title, author = excluded.author, body = excluded.body,
+			url = excluded.url, missing = excluded.missing, created_at = excluded.created_at, record = excluded.record,
+			created_key = excluded.created_key, label_key = excluded.label_key`,
+		content.Hash, content.Label, content.Author, content.Definition, content.URL, content.Missing,
+		content.CreatedAt.Format(time.RFC3339Nano), string(record),
+		sortIndexKey(keys["created"], content.Hash), sortIndexKey(keys["label"], content.Hash))
+	if err != nil {
+		return fmt.Errorf("could not insert content: %v", err)
+	}
+	return nil
+}
+
+// DeleteContent removes the content. Its edges go with it through the foreign key.
+func (s *sqliteStore) DeleteContent(hash string) error {
+	if _, err := s.db.Exec("DELETE FROM content WHERE hash = ?", hash); err != nil {
+		return fmt.Errorf("could not delete content: %v", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) ListContent(opts ListOptions) ([]Content, PageInfo, error) {
+	hashes, info, err := pageIndex(s.walker("content", "hash", sqliteSortColumns[opts.Sort]), opts)
+	if err != nil {
+		return nil, info, err
+	}
+	results := []Content{}
+	for _, hash := range hashes {
+		content, err := s.GetContent(hash)
+		if errors.Is(err, errContentNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, info, err
+		}
+		results = append(results, *content)
+	}
+	return results, info, nil
+}
+
+func (s *sqliteStore) GetTag(slug string) (*Tag, error) {
+	return sqliteLookupTag(s.db, slug)
+}
+
+func sqliteLookupTag(q queryer, slug string) (*Tag, error) {
+	var record []byte
+	err := q.QueryRow("SELECT record FROM tags WHERE slug = ?", slug).Scan(&record)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errTagNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	tag := Tag{}
+	if err := json.Unmarshal(record, &tag); err != nil {
+		return nil, err
+	}
+	return &tag, nil
+}
+
+// PutTag writes a tag and its rows in tag_parents in one transaction, after checking the parents.
+func (s *sqliteStore) PutTag(tag Tag) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := sqlitePutTag(tx, tag); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func sqlitePutTag(tx *sql.Tx, tag Tag) error {
+	tag.Parents = uniqueStrings(tag.Parents)
+	lookup := func(slug string) (*Tag, error) { return sqliteLookupTag(tx, slug) }
+	if err := checkTagParents(tag.Slug, tag.Parents, lookup); err != nil {
+		return err
+	}
+	record, err := json.Marshal(tag)
+	if err != nil {
+		return err
+	}
+	keys := tagSortKeys(&tag)
+	_, err = tx.Exec(`INSERT INTO tags (slug, title, author, body, created_at, record, created_key, label_key)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (slug) DO UPDATE SET title = excluded.title, author = excluded.author, body = excluded.body,
+			created_at = excluded.created_at, record = excluded.record,
+			created_key = excluded.created_key, label_key = excluded.label_key`,
+		tag.Slug, tag.Label, tag.Author, tag.Definition, tag.CreatedAt.Format(time.RFC3339Nano), string(record),
+		sortIndexKey(keys["created"], tag.Slug), sortIndexKey(keys["label"], tag.Slug))
+	if err != nil {
+		return fmt.Errorf("could not insert tag: %v", err)
+	}
+	if _, err := tx.Exec("DELETE FROM tag_parents WHERE tag = ?", tag.Slug); err != nil {
+		return fmt.Errorf("could not delete tag_parents: %v", err)
+	}
+	for _, parent := range tag.Parents {
+		if _, err := tx.Exec("INSERT INTO tag_parents (tag, parent) VALUES (?, ?)", tag.Slug, parent); err != nil {
+			return fmt.Errorf("could not insert tag_parents: %v", err)
+		}
+	}
+	return nil
+}
+
+// DeleteTag removes a tag. Its edges and parent rows go with it through the foreign keys,
+// and its children are rewritten without it so their records agree with tag_parents.
+func (s *sqliteStore) DeleteTag(slug string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var children []Tag
+	err = readRecords(tx, func(record []byte) error {
+		tag := Tag{}
+		if err := json.Unmarshal(record, &tag); err != nil {
+			return err
+		}
+		children = append(children, tag)
+		return nil
+	}, "SELECT tags.record FROM tag_parents JOIN tags ON tags.slug = tag_parents.tag WHERE tag_parents.parent = ?", slug)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		child.Parents = removeString(child.Parents, slug)
+		if err := sqlitePutTag(tx, child); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM tags WHERE slug = ?", slug); err != nil {
+		return fmt.Errorf("could not delete tag: %v", err)
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) ListTags(opts ListOptions) ([]Tag, PageInfo, error) {
+	slugs, info, err := pageIndex(s.walker("tags", "slug", sqliteSortColumns[opts.Sort]), opts)
+	if err != nil {
+		return nil, info, err
+	}
+	results := []Tag{}
+	for _, slug := range slugs {
+		tag, err := s.GetTag(slug)
+		if errors.Is(err, errTagNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, info, err
+		}
+		results = append(results, *tag)
+	}
+	return results, info, nil
+}
+
+func (s *sqliteStore) ChildTags(slug string) ([]Tag, error) {
+	return s.readTags(`SELECT tags.record FROM tag_parents JOIN tags ON tags.slug = tag_parents.tag
+		WHERE tag_parents.parent = ? ORDER BY tags.label_key`, slug)
+}
+
+func (s *sqliteStore) GetEdge(slug string, hash string) (*Edge, error) {
+	var createdAt string
+	err := s.db.QueryRow("SELECT created_at FROM edges WHERE tag = ? AND content = ?", slug, hash).Scan(&createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errEdgeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	edge := Edge{Tag: slug, Content: hash}
+	edge.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt)
+	if err != nil {
+		return nil, err
+	}
+	return &edge, nil
+}
+
+func (s *sqliteStore) ApplyTag(hash string, slug string) (*Edge, error) {
+	return s.PutEdge(Edge{Tag: slug, Content: hash, CreatedAt: time.Now()})
+}
+
+func (s *sqliteStore) PutEdge(edge Edge) (*Edge, error) {
+	if _, err := s.GetContent(edge.Content); err != nil {
+		return nil, err
+	}
+	if _, err := s.GetTag(edge.Tag); err != nil {
+		return nil, err
+	}
+	_, err := s.db.Exec("INSERT INTO edges (tag, content, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING",
+		edge.Tag, edge.Content, edge.CreatedAt.Format(time.RFC3339Nano))
+	if err != nil {
+		return nil, fmt.Errorf("could not insert edge: %v", err)
+	}
+	return s.GetEdge(edge.Tag, edge.Content)
+}
+
+func (s *sqliteStore) DeleteEdge(slug string, hash string) error {
+	if _, err := s.db.Exec("DELETE FROM edges WHERE tag = ? AND content = ?", slug, hash); err != nil {
+		return fmt.Errorf("could not delete edge: %v", err)
+	}
+	return nil
+}
+
+func (s *sqliteStore) TagsForContent(hash string) ([]Tag, error) {
+	return s.readTags(`SELECT tags.record FROM edges JOIN tags ON tags.slug = edges.tag
+		WHERE edges.content = ? ORDER BY tags.label_key`, hash)
+}
+
+func (s *sqliteStore) ContentForTag(slug string) ([]Content, error) {
+	results := []Content{}
+	err := readRecords(s.db, func(record []byte) error {
+		content := Content{}
+		if err := json.Unmarshal(record, &content); err != nil {
+			return err
+		}
+		results = append(results, content)
+		return nil
+	}, `SELECT content.record FROM edges JOIN content ON content.hash = edges.content
+		WHERE edges.tag = ? ORDER BY content.label_key`, slug)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// readTags runs a query selecting tag records.
+func (s *sqliteStore) readTags(query string, args ...interface{}) ([]Tag, error) {
+	results := []Tag{}
+	err := readRecords(s.db, func(record []byte) error {
+		tag := Tag{}
+		if err := json.Unmarshal(record, &tag); err != nil {
+			return err
+		}
+		results = append(results, tag)
+		return nil
+	}, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Store keeps content, tags and the edges between them. The bolt store is the full featured backend:
+// full text search, tag queries, aliases, scans and the watcher are built directly on its buckets, so their
+// routes answer 501 on the other stores (see boltOnly). The memory and SQLite stores serve content, tags and edges.
+//
+// Lookups of records that do not exist return errContentNotFound, errTagNotFound or errEdgeNotFound.
+// ApplyTag and PutEdge keep an existing edge as it is. PutEdge is ApplyTag with the edge's CreatedAt
+// given by the caller, for restoring edges from an export.
+// PutTag returns a hierarchy error (see isHierarchyError) when the tag's parents are invalid.
+type Store interface {
+	GetContent(hash string) (*Content, error)
+	PutContent(content Content) error
+	DeleteContent(hash string) error
+	ListContent(opts ListOptions) ([]Content, PageInfo, error)
+
+	GetTag(slug string) (*Tag, error)
+	PutTag(tag Tag) error
+	DeleteTag(slug string) error
+	ListTags(opts ListOptions) ([]Tag, PageInfo, error)
+	ChildTags(slug string) ([]Tag, error)
+
+	GetEdge(slug string, hash string) (*Edge, error)
+	ApplyTag(hash string, slug string) (*Edge, error)
+	PutEdge(edge Edge) (*Edge, error)
+	DeleteEdge(slug string, hash string) error
+	TagsForContent(hash string) ([]Tag, error)
+	ContentForTag(slug string) ([]Content, error)
+
+	Close() error
+}
+
+var errEdgeNotFound = errors.New("edge not found")
+
+// openStore opens the store selected by cfg.Store: "bolt", "memory" or "sqlite".
+func openStore(cfg Config) (Store, error) {
+	switch cfg.Store {
+	case "", "bolt":
+		db, err := setupDB(cfg.DB)
+		if err != nil {
+			return nil, err
+		}
+		return &boltStore{db: db}, nil
+	case "memory":
+		return newMemoryStore(), nil
+	case "sqlite":
+		return openSQLiteStore(cfg.SQLite)
+	default:
+		return nil, fmt.Errorf("unknown store %q, expected bolt, memory or sqlite", cfg.Store)
+	}
+}
+
+// boltDB returns the bolt database behind a store, or nil if the store is not backed by bolt.
+func boltDB(store Store) *bolt.DB {
+	if s, ok := store.(*boltStore); ok {
+		return s.db
+	}
+	return nil
+}
+
+// boltOnly returns h when the store is backed by bolt. On the other stores the route still exists but answers
+// 501 Not Implemented, so clients can tell a feature the store lacks from a route that does not exist.
+func boltOnly(store Store, h http.HandlerFunc) http.HandlerFunc {
+	if boltDB(store) != nil {
+		return h
+	}
+	message := "Not supported by this store. Search, aliases, namespaces, content types, collections, revisions, scans and accounts need the bolt store."
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			writeAPIError(res, http.StatusNotImplemented, message, nil)
+			return
+		}
+		res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+		res.WriteHeader(http.StatusNotImplemented)
+		res.Write([]byte(message))
+	}
+	return fn
+}
+
+// resolveTag looks up a tag by slug, falling back to the tag an alias refers to when the store has aliases.
+func resolveTag(store Store, name string) (*Tag, error) {
+	tag, err := store.GetTag(name)
+	if !errors.Is(err, errTagNotFound) {
+		return tag, err
+	}
+	db := boltDB(store)
+	if db == nil {
+		return nil, err
+	}
+	db.View(func(tx *bolt.Tx) error {
+		name = resolveTagSlug(tx, name)
+		return nil
+	})
+	return store.GetTag(name)
+}
+
+// contentSlice returns the content in a map ordered by label, so whole lists come back in a stable order.
+func contentSlice(m ContentMap) []Content {
+	list := make([]Content, 0, len(m))
+	for _, content := range m {
+		list = append(list, content)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if a, b := strings.ToLower(list[i].Label), strings.ToLower(list[j].Label); a != b {
+			return a < b
+		}
+		return list[i].Hash < list[j].Hash
+	})
+	return list
+}
+
+// tagSlice returns the tags in a map ordered by label.
+func tagSlice(m TagMap) []Tag {
+	list := make([]Tag, 0, len(m))
+	for _, tag := range m {
+		list = append(list, tag)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if a, b := strings.ToLower(list[i].Label), strings.ToLower(list[j].Label); a != b {
+			return a < b
+		}
+		return list[i].Slug < list[j].Slug
+	})
+	return list
+}
+
+// boltStore is the Store backed by the bolt buckets set up in setupDB.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func (s *boltStore) GetContent(hash string) (*Content, error) {
+	var content *Content
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		content, err = lookupContent(tx, hash)
+		return err
+	})
+	if err == nil && content == nil {
+		err = errContentNotFound
+	}
+	return content, err
+}
+
+func (s *boltStore) PutContent(content Content) error {
+	return upsertContent(s.db, content, content.Hash)
+}
+
+func (s *boltStore) DeleteContent(hash string) error {
+	return deleteContent(s.db, hash)
+}
+
+func (s *boltStore) ListContent(opts ListOptions) ([]Content, PageInfo, error) {
+	return listContent(s.db, opts)
+}
+
+func (s *boltStore) GetTag(slug string) (*Tag, error) {
+	var tag *Tag
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		tag, err = lookupTag(tx, slug)
+		return err
+	})
+	if err == nil && tag == nil {
+		err = errTagNotFound
+	}
+	return tag, err
+}
+
+func (s *boltStore) PutTag(tag Tag) error {
+	return upsertTag(s.db, tag, tag.Slug)
+}
+
+func (s *boltStore) DeleteTag(slug string) error {
+	return deleteTag(s.db, slug)
+}
+
+func (s *boltStore) ListTags(opts ListOptions) ([]Tag, PageInfo, error) {
+	return listTag(s.db, opts)
+}
+
+func (s *boltStore) ChildTags(slug string) ([]Tag, error) {
+	tags, err := listTagRelatives(s.db, slug, tagChildren)
+	if err != nil {
+		return nil, err
+	}
+	return tagSlice(tags), nil
+}
+
+func (s *boltStore) GetEdge(slug string, hash string) (*Edge, error) {
+	edge, err := getEdge(s.db, slug, hash)
+	if err != nil {
+		return nil, errEdgeNotFound
+	}
+	return edge, nil
+}
+
+func (s *boltStore) ApplyTag(hash string, slug string) (*Edge, error) {
+	return s.PutEdge(Edge{Tag: slug, Content: hash, CreatedAt: time.Now()})
+}
+
+func (s *boltStore) PutEdge(edge Edge) (*Edge, error) {
+	return applyEdge(s.db, edge)
+}
+
+func (s *boltStore) DeleteEdge(slug string, hash string) error {
+	return deleteEdge(s.db, slug, hash)
+}
+
+func (s *boltStore) TagsForContent(hash string) ([]Tag, error) {
+	tags, err := listTagsForContent(s.db, hash)
+	if err != nil {
+		return nil, err
+	}
+	return tagSlice(tags), nil
+}
+
+func (s *boltStore) ContentForTag(slug string) ([]Content, error) {
+	content, err := listContentForTag(s.db, slug)
+	if err != nil {
+		return nil, err
+	}
+	return contentSlice(content), nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// testStores are the Stores every contract test runs against, each opened fresh in a temporary directory.
+var testStores = []struct {
+	name string
+	open func(t *testing.T) Store
+}{
+	{"memory", func(t *testing.T) Store { return newMemoryStore() }},
+	{"bolt", func(t *testing.T) Store { return &boltStore{db: newTestDB(t)} }},
+	{"sqlite", func(t *testing.T) Store {
+		store, err := openSQLiteStore(filepath.Join(t.TempDir(), "anansi.sqlite"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}},
+}
+
+// newTestDB sets up a bolt database in a temporary directory that is closed when the test ends.
+func newTestDB(tb testing.TB) *bolt.DB {
+	tb.Helper()
+	db, err := setupDB(filepath.Join(tb.TempDir(), "anansi.db"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	return db
+}
+
+// eachStore runs test as a subtest against every Store in testStores.
+func eachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	for _, s := range testStores {
+		t.Run(s.name, func(t *testing.T) {
+			store := s.open(t)
+			t.Cleanup(func() { store.Close() })
+			test(t, store)
+		})
+	}
+}
+
+// seedStore puts content a, b and c and tags red and blue, and tags a and b with red and a with blue.
+func seedStore(t *testing.T, store Store) {
+	t.Helper()
+	created := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i, hash := range []string{"a", "b", "c"} {
+		content := Content{Hash: hash, Label: "Content " + hash, CreatedAt: created.Add(time.Duration(i) * time.Hour)}
+		if err := store.PutContent(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, slug := range []string{"red", "blue"} {
+		if err := store.PutTag(Tag{Slug: slug, Label: slug, CreatedAt: created}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, edge := range [][2]string{{"a", "red"}, {"b", "red"}, {"a", "blue"}} {
+		if _, err := store.ApplyTag(edge[0], edge[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func contentHashes(content []Content) []string {
+	hashes := []string{}
+	for _, c := range content {
+		hashes = append(hashes, c.Hash)
+	}
+	return hashes
+}
+
+func tagSlugs(tags []Tag) []string {
+	slugs := []string{}
+	for _, tag := range tags {
+		slugs = append(slugs, tag.Slug)
+	}
+	return slugs
+}
+
+func TestStoreDeleteContentRemovesEdges(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		seedStore(t, store)
+		if err := store.DeleteContent("a"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.GetContent("a"); !errors.Is(err, errContentNotFound) {
+			t.Errorf("GetContent(a) after delete: got %v, want errContentNotFound", err)
+		}
+		if _, err := store.GetEdge("red", "a"); !errors.Is(err, errEdgeNotFound) {
+			t.Errorf("GetEdge(red, a) after delete: got %v, want errEdgeNotFound", err)
+		}
+		content, err := store.ContentForTag("red")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(contentHashes(content)); got != "[b]" {
+			t.Errorf("ContentForTag(red) = %s, want [b]", got)
+		}
+		content, err = store.ContentForTag("blue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(content) != 0 {
+			t.Errorf("ContentForTag(blue) = %v, want nothing", contentHashes(content))
+		}
+	})
+}
+
+func TestStoreDeleteTagRemovesEdges(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		seedStore(t, store)
+		if err := store.DeleteTag("red"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.GetTag("red"); !errors.Is(err, errTagNotFound) {
+			t.Errorf("GetTag(red) after delete: got %v, want errTagNotFound", err)
+		}
+		if _, err := store.GetEdge("red", "b"); !errors.Is(err, errEdgeNotFound) {
+			t.Errorf("GetEdge(red, b) after delete: got %v, want errEdgeNotFound", err)
+		}
+		tags, err := store.TagsForContent("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(tagSlugs(tags)); got != "[blue]" {
+			t.Errorf("TagsForContent(a) = %s, want [blue]", got)
+		}
+		tags, err = store.TagsForContent("b")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tags) != 0 {
+			t.Errorf("TagsForContent(b) = %v, want nothing", tagSlugs(tags))
+		}
+		if _, err := store.GetContent("b"); err != nil {
+			t.Errorf("GetContent(b) after deleting its tag: %v", err)
+		}
+	})
+}
+
+func TestStoreListContentPages(t *testing.T) {
+	tests := []struct {
+		sort  string
+		order string
+		want  string
+	}{
+		{"created", "asc", "[c0 c1 c2 c3 c4]"},
+		{"created", "desc", "[c4 c3 c2 c1 c0]"},
+		{"label", "asc", "[c4 c3 c2 c1 c0]"},
+		{"label", "desc", "[c0 c1 c2 c3 c4]"},
+	}
+	eachStore(t, func(t *testing.T, store Store) {
+		created := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < 5; i++ {
+			content := Content{
+				Hash:      fmt.Sprintf("c%d", i),
+				Label:     string(rune('e' - i)),
+				CreatedAt: created.Add(time.Duration(i) * time.Hour),
+			}
+			if err := store.PutContent(content); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, tt := range tests {
+			opts := ListOptions{Limit: 2, Sort: tt.sort, Order: tt.order}
+			var hashes []string
+			var pages int
+			for {
+				page, info, err := store.ListContent(opts)
+				if err != nil {
+					t.Fatalf("%s %s: %v", tt.sort, tt.order, err)
+				}
+				if len(page) > opts.Limit {
+					t.Errorf("%s %s: page of %d, want at most %d", tt.sort, tt.order, len(page), opts.Limit)
+				}
+				hashes = append(hashes, contentHashes(page)...)
+				pages++
+				if info.Next == "" || pages > 5 {
+					break
+				}
+				opts.Cursor = info.Next
+			}
+			if got := fmt.Sprint(hashes); got != tt.want {
+				t.Errorf("%s %s: paged through %s, want %s", tt.sort, tt.order, got, tt.want)
+			}
+			if pages != 3 {
+				t.Errorf("%s %s: %d pages, want 3", tt.sort, tt.order, pages)
+			}
+		}
+	})
+}
+
+func TestStoreListContentBadCursor(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		seedStore(t, store)
+		_, _, err := store.ListContent(ListOptions{Limit: 2, Sort: "created", Order: "asc", Cursor: "not a cursor"})
+		if err == nil {
+			t.Error("ListContent with a bad cursor did not fail")
+		}
+	})
+}
+
+func TestStoreEdgesAreIdempotent(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		seedStore(t, store)
+		first, err := store.GetEdge("red", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.ApplyTag("a", "red"); err != nil {
+			t.Fatalf("applying red to a again: %v", err)
+		}
+		if _, err := store.PutEdge(Edge{Tag: "red", Content: "a", CreatedAt: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatalf("putting the red edge of a again: %v", err)
+		}
+		edge, err := store.GetEdge("red", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !edge.CreatedAt.Equal(first.CreatedAt) {
+			t.Errorf("edge created at %v after applying it again, want %v", edge.CreatedAt, first.CreatedAt)
+		}
+		tags, err := store.TagsForContent("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(tagSlugs(tags)); got != "[blue red]" {
+			t.Errorf("TagsForContent(a) = %s, want [blue red]", got)
+		}
+		content, err := store.ContentForTag("red")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(contentHashes(content)); got != "[a b]" {
+			t.Errorf("ContentForTag(red) = %s, want [a b]", got)
+		}
+		for i := 0; i < 2; i++ {
+			if err := store.DeleteEdge("red", "a"); err != nil {
+				t.Fatalf("deleting the red edge of a, time %d: %v", i+1, err)
+			}
+		}
+		if _, err := store.GetEdge("red", "a"); !errors.Is(err, errEdgeNotFound) {
+			t.Errorf("GetEdge(red, a) after delete: got %v, want errEdgeNotFound", err)
+		}
+	})
+}
+
+func TestStoreEdgesNeedContentAndTag(t *testing.T) {
+	eachStore(t, func(t *testing.T, store Store) {
+		seedStore(t, store)
+		if _, err := store.ApplyTag("missing", "red"); !errors.Is(err, errContentNotFound) {
+			t.Errorf("ApplyTag(missing, red): got %v, want errContentNotFound", err)
+		}
+		if _, err := store.ApplyTag("a", "missing"); !errors.Is(err, errTagNotFound) {
+			t.Errorf("ApplyTag(a, missing): got %v, want errTagNotFound", err)
+		}
+	})
+}
+
+func TestBoltOnlyRoutes(t *testing.T) {
+	r, err := newRouter(newMemoryStore(), "templates", t.TempDir(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method string
+		target string
+		status int
+		json   bool
+	}{
+		{"GET", "/api/v1/search?q=red", http.StatusNotImplemented, true},
+		{"GET", "/api/v1/tags/suggest?q=re", http.StatusNotImplemented, true},
+		{"POST", "/api/v1/tags/red/aliases", http.StatusNotImplemented, true},
+		{"GET", "/api/v1/users", http.StatusNotImplemented, true},
+		{"GET", "/collections", http.StatusNotImplemented, false},
+		{"GET", "/tags/suggest?q=re", http.StatusNotImplemented, false},
+		{"POST", "/scan", http.StatusNotImplemented, false},
+		{"GET", "/api/v1/content", http.StatusOK, true},
+		{"GET", "/api/v1/missing", http.StatusNotFound, true},
+	}
+	for _, tt := range tests {
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, httptest.NewRequest(tt.method, tt.target, nil))
+		if res.Code != tt.status {
+			t.Errorf("%s %s on the memory store: status %d, want %d", tt.method, tt.target, res.Code, tt.status)
+		}
+		if isJSON := strings.HasPrefix(res.Header().Get("Content-Type"), "application/json"); isJSON != tt.json {
+			t.Errorf("%s %s on the memory store: content type %q", tt.method, tt.target, res.Header().Get("Content-Type"))
+		}
+	}
+
+	r, _ = newTestRouter(t, nil)
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, httptest.NewRequest("GET", "/api/v1/collections", nil))
+	if res.Code != http.StatusOK {
+		t.Errorf("collections on the bolt store: status %d, want 200", res.Code)
+	}
+}
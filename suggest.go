@@ -0,0 +1,341 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Tag suggestions complete what someone has started typing into the names of tags. TAG_NAMES maps the
+// folded label of every tag and every alias, followed by the tag's slug and whether it is an alias, to
+// the name as it was written, so the names starting with a prefix are one cursor range. TAG_USAGE counts
+// the content each tag is applied to, to rank them.
+const tagNamesBucket = "TAG_NAMES"
+const tagUsageBucket = "TAG_USAGE"
+
+const defaultSuggestLimit = 10
+const maxSuggestLimit = 100
+
+// maxSuggestScan is the most names starting with a prefix that a suggestion looks at.
+const maxSuggestScan = 2000
+
+// TagSuggestion is a tag whose label or alias starts with the prefix asked for.
+type TagSuggestion struct {
+	Slug      string `json:"slug"`
+	Label     string `json:"title"`
+	Namespace string `json:"namespace,omitempty"`
+	Alias     string `json:"alias,omitempty"` // The alias that matched, when the label did not.
+	Count     int    `json:"count"`           // How much content the tag is applied to.
+}
+
+// foldName reduces a name to what suggestions compare: lower case, without accents, and with every run of
+// punctuation and spaces turned into one space, so "Café au lait", "cafe-au-lait" and "CAFE AU LAIT" match.
+func foldName(name string) string {
+	var b strings.Builder
+	gap := false
+	for _, r := range norm.NFD.String(name) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if gap && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			gap = false
+			b.WriteRune(unicode.ToLower(r))
+		default:
+			gap = true
+		}
+	}
+	return b.String()
+}
+
+// foldPrefix folds a prefix like foldName, but keeps a trailing gap so "new " only suggests names with
+// a word after new.
+func foldPrefix(prefix string) string {
+	folded := foldName(prefix)
+	if folded == "" {
+		return ""
+	}
+	last := []rune(prefix)[len([]rune(prefix))-1]
+	if !unicode.IsLetter(last) && !unicode.IsDigit(last) && !unicode.Is(unicode.Mn, last) {
+		folded += " "
+	}
+	return folded
+}
+
+// tagSuggestHandler returns the tags matching the prefix parameter as JSON, the most used first.
+// The optional limit parameter caps the number of suggestions, which defaults to 10.
+func tagSuggestHandler(db *bolt.DB) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		suggestions, err := suggestTags(db, r.URL.Query().Get("prefix"), suggestLimit(r))
+		res.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		if err != nil {
+			res.WriteHeader(http.StatusInternalServerError)
+			res.Write([]byte(`{"error":"Could not suggest tags."}`))
+			return
+		}
+		res.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(res).Encode(suggestions); err != nil {
+			panic(err)
+		}
+	}
+	return fn
+}
+
+// apiTagSuggestHandler returns the tags matching the prefix parameter, the most used first.
+func apiTagSuggestHandler(store Store) http.HandlerFunc {
+	db := boltDB(store)
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		suggestions, err := suggestTags(db, r.URL.Query().Get("prefix"), suggestLimit(r))
+		if err != nil {
+			writeAPIStoreError(res, err)
+			return
+		}
+		writeAPIList(res, suggestions, nil)
+	}
+	return fn
+}
+
+// suggestLimit reads the limit parameter of a suggestion request.
+func suggestLimit(r *http.Request) int {
+	limit := defaultSuggestLimit
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	if limit > maxSuggestLimit {
+		limit = maxSuggestLimit
+	}
+	return limit
+}
+
+// DATA STORE FUNCTIONS
+
+// suggestTags returns up to limit tags with a label or alias starting with prefix, the most used first.
+// A tag matched by both its label and an alias is suggested once, by its label. A blank prefix suggests nothing.
+// Only the first maxSuggestScan names starting with the prefix are ranked, so a short prefix of a large
+// library stays cheap; typing more of the name narrows it down.
+func suggestTags(db *bolt.DB, prefix string, limit int) ([]TagSuggestion, error) {
+	results := []TagSuggestion{}
+	folded := foldPrefix(prefix)
+	if folded == "" {
+		return results, nil
+	}
+	err := db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(topLevelBucket))
+		usage := root.Bucket([]byte(tagUsageBucket))
+		found := map[string]*rankedSuggestion{}
+		best := &suggestionHeap{}
+		scanned := 0
+		c := root.Bucket([]byte(tagNamesBucket)).Cursor()
+		for k, v := c.Seek([]byte(folded)); k != nil && strings.HasPrefix(string(k), folded) && scanned < maxSuggestScan; k, v = c.Next() {
+			scanned++
+			parts := strings.SplitN(string(k), "\x00", 3)
+			slug, alias := parts[1], parts[2] == "alias"
+			if s, ok := found[slug]; ok {
+				if alias || s.Alias == "" {
+					continue
+				}
+				// Matched by its label after an alias, which ranks it higher.
+				s.Alias = ""
+				if s.index >= 0 {
+					heap.Fix(best, s.index)
+				} else {
+					heap.Push(best, s)
+				}
+			} else {
+				s := &rankedSuggestion{TagSuggestion: TagSuggestion{Slug: slug, Count: int(decodeUvarint(usage.Get([]byte(slug))))}}
+				if alias {
+					s.Alias = string(v)
+				}
+				found[slug] = s
+				heap.Push(best, s)
+			}
+			if best.Len() > limit {
+				heap.Pop(best)
+			}
+		}
+		results = make([]TagSuggestion, best.Len())
+		for i := len(results) - 1; i >= 0; i-- {
+			results[i] = heap.Pop(best).(*rankedSuggestion).TagSuggestion
+		}
+		for i := range results {
+			tag, err := lookupTag(tx, results[i].Slug)
+			if err != nil {
+				return err
+			}
+			if tag != nil {
+				results[i].Label, results[i].Namespace = tag.Label, tag.Namespace
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// suggestionBefore reports whether a ranks ahead of b: the most used first, then tags matched by their label
+// ahead of those matched by an alias, then by slug.
+func suggestionBefore(a TagSuggestion, b TagSuggestion) bool {
+	if a.Count != b.Count {
+		return a.Count > b.Count
+	}
+	if (a.Alias == "") != (b.Alias == "") {
+		return a.Alias == ""
+	}
+	return a.Slug < b.Slug
+}
+
+// rankedSuggestion is a suggestion with its place in a suggestionHeap.
+type rankedSuggestion struct {
+	TagSuggestion
+	index int // -1 once it has been popped.
+}
+
+// suggestionHeap holds the best suggestions found so far with the worst on top, so it can be kept to the limit
+// by popping.
+type suggestionHeap []*rankedSuggestion
+
+func (h suggestionHeap) Len() int { return len(h) }
+
+func (h suggestionHeap) Less(i, j int) bool {
+	return suggestionBefore(h[j].TagSuggestion, h[i].TagSuggestion)
+}
+
+func (h suggestionHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *suggestionHeap) Push(x interface{}) {
+	s := x.(*rankedSuggestion)
+	s.index = len(*h)
+	*h = append(*h, s)
+}
+
+func (h *suggestionHeap) Pop() interface{} {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	s.index = -1
+	return s
+}
+
+// tagSuggestNames are the names a tag is suggested for besides its aliases: its label, and namespace:label
+// when it is in a namespace.
+func tagSuggestNames(tag Tag) []string {
+	if tag.Namespace == "" {
+		return []string{tag.Label}
+	}
+	return []string{tag.Label, tagName(tag)}
+}
+
+// tagNameKey is the TAG_NAMES key of the label or an alias of the tag with the slug.
+func tagNameKey(name string, slug string, alias bool) []byte {
+	kind := "label"
+	if alias {
+		kind = "alias"
+	}
+	return []byte(foldName(name) + "\x00" + slug + "\x00" + kind)
+}
+
+// indexTagName adds a label or an alias of a tag to the suggestions inside an existing transaction.
+func indexTagName(tx *bolt.Tx, slug string, name string, alias bool) error {
+	b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagNamesBucket))
+	if b == nil || foldName(name) == "" {
+		return nil
+	}
+	if err := b.Put(tagNameKey(name, slug, alias), []byte(name)); err != nil {
+		return fmt.Errorf("could not index tag name: %v", err)
+	}
+	return nil
+}
+
+// unindexTagName removes a label or an alias of a tag from the suggestions inside an existing transaction.
+func unindexTagName(tx *bolt.Tx, slug string, name string, alias bool) error {
+	b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagNamesBucket))
+	if b == nil || foldName(name) == "" {
+		return nil
+	}
+	if err := b.Delete(tagNameKey(name, slug, alias)); err != nil {
+		return fmt.Errorf("could not unindex tag name: %v", err)
+	}
+	return nil
+}
+
+// countTagUsage adds delta to the number of content items a tag is applied to inside an existing transaction.
+func countTagUsage(tx *bolt.Tx, slug string, delta int) error {
+	b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagUsageBucket))
+	if b == nil {
+		return nil
+	}
+	count := int(decodeUvarint(b.Get([]byte(slug)))) + delta
+	if count <= 0 {
+		return b.Delete([]byte(slug))
+	}
+	return b.Put([]byte(slug), encodeUvarint(uint64(count)))
+}
+
+// setupTagSuggestions creates the suggestion buckets, filling them from the stored tags, aliases and edges
+// when they are new.
+func setupTagSuggestions(tx *bolt.Tx) error {
+	root := tx.Bucket([]byte(topLevelBucket))
+	if root.Bucket([]byte(tagNamesBucket)) != nil && root.Bucket([]byte(tagUsageBucket)) != nil {
+		return nil
+	}
+	for _, name := range []string{tagNamesBucket, tagUsageBucket} {
+		if root.Bucket([]byte(name)) != nil {
+			if err := root.DeleteBucket([]byte(name)); err != nil {
+				return fmt.Errorf("could not reset %s bucket: %v", strings.ToLower(name), err)
+			}
+		}
+		if _, err := root.CreateBucket([]byte(name)); err != nil {
+			return fmt.Errorf("could not create %s bucket: %v", strings.ToLower(name), err)
+		}
+	}
+	err := root.Bucket([]byte(tagBucket)).ForEach(func(k, v []byte) error {
+		tag := Tag{}
+		if err := json.Unmarshal(v, &tag); err != nil {
+			return err
+		}
+		for _, name := range tagSuggestNames(tag) {
+			if err := indexTagName(tx, string(k), name, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not index tag names: %v", err)
+	}
+	aliases := root.Bucket([]byte(tagAliasBucket))
+	err = aliases.ForEach(func(k, v []byte) error {
+		alias := Alias{}
+		if err := json.Unmarshal(v, &alias); err != nil {
+			return err
+		}
+		return indexTagName(tx, alias.Tag, alias.Alias, true)
+	})
+	if err != nil {
+		return fmt.Errorf("could not index tag aliases: %v", err)
+	}
+	byTag := root.Bucket([]byte(edgeByTagBucket))
+	err = byTag.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return nil
+		}
+		return countTagUsage(tx, string(k), len(edgeKeys(tx, edgeByTagBucket, string(k))))
+	})
+	if err != nil {
+		return fmt.Errorf("could not count tag usage: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// putSuggestTags stores n tags labelled by label(i) with usage(i) content each, indexed for suggestions,
+// in one transaction.
+func putSuggestTags(tb testing.TB, db *bolt.DB, n int, label func(i int) string, usage func(i int) int) {
+	tb.Helper()
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(tagBucket))
+		for i := 0; i < n; i++ {
+			tag := Tag{Slug: fmt.Sprintf("tag-%06d", i), Label: label(i)}
+			buf, err := json.Marshal(tag)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(tag.Slug), buf); err != nil {
+				return err
+			}
+			if err := indexTagName(tx, tag.Slug, tag.Label, false); err != nil {
+				return err
+			}
+			if err := countTagUsage(tx, tag.Slug, usage(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestSuggestTags(t *testing.T) {
+	db := newTestDB(t)
+	store := &boltStore{db: db}
+	for _, tag := range []Tag{{Slug: "new-york", Label: "New York"}, {Slug: "newark", Label: "Newark"}, {Slug: "news", Label: "News"}, {Slug: "nyc", Label: "Big Apple"}} {
+		if err := store.PutTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, alias := range [][2]string{{"nyc", "New York City"}, {"new-york", "Newyorkers"}} {
+		if _, err := createAlias(db, alias[0], alias[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, hash := range []string{"a", "b", "c"} {
+		if err := store.PutContent(Content{Hash: hash}); err != nil {
+			t.Fatal(err)
+		}
+		for _, slug := range []string{"news", "newark", "nyc"}[:i+1] {
+			if _, err := store.ApplyTag(hash, slug); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	tests := []struct {
+		prefix string
+		limit  int
+		want   string
+	}{
+		// news is on 3 items, newark on 2, nyc on 1 by its alias, and new-york on none, once by its label.
+		{"new", 10, "[news newark nyc(new-york-city) new-york]"},
+		{"New", 2, "[news newark]"},
+		{"new ", 10, "[nyc(new-york-city) new-york]"},
+		{"newyork", 10, "[new-york(newyorkers)]"},
+		{"big", 10, "[nyc]"},
+		{"-", 10, "[]"},
+		{"zzz", 10, "[]"},
+	}
+	for _, tt := range tests {
+		suggestions, err := suggestTags(db, tt.prefix, tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, s := range suggestions {
+			if s.Alias != "" {
+				got = append(got, s.Slug+"("+s.Alias+")")
+				continue
+			}
+			got = append(got, s.Slug)
+		}
+		if fmt.Sprint(got) != tt.want {
+			t.Errorf("suggestTags(%q, %d) = %v, want %s", tt.prefix, tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestSuggestTagsRanksLikeASort(t *testing.T) {
+	db := newTestDB(t)
+	rnd := rand.New(rand.NewSource(1))
+	counts := make([]int, 500)
+	for i := range counts {
+		counts[i] = rnd.Intn(20)
+	}
+	putSuggestTags(t, db, len(counts), func(i int) string { return fmt.Sprintf("Tag %d", i) }, func(i int) int { return counts[i] })
+	all, err := suggestTags(db, "tag", len(counts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(counts) {
+		t.Fatalf("%d suggestions, want all %d tags", len(all), len(counts))
+	}
+	sorted := sort.SliceIsSorted(all, func(i, j int) bool { return suggestionBefore(all[i], all[j]) })
+	if !sorted {
+		t.Error("the suggestions are not ranked")
+	}
+	top, err := suggestTags(db, "tag", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(top) != fmt.Sprint(all[:7]) {
+		t.Errorf("top 7 %v, want the first of the full ranking %v", top, all[:7])
+	}
+}
+
+func BenchmarkSuggestTags(b *testing.B) {
+	db := newTestDB(b)
+	putSuggestTags(b, db, 100000, func(i int) string { return fmt.Sprintf("Tag %d", i) }, func(i int) int { return i % 97 })
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := suggestTags(db, "t", defaultSuggestLimit); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
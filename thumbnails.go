@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // Register the decoders image.Decode uses.
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/gorilla/mux"
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Thumbnails are small JPEG copies of image content for the content list and detail pages. They are made
+// the first time one is asked for, from the first path of the content that decodes, and kept in the
+// thumbnails directory as <hash>-<size>.jpg inside a directory named after the first two characters of
+// the hash. Content is keyed by the MD5 of its bytes, so a thumbnail never goes stale and browsers can keep
+// it for good; it also outlives the file it was made from going missing.
+
+// thumbnailSizes are the sizes thumbnails are made in, by name, as the length of their longest side in pixels.
+var thumbnailSizes = map[string]int{"small": 160, "medium": 320, "large": 640}
+
+const defaultThumbnailSize = "medium"
+
+// maxThumbnailPixels is the largest image thumbnails are made of. Decoding holds the whole image in memory,
+// so bigger ones are refused rather than risk running out.
+const maxThumbnailPixels = 100 * 1000 * 1000
+
+// thumbnailExtensions are the extensions of the files thumbnails can be made of.
+var thumbnailExtensions = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".bmp": true}
+
+var errNoThumbnail = errors.New("no thumbnail")
+var errBadThumbnailSize = errors.New("bad thumbnail size")
+
+// Thumbnails makes thumbnails and caches them in dir. busy limits how many are made at the same time,
+// since each one decodes a whole image.
+type Thumbnails struct {
+	dir  string
+	busy chan struct{}
+}
+
+// newThumbnails returns Thumbnails cached in dir, which is created when the first thumbnail is made.
+func newThumbnails(dir string) *Thumbnails {
+	return &Thumbnails{dir: dir, busy: make(chan struct{}, runtime.NumCPU())}
+}
+
+// HasImage reports whether the content has a file thumbnails can be made of.
+func (c Content) HasImage() bool {
+	if c.Missing {
+		return false
+	}
+	for _, path := range c.Paths {
+		if thumbnailExtensions[strings.ToLower(filepath.Ext(path))] {
+			return true
+		}
+	}
+	return false
+}
+
+// THUMBNAIL HANDLERS
+
+// thumbnailHandler serves a thumbnail of the image content in the URL. The size query parameter is small,
+// medium or large, medium when it is left out.
+func thumbnailHandler(store Store, thumbnails *Thumbnails) http.HandlerFunc {
+	fn := func(res http.ResponseWriter, r *http.Request) {
+		hash := mux.Vars(r)["hash"]
+		size := r.URL.Query().Get("size")
+		if size == "" {
+			size = defaultThumbnailSize
+		}
+		content, err := store.GetContent(hash)
+		if err != nil {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusNotFound)
+			res.Write([]byte("404 Page Not Found"))
+			return
+		}
+		path, err := thumbnails.get(*content, size)
+		if err != nil {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			switch {
+			case errors.Is(err, errBadThumbnailSize):
+				res.WriteHeader(http.StatusBadRequest)
+				res.Write([]byte(err.Error()))
+			case errors.Is(err, errNoThumbnail):
+				res.WriteHeader(http.StatusNotFound)
+				res.Write([]byte(err.Error()))
+			default:
+				log.Println(err)
+				res.WriteHeader(http.StatusInternalServerError)
+				res.Write([]byte("Could not make the thumbnail."))
+			}
+			return
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusInternalServerError)
+			res.Write([]byte("Could not read the thumbnail."))
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			res.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+			res.WriteHeader(http.StatusInternalServerError)
+			res.Write([]byte("Could not read the thumbnail."))
+			return
+		}
+		// The thumbnail of a hash never changes. It is private because reading content may need a login.
+		res.Header().Set("Content-Type", "image/jpeg")
+		res.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+		res.Header().Set("ETag", fmt.Sprintf("%q", hash+"-"+size))
+		http.ServeContent(res, r, "", info.ModTime(), f)
+	}
+	return fn
+}
+
+// THUMBNAIL FUNCTIONS
+
+// get returns the path of the cached thumbnail of content in size, making the thumbnails of every size
+// first if it is not cached yet.
+func (t *Thumbnails) get(content Content, size string) (string, error) {
+	if _, ok := thumbnailSizes[size]; !ok {
+		return "", fmt.Errorf("%w: %q, it must be small, medium or large", errBadThumbnailSize, size)
+	}
+	if content.Hash == "" || filepath.Base(content.Hash) != content.Hash {
+		return "", fmt.Errorf("%w: %s can not be stored", errNoThumbnail, content.Hash)
+	}
+	path := t.path(content.Hash, size)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	if !content.HasImage() {
+		return "", fmt.Errorf("%w: %s has no image file", errNoThumbnail, content.Hash)
+	}
+	t.busy <- struct{}{}
+	defer func() { <-t.busy }()
+	// Another request may have made it while this one waited.
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	img, err := decodeContentImage(content)
+	if err != nil {
+		return "", err
+	}
+	for name, px := range thumbnailSizes {
+		if err := writeThumbnail(t.path(content.Hash, name), scaleImage(img, px)); err != nil {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// path is where the thumbnail of a hash in size is cached.
+func (t *Thumbnails) path(hash string, size string) string {
+	prefix := hash
+	if len(prefix) > 2 {
+		prefix = prefix[:2]
+	}
+	return filepath.Join(t.dir, prefix, hash+"-"+size+".jpg")
+}
+
+// decodeContentImage decodes the first image file of content that can be decoded.
+func decodeContentImage(content Content) (image.Image, error) {
+	problems := []string{}
+	for _, path := range content.Paths {
+		if !thumbnailExtensions[strings.ToLower(filepath.Ext(path))] {
+			continue
+		}
+		img, err := decodeImageFile(path)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		return img, nil
+	}
+	return nil, fmt.Errorf("%w: %s", errNoThumbnail, strings.Join(problems, "; "))
+}
+
+// decodeImageFile decodes a JPEG, PNG, GIF, WebP or BMP file, after checking from its header that it is
+// not too big to decode.
+func decodeImageFile(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode %s: %v", path, err)
+	}
+	if config.Width*config.Height > maxThumbnailPixels {
+		return nil, fmt.Errorf("%s is %dx%d, too big to make a thumbnail of", path, config.Width, config.Height)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode %s: %v", path, err)
+	}
+	return img, nil
+}
+
+// scaleImage scales img down so its longest side is px, keeping its aspect ratio. Images that are smaller
+// already keep their size. Transparent parts are made white, since JPEG has no transparency.
+func scaleImage(img image.Image, px int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > px || h > px {
+		if w >= h {
+			w, h = px, h*px/w
+		} else {
+			w, h = w*px/h, px
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.BiLinear.Scale(dst, dst.Bounds(), img, b, draw.Over, nil)
+	return dst
+}
+
+// writeThumbnail encodes img as a JPEG at path. It is written to a temporary file first, so a thumbnail
+// that is being made is never served half written.
+func writeThumbnail(path string, img image.Image) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("could not create the thumbnail directory: %v", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".thumb-*")
+	if err != nil {
+		return fmt.Errorf("could not write the thumbnail: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if err := jpeg.Encode(f, img, &jpeg.Options{Quality: 85}); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write the thumbnail: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not write the thumbnail: %v", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("could not write the thumbnail: %v", err)
+	}
+	return nil
+}
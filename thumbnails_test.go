@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// writePNG writes a w by h PNG filled with c under dir and returns its path.
+func writePNG(t *testing.T, dir string, name string, w int, h int, c color.Color) string {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return writeFile(t, dir, name, buf.String())
+}
+
+// thumbnailRouter serves the thumbnails of the content in store, cached in dir.
+func thumbnailRouter(store Store, dir string) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/content/{hash}/thumb", thumbnailHandler(store, newThumbnails(dir))).Methods("GET")
+	return r
+}
+
+func TestThumbnailHandler(t *testing.T) {
+	store := &boltStore{db: newTestDB(t)}
+	photos := t.TempDir()
+	wide := writePNG(t, photos, "wide.png", 800, 400, color.RGBA{255, 0, 0, 255})
+	if err := store.PutContent(Content{Hash: "abcdef", Paths: []string{wide}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutContent(Content{Hash: "notes", Paths: []string{writeFile(t, photos, "notes.txt", "notes")}}); err != nil {
+		t.Fatal(err)
+	}
+	cache := t.TempDir()
+	r := thumbnailRouter(store, cache)
+
+	tests := []struct {
+		query string
+		w, h  int
+	}{
+		{"", 320, 160},
+		{"?size=small", 160, 80},
+		{"?size=large", 640, 320},
+	}
+	for _, tt := range tests {
+		res := request(r, "GET", "/content/abcdef/thumb"+tt.query, "", "")
+		if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "image/jpeg" {
+			t.Fatalf("thumb%s: status %d %s, want a JPEG", tt.query, res.Code, res.Header().Get("Content-Type"))
+		}
+		img, err := jpeg.Decode(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("thumb%s is %dx%d, want %dx%d", tt.query, b.Dx(), b.Dy(), tt.w, tt.h)
+		}
+	}
+	// The first request made every size.
+	for size := range thumbnailSizes {
+		if _, err := os.Stat(filepath.Join(cache, "ab", "abcdef-"+size+".jpg")); err != nil {
+			t.Errorf("the %s thumbnail is not cached: %v", size, err)
+		}
+	}
+
+	for _, target := range []string{"/content/notes/thumb", "/content/missing/thumb"} {
+		if res := request(r, "GET", target, "", ""); res.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 404", target, res.Code)
+		}
+	}
+	if res := request(r, "GET", "/content/abcdef/thumb?size=huge", "", ""); res.Code != http.StatusBadRequest {
+		t.Errorf("a huge thumbnail: status %d, want 400", res.Code)
+	}
+}
+
+func TestThumbnailCache(t *testing.T) {
+	store := &boltStore{db: newTestDB(t)}
+	photos := t.TempDir()
+	photo := writePNG(t, photos, "photo.png", 100, 100, color.RGBA{255, 0, 0, 255})
+	if err := store.PutContent(Content{Hash: "red", Paths: []string{photo}}); err != nil {
+		t.Fatal(err)
+	}
+	r := thumbnailRouter(store, t.TempDir())
+	first := request(r, "GET", "/content/red/thumb", "", "")
+	if first.Code != http.StatusOK {
+		t.Fatalf("status %d %s, want 200", first.Code, first.Body)
+	}
+	etag := first.Header().Get("ETag")
+	if etag == "" || first.Header().Get("Cache-Control") != "private, max-age=31536000, immutable" {
+		t.Errorf("ETag %q and Cache-Control %q, want the thumbnail kept for good", etag, first.Header().Get("Cache-Control"))
+	}
+
+	// A browser that has the thumbnail is told it has not changed.
+	req := httptest.NewRequest("GET", "/content/red/thumb", nil)
+	req.Header.Set("If-None-Match", etag)
+	res := httptest.NewRecorder()
+	r.ServeHTTP(res, req)
+	if res.Code != http.StatusNotModified {
+		t.Errorf("revalidating: status %d, want 304", res.Code)
+	}
+	if other := request(r, "GET", "/content/red/thumb?size=small", "", "").Header().Get("ETag"); other == etag {
+		t.Errorf("the small and medium thumbnails share the ETag %s", etag)
+	}
+
+	// The file changing is new content under a new hash, so it gets a thumbnail of its own, while the
+	// cached one outlives the file it was made from.
+	writePNG(t, photos, "photo.png", 100, 100, color.RGBA{0, 0, 255, 255})
+	if err := store.PutContent(Content{Hash: "blue", Paths: []string{photo}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutContent(Content{Hash: "red", Paths: []string{photo}, Missing: true}); err != nil {
+		t.Fatal(err)
+	}
+	for hash, want := range map[string]color.RGBA{"red": {255, 0, 0, 255}, "blue": {0, 0, 255, 255}} {
+		res := request(r, "GET", "/content/"+hash+"/thumb", "", "")
+		if res.Code != http.StatusOK {
+			t.Fatalf("the %s thumbnail: status %d %s, want 200", hash, res.Code, res.Body)
+		}
+		img, err := jpeg.Decode(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		red, _, blue, _ := img.At(50, 50).RGBA()
+		if red > blue != (want.R > want.B) {
+			t.Errorf("the %s thumbnail is colored %v, want %v", hash, img.At(50, 50), want)
+		}
+	}
+}
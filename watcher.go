@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchSettle is how long a path must be quiet before its changes are written.
+// Editors and copies produce bursts of events, and a move shows up as a remove followed by a create,
+// so changes are collected and applied together once things settle.
+const watchSettle = 500 * time.Millisecond
+
+// Watcher keeps Content.Paths in step with the filesystem under a set of root directories.
+type Watcher struct {
+	db      *bolt.DB
+	roots   []string
+	fs      *fsnotify.Watcher
+	mu      sync.Mutex
+	pending map[string]bool
+	timer   *time.Timer
+	closed  bool
+	done    chan struct{}
+}
+
+// startWatcher begins watching every directory under roots. Directories created later are watched as they appear.
+func startWatcher(db *bolt.DB, roots []string) (*Watcher, error) {
+	fs, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("could not start watcher: %v", err)
+	}
+	w := &Watcher{db: db, fs: fs, pending: map[string]bool{}, done: make(chan struct{})}
+	for _, root := range roots {
+		abs, err := filepath.Abs(root)
+		if err != nil {
+			fs.Close()
+			return nil, fmt.Errorf("could not resolve %s: %v", root, err)
+		}
+		if err := w.addTree(abs, false); err != nil {
+			fs.Close()
+			return nil, err
+		}
+		w.roots = append(w.roots, abs)
+	}
+	go w.run()
+	log.Printf("Watching %s \n", strings.Join(w.roots, ", "))
+	return w, nil
+}
+
+// Close stops the watcher. Changes that have not settled yet are written before it returns.
+func (w *Watcher) Close() error {
+	err := w.fs.Close()
+	<-w.done
+	w.mu.Lock()
+	w.closed = true
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.mu.Unlock()
+	w.flush()
+	return err
+}
+
+// addTree watches dir and every directory below it. When queue is true the files found are queued
+// as changes, which is how files moved into a watched tree are picked up.
+func (w *Watcher) addTree(dir string, queue bool) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			log.Printf("Watcher could not read %s: %v \n", path, err)
+			return nil
+		}
+		if info.IsDir() {
+			if err := w.fs.Add(path); err != nil {
+				return fmt.Errorf("could not watch %s: %v", path, err)
+			}
+			return nil
+		}
+		if queue && info.Mode().IsRegular() {
+			w.queue(path)
+		}
+		return nil
+	})
+}
+
+func (w *Watcher) run() {
+	defer close(w.done)
+	for {
+		select {
+		case event, ok := <-w.fs.Events:
+			if !ok {
+				return
+			}
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := w.addTree(event.Name, true); err != nil {
+						log.Println(err)
+					}
+					continue
+				}
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Remove|fsnotify.Rename) != 0 {
+				w.queue(event.Name)
+			}
+		case err, ok := <-w.fs.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Watcher error: %v \n", err)
+		}
+	}
+}
+
+// queue records that path changed and restarts the settle timer. Once the watcher is closed it does nothing.
+func (w *Watcher) queue(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	w.pending[path] = true
+	if w.timer == nil {
+		w.timer = time.AfterFunc(watchSettle, w.flush)
+		return
+	}
+	w.timer.Reset(watchSettle)
+}
+
+// flush writes every pending change.
+func (w *Watcher) flush() {
+	w.mu.Lock()
+	paths := make([]string, 0, len(w.pending))
+	for path := range w.pending {
+		paths = append(paths, path)
+	}
+	w.pending = map[string]bool{}
+	w.mu.Unlock()
+	if len(paths) == 0 {
+		return
+	}
+	sort.Strings(paths)
+	if err := applyPathChanges(w.db, paths); err != nil {
+		log.Printf("Watcher could not record changes: %v \n", err)
+	}
+}
+
+// applyPathChanges looks at each path as it is now and updates the content that refers to it,
+// all in a single transaction. A path that holds a regular file is re-hashed and moved to the content
+// with that hash, creating it if needed. A path that is gone, along with every known path below it
+// when it was a directory, is removed from its content, which is marked missing if it has no paths left.
+// When a file is edited in place, so its content's only path now holds different bytes, the content is
+// carried over to the new hash with carryContent rather than left behind as missing.
+func applyPathChanges(db *bolt.DB, paths []string) error {
+	current := map[string]string{}
+	gone := []string{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			gone = append(gone, path)
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		hash, err := hashFile(path)
+		if err != nil {
+			log.Printf("Watcher could not hash %s: %v \n", path, err)
+			continue
+		}
+		current[path] = hash
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		index := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(pathBucket))
+		changed := map[string]*Content{}
+		load := func(hash string) (*Content, error) {
+			if content, ok := changed[hash]; ok {
+				return content, nil
+			}
+			content, err := lookupContent(tx, hash)
+			if err != nil || content == nil {
+				return content, err
+			}
+			changed[hash] = content
+			return content, nil
+		}
+		detach := func(path string) error {
+			hash := string(index.Get([]byte(path)))
+			if hash == "" {
+				return nil
+			}
+			content, err := load(hash)
+			if err != nil || content == nil {
+				return err
+			}
+			content.Paths = removeString(content.Paths, path)
+			return nil
+		}
+
+		for _, path := range gone {
+			// Directories are not in the index themselves, so collect every indexed path below them too.
+			affected := []string{path}
+			prefix := []byte(strings.TrimSuffix(path, string(filepath.Separator)) + string(filepath.Separator))
+			c := index.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, _ = c.Next() {
+				affected = append(affected, string(k))
+			}
+			for _, p := range affected {
+				if _, ok := current[p]; ok {
+					continue
+				}
+				if err := detach(p); err != nil {
+					return err
+				}
+			}
+		}
+		created := map[string]bool{}
+		moved := map[string][]string{} // New hashes of the paths of each old hash.
+		for path, hash := range current {
+			old := string(index.Get([]byte(path)))
+			if old == hash {
+				continue
+			}
+			if err := detach(path); err != nil {
+				return err
+			}
+			if old != "" {
+				moved[old] = append(moved[old], hash)
+			}
+			content, err := load(hash)
+			if err != nil {
+				return err
+			}
+			if content == nil {
+				content = &Content{Label: filepath.Base(path), CreatedAt: time.Now(), Hash: hash}
+				changed[hash] = content
+				created[hash] = true
+			}
+			if !containsString(content.Paths, path) {
+				content.Paths = append(content.Paths, path)
+				sort.Strings(content.Paths)
+			}
+		}
+
+		// Content whose every path was edited into the same new bytes moves to the new hash.
+		dropped := []string{}
+		for old, hashes := range moved {
+			from := changed[old]
+			if from == nil || len(from.Paths) > 0 || len(uniqueStrings(hashes)) != 1 {
+				continue
+			}
+			to := changed[hashes[0]]
+			if err := carryContent(tx, from, to, created[to.Hash]); err != nil {
+				return err
+			}
+			delete(changed, old)
+			dropped = append(dropped, old)
+		}
+
+		for hash, content := range changed {
+			content.Missing = len(content.Paths) == 0
+			if err := putContent(tx, *content, hash); err != nil {
+				return err
+			}
+		}
+		for _, hash := range dropped {
+			if err := removeContent(tx, hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// carryContent moves what was recorded about from, content whose file was edited, to to, the content with
+// the file's new hash, inside an existing transaction: its tags, its place in collections and, unless to
+// already had them, its type and fields. fresh says to was only just made for the new hash, in which case
+// it also takes the label, body, author and creation time of from. Tags that an exclusive namespace does
+// not let to have alongside its own, and fields its type no longer allows, are left behind. The caller
+// writes to and removes from.
+func carryContent(tx *bolt.Tx, from *Content, to *Content, fresh bool) error {
+	if fresh {
+		to.Label, to.Definition, to.Author, to.CreatedAt = from.Label, from.Definition, from.Author, from.CreatedAt
+	}
+	if to.Type == "" && from.Type != "" {
+		carried := *to
+		carried.Type, carried.Fields = from.Type, map[string]interface{}{}
+		for name, v := range from.Fields {
+			carried.Fields[name] = v
+		}
+		if err := settleContentFields(tx, &carried); err == nil {
+			to.Type, to.Fields = carried.Type, carried.Fields
+		} else if !errors.Is(err, errBadFields) {
+			return err
+		}
+	}
+
+	byContent := tx.Bucket([]byte(topLevelBucket)).Bucket([]byte(edgeByContentBucket))
+	for _, slug := range edgeKeys(tx, edgeByContentBucket, from.Hash) {
+		edge := Edge{}
+		if err := json.Unmarshal(byContent.Bucket([]byte(from.Hash)).Get([]byte(slug)), &edge); err != nil {
+			return err
+		}
+		edge.Content = to.Hash
+		applied := edgeKeys(tx, edgeByContentBucket, to.Hash)
+		if containsString(applied, slug) {
+			continue
+		}
+		conflict, err := exclusiveConflict(tx, slug, applied)
+		if err != nil {
+			return err
+		}
+		if conflict != "" {
+			log.Printf("Watcher left %s behind on %s: %s already has %s \n", slug, from.Hash, to.Hash, conflict)
+			continue
+		}
+		if err := putEdge(tx, edge); err != nil {
+			return err
+		}
+	}
+
+	for _, slug := range contentCollectionSlugs(tx, from.Hash) {
+		collection, err := lookupCollection(tx, slug)
+		if err != nil {
+			return err
+		}
+		if collection == nil {
+			continue
+		}
+		items := []string{}
+		for _, item := range collection.Items {
+			switch {
+			case item == from.Hash && !containsString(collection.Items, to.Hash):
+				items = append(items, to.Hash)
+			case item != from.Hash:
+				items = append(items, item)
+			}
+		}
+		collection.Items = items
+		if err := putCollection(tx, *collection); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeString returns list without any occurrence of s.
+func removeString(list []string, s string) []string {
+	result := []string{}
+	for _, item := range list {
+		if item != s {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// runWatchCommand implements `anansi watch <dir>...`, watching directories until interrupted.
+func runWatchCommand(db *bolt.DB, roots []string) error {
+	if len(roots) == 0 {
+		return fmt.Errorf("usage: anansi watch <dir>...")
+	}
+	w, err := startWatcher(db, roots)
+	if err != nil {
+		return err
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	<-c
+	return w.Close()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// writeFile writes data to a file under dir and returns its path.
+func writeFile(t *testing.T, dir string, name string, data string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// applyChanges runs applyPathChanges over paths and fails the test if it does.
+func applyChanges(t *testing.T, db *bolt.DB, paths ...string) {
+	t.Helper()
+	if err := applyPathChanges(db, paths); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fileContent returns the content stored for the bytes of data.
+func fileContent(t *testing.T, store Store, data string) *Content {
+	t.Helper()
+	hash, err := hashFile(writeFile(t, t.TempDir(), "probe", data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := store.GetContent(hash)
+	if err != nil {
+		t.Fatalf("content of %q: %v", data, err)
+	}
+	return content
+}
+
+func TestApplyPathChangesMovesAndRemoves(t *testing.T) {
+	db := newTestDB(t)
+	store := &boltStore{db: db}
+	dir := t.TempDir()
+	photo := writeFile(t, dir, "photo.jpg", "photo bytes")
+	applyChanges(t, db, photo)
+	content := fileContent(t, store, "photo bytes")
+	if content.Label != "photo.jpg" || strings.Join(content.Paths, " ") != photo || content.Missing {
+		t.Fatalf("new file: content %q at %v missing %v, want photo.jpg at %s", content.Label, content.Paths, content.Missing, photo)
+	}
+
+	// A move shows up as the old path gone and the new one created.
+	moved := filepath.Join(dir, "album", "photo.jpg")
+	if err := os.MkdirAll(filepath.Dir(moved), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(photo, moved); err != nil {
+		t.Fatal(err)
+	}
+	applyChanges(t, db, photo, moved)
+	content = fileContent(t, store, "photo bytes")
+	if strings.Join(content.Paths, " ") != moved || content.Missing {
+		t.Errorf("moved file: paths %v missing %v, want %s", content.Paths, content.Missing, moved)
+	}
+
+	// A copy adds a path, and removing the directory takes every path below it.
+	copied := writeFile(t, dir, "album/copy.jpg", "photo bytes")
+	applyChanges(t, db, copied)
+	content = fileContent(t, store, "photo bytes")
+	if len(content.Paths) != 2 {
+		t.Errorf("copied file: paths %v, want both", content.Paths)
+	}
+	if err := os.RemoveAll(filepath.Dir(moved)); err != nil {
+		t.Fatal(err)
+	}
+	applyChanges(t, db, filepath.Dir(moved))
+	content = fileContent(t, store, "photo bytes")
+	if len(content.Paths) != 0 || !content.Missing {
+		t.Errorf("removed directory: paths %v missing %v, want none and missing", content.Paths, content.Missing)
+	}
+}
+
+func TestApplyPathChangesCarriesEditedContent(t *testing.T) {
+	db := newTestDB(t)
+	store := &boltStore{db: db}
+	dir := t.TempDir()
+	notes := writeFile(t, dir, "notes.txt", "first draft")
+	applyChanges(t, db, notes)
+	before := fileContent(t, store, "first draft")
+	before.Label, before.Definition, before.Author = "Notes", "What I wrote down.", "steve"
+	if err := store.PutContent(*before); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutTag(Tag{Slug: "todo", Label: "To do"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ApplyTag(before.Hash, "todo"); err != nil {
+		t.Fatal(err)
+	}
+	collection, err := createCollection(db, Collection{Name: "Reading", Items: []string{before.Hash}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, dir, "notes.txt", "second draft")
+	applyChanges(t, db, notes)
+	if _, err := store.GetContent(before.Hash); !errors.Is(err, errContentNotFound) {
+		t.Errorf("the content of the first draft is still stored: %v", err)
+	}
+	after := fileContent(t, store, "second draft")
+	if after.Label != "Notes" || after.Definition != before.Definition || after.Author != "steve" || !after.CreatedAt.Equal(before.CreatedAt) {
+		t.Errorf("edited file: content %+v, want what was recorded about the first draft", after)
+	}
+	if strings.Join(after.Paths, " ") != notes || after.Missing {
+		t.Errorf("edited file: paths %v missing %v, want %s", after.Paths, after.Missing, notes)
+	}
+	if _, err := store.GetEdge("todo", after.Hash); err != nil {
+		t.Errorf("edited file: the todo tag was not carried over: %v", err)
+	}
+	view, err := openCollection(db, collection.Slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(view.Items, " ") != after.Hash {
+		t.Errorf("edited file: collection items %v, want the new hash %s", view.Items, after.Hash)
+	}
+}
+
+func TestApplyPathChangesEditIntoExistingContent(t *testing.T) {
+	db := newTestDB(t)
+	store := &boltStore{db: db}
+	dir := t.TempDir()
+	draft := writeFile(t, dir, "draft.txt", "draft")
+	final := writeFile(t, dir, "final.txt", "final")
+	applyChanges(t, db, draft, final)
+	if err := store.PutTag(Tag{Slug: "todo", Label: "To do"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ApplyTag(fileContent(t, store, "draft").Hash, "todo"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The draft becomes a copy of the final file, which keeps its own label and gains the draft's tags.
+	writeFile(t, dir, "draft.txt", "final")
+	applyChanges(t, db, draft)
+	content := fileContent(t, store, "final")
+	if content.Label != "final.txt" || len(content.Paths) != 2 {
+		t.Errorf("content %q at %v, want final.txt at both paths", content.Label, content.Paths)
+	}
+	if _, err := store.GetEdge("todo", content.Hash); err != nil {
+		t.Errorf("the todo tag was not carried over: %v", err)
+	}
+}
+
+func TestWatcherCloseFlushesAndStops(t *testing.T) {
+	db := newTestDB(t)
+	dir := t.TempDir()
+	w, err := startWatcher(db, []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeFile(t, dir, "queued.txt", "queued")
+	w.queue(path)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fileContent(t, &boltStore{db: db}, "queued")
+	w.queue(filepath.Join(dir, "late.txt"))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timer != nil || len(w.pending) != 0 {
+		t.Errorf("after closing: timer %v and pending %v, want neither", w.timer, w.pending)
+	}
+}